@@ -1,11 +1,19 @@
 package calibre
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -14,8 +22,68 @@ type ConnectionInfo struct {
 	Host    string `json:"host"`
 	TCPPort int    `json:"port"`
 	Name    string `json:"name"`
+	// Hostname is the name of the computer Calibre is running on, as announced
+	// in its discovery reply. Discovery sets Name to the same value.
+	Hostname string `json:"hostname,omitempty"`
+	// LegacyPort is the other port announced in the discovery reply, which
+	// older Calibre versions served the device connection on. Zero if unset.
+	LegacyPort int `json:"legacy_port,omitempty"`
+	// OS is the operating system Calibre is running on, if its discovery reply
+	// includes it. Calibre's own replies don't, but forks may.
+	OS string `json:"os,omitempty"`
+	// UseTLS wraps the connection in TLS. Calibre itself does not support TLS,
+	// but it may be reached through a TLS terminating proxy such as stunnel.
+	UseTLS bool       `json:"use_tls,omitempty"`
+	TLS    TLSOptions `json:"tls,omitempty"`
 }
 
+// TLSOptions configures the TLS connection when ConnectionInfo.UseTLS is set
+type TLSOptions struct {
+	// CAFile is a PEM file of CA certificates used to verify the server. The
+	// system CA pool is used if empty.
+	CAFile string `json:"ca_file,omitempty"`
+	// CertFile and KeyFile are a PEM encoded client certificate and key, for
+	// proxies that require client authentication
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// ServerName is the name used to verify the server certificate. Host is used if empty.
+	ServerName string `json:"server_name,omitempty"`
+	// InsecureSkipVerify disables verification of the server certificate
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+}
+
+// config builds a tls.Config from the options
+func (o TLSOptions) config(host string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("config: error reading CA file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("config: no certificates found in %s", o.CAFile)
+		}
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("config: error loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// ErrNoReply is returned when a Calibre instance did not reply to a discovery packet
+var ErrNoReply = errors.New("no reply to discovery packet")
+
 // Logger is an interface to provide logging functionality
 type Logger interface {
 	// LogPrintf logs non-critical warnings
@@ -27,75 +95,472 @@ func timeoutReached(err error) bool {
 	return errors.As(err, &terr) && terr.Timeout()
 }
 
-// discoverBCast attempts to discover Calibre instances using its broadcast method
-func discoverSmartBCast(calLog Logger) ([]ConnectionInfo, error) {
-	// Most calibre instances will respond to the first port in this list, as that
-	// is what it tries to bins to first, but all of them should be checked for
-	// completeness sake.
-	bcastPorts := []int{54982, 48123, 39001, 44044, 59678}
+// DiscoveryOptions allows the caller to tune how Calibre instances are
+// searched for. Any field left at its zero value uses the default.
+type DiscoveryOptions struct {
+	// Ports are the UDP ports the discovery packet is broadcast to
+	Ports []int
+	// Retries is the number of discovery attempts made before giving up
+	Retries int
+	// Timeout is how long each attempt waits for replies, after the last
+	// discovery packet is sent
+	Timeout time.Duration
+	// Packet is the content of the discovery ('hello') packet
+	Packet []byte
+	// Interval is the time between discovery attempts when using Watch
+	Interval time.Duration
+	// Interfaces restricts discovery to the named network interfaces. The discovery
+	// packet is sent to the broadcast address of each interface
+	Interfaces []string
+	// AllInterfaces sends the discovery packet to the broadcast address of every
+	// network interface, instead of the limited broadcast address 255.255.255.255.
+	// It is ignored if Interfaces is not empty.
+	AllInterfaces bool
+	// ReplyPattern matches the reply sent by Calibre. It must contain three
+	// capturing groups: the instance name, the legacy port and the wireless
+	// device port. Forks that change the reply format can be supported by
+	// setting this. Groups may instead be named "name", "legacy" and "port", and
+	// a group named "os" fills in ConnectionInfo.OS.
+	ReplyPattern *regexp.Regexp
+	// targets, if set, are sent the discovery packet instead of the broadcast
+	// addresses. Tests use it to discover responders on loopback.
+	targets []*net.UDPAddr
+}
+
+// DefaultDiscoveryOptions returns the options used by DiscoverSmartDevice
+func DefaultDiscoveryOptions() DiscoveryOptions {
+	return DiscoveryOptions{
+		// Most calibre instances will respond to the first port in this list, as that
+		// is what it tries to bind to first, but all of them should be checked for
+		// completeness sake.
+		Ports:        []int{54982, 48123, 39001, 44044, 59678},
+		Retries:      3,
+		Timeout:      1000 * time.Millisecond,
+		Packet:       []byte("UNCaGED"),
+		Interval:     2 * time.Second,
+		ReplyPattern: replyRegex,
+	}
+}
+
+// withDefaults fills any unset option with its default value
+func (o DiscoveryOptions) withDefaults() DiscoveryOptions {
+	def := DefaultDiscoveryOptions()
+	if len(o.Ports) == 0 {
+		o.Ports = def.Ports
+	}
+	if o.Retries <= 0 {
+		o.Retries = def.Retries
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = def.Timeout
+	}
+	if len(o.Packet) == 0 {
+		o.Packet = def.Packet
+	}
+	if o.Interval <= 0 {
+		o.Interval = def.Interval
+	}
+	if o.ReplyPattern == nil {
+		o.ReplyPattern = def.ReplyPattern
+	}
+	return o
+}
+
+// replyRegex matches the reply Calibre sends in response to a discovery packet
+// by default
+var replyRegex = regexp.MustCompile(`calibre wireless device client \(on ([^\)]+)\);(\d{2,5}),(\d{2,5})`)
+
+// parseReply parses a reply to a discovery packet received from host, using
+// the pattern re
+func parseReply(re *regexp.Regexp, reply []byte, host string) (ConnectionInfo, bool) {
+	match := re.FindSubmatch(reply)
+	if match == nil {
+		return ConnectionInfo{}, false
+	}
+	// group returns the named group, or the group at pos if there is no such name
+	group := func(name string, pos int) string {
+		if i := re.SubexpIndex(name); i > 0 {
+			return string(match[i])
+		}
+		if pos > 0 && pos < len(match) {
+			return string(match[pos])
+		}
+		return ""
+	}
+	port, err := strconv.Atoi(group("port", 3))
+	if err != nil {
+		return ConnectionInfo{}, false
+	}
+	name := group("name", 1)
+	legacy, _ := strconv.Atoi(group("legacy", 2))
+	return ConnectionInfo{
+		Host:       host,
+		Name:       name,
+		TCPPort:    port,
+		Hostname:   name,
+		LegacyPort: legacy,
+		OS:         group("os", 0),
+	}, true
+}
+
+// Label describes the instance for display in selection lists, such as
+// "laptop (192.168.1.10:9090)"
+func (c ConnectionInfo) Label() string {
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(c.TCPPort))
+	name := c.Hostname
+	if name == "" {
+		name = c.Name
+	}
+	if name == "" {
+		return addr
+	}
+	if c.OS != "" {
+		name += ", " + c.OS
+	}
+	return fmt.Sprintf("%s (%s)", name, addr)
+}
+
+// discoverSmart sends the discovery packet to each of the target addresses,
+// and collects the replies of any Calibre instances that respond
+func discoverSmart(calLog Logger, opts DiscoveryOptions, targets []*net.UDPAddr) ([]ConnectionInfo, error) {
+	ci := make([]ConnectionInfo, 0)
+	err := scanSmart(context.Background(), calLog, opts, targets, func(c ConnectionInfo) bool {
+		ci = append(ci, c)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dedupeInstances(calLog, ci), nil
+}
+
+// instanceKey identifies a Calibre instance, whatever address it was found at
+func (c ConnectionInfo) instanceKey() string {
+	return c.Name + ";" + strconv.Itoa(c.TCPPort)
+}
+
+// dedupeInstances merges instances found at more than one address, such as a
+// computer reachable through two network interfaces. An address on the same
+// subnet as one of ours is kept, or else the address that replied first.
+// Calibre treats every connection to its device port as a device connecting,
+// so the addresses are never dialled to compare them.
+func dedupeInstances(calLog Logger, ci []ConnectionInfo) []ConnectionInfo {
+	groups := make(map[string][]ConnectionInfo)
+	var order []string
+	for _, c := range ci {
+		key := c.instanceKey()
+		if _, exists := groups[key]; !exists {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], c)
+	}
+	var nets []*net.IPNet
+	deduped := make([]ConnectionInfo, 0, len(order))
+	for _, key := range order {
+		addrs := groups[key]
+		if len(addrs) > 1 {
+			if nets == nil {
+				nets = localNets()
+			}
+			best := preferredAddress(addrs, nets)
+			calLog.LogPrintf("dedupeInstances: '%s' found at %d addresses, using %s", best.Name, len(addrs), best.Host)
+			addrs[0] = best
+		}
+		deduped = append(deduped, addrs[0])
+	}
+	return deduped
+}
+
+// preferredAddress returns the first instance with an address in one of nets.
+// addrs are in the order their replies arrived, so the first instance is
+// returned if none are.
+func preferredAddress(addrs []ConnectionInfo, nets []*net.IPNet) ConnectionInfo {
+	for _, c := range addrs {
+		ip := net.ParseIP(c.Host)
+		for _, n := range nets {
+			if ip != nil && n.Contains(ip) {
+				return c
+			}
+		}
+	}
+	return addrs[0]
+}
+
+// localNets returns the subnets of the local network interfaces
+func localNets() []*net.IPNet {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var nets []*net.IPNet
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// scanSmart sends the discovery packet to each of the target addresses, and calls
+// found for each Calibre instance that responds, as its reply arrives. Scanning stops
+// opts.Timeout after the last packet is sent, once ctx is cancelled, or when found
+// returns false.
+// found is never called after scanSmart returns.
+func scanSmart(ctx context.Context, calLog Logger, opts DiscoveryOptions, targets []*net.UDPAddr, found func(ConnectionInfo) bool) error {
 	pc, err := net.ListenPacket("udp", "0.0.0.0:0")
 	if err != nil {
-		return nil, fmt.Errorf("discoverBCast: error opening PacketConn: %w", err)
+		return fmt.Errorf("scanSmart: error opening PacketConn: %w", err)
+	}
+	defer pc.Close()
+	// stop unblocks the reader by expiring its deadline. Sending packets takes
+	// time, so the deadline is extended as each one is sent, unless the reader
+	// has already been stopped.
+	var deadlineMu sync.Mutex
+	stopped := false
+	stop := func() {
+		deadlineMu.Lock()
+		defer deadlineMu.Unlock()
+		stopped = true
+		pc.SetReadDeadline(time.Now())
 	}
-	instances := make(chan []ConnectionInfo)
+	extend := func() {
+		deadlineMu.Lock()
+		defer deadlineMu.Unlock()
+		if !stopped {
+			pc.SetReadDeadline(time.Now().Add(opts.Timeout))
+		}
+	}
+	extend()
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		replies := make(map[string]struct{})
-		ci := make([]ConnectionInfo, 0)
 		calibreReply := make([]byte, 512)
-		pc.SetReadDeadline(time.Now().Add(1000 * time.Millisecond))
-		msgRegex := regexp.MustCompile(`calibre wireless device client \(on ([^\)]+)\);(\d{2,5}),(\d{2,5})`)
 		for {
 			bytesRead, addr, err := pc.ReadFrom(calibreReply)
 			if bytesRead > 0 {
 				host, _, _ := net.SplitHostPort(addr.String())
 				reply := calibreReply[:bytesRead]
-				calLog.LogPrintf("discoverSmartBCast: received reply from %s", host)
-				match := msgRegex.FindSubmatch(reply)
-				if match != nil {
-					fullStr, nameStr, wirelessPort := string(match[0]), string(match[1]), string(match[3])
-					calLog.LogPrintf("discoverSmartBCast: name: %s port: %s", nameStr, wirelessPort)
-					if _, exists := replies[fullStr]; !exists {
-						port, _ := strconv.Atoi(wirelessPort)
-						ci = append(ci, ConnectionInfo{Host: host, Name: nameStr, TCPPort: port})
-						replies[fullStr] = struct{}{}
+				calLog.LogPrintf("scanSmart: received reply from %s", host)
+				if c, ok := parseReply(opts.ReplyPattern, reply, host); ok {
+					calLog.LogPrintf("scanSmart: name: %s port: %d", c.Name, c.TCPPort)
+					// Retries and multiple broadcast addresses produce repeated replies
+					key := net.JoinHostPort(c.Host, strconv.Itoa(c.TCPPort))
+					if _, exists := replies[key]; !exists {
+						replies[key] = struct{}{}
+						if !found(c) {
+							return
+						}
 					}
 				}
 			}
 			if timeoutReached(err) {
-				calLog.LogPrintf("discoverSmartBCast: read timed out")
-				break
+				calLog.LogPrintf("scanSmart: read timed out")
+				return
+			} else if err != nil {
+				return
 			}
 		}
-		instances <- ci
-		close(instances)
 	}()
-	discoverPacket := []byte("UNCaGED")
-	for i := 0; i < 3; i++ {
-		for _, p := range bcastPorts {
-			a, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("255.255.255.255:%d", p))
+	go func() {
+		select {
+		case <-ctx.Done():
+			stop()
+		case <-done:
+		}
+	}()
+	discoverPacket := opts.Packet
+	for i := 0; i < 3 && ctx.Err() == nil; i++ {
+		for _, a := range targets {
+			extend()
 			pc.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
 			n, err := pc.WriteTo(discoverPacket, a)
 			if n != len(discoverPacket) || err != nil {
 				if timeoutReached(err) {
-					calLog.LogPrintf("discoverSmartBCast: write timed out")
+					calLog.LogPrintf("scanSmart: write timed out")
 					continue
 				}
-				return nil, fmt.Errorf("discoverSmartBCast: wrote %d of %d bytes: %w", n, len(discoverPacket), err)
+				stop()
+				<-done
+				return fmt.Errorf("scanSmart: wrote %d of %d bytes: %w", n, len(discoverPacket), err)
 			}
-			calLog.LogPrintf("discoverSmartBCast: wrote 'hello' packet to port %d", p)
+			calLog.LogPrintf("scanSmart: wrote 'hello' packet to %s", a)
 			time.Sleep(50 * time.Millisecond)
 		}
 	}
-	return <-instances, nil
+	extend()
+	<-done
+	return nil
+}
+
+// broadcastAddrs returns the broadcast addresses discovery packets should be sent to
+func broadcastAddrs(opts DiscoveryOptions) ([]net.IP, error) {
+	if len(opts.Interfaces) == 0 && !opts.AllInterfaces {
+		return []net.IP{net.IPv4bcast}, nil
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("broadcastAddrs: error listing interfaces: %w", err)
+	}
+	wanted := make(map[string]struct{})
+	for _, name := range opts.Interfaces {
+		wanted[name] = struct{}{}
+	}
+	var bcast []net.IP
+	for _, iface := range ifaces {
+		if len(wanted) > 0 {
+			if _, ok := wanted[iface.Name]; !ok {
+				continue
+			}
+		}
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, mask := ipNet.IP.To4(), ipNet.Mask
+			if ip == nil || len(mask) != net.IPv4len {
+				continue
+			}
+			b := make(net.IP, net.IPv4len)
+			for i := range ip {
+				b[i] = ip[i] | ^mask[i]
+			}
+			bcast = append(bcast, b)
+		}
+	}
+	if len(bcast) == 0 {
+		return nil, fmt.Errorf("broadcastAddrs: no usable broadcast interfaces found")
+	}
+	return bcast, nil
+}
+
+// broadcastTargets returns every broadcast address and port combination
+// discovery packets should be sent to
+func broadcastTargets(opts DiscoveryOptions) ([]*net.UDPAddr, error) {
+	if len(opts.targets) > 0 {
+		return opts.targets, nil
+	}
+	bcast, err := broadcastAddrs(opts)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]*net.UDPAddr, 0, len(bcast)*len(opts.Ports))
+	for _, ip := range bcast {
+		for _, p := range opts.Ports {
+			targets = append(targets, &net.UDPAddr{IP: ip, Port: p})
+		}
+	}
+	return targets, nil
+}
+
+// discoverBCast attempts to discover Calibre instances using its broadcast method
+func discoverSmartBCast(calLog Logger, opts DiscoveryOptions) ([]ConnectionInfo, error) {
+	targets, err := broadcastTargets(opts)
+	if err != nil {
+		return nil, fmt.Errorf("discoverSmartBCast: %w", err)
+	}
+	return discoverSmart(calLog, opts, targets)
+}
+
+// Scanner searches the local network for Calibre instances, streaming each
+// instance found as soon as its reply arrives. This allows UIs that let the
+// user pick an instance to populate immediately, rather than waiting for
+// discovery to finish.
+type Scanner struct {
+	log  Logger
+	opts DiscoveryOptions
+}
+
+// NewScanner returns a Scanner that searches using opts
+func NewScanner(calLog Logger, opts DiscoveryOptions) *Scanner {
+	return &Scanner{log: calLog, opts: opts.withDefaults()}
+}
+
+// Scan starts searching for Calibre instances, and sends each unique instance
+// found on the returned channel. Discovery is attempted as many times as the
+// scanner's Retries option allows. The channel is closed once discovery has
+// finished, or ctx is cancelled. Cancel ctx to stop early, for example once the
+// user has selected an instance.
+func (s *Scanner) Scan(ctx context.Context) (<-chan ConnectionInfo, error) {
+	targets, err := broadcastTargets(s.opts)
+	if err != nil {
+		return nil, fmt.Errorf("Scan: %w", err)
+	}
+	results := make(chan ConnectionInfo)
+	go func() {
+		defer close(results)
+		seen := make(map[string]struct{})
+		found := func(c ConnectionInfo) bool {
+			// Instances are streamed as they're found, so the first address wins
+			key := c.instanceKey()
+			if _, exists := seen[key]; exists {
+				return true
+			}
+			seen[key] = struct{}{}
+			select {
+			case results <- c:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for i := 0; i < s.opts.Retries && ctx.Err() == nil; i++ {
+			if err := scanSmart(ctx, s.log, s.opts, targets, found); err != nil {
+				s.log.LogPrintf("Scan: discovery failed: %v", err)
+				return
+			}
+		}
+	}()
+	return results, nil
+}
+
+// Probe sends the discovery packet directly to host, instead of broadcasting it,
+// and returns the connection details of the Calibre instance that replies.
+// This allows the wireless device port to be detected for Calibre instances
+// on other networks.
+func Probe(calLog Logger, host string, opts DiscoveryOptions) (ConnectionInfo, error) {
+	opts = opts.withDefaults()
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return ConnectionInfo{}, fmt.Errorf("Probe: unable to resolve host: %w", err)
+	}
+	targets := make([]*net.UDPAddr, len(opts.Ports))
+	for i, p := range opts.Ports {
+		targets[i] = &net.UDPAddr{IP: ips[0], Port: p}
+	}
+	for i := 0; i < opts.Retries; i++ {
+		ci, err := discoverSmart(calLog, opts, targets)
+		if err != nil {
+			return ConnectionInfo{}, fmt.Errorf("Probe: %w", err)
+		}
+		if len(ci) > 0 {
+			return ci[0], nil
+		}
+	}
+	return ConnectionInfo{}, fmt.Errorf("Probe: no reply from %s: %w", host, ErrNoReply)
 }
 
 // DiscoverSmartDevice Calibre smart device instances on the local network
 func DiscoverSmartDevice(calLog Logger) ([]ConnectionInfo, error) {
-	// TODO: Try and get mDNS (Bonjour) working
+	return DiscoverSmartDeviceWithOptions(calLog, DefaultDiscoveryOptions())
+}
 
-	// Attempt discovery up to three times to try and compensate for poor network conditions
-	for i := 0; i < 3; i++ {
-		ci, err := discoverSmartBCast(calLog)
+// DiscoverSmartDeviceWithOptions discovers Calibre smart device instances on the
+// local network, using the provided options
+func DiscoverSmartDeviceWithOptions(calLog Logger, opts DiscoveryOptions) ([]ConnectionInfo, error) {
+	// TODO: Try and get mDNS (Bonjour) working
+	opts = opts.withDefaults()
+	// Attempt discovery multiple times to try and compensate for poor network conditions
+	for i := 0; i < opts.Retries; i++ {
+		ci, err := discoverSmartBCast(calLog, opts)
 		if len(ci) > 0 {
 			return ci, err
 		} else if err != nil {
@@ -106,16 +571,214 @@ func DiscoverSmartDevice(calLog Logger) ([]ConnectionInfo, error) {
 	return nil, nil
 }
 
+// WatchEvent is sent by Watch whenever a Calibre instance appears or disappears
+type WatchEvent struct {
+	Instance ConnectionInfo
+	// Lost is true if the instance was previously found, but has stopped responding
+	Lost bool
+}
+
+// watchMissLimit is the number of consecutive discovery attempts an instance
+// may fail to respond to before Watch considers it lost
+const watchMissLimit = 3
+
+// Watch continuously searches for Calibre instances on the local network, until
+// ctx is cancelled. An event is sent on the returned channel each time an instance
+// is found, or a previously found instance is lost. The channel is closed once
+// ctx is done.
+func Watch(ctx context.Context, calLog Logger, opts DiscoveryOptions) <-chan WatchEvent {
+	opts = opts.withDefaults()
+	events := make(chan WatchEvent)
+	go func() {
+		defer close(events)
+		type watched struct {
+			ci     ConnectionInfo
+			missed int
+		}
+		known := make(map[string]*watched)
+		send := func(ev WatchEvent) bool {
+			select {
+			case events <- ev:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for {
+			ci, err := discoverSmartBCast(calLog, opts)
+			if err != nil {
+				calLog.LogPrintf("Watch: discovery failed: %v", err)
+			}
+			seen := make(map[string]struct{})
+			for _, c := range ci {
+				// An instance found at a different address, such as through
+				// another network interface, is still the same instance
+				key := c.instanceKey()
+				seen[key] = struct{}{}
+				if w, exists := known[key]; exists {
+					w.ci, w.missed = c, 0
+					continue
+				}
+				known[key] = &watched{ci: c}
+				if !send(WatchEvent{Instance: c}) {
+					return
+				}
+			}
+			for key, w := range known {
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				if w.missed++; w.missed >= watchMissLimit {
+					delete(known, key)
+					if !send(WatchEvent{Instance: w.ci, Lost: true}) {
+						return
+					}
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(opts.Interval):
+			}
+		}
+	}()
+	return events
+}
+
 // Connect to a Calibre instance, either on local or remote networks
 func Connect(host string, port int) (net.Conn, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
 	if err != nil {
 		return nil, fmt.Errorf("Connect: error dialling Calibre: %w", err)
 	}
 	return conn, nil
 }
 
+// ConnectTLS connects to a Calibre instance through a TLS terminating proxy
+func ConnectTLS(host string, port int, opts TLSOptions) (net.Conn, error) {
+	cfg, err := opts.config(host)
+	if err != nil {
+		return nil, fmt.Errorf("ConnectTLS: %w", err)
+	}
+	conn, err := tls.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("ConnectTLS: error dialling Calibre: %w", err)
+	}
+	return conn, nil
+}
+
 // Connect to this Calibre instance
 func (c *ConnectionInfo) Connect() (net.Conn, error) {
+	if c.UseTLS {
+		return ConnectTLS(c.Host, c.TCPPort, c.TLS)
+	}
 	return Connect(c.Host, c.TCPPort)
 }
+
+// defaultPingTimeout limits how long Ping takes, if ctx has no deadline
+const defaultPingTimeout = 5 * time.Second
+
+// maxInitPacket is the largest initialization packet Ping will read
+const maxInitPacket = 64 * 1024
+
+// initInfoOpcode is the opcode of the initialization info Calibre sends each
+// device that connects
+const initInfoOpcode = 9
+
+// PingResult describes a Calibre instance that responded to Ping
+type PingResult struct {
+	// Latency is how long the TCP connection took to establish
+	Latency time.Duration
+	// The following are only set if Ping read the initialization info
+	LibraryName      string
+	LibraryUUID      string
+	CalibreVersion   []int
+	PasswordRequired bool
+	// InitInfo is the raw initialization info payload
+	InitInfo json.RawMessage
+}
+
+// Ping checks that the Calibre instance is accepting connections, without
+// starting a session. If readInit is true, Ping also waits for the
+// initialization info Calibre sends when a device connects, which confirms
+// it is Calibre listening, and reports the library it has open. The connection
+// is closed before Ping returns. Ping times out after 5 seconds, unless ctx has
+// a deadline.
+func (c *ConnectionInfo) Ping(ctx context.Context, readInit bool) (PingResult, error) {
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultPingTimeout)
+		defer cancel()
+	}
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(c.TCPPort))
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	if c.UseTLS {
+		var cfg *tls.Config
+		if cfg, err = c.TLS.config(c.Host); err != nil {
+			return PingResult{}, fmt.Errorf("Ping: %w", err)
+		}
+		d := tls.Dialer{Config: cfg}
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return PingResult{}, fmt.Errorf("Ping: error dialling Calibre: %w", err)
+	}
+	defer conn.Close()
+	res := PingResult{Latency: time.Since(start)}
+	if !readInit {
+		return res, nil
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	// Cancelling ctx interrupts the read
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	if res.InitInfo, err = readInitInfo(conn); err != nil {
+		return PingResult{}, fmt.Errorf("Ping: %w", err)
+	}
+	var info struct {
+		LibraryName       string `json:"currentLibraryName"`
+		LibraryUUID       string `json:"currentLibraryUUID"`
+		CalibreVersion    []int  `json:"calibre_version"`
+		PasswordChallenge string `json:"passwordChallenge"`
+	}
+	if err = json.Unmarshal(res.InitInfo, &info); err != nil {
+		return PingResult{}, fmt.Errorf("Ping: error decoding initialization info: %w", err)
+	}
+	res.LibraryName, res.LibraryUUID = info.LibraryName, info.LibraryUUID
+	res.CalibreVersion = info.CalibreVersion
+	res.PasswordRequired = info.PasswordChallenge != ""
+	return res, nil
+}
+
+// readInitInfo reads the initialization info packet Calibre sends when a device
+// connects, and returns its payload
+func readInitInfo(conn net.Conn) (json.RawMessage, error) {
+	rd := bufio.NewReader(conn)
+	sz, err := rd.ReadString('[')
+	if err != nil {
+		return nil, fmt.Errorf("readInitInfo: error reading packet length: %w", err)
+	}
+	n, err := strconv.Atoi(sz[:len(sz)-1])
+	if err != nil || n < 2 || n > maxInitPacket {
+		return nil, fmt.Errorf("readInitInfo: invalid packet length '%s'", sz[:len(sz)-1])
+	}
+	packet := make([]byte, n)
+	packet[0] = '['
+	if _, err = io.ReadFull(rd, packet[1:]); err != nil {
+		return nil, fmt.Errorf("readInitInfo: error reading packet: %w", err)
+	}
+	var pkt []json.RawMessage
+	if err = json.Unmarshal(packet, &pkt); err != nil || len(pkt) != 2 {
+		return nil, fmt.Errorf("readInitInfo: invalid packet: %v", err)
+	}
+	if op, _ := strconv.Atoi(string(pkt[0])); op != initInfoOpcode {
+		return nil, fmt.Errorf("readInitInfo: expected initialization info, got opcode %d", op)
+	}
+	return pkt[1], nil
+}
@@ -0,0 +1,204 @@
+package calibre
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testLogger discards log messages
+type testLogger struct{}
+
+func (testLogger) LogPrintf(format string, a ...interface{}) {}
+
+// udpResponder answers discovery packets at the loopback address ip as Calibre
+// would, if answer returns true for the number of packets received so far. The
+// reply gives port as the wireless device port, or the responder's own port if
+// port is zero. It returns the responder's address.
+func udpResponder(t *testing.T, ip, name string, port int, answer func(n int) bool) *net.UDPAddr {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	if port == 0 {
+		port = pc.LocalAddr().(*net.UDPAddr).Port
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for n := 1; ; n++ {
+			_, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if answer(n) {
+				pc.WriteTo([]byte(fmt.Sprintf("calibre wireless device client (on %s);9090,%d", name, port)), addr)
+			}
+		}
+	}()
+	return pc.LocalAddr().(*net.UDPAddr)
+}
+
+func TestPreferredAddress(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.20/24")
+	addrs := []ConnectionInfo{{Host: "10.8.0.2"}, {Host: "192.168.1.10"}, {Host: "192.168.1.11"}}
+	tests := []struct {
+		name string
+		nets []*net.IPNet
+		want string
+	}{
+		{"same subnet", []*net.IPNet{lan}, "192.168.1.10"},
+		{"first reply", nil, "10.8.0.2"},
+	}
+	for _, tt := range tests {
+		if got := preferredAddress(addrs, tt.nets); got.Host != tt.want {
+			t.Errorf("%s: preferred %s, want %s", tt.name, got.Host, tt.want)
+		}
+	}
+}
+
+func TestScanSmartLateReply(t *testing.T) {
+	// Only the last of many packets is answered, long after the timeout
+	// would have passed had it started with the first packet
+	const targets = 4
+	addr := udpResponder(t, "127.0.0.1", "late", 0, func(n int) bool { return n == 3*targets })
+	var addrs []*net.UDPAddr
+	for i := 0; i < targets; i++ {
+		addrs = append(addrs, addr)
+	}
+	opts := DiscoveryOptions{Timeout: 200 * time.Millisecond}.withDefaults()
+	var found []ConnectionInfo
+	err := scanSmart(context.Background(), testLogger{}, opts, addrs, func(c ConnectionInfo) bool {
+		found = append(found, c)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Name != "late" || found[0].TCPPort != addr.Port {
+		t.Errorf("Expected the late reply to be found, got %+v", found)
+	}
+}
+
+func TestWatchAddressChange(t *testing.T) {
+	// The same instance answers at one address until it is found, then at
+	// another for six requests (at least two rounds), then not at all
+	var moved, answered int32
+	first := udpResponder(t, "127.0.0.1", "laptop", 9090, func(n int) bool { return atomic.LoadInt32(&moved) == 0 })
+	second := udpResponder(t, "127.0.0.2", "laptop", 9090, func(n int) bool {
+		return atomic.LoadInt32(&moved) != 0 && atomic.AddInt32(&answered, 1) <= 6
+	})
+	opts := DiscoveryOptions{Timeout: 200 * time.Millisecond, Interval: 10 * time.Millisecond}
+	opts.targets = []*net.UDPAddr{first, second}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var events []WatchEvent
+	for ev := range Watch(ctx, testLogger{}, opts) {
+		events = append(events, ev)
+		atomic.StoreInt32(&moved, 1)
+		if ev.Lost {
+			cancel()
+		}
+	}
+	if len(events) != 2 || events[0].Lost || events[0].Instance.Host != "127.0.0.1" {
+		t.Fatalf("Expected the instance found once, then lost, got %+v", events)
+	}
+	if !events[1].Lost || events[1].Instance.Host != "127.0.0.2" {
+		t.Errorf("Expected the instance lost at its latest address, got %+v", events[1])
+	}
+}
+
+func TestWatch(t *testing.T) {
+	// One instance keeps answering, the other stops once it has been found
+	var gone, ignored int32
+	stays := udpResponder(t, "127.0.0.1", "desktop", 0, func(n int) bool { return true })
+	goes := udpResponder(t, "127.0.0.1", "laptop", 0, func(n int) bool {
+		if atomic.LoadInt32(&gone) == 0 {
+			return true
+		}
+		atomic.AddInt32(&ignored, 1)
+		return false
+	})
+	opts := DiscoveryOptions{Timeout: 200 * time.Millisecond, Interval: 10 * time.Millisecond}
+	opts.targets = []*net.UDPAddr{stays, goes}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	found := make(map[string]bool)
+	var lost []string
+	for ev := range Watch(ctx, testLogger{}, opts) {
+		if !ev.Lost {
+			found[ev.Instance.Name] = true
+			if ev.Instance.Name == "laptop" {
+				atomic.StoreInt32(&gone, 1)
+			}
+			continue
+		}
+		lost = append(lost, ev.Instance.Name)
+		// The instance is only lost once it has missed watchMissLimit rounds
+		if n := atomic.LoadInt32(&ignored); n < watchMissLimit {
+			t.Errorf("Expected the instance lost after %d rounds, got %d requests ignored", watchMissLimit, n)
+		}
+		cancel()
+	}
+	if !found["desktop"] || !found["laptop"] || len(found) != 2 {
+		t.Errorf("Expected both instances found, got %v", found)
+	}
+	if len(lost) != 1 || lost[0] != "laptop" {
+		t.Errorf("Expected only laptop lost, got %v", lost)
+	}
+}
+
+func TestScanner(t *testing.T) {
+	desktop := udpResponder(t, "127.0.0.1", "desktop", 0, func(n int) bool { return true })
+	laptop := udpResponder(t, "127.0.0.1", "laptop", 0, func(n int) bool { return true })
+	// The scan would take far longer than the test, if it weren't streamed
+	// and cancelled
+	opts := DiscoveryOptions{Timeout: time.Minute}
+	opts.targets = []*net.UDPAddr{desktop, laptop}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results, err := NewScanner(testLogger{}, opts).Scan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for len(found) < 2 {
+		select {
+		case c := <-results:
+			found[c.Name] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected instances streamed as they reply, got %v", found)
+		}
+	}
+	cancel()
+	select {
+	case c, ok := <-results:
+		if ok {
+			t.Errorf("Expected no more results after cancelling, got %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the scan to stop when cancelled")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	answers := udpResponder(t, "127.0.0.1", "desktop", 0, func(n int) bool { return true })
+	silent := udpResponder(t, "127.0.0.1", "silent", 0, func(n int) bool { return false })
+	opts := DiscoveryOptions{Ports: []int{answers.Port}, Retries: 1, Timeout: 100 * time.Millisecond}
+	c, err := Probe(testLogger{}, "127.0.0.1", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "desktop" || c.TCPPort != answers.Port {
+		t.Errorf("Unexpected instance %+v", c)
+	}
+	opts.Ports = []int{silent.Port}
+	if _, err = Probe(testLogger{}, "127.0.0.1", opts); !errors.Is(err, ErrNoReply) {
+		t.Errorf("Expected ErrNoReply, got %v", err)
+	}
+}
@@ -0,0 +1,362 @@
+// Package calibretest provides a fake Calibre smart device server, for end to
+// end testing of UNCaGED and its clients without a Calibre install.
+//
+// A Server listens on the loopback interface. Point a client at it with
+// ClientOptions.DirectConnect, then drive the session from the test by
+// calling Session methods, each of which performs one exchange of the smart
+// device protocol, just as Calibre would.
+package calibretest
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/shermp/UNCaGED/calibre"
+)
+
+// Smart device protocol opcodes
+const (
+	OpOK                   = 0
+	OpSetCalibreDeviceInfo = 1
+	OpGetDeviceInformation = 3
+	OpFreeSpace            = 5
+	OpGetBookCount         = 6
+	OpSendBooklists        = 7
+	OpSendBook             = 8
+	OpGetInitInfo          = 9
+	OpBookData             = 10
+	OpNoop                 = 12
+	OpDeleteBook           = 13
+	OpGetBookFileSegment   = 14
+	OpSendBookMetadata     = 16
+	OpDisplayMessage       = 17
+	OpCalibreBusy          = 18
+	OpSetLibraryInfo       = 19
+)
+
+// passwordError is the DISPLAY_MESSAGE kind telling the device its password was wrong
+const passwordError = 1
+
+// ErrPasswordRejected is returned by Accept when the device gives up after
+// its password was rejected
+var ErrPasswordRejected = errors.New("device did not provide the correct password")
+
+// Server is a fake Calibre instance. Set its fields before calling Accept.
+type Server struct {
+	// Password, if set, is required of connecting devices
+	Password string
+	// LibraryName and LibraryUUID describe the library the server has open
+	LibraryName string
+	LibraryUUID string
+	// LpathChanges allows the device to store books under a different lpath
+	LpathChanges bool
+	// Timeout limits how long each exchange may take. Defaults to 10 seconds
+	Timeout time.Duration
+	ln      net.Listener
+}
+
+// NewServer starts a server listening on a random loopback port
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("NewServer: %w", err)
+	}
+	return &Server{LibraryName: "Test Library", LibraryUUID: "calibretest-library", ln: ln}, nil
+}
+
+// ConnectionInfo returns the details a client needs to connect to the server
+func (s *Server) ConnectionInfo() calibre.ConnectionInfo {
+	return calibre.ConnectionInfo{Host: "127.0.0.1", TCPPort: s.ln.Addr().(*net.TCPAddr).Port, Name: "calibretest"}
+}
+
+// Close stops the server listening
+func (s *Server) Close() error {
+	return s.ln.Close()
+}
+
+func (s *Server) timeout() time.Duration {
+	if s.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return s.Timeout
+}
+
+// Session is a connection from a device to the server
+type Session struct {
+	s    *Server
+	conn net.Conn
+	rd   *bufio.Reader
+	// InitReply is the device's reply to the initialization info
+	InitReply map[string]interface{}
+}
+
+// Accept waits for a device to connect, and performs the handshake. If the
+// server has a password, the device is challenged, and is expected to
+// reconnect with the password as UNCaGED does. ErrPasswordRejected is
+// returned if it doesn't.
+func (s *Server) Accept() (*Session, error) {
+	const challenge = "calibretest-challenge"
+	for attempt := 0; ; attempt++ {
+		ss, err := s.accept()
+		if err != nil {
+			if attempt > 0 {
+				return nil, fmt.Errorf("Accept: %w", ErrPasswordRejected)
+			}
+			return nil, fmt.Errorf("Accept: %w", err)
+		}
+		initInfo := map[string]interface{}{
+			"calibre_version":        []int{5, 0, 0},
+			"serverProtocolVersion":  1,
+			"canSupportLpathChanges": s.LpathChanges,
+			"canSupportUpdateBooks":  true,
+			"currentLibraryName":     s.LibraryName,
+			"currentLibraryUUID":     s.LibraryUUID,
+			"pubdateFormat":          "MMM yyyy",
+			"timestampFormat":        "dd MMM yyyy",
+			"lastModifiedFormat":     "dd MMM yyyy",
+		}
+		if s.Password != "" {
+			initInfo["passwordChallenge"] = challenge
+		}
+		if err = ss.Send(OpGetInitInfo, initInfo); err == nil {
+			err = ss.Recv(&ss.InitReply)
+		}
+		if err != nil {
+			ss.Close()
+			return nil, fmt.Errorf("Accept: %w", err)
+		}
+		if s.Password == "" {
+			return ss, nil
+		}
+		h := sha1.Sum([]byte(s.Password + challenge))
+		if hash, _ := ss.InitReply["passwordHash"].(string); hash == hex.EncodeToString(h[:]) {
+			return ss, nil
+		}
+		// Calibre tells the device the password was wrong, then closes the connection
+		if err = ss.Send(OpDisplayMessage, map[string]interface{}{"messageKind": passwordError}); err == nil {
+			err = ss.Recv(nil)
+		}
+		ss.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Accept: %w", err)
+		}
+	}
+}
+
+// accept waits for a connection, for at most the server's timeout
+func (s *Server) accept() (*Session, error) {
+	if tl, ok := s.ln.(*net.TCPListener); ok {
+		tl.SetDeadline(time.Now().Add(s.timeout()))
+	}
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Session{s: s, conn: conn, rd: bufio.NewReader(conn)}, nil
+}
+
+// Close ends the session, as Calibre does when the device is ejected
+func (ss *Session) Close() error {
+	return ss.conn.Close()
+}
+
+// Send sends the device a packet with opcode op, and payload v
+func (ss *Session) Send(op int, v interface{}) error {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("Send: %w", err)
+	}
+	pkt := fmt.Sprintf("[%d,%s]", op, js)
+	ss.conn.SetDeadline(time.Now().Add(ss.s.timeout()))
+	if _, err = fmt.Fprintf(ss.conn, "%d%s", len(pkt), pkt); err != nil {
+		return fmt.Errorf("Send: opcode %d: %w", op, err)
+	}
+	return nil
+}
+
+// Recv reads an OK reply from the device, and decodes its payload into v,
+// unless v is nil
+func (ss *Session) Recv(v interface{}) error {
+	ss.conn.SetDeadline(time.Now().Add(ss.s.timeout()))
+	sz, err := ss.rd.ReadString('[')
+	if err != nil {
+		return fmt.Errorf("Recv: %w", err)
+	}
+	n, err := strconv.Atoi(sz[:len(sz)-1])
+	if err != nil || n < 2 {
+		return fmt.Errorf("Recv: bad length '%s'", sz)
+	}
+	buf := make([]byte, n)
+	buf[0] = '['
+	if _, err = io.ReadFull(ss.rd, buf[1:]); err != nil {
+		return fmt.Errorf("Recv: %w", err)
+	}
+	var pkt []json.RawMessage
+	if err = json.Unmarshal(buf, &pkt); err != nil || len(pkt) != 2 {
+		return fmt.Errorf("Recv: bad packet '%s': %v", buf, err)
+	}
+	if op, _ := strconv.Atoi(string(pkt[0])); op != OpOK {
+		return fmt.Errorf("Recv: expected OK, got opcode %d: %s", op, pkt[1])
+	}
+	if v != nil {
+		if err = json.Unmarshal(pkt[1], v); err != nil {
+			return fmt.Errorf("Recv: %w", err)
+		}
+	}
+	return nil
+}
+
+// exchange sends a packet, and decodes the reply into v
+func (ss *Session) exchange(op int, payload, v interface{}) error {
+	if err := ss.Send(op, payload); err != nil {
+		return err
+	}
+	return ss.Recv(v)
+}
+
+// DeviceInfo asks for the device information, then sends the device the
+// details Calibre stores on it. The device information is returned.
+func (ss *Session) DeviceInfo(deviceName string) (map[string]interface{}, error) {
+	var info map[string]interface{}
+	if err := ss.exchange(OpGetDeviceInformation, map[string]interface{}{}, &info); err != nil {
+		return nil, fmt.Errorf("DeviceInfo: %w", err)
+	}
+	devInfo := map[string]interface{}{
+		"device_name":       deviceName,
+		"location_code":     "main",
+		"last_library_uuid": ss.s.LibraryUUID,
+		"calibre_version":   "5.0.0",
+	}
+	if err := ss.exchange(OpSetCalibreDeviceInfo, devInfo, nil); err != nil {
+		return nil, fmt.Errorf("DeviceInfo: %w", err)
+	}
+	return info, nil
+}
+
+// FreeSpace asks the device how much free space it has
+func (ss *Session) FreeSpace() (uint64, error) {
+	var space struct {
+		FreeSpace uint64 `json:"free_space_on_device"`
+	}
+	if err := ss.exchange(OpFreeSpace, map[string]interface{}{}, &space); err != nil {
+		return 0, fmt.Errorf("FreeSpace: %w", err)
+	}
+	return space.FreeSpace, nil
+}
+
+// Book is a book the device reported in its book count
+type Book struct {
+	Lpath string `json:"lpath"`
+	UUID  string `json:"uuid"`
+}
+
+// BookCount asks the device for the books it has. If cached is true, the
+// device sends abridged metadata, as it does when Calibre has the metadata cached.
+func (ss *Session) BookCount(cached bool) ([]Book, error) {
+	var count struct {
+		Count int `json:"count"`
+	}
+	opts := map[string]interface{}{"canStream": true, "canScan": true, "willUseCachedMetadata": cached}
+	if err := ss.exchange(OpGetBookCount, opts, &count); err != nil {
+		return nil, fmt.Errorf("BookCount: %w", err)
+	}
+	books := make([]Book, count.Count)
+	for i := range books {
+		if err := ss.Recv(&books[i]); err != nil {
+			return nil, fmt.Errorf("BookCount: %w", err)
+		}
+	}
+	return books, nil
+}
+
+// SendBook sends the device a book, with metadata md. The lpath and uuid in md
+// default to lpath and a UUID derived from it. The lpath the device stored
+// the book under is returned.
+func (ss *Session) SendBook(lpath string, md map[string]interface{}, book []byte) (string, error) {
+	if md == nil {
+		md = make(map[string]interface{})
+	}
+	if _, ok := md["lpath"]; !ok {
+		md["lpath"] = lpath
+	}
+	if _, ok := md["uuid"]; !ok {
+		md["uuid"] = "uuid-" + lpath
+	}
+	if _, ok := md["title"]; !ok {
+		md["title"] = lpath
+	}
+	details := map[string]interface{}{
+		"lpath":                  lpath,
+		"length":                 len(book),
+		"totalBooks":             1,
+		"thisBook":               0,
+		"willStreamBinary":       true,
+		"willStreamBooks":        true,
+		"canSupportLpathChanges": ss.s.LpathChanges,
+		"wantsSendOkToSendbook":  true,
+		"metadata":               md,
+	}
+	var reply struct {
+		Lpath string `json:"lpath"`
+	}
+	if err := ss.exchange(OpSendBook, details, &reply); err != nil {
+		return "", fmt.Errorf("SendBook: %w", err)
+	}
+	if _, err := ss.conn.Write(book); err != nil {
+		return "", fmt.Errorf("SendBook: %w", err)
+	}
+	if reply.Lpath != "" {
+		return reply.Lpath, nil
+	}
+	return lpath, nil
+}
+
+// GetBook asks the device for the book at lpath, and returns its contents
+func (ss *Session) GetBook(lpath string) ([]byte, error) {
+	req := map[string]interface{}{
+		"lpath":           lpath,
+		"position":        0,
+		"thisBook":        0,
+		"totalBooks":      1,
+		"canStream":       true,
+		"canStreamBinary": true,
+	}
+	var reply struct {
+		FileLength int64 `json:"fileLength"`
+	}
+	if err := ss.exchange(OpGetBookFileSegment, req, &reply); err != nil {
+		return nil, fmt.Errorf("GetBook: %w", err)
+	}
+	book := make([]byte, reply.FileLength)
+	if _, err := io.ReadFull(ss.rd, book); err != nil {
+		return nil, fmt.Errorf("GetBook: %w", err)
+	}
+	return book, nil
+}
+
+// DeleteBooks asks the device to delete the books at lpaths, and returns the
+// UUIDs of the deleted books
+func (ss *Session) DeleteBooks(lpaths ...string) ([]string, error) {
+	if err := ss.exchange(OpDeleteBook, map[string]interface{}{"lpaths": lpaths}, nil); err != nil {
+		return nil, fmt.Errorf("DeleteBooks: %w", err)
+	}
+	uuids := make([]string, len(lpaths))
+	for i := range lpaths {
+		var reply struct {
+			UUID string `json:"uuid"`
+		}
+		if err := ss.Recv(&reply); err != nil {
+			return nil, fmt.Errorf("DeleteBooks: %w", err)
+		}
+		uuids[i] = reply.UUID
+	}
+	return uuids, nil
+}
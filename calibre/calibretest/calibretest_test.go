@@ -0,0 +1,90 @@
+package calibretest_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/shermp/UNCaGED/calibre/calibretest"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// memClient keeps books in memory
+type memClient struct {
+	uc.BaseClient
+	srv   *calibretest.Server
+	books map[string][]byte
+}
+
+func (mc *memClient) GetClientOptions() (uc.ClientOptions, error) {
+	opts, err := mc.BaseClient.GetClientOptions()
+	opts.DirectConnect = mc.srv.ConnectionInfo()
+	return opts, err
+}
+
+func (mc *memClient) GetPassword(calibreInfo uc.CalibreInitInfo) (string, error) {
+	return "secret", nil
+}
+
+func (mc *memClient) SaveBook(md uc.CalibreBookMeta, book io.Reader, len int, lastBook bool) error {
+	b, err := ioutil.ReadAll(io.LimitReader(book, int64(len)))
+	mc.books[md.Lpath] = b
+	return err
+}
+
+func (mc *memClient) GetBook(book uc.BookID, filePos int64) (io.ReadCloser, int64, error) {
+	b := mc.books[book.Lpath]
+	return ioutil.NopCloser(bytes.NewReader(b)), int64(len(b)), nil
+}
+
+func (mc *memClient) DeleteBook(book uc.BookID) error {
+	delete(mc.books, book.Lpath)
+	return nil
+}
+
+func TestSession(t *testing.T) {
+	srv, err := calibretest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Password = "secret"
+	client := &memClient{srv: srv, books: make(map[string][]byte)}
+	ucc, err := uc.New(client, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- ucc.Start() }()
+
+	ss, err := srv.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+	if _, err = ss.DeviceInfo("Test Device"); err != nil {
+		t.Fatal(err)
+	}
+	book := []byte("not really an epub")
+	lpath, err := ss.SendBook("Author/Title.epub", nil, book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if books, err := ss.BookCount(true); err != nil || len(books) != 1 || books[0].Lpath != lpath || books[0].UUID != "uuid-"+lpath {
+		t.Errorf("Expected %s on the device, got %v: %v", lpath, books, err)
+	}
+	if got, err := ss.GetBook(lpath); err != nil || !bytes.Equal(got, book) {
+		t.Errorf("GetBook = %q, %v, want %q", got, err, book)
+	}
+	if uuids, err := ss.DeleteBooks(lpath); err != nil || len(uuids) != 1 || uuids[0] != "uuid-"+lpath {
+		t.Errorf("DeleteBooks = %v, %v", uuids, err)
+	}
+	if len(client.books) != 0 {
+		t.Errorf("Expected the book deleted, got %v", client.books)
+	}
+	ss.Close()
+	if err = <-done; err != nil {
+		t.Errorf("Session failed: %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+/*
+	UNCaGED - Universal Networked Calibre Go Ereader Device
+    Copyright (C) 2018 Sherman Perry
+
+    This file is part of UNCaGED.
+
+    UNCaGED is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    UNCaGED is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package content implements a client for Calibre's HTTP content server.
+// It allows books to be listed, searched and downloaded from a library
+// without Calibre's wireless device driver running.
+package content
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to a Calibre content server
+type Client struct {
+	// BaseURL is the address of the content server, eg: http://192.168.1.10:8080
+	BaseURL string
+	// Username and Password are used if the content server requires authentication.
+	// Note that the content server must be set to use 'basic' authentication.
+	Username string
+	Password string
+	// HTTPClient is the client used to make requests. http.DefaultClient is used if nil
+	HTTPClient *http.Client
+}
+
+// LibraryInfo lists the libraries available on the content server
+type LibraryInfo struct {
+	// LibraryMap maps library IDs to library names
+	LibraryMap     map[string]string `json:"library_map"`
+	DefaultLibrary string            `json:"default_library"`
+}
+
+// SearchOptions controls the results returned by Search
+type SearchOptions struct {
+	Num       int    // Maximum number of results to return. Server default if zero
+	Offset    int    // Offset of the first result
+	Sort      string // Field to sort results by, eg: "timestamp"
+	SortOrder string // "asc" or "desc"
+}
+
+// SearchResult is the result of a search. It only contains book IDs, use
+// Books or Book to retrieve their metadata
+type SearchResult struct {
+	TotalNum  int    `json:"total_num"`
+	Offset    int    `json:"offset"`
+	Num       int    `json:"num"`
+	LibraryID string `json:"library_id"`
+	Query     string `json:"query"`
+	BookIDs   []int  `json:"book_ids"`
+}
+
+// BookMetadata is the metadata the content server provides for a book
+type BookMetadata struct {
+	ID           int                        `json:"application_id"`
+	UUID         string                     `json:"uuid"`
+	Title        string                     `json:"title"`
+	TitleSort    string                     `json:"title_sort"`
+	Authors      []string                   `json:"authors"`
+	AuthorSort   string                     `json:"author_sort"`
+	Series       *string                    `json:"series"`
+	SeriesIndex  *float64                   `json:"series_index"`
+	Tags         []string                   `json:"tags"`
+	Publisher    *string                    `json:"publisher"`
+	Languages    []string                   `json:"languages"`
+	Identifiers  map[string]string          `json:"identifiers"`
+	Comments     *string                    `json:"comments"`
+	Rating       *float64                   `json:"rating"`
+	Pubdate      string                     `json:"pubdate"`
+	Timestamp    string                     `json:"timestamp"`
+	LastModified string                     `json:"last_modified"`
+	Formats      []string                   `json:"formats"`
+	FormatSizes  map[string]int64           `json:"format_sizes"`
+	MainFormat   map[string]string          `json:"main_format"`
+	OtherFormats map[string]string          `json:"other_formats"`
+	UserMetadata map[string]json.RawMessage `json:"user_metadata"`
+}
+
+// httpClient returns the HTTP client to use for requests
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// get performs a GET request on path, returning the response if the server
+// responded with 200 OK
+func (c *Client) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := strings.TrimSuffix(c.BaseURL, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("get: error creating request: %w", err)
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get: request failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &StatusError{StatusCode: resp.StatusCode, Path: path}
+	}
+	return resp, nil
+}
+
+// getJSON performs a GET request on path, and decodes the JSON response into v
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	resp, err := c.get(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("getJSON: error decoding response: %w", err)
+	}
+	return nil
+}
+
+// StatusError is returned when the content server responds with anything
+// other than 200 OK
+type StatusError struct {
+	StatusCode int
+	Path       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("content server returned status %d for %s", e.StatusCode, e.Path)
+}
+
+// Libraries lists the libraries available on the content server
+func (c *Client) Libraries(ctx context.Context) (LibraryInfo, error) {
+	var li LibraryInfo
+	if err := c.getJSON(ctx, "/ajax/library-info", nil, &li); err != nil {
+		return li, fmt.Errorf("Libraries: %w", err)
+	}
+	return li, nil
+}
+
+// Search searches the library using Calibre's search syntax. An empty
+// libraryID searches the default library, and an empty query matches all books
+func (c *Client) Search(ctx context.Context, libraryID, query string, opts SearchOptions) (SearchResult, error) {
+	var sr SearchResult
+	q := url.Values{}
+	q.Set("query", query)
+	if opts.Num > 0 {
+		q.Set("num", strconv.Itoa(opts.Num))
+	}
+	if opts.Offset > 0 {
+		q.Set("offset", strconv.Itoa(opts.Offset))
+	}
+	if opts.Sort != "" {
+		q.Set("sort", opts.Sort)
+	}
+	if opts.SortOrder != "" {
+		q.Set("sort_order", opts.SortOrder)
+	}
+	if err := c.getJSON(ctx, "/ajax/search"+libraryPath(libraryID), q, &sr); err != nil {
+		return sr, fmt.Errorf("Search: %w", err)
+	}
+	return sr, nil
+}
+
+// Book fetches the metadata of a single book
+func (c *Client) Book(ctx context.Context, libraryID string, bookID int) (BookMetadata, error) {
+	var md BookMetadata
+	if err := c.getJSON(ctx, "/ajax/book/"+strconv.Itoa(bookID)+libraryPath(libraryID), nil, &md); err != nil {
+		return md, fmt.Errorf("Book: %w", err)
+	}
+	return md, nil
+}
+
+// Books fetches the metadata of multiple books. Books that do not exist
+// in the library are not included in the returned map.
+func (c *Client) Books(ctx context.Context, libraryID string, bookIDs []int) (map[int]BookMetadata, error) {
+	ids := make([]string, len(bookIDs))
+	for i, id := range bookIDs {
+		ids[i] = strconv.Itoa(id)
+	}
+	q := url.Values{}
+	q.Set("ids", strings.Join(ids, ","))
+	raw := make(map[string]*BookMetadata)
+	if err := c.getJSON(ctx, "/ajax/books"+libraryPath(libraryID), q, &raw); err != nil {
+		return nil, fmt.Errorf("Books: %w", err)
+	}
+	books := make(map[int]BookMetadata, len(raw))
+	for k, md := range raw {
+		id, err := strconv.Atoi(k)
+		if err != nil || md == nil {
+			continue
+		}
+		books[id] = *md
+	}
+	return books, nil
+}
+
+// Download downloads a book in the requested format (eg: "EPUB"). The caller
+// must close the returned io.ReadCloser. The size is -1 if the server
+// did not report it.
+func (c *Client) Download(ctx context.Context, libraryID string, bookID int, format string) (io.ReadCloser, int64, error) {
+	path := "/get/" + url.PathEscape(strings.ToUpper(format)) + "/" + strconv.Itoa(bookID) + libraryPath(libraryID)
+	resp, err := c.get(ctx, path, nil)
+	if err != nil {
+		return nil, -1, fmt.Errorf("Download: %w", err)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// LastModifiedTime parses the last modified time of the book, returning the zero
+// time if it is not set or invalid
+func (md BookMetadata) LastModifiedTime() time.Time {
+	t, _ := time.Parse(time.RFC3339, md.LastModified)
+	return t
+}
+
+// libraryPath returns the library path component for a libraryID
+func libraryPath(libraryID string) string {
+	if libraryID == "" {
+		return ""
+	}
+	return "/" + url.PathEscape(libraryID)
+}
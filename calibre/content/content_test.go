@@ -0,0 +1,65 @@
+package content
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ajax/library-info", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"library_map": {"Calibre_Library": "Calibre Library"}, "default_library": "Calibre_Library"}`))
+	})
+	mux.HandleFunc("/ajax/search/Calibre_Library", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("query") != "tag:scifi" || r.URL.Query().Get("num") != "2" {
+			t.Errorf("Unexpected search query: %s", r.URL.RawQuery)
+		}
+		w.Write([]byte(`{"total_num": 3, "offset": 0, "num": 2, "query": "tag:scifi", "book_ids": [3, 1]}`))
+	})
+	mux.HandleFunc("/ajax/books/Calibre_Library", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"1": {"title": "One", "uuid": "u1", "formats": ["EPUB"]}, "2": null}`))
+	})
+	mux.HandleFunc("/get/EPUB/1/Calibre_Library", func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("epub data"))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestContentClient(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	ctx := context.Background()
+	c := &Client{BaseURL: srv.URL + "/"}
+
+	li, err := c.Libraries(ctx)
+	if err != nil || li.DefaultLibrary != "Calibre_Library" {
+		t.Fatalf("Libraries: got %+v, %v", li, err)
+	}
+	sr, err := c.Search(ctx, li.DefaultLibrary, "tag:scifi", SearchOptions{Num: 2})
+	if err != nil || sr.TotalNum != 3 || len(sr.BookIDs) != 2 {
+		t.Fatalf("Search: got %+v, %v", sr, err)
+	}
+	books, err := c.Books(ctx, li.DefaultLibrary, []int{1, 2})
+	if err != nil || len(books) != 1 || books[1].UUID != "u1" {
+		t.Fatalf("Books: got %+v, %v", books, err)
+	}
+	if _, _, err = c.Download(ctx, li.DefaultLibrary, 1, "epub"); err == nil {
+		t.Fatalf("Download: expected authentication failure")
+	}
+	c.Username, c.Password = "user", "pass"
+	rc, _, err := c.Download(ctx, li.DefaultLibrary, 1, "epub")
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	defer rc.Close()
+	if b, _ := ioutil.ReadAll(rc); string(b) != "epub data" {
+		t.Errorf("Download: got '%s'", b)
+	}
+}
@@ -0,0 +1,52 @@
+package calibre_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/shermp/UNCaGED/calibre/calibretest"
+)
+
+func TestPing(t *testing.T) {
+	srv, err := calibretest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Password = "secret"
+	ci := srv.ConnectionInfo()
+	// Ping hangs up after the initialization info, which the server reports
+	go srv.Accept()
+	res, err := ci.Ping(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.LibraryName != srv.LibraryName || res.LibraryUUID != srv.LibraryUUID || !res.PasswordRequired {
+		t.Errorf("Unexpected ping result %+v", res)
+	}
+	if len(res.CalibreVersion) == 0 || res.CalibreVersion[0] != 5 {
+		t.Errorf("Expected Calibre version 5, got %v", res.CalibreVersion)
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	srv, err := calibretest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ci := srv.ConnectionInfo()
+	// The connection is accepted by the OS, but nothing is ever sent
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = ci.Ping(ctx, true); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected the ping to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the ping to stop at the deadline, took %v", elapsed)
+	}
+}
@@ -0,0 +1,241 @@
+package calibre
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// KnownServer is a Calibre instance the device has found or connected to before
+type KnownServer struct {
+	ConnectionInfo
+	// LastSeen is when the instance was last found by discovery
+	LastSeen time.Time `json:"last_seen,omitempty"`
+	// LastConnected is when the device last connected to the instance
+	LastConnected time.Time `json:"last_connected,omitempty"`
+	// LibraryUUID is the library the instance had open when last connected to
+	LibraryUUID string `json:"library_uuid,omitempty"`
+	// Found is set on servers returned by Registry.Merge that were found by the
+	// discovery being merged. It isn't persisted.
+	Found bool `json:"-"`
+}
+
+// RegistryStore persists the servers in a Registry
+type RegistryStore interface {
+	// Load returns the servers last saved, or nil if there are none
+	Load() ([]KnownServer, error)
+	// Save replaces the saved servers
+	Save(servers []KnownServer) error
+}
+
+// FileRegistryStore is a RegistryStore persisted as a JSON file
+type FileRegistryStore struct {
+	path string
+}
+
+// NewFileRegistryStore creates a FileRegistryStore saved at path
+func NewFileRegistryStore(path string) *FileRegistryStore {
+	return &FileRegistryStore{path: path}
+}
+
+// Load reads the servers from the file. A missing file is an empty store.
+func (s *FileRegistryStore) Load() ([]KnownServer, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Load: error reading server registry: %w", err)
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var servers []KnownServer
+	if err = json.Unmarshal(data, &servers); err != nil {
+		return nil, fmt.Errorf("Load: error decoding server registry: %w", err)
+	}
+	return servers, nil
+}
+
+// Save writes the servers to the file, replacing its contents
+func (s *FileRegistryStore) Save(servers []KnownServer) error {
+	data, err := json.MarshalIndent(servers, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Save: error encoding server registry: %w", err)
+	}
+	// Write to a temporary file first, so a failed save doesn't lose the registry
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("Save: error writing server registry: %w", err)
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("Save: error replacing server registry: %w", err)
+	}
+	return nil
+}
+
+// Registry remembers the Calibre instances a device has seen, so clients can
+// offer recently used servers even when discovery finds nothing. Instances are
+// identified by their name and port, so an instance whose address changes is
+// updated rather than added again. Changes are kept in memory until Save is
+// called. A Registry may be used from multiple goroutines.
+type Registry struct {
+	mu      sync.Mutex
+	store   RegistryStore
+	servers []KnownServer
+}
+
+// NewRegistry creates a Registry, loading the servers saved in store
+func NewRegistry(store RegistryStore) (*Registry, error) {
+	servers, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("NewRegistry: %w", err)
+	}
+	return &Registry{store: store, servers: servers}, nil
+}
+
+// serverKey identifies a server in the registry. Instances added by hand may
+// have no name, so are identified by their address.
+func serverKey(ci ConnectionInfo) string {
+	if ci.Name == "" {
+		return net.JoinHostPort(ci.Host, strconv.Itoa(ci.TCPPort))
+	}
+	return ci.instanceKey()
+}
+
+// find returns the index of the server matching ci, or -1
+func (r *Registry) find(ci ConnectionInfo) int {
+	key := serverKey(ci)
+	for i, s := range r.servers {
+		if serverKey(s.ConnectionInfo) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// update records ci in the registry, keeping the TLS settings of a known
+// server, as discovery doesn't report them. The index of the server is returned.
+func (r *Registry) update(ci ConnectionInfo) int {
+	i := r.find(ci)
+	if i < 0 {
+		r.servers = append(r.servers, KnownServer{ConnectionInfo: ci})
+		return len(r.servers) - 1
+	}
+	if !ci.UseTLS {
+		ci.UseTLS, ci.TLS = r.servers[i].UseTLS, r.servers[i].TLS
+	}
+	r.servers[i].ConnectionInfo = ci
+	return i
+}
+
+// Merge adds the instances found by discovery to the registry, and returns
+// every known server. The instances found are listed first, in the order
+// provided, with Found set. The rest are ordered as Servers orders them.
+func (r *Registry) Merge(found []ConnectionInfo) []KnownServer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().UTC()
+	foundKeys := make(map[string]bool)
+	merged := make([]KnownServer, 0, len(r.servers)+len(found))
+	for _, ci := range found {
+		key := serverKey(ci)
+		if foundKeys[key] {
+			continue
+		}
+		foundKeys[key] = true
+		i := r.update(ci)
+		r.servers[i].LastSeen = now
+		s := r.servers[i]
+		s.Found = true
+		merged = append(merged, s)
+	}
+	for _, s := range r.sorted() {
+		if !foundKeys[serverKey(s.ConnectionInfo)] {
+			merged = append(merged, s)
+		}
+	}
+	return merged
+}
+
+// MarkConnected records that the device connected to ci
+func (r *Registry) MarkConnected(ci ConnectionInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.update(ci)
+	r.servers[i].LastConnected = time.Now().UTC()
+}
+
+// SetLibrary records that ci has the library with UUID libraryUUID open
+func (r *Registry) SetLibrary(ci ConnectionInfo, libraryUUID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.update(ci)
+	r.servers[i].LibraryUUID = libraryUUID
+}
+
+// LibraryServer returns the instance in found that last had the library with
+// UUID libraryUUID open, and false if none of them is known to. If several
+// did, the most recently connected to is returned.
+func (r *Registry) LibraryServer(libraryUUID string, found []ConnectionInfo) (ConnectionInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.sorted() {
+		if libraryUUID == "" || s.LibraryUUID != libraryUUID {
+			continue
+		}
+		key := serverKey(s.ConnectionInfo)
+		for _, ci := range found {
+			if serverKey(ci) == key {
+				return ci, true
+			}
+		}
+	}
+	return ConnectionInfo{}, false
+}
+
+// Remove forgets the server matching ci
+func (r *Registry) Remove(ci ConnectionInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i := r.find(ci); i >= 0 {
+		r.servers = append(r.servers[:i], r.servers[i+1:]...)
+	}
+}
+
+// Servers returns every known server, most recently connected first. Servers
+// never connected to are ordered by when they were last seen.
+func (r *Registry) Servers() []KnownServer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sorted()
+}
+
+// sorted returns a sorted copy of the servers
+func (r *Registry) sorted() []KnownServer {
+	servers := append([]KnownServer(nil), r.servers...)
+	sort.SliceStable(servers, func(i, j int) bool {
+		a, b := servers[i], servers[j]
+		if !a.LastConnected.Equal(b.LastConnected) {
+			return a.LastConnected.After(b.LastConnected)
+		}
+		return a.LastSeen.After(b.LastSeen)
+	})
+	return servers
+}
+
+// Save saves the registry to its store
+func (r *Registry) Save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.store.Save(r.servers); err != nil {
+		return fmt.Errorf("Save: %w", err)
+	}
+	return nil
+}
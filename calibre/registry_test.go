@@ -0,0 +1,60 @@
+package calibre
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "calibre-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileRegistryStore(filepath.Join(dir, "servers.json"))
+	reg, err := NewRegistry(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desktop := ConnectionInfo{Host: "192.168.1.10", TCPPort: 9090, Name: "desktop"}
+	laptop := ConnectionInfo{Host: "192.168.1.11", TCPPort: 9090, Name: "laptop"}
+	remote := ConnectionInfo{Host: "calibre.example.com", TCPPort: 9443, UseTLS: true}
+	reg.MarkConnected(remote)
+	reg.Merge([]ConnectionInfo{desktop, laptop})
+	reg.MarkConnected(laptop)
+	if err = reg.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if reg, err = NewRegistry(store); err != nil {
+		t.Fatal(err)
+	}
+	// The desktop's address changed, and discovery found nothing else
+	moved := desktop
+	moved.Host = "192.168.1.20"
+	servers := reg.Merge([]ConnectionInfo{moved})
+	if len(servers) != 3 {
+		t.Fatalf("Expected 3 servers, got %+v", servers)
+	}
+	if s := servers[0]; !s.Found || s.Host != "192.168.1.20" || s.LastSeen.IsZero() {
+		t.Errorf("Expected the moved desktop first, got %+v", s)
+	}
+	if servers[1].Name != "laptop" || servers[1].Found || servers[2].Host != remote.Host || !servers[2].UseTLS {
+		t.Errorf("Expected the laptop, then the remote server, got %+v", servers[1:])
+	}
+	if all := reg.Servers(); all[0].Name != "laptop" || all[1].Host != remote.Host {
+		t.Errorf("Expected servers ordered by last connection, got %+v", all)
+	}
+	reg.SetLibrary(laptop, "lib-uuid")
+	if ci, ok := reg.LibraryServer("lib-uuid", []ConnectionInfo{moved, laptop}); !ok || ci.Name != "laptop" {
+		t.Errorf("Expected the laptop to have the library, got %+v, %v", ci, ok)
+	}
+	if _, ok := reg.LibraryServer("other-uuid", []ConnectionInfo{moved, laptop}); ok {
+		t.Errorf("Expected no server with an unknown library")
+	}
+	reg.Remove(laptop)
+	if len(reg.Servers()) != 2 {
+		t.Errorf("Expected the laptop to be removed")
+	}
+}
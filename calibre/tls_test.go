@@ -0,0 +1,132 @@
+package calibre
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for name, and its key, to dir
+func writeCert(t *testing.T, dir, name string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	cert, _ = x509.ParseCertificate(der)
+	return certFile, keyFile, cert
+}
+
+func TestConnectTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "calibre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverCert, serverKey, _ := writeCert(t, dir, "proxy.test")
+	clientCert, clientKey, client := writeCert(t, dir, "device.test")
+	_, _, other := writeCert(t, dir, "other.test")
+	notPEM := filepath.Join(dir, "empty.pem")
+	ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600)
+
+	// serve starts a TLS proxy that says "ok" to each connection, trusting
+	// client certificates signed by clientCA, if set
+	serve := func(clientCA *x509.Certificate) int {
+		cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if clientCA != nil {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			cfg.ClientCAs = x509.NewCertPool()
+			cfg.ClientCAs.AddCert(clientCA)
+		}
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				conn.Write([]byte("ok"))
+				conn.Close()
+			}
+		}()
+		return ln.Addr().(*net.TCPAddr).Port
+	}
+	plain := serve(nil)
+	mutual := serve(client)
+	wrongClient := serve(other)
+
+	tests := []struct {
+		name string
+		port int
+		opts TLSOptions
+		ok   bool
+	}{
+		{"CA file", plain, TLSOptions{CAFile: serverCert}, true},
+		{"system CAs", plain, TLSOptions{}, false},
+		{"skip verify", plain, TLSOptions{InsecureSkipVerify: true}, true},
+		{"server name", plain, TLSOptions{CAFile: serverCert, ServerName: "proxy.test"}, true},
+		{"wrong server name", plain, TLSOptions{CAFile: serverCert, ServerName: "wrong.test"}, false},
+		{"missing CA file", plain, TLSOptions{CAFile: filepath.Join(dir, "missing.pem")}, false},
+		{"CA file without certificates", plain, TLSOptions{CAFile: notPEM}, false},
+		{"client certificate", mutual, TLSOptions{CAFile: serverCert, CertFile: clientCert, KeyFile: clientKey}, true},
+		{"no client certificate", mutual, TLSOptions{CAFile: serverCert}, false},
+		{"untrusted client certificate", wrongClient, TLSOptions{CAFile: serverCert, CertFile: clientCert, KeyFile: clientKey}, false},
+		{"missing client key", mutual, TLSOptions{CAFile: serverCert, CertFile: clientCert}, false},
+	}
+	for _, tt := range tests {
+		ci := ConnectionInfo{Host: "127.0.0.1", TCPPort: tt.port, UseTLS: true, TLS: tt.opts}
+		conn, err := ci.Connect()
+		var reply []byte
+		if err == nil {
+			// Client certificates are only checked once the handshake is over
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			reply, err = ioutil.ReadAll(conn)
+			conn.Close()
+		}
+		if ok := err == nil && string(reply) == "ok"; ok != tt.ok {
+			t.Errorf("%s: expected success %v, got %q, %v", tt.name, tt.ok, reply, err)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+/*
+	UNCaGED - Universal Networked Calibre Go Ereader Device
+    Copyright (C) 2018 Sherman Perry
+
+    This file is part of UNCaGED.
+
+    UNCaGED is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    UNCaGED is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with UNCaGED.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Command appliance is an example headless sync box, such as a Raspberry Pi with
+// a USB drive attached. It runs forever, waiting for a Calibre instance to appear on
+// the network, and mirrors the books Calibre sends to a directory on the drive.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/shermp/UNCaGED/uc"
+)
+
+const metadataFile = ".metadata.calibre"
+const drivinfoFile = ".driveinfo.calibre"
+const checksumFile = ".checksums.calibre"
+
+// Metrics, published by expvar at /debug/vars on the metrics address
+var (
+	sessions      = expvar.NewInt("sessions")
+	sessionErrors = expvar.NewInt("session_errors")
+	booksReceived = expvar.NewInt("books_received")
+	booksDeleted  = expvar.NewInt("books_deleted")
+	bytesReceived = expvar.NewInt("bytes_received")
+	throughput    = expvar.NewFloat("throughput_bytes_per_second")
+)
+
+// appliance implements uc.Client, storing books and their metadata in a directory
+type appliance struct {
+	dir      string
+	name     string
+	password string
+	logger   *log.Logger
+	books    []uc.CalibreBookMeta
+	devInfo  uc.DeviceInfo
+	received int
+}
+
+func (a *appliance) path(name string) string {
+	return filepath.Join(a.dir, name)
+}
+
+func (a *appliance) load() error {
+	mdJSON, err := ioutil.ReadFile(a.path(metadataFile))
+	if err == nil && len(mdJSON) > 0 {
+		err = json.Unmarshal(mdJSON, &a.books)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("load: error reading metadata: %w", err)
+	}
+	diJSON, err := ioutil.ReadFile(a.path(drivinfoFile))
+	if err == nil && len(diJSON) > 0 {
+		err = json.Unmarshal(diJSON, &a.devInfo.DevInfo)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("load: error reading drive info: %w", err)
+	}
+	if a.devInfo.DevInfo.DeviceName == "" {
+		a.devInfo.DevInfo.DeviceName = a.name
+	}
+	return nil
+}
+
+func (a *appliance) saveJSON(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(a.path(name), data, 0644)
+}
+
+// SelectCalibreInstance picks the first instance found. An appliance has no
+// one to ask.
+func (a *appliance) SelectCalibreInstance(calInstances []uc.CalInstance) uc.CalInstance {
+	return calInstances[0]
+}
+
+// GetClientOptions returns the options for a generic device, with reconnects
+// enabled so a flaky network doesn't end the session
+func (a *appliance) GetClientOptions() (uc.ClientOptions, error) {
+	checksums, err := uc.NewFileChecksumStore(a.path(checksumFile))
+	if err != nil {
+		return uc.ClientOptions{}, err
+	}
+	opts := uc.ClientOptions{
+		ClientName:    "UNCaGED Appliance",
+		DeviceName:    a.name,
+		DeviceModel:   "Appliance",
+		SupportedExt:  []string{"epub", "kepub", "mobi", "azw3", "pdf"},
+		AutoReconnect: true,
+		Checksums:     checksums,
+		ConnectRetry:  uc.RetryPolicy{Attempts: 5, InitialDelay: time.Second, MaxDelay: 30 * time.Second, Jitter: 0.2},
+	}
+	opts.CoverDims.Width, opts.CoverDims.Height = 530, 530
+	return opts, nil
+}
+
+// GetDeviceBookList returns the books stored on the drive
+func (a *appliance) GetDeviceBookList() ([]uc.BookCountDetails, error) {
+	bl := make([]uc.BookCountDetails, 0, len(a.books))
+	for _, md := range a.books {
+		lastMod := time.Now()
+		if md.LastModified != nil {
+			lastMod = *md.LastModified.GetTime()
+		}
+		bl = append(bl, uc.BookCountDetails{
+			UUID:         md.UUID,
+			Lpath:        md.Lpath,
+			LastModified: lastMod,
+			Extension:    filepath.Ext(md.Lpath),
+		})
+	}
+	return bl, nil
+}
+
+// metaIter iterates over a list of metadata
+type metaIter struct {
+	md  []uc.CalibreBookMeta
+	pos int
+}
+
+func (it *metaIter) Next() bool {
+	it.pos++
+	return it.pos < len(it.md)
+}
+func (it *metaIter) Count() int {
+	return len(it.md)
+}
+func (it *metaIter) Get() (uc.CalibreBookMeta, error) {
+	return it.md[it.pos], nil
+}
+
+// GetMetadataIter provides metadata for the requested books, or all books
+func (a *appliance) GetMetadataIter(books []uc.BookID) uc.MetadataIter {
+	if len(books) == 0 {
+		return &metaIter{md: a.books, pos: -1}
+	}
+	wanted := make(map[string]bool)
+	for _, b := range books {
+		wanted[b.Lpath] = true
+	}
+	it := &metaIter{pos: -1}
+	for _, md := range a.books {
+		if wanted[md.Lpath] {
+			it.md = append(it.md, md)
+		}
+	}
+	return it
+}
+
+// GetDeviceInfo returns the saved drive info
+func (a *appliance) GetDeviceInfo() (uc.DeviceInfo, error) {
+	return a.devInfo, nil
+}
+
+// SetDeviceInfo saves the drive info Calibre sends
+func (a *appliance) SetDeviceInfo(devInfo uc.DeviceInfo) error {
+	a.devInfo = devInfo
+	return a.saveJSON(drivinfoFile, a.devInfo.DevInfo)
+}
+
+// SetLibraryInfo logs the library being mirrored
+func (a *appliance) SetLibraryInfo(libInfo uc.CalibreLibraryInfo) error {
+	a.logger.Printf("mirroring library %s (%s)", libInfo.LibraryName, libInfo.LibraryUUID)
+	return nil
+}
+
+// UpdateMetadata replaces the metadata of books already on the drive
+func (a *appliance) UpdateMetadata(mdList []uc.CalibreBookMeta) error {
+	for _, newMD := range mdList {
+		for i, md := range a.books {
+			if md.Lpath == newMD.Lpath {
+				a.books[i] = newMD
+			}
+		}
+	}
+	return a.saveJSON(metadataFile, a.books)
+}
+
+// GetPassword returns the password read from -password-file or UNCAGED_PASSWORD
+func (a *appliance) GetPassword(calibreInfo uc.CalibreInitInfo) (string, error) {
+	return a.password, nil
+}
+
+// GetFreeSpace reports the free space on the drive. A fixed 1GB is reported if
+// the drive can't be queried, rather than telling Calibre the device is full.
+func (a *appliance) GetFreeSpace() uint64 {
+	free, _, err := diskSpace(a.dir)
+	if err != nil {
+		return 1024 * 1024 * 1024
+	}
+	return free
+}
+
+// GetTotalSpace reports the capacity of the drive. A fixed 8GB is reported if
+// the drive can't be queried.
+func (a *appliance) GetTotalSpace() uint64 {
+	_, total, err := diskSpace(a.dir)
+	if err != nil {
+		return 8 * 1024 * 1024 * 1024
+	}
+	return total
+}
+
+// SaveBook writes a book to the drive
+func (a *appliance) SaveBook(md uc.CalibreBookMeta, book io.Reader, len int, lastBook bool) error {
+	bookPath := a.path(md.Lpath)
+	if err := os.MkdirAll(filepath.Dir(bookPath), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(bookPath)
+	if err != nil {
+		return err
+	}
+	n, err := io.CopyN(f, book, int64(len))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("SaveBook: wrote %d of %d bytes: %w", n, len, err)
+	}
+	// The appliance has no screen, so thumbnails aren't kept
+	md.Thumbnail = nil
+	replaced := false
+	for i, m := range a.books {
+		if m.Lpath == md.Lpath {
+			a.books[i], replaced = md, true
+		}
+	}
+	if !replaced {
+		a.books = append(a.books, md)
+	}
+	a.received++
+	booksReceived.Add(1)
+	bytesReceived.Add(int64(len))
+	if lastBook {
+		return a.saveJSON(metadataFile, a.books)
+	}
+	return nil
+}
+
+// GetBook opens a book on the drive, so it can be sent to Calibre
+func (a *appliance) GetBook(book uc.BookID, filePos int64) (io.ReadCloser, int64, error) {
+	f, err := os.Open(a.path(book.Lpath))
+	if err != nil {
+		return nil, -1, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, -1, err
+	}
+	if filePos > 0 {
+		f.Seek(filePos, io.SeekStart)
+	}
+	return f, fi.Size(), nil
+}
+
+// DeleteBook removes a book from the drive
+func (a *appliance) DeleteBook(book uc.BookID) error {
+	if err := os.Remove(a.path(book.Lpath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i, md := range a.books {
+		if md.Lpath == book.Lpath {
+			a.books = append(a.books[:i], a.books[i+1:]...)
+			break
+		}
+	}
+	booksDeleted.Add(1)
+	return a.saveJSON(metadataFile, a.books)
+}
+
+// LogPrintf logs to the appliance log
+func (a *appliance) LogPrintf(logLevel uc.LogLevel, format string, v ...interface{}) {
+	if logLevel == uc.Debug {
+		return
+	}
+	a.logger.Printf(strings.TrimSuffix(format, "\n"), v...)
+}
+
+// DisplayMessage logs messages from Calibre, as the appliance has no display
+func (a *appliance) DisplayMessage(kind uc.MessageKind, text string) {
+	a.logger.Printf("message from calibre: %s", text)
+}
+
+// UpdateBandwidth publishes the connection throughput as a metric
+func (a *appliance) UpdateBandwidth(est uc.BandwidthEstimate) {
+	throughput.Set(est.BytesPerSecond)
+}
+
+// ReportWarning logs warnings, such as duplicate books
+func (a *appliance) ReportWarning(w uc.Warning) {
+	a.logger.Printf("warning: %s", w.Message)
+}
+
+// notify posts a JSON event to the webhook URL, if one is set
+func notify(url string, event interface{}) {
+	if url == "" {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("webhook: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// syncEvent is sent to the webhook at the end of each session
+type syncEvent struct {
+	Device   string `json:"device"`
+	Books    int    `json:"books_received"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+func main() {
+	dir := flag.String("dir", "/mnt/usb/books", "directory to mirror books to")
+	name := flag.String("name", "UNCaGED Appliance", "device name shown in Calibre")
+	// The password isn't taken as a flag, as expvar publishes the command line
+	passwordFile := flag.String("password-file", "", "file containing the Calibre wireless device password. UNCAGED_PASSWORD is used if not set")
+	webhook := flag.String("webhook", "", "URL to POST a JSON event to after each sync")
+	metrics := flag.String("metrics", "", "address to serve expvar metrics on, eg: 127.0.0.1:8080. Disabled if empty")
+	logFile := flag.String("log", "", "log to a rotating file, instead of stderr")
+	wait := flag.Duration("wait", 10*time.Second, "time to wait between searches for Calibre")
+	flag.Parse()
+
+	app := &appliance{dir: *dir, name: *name, password: os.Getenv("UNCAGED_PASSWORD"), logger: log.New(os.Stderr, "", log.LstdFlags)}
+	if *passwordFile != "" {
+		password, err := ioutil.ReadFile(*passwordFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.password = strings.TrimSpace(string(password))
+	}
+	if *logFile != "" {
+		df, err := uc.NewDiagFile(*logFile, uc.DiagFileOptions{Compress: true})
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer df.Close()
+		app.logger.SetOutput(df)
+	}
+	if err := os.MkdirAll(app.dir, 0755); err != nil {
+		app.logger.Fatal(err)
+	}
+	if err := app.load(); err != nil {
+		app.logger.Fatal(err)
+	}
+	if *metrics != "" {
+		go func() {
+			app.logger.Println(http.ListenAndServe(*metrics, nil))
+		}()
+	}
+	for {
+		c, err := uc.New(app, false)
+		if errors.Is(err, uc.CalibreNotFound) {
+			time.Sleep(*wait)
+			continue
+		} else if err != nil {
+			app.logger.Printf("error connecting to calibre: %v", err)
+			time.Sleep(*wait)
+			continue
+		}
+		sessions.Add(1)
+		app.received = 0
+		start := time.Now()
+		ev := syncEvent{Device: app.name}
+		if err = c.Start(); err != nil {
+			sessionErrors.Add(1)
+			app.logger.Printf("sync failed: %v", err)
+			ev.Error = err.Error()
+		}
+		ev.Books, ev.Duration = app.received, time.Since(start).Round(time.Second).String()
+		notify(*webhook, ev)
+		// Calibre keeps answering discovery after the device is ejected, so
+		// don't reconnect straight away
+		time.Sleep(*wait)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import "syscall"
+
+// diskSpace returns the free and total space of the filesystem dir is on
+func diskSpace(dir string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	avail := st.F_bavail
+	if avail < 0 {
+		avail = 0
+	}
+	return uint64(avail) * uint64(st.F_bsize), st.F_blocks * uint64(st.F_bsize), nil
+}
@@ -1,5 +1,8 @@
 module github.com/shermp/UNCaGED
 
-go 1.13
+go 1.21
 
-require github.com/slongfield/pyfmt v0.0.0-20180124071345-020a7cb18bca
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/slongfield/pyfmt v0.0.0-20180124071345-020a7cb18bca
+)
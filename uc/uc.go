@@ -22,14 +22,22 @@ package uc
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log/slog"
 	"net"
+	"path"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/shermp/UNCaGED/calibre"
@@ -37,6 +45,29 @@ import (
 
 const bookPacketContentLen = 4096
 
+// metadataOnlyDeadline is the connection deadline used while receiving
+// metadata in a sync that doesn't involve sending books
+const metadataOnlyDeadline = 300 * time.Second
+
+// defaultBusyRetry is used when Calibre is busy, if the client does not set
+// ClientOptions.BusyRetry
+var defaultBusyRetry = RetryPolicy{Attempts: 5, InitialDelay: 2 * time.Second, MaxDelay: 30 * time.Second}
+
+// defaultPasswordRetry limits password attempts, if the client does not set
+// ClientOptions.PasswordRetry
+var defaultPasswordRetry = RetryPolicy{Attempts: 3, InitialDelay: time.Second, MaxDelay: 30 * time.Second}
+
+// defaultBooklistChunk is the number of booklist entries sent in each write,
+// if the client does not set ClientOptions.BooklistChunkSize
+const defaultBooklistChunk = 100
+
+// booklistBufSize is the size of the buffer the booklist is written through
+const booklistBufSize = 64 * 1024
+
+// bandwidthSampleMin is the minimum number of bytes a packet must contain
+// to be used to estimate the connection throughput
+const bandwidthSampleMin = 32 * 1024
+
 // buildJSONpayload builds a payload in the format that Calibre expects
 func buildJSONpayload(data interface{}, op calOpCode) []byte {
 	jsonBytes, _ := json.Marshal(data)
@@ -46,9 +77,85 @@ func buildJSONpayload(data interface{}, op calOpCode) []byte {
 	return payload
 }
 
+// payloadPrefixLen is the space reserved for the length prefix of a payload
+const payloadPrefixLen = 20
+
+// maxPooledPayload is the largest payload buffer kept for reuse
+const maxPooledPayload = 1024 * 1024
+
+// payloadPool holds the buffers payloads are encoded into
+var payloadPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// encodedPayload is a payload encoded into a pooled buffer
+type encodedPayload struct {
+	buf   *bytes.Buffer
+	start int
+}
+
+// encodeJSONpayload encodes a payload in the format that Calibre expects. Unlike
+// buildJSONpayload, the JSON is encoded once, straight into a buffer with room
+// for the length prefix, which matters for metadata with embedded covers.
+// Call release once the payload has been written.
+func encodeJSONpayload(data interface{}, op calOpCode) (encodedPayload, error) {
+	buf := payloadPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	buf.Write(make([]byte, payloadPrefixLen))
+	fmt.Fprintf(buf, "[%d,", op)
+	if err := json.NewEncoder(buf).Encode(data); err != nil {
+		payloadPool.Put(buf)
+		return encodedPayload{}, fmt.Errorf("encodeJSONpayload: %w", err)
+	}
+	// Encode ends the JSON with a newline
+	buf.Truncate(buf.Len() - 1)
+	buf.WriteByte(']')
+	b := buf.Bytes()
+	var prefix [payloadPrefixLen]byte
+	lenStr := strconv.AppendInt(prefix[:0], int64(len(b)-payloadPrefixLen), 10)
+	start := payloadPrefixLen - len(lenStr)
+	copy(b[start:], lenStr)
+	return encodedPayload{buf: buf, start: start}, nil
+}
+
+// bytes returns the encoded payload, which is only valid until release is called
+func (ep encodedPayload) bytes() []byte {
+	return ep.buf.Bytes()[ep.start:]
+}
+
+// release returns the payload's buffer to the pool
+func (ep encodedPayload) release() {
+	if ep.buf.Cap() <= maxPooledPayload {
+		payloadPool.Put(ep.buf)
+	}
+}
+
+// writeJSON encodes a payload, and writes it to Calibre
+func (c *calConn) writeJSON(data interface{}, op calOpCode) error {
+	ep, err := encodeJSONpayload(data, op)
+	if err != nil {
+		return err
+	}
+	defer ep.release()
+	return c.writeTCP(ep.bytes())
+}
+
 // New initilizes the calibre connection, and returns it
 // An error is returned if a Calibre instance cannot be found
+//
+// Client callbacks are called from the goroutine running Start, one at a time.
+// While Start is running, only the following methods may be called from other
+// goroutines, such as a UI goroutine: Stats, Bandwidth, CalibreInfo,
+// LastConnected, BookByLpath, BookByUUID, AllBooks, MarkMissing, OfferBooks and
+// CancelBook. They may also be called from client callbacks.
 func New(client Client, enableDebug bool) (*calConn, error) {
+	return NewWithOptions(client, enableDebug, nil)
+}
+
+// NewWithOptions is New, with override called to change the options returned
+// by the client's GetClientOptions, if it isn't nil. It allows code running
+// sessions on behalf of a client, such as a control server, to choose the
+// Calibre instance or watch events, without wrapping the client and hiding the
+// optional interfaces it implements.
+func NewWithOptions(client Client, enableDebug bool, override func(opts *ClientOptions)) (*calConn, error) {
 	var retErr error
 	retErr = nil
 	c := &calConn{}
@@ -58,40 +165,100 @@ func New(client Client, enableDebug bool) (*calConn, error) {
 	if retErr != nil {
 		return nil, fmt.Errorf("New: Error getting client options: %w", retErr)
 	}
+	if override != nil {
+		override(&c.clientOpts)
+	}
+	if c.clientOpts.Preset != "" {
+		preset, err := PresetByName(c.clientOpts.Preset)
+		if err != nil {
+			return nil, fmt.Errorf("New: %w", err)
+		}
+		preset.Apply(&c.clientOpts)
+	}
+	if c.allowlist, retErr = parseAllowlist(c.clientOpts.AllowedHosts); retErr != nil {
+		return nil, fmt.Errorf("New: %w", retErr)
+	}
 	c.transferCount = 0
 	c.okStr = "6[0,{}]"
-	c.tcpDeadline.stdDuration = 60 * time.Second
+	c.passwords = make(map[string]string)
+	c.passwordFailures = make(map[string]int)
+	c.tcpDeadline.std = 60 * time.Second
 	c.ucdb = &UncagedDB{}
-	bookList, retErr := c.client.GetDeviceBookList()
-	if retErr != nil {
-		return nil, fmt.Errorf("New: Error getting booklist from device: %w", retErr)
+	var bookList []BookCountDetails
+	if c.clientOpts.BookStore != nil {
+		if bookList, retErr = c.clientOpts.BookStore.Load(); retErr != nil {
+			return nil, fmt.Errorf("New: Error loading books from store: %w", retErr)
+		}
+	}
+	var duplicates [][]BookID
+	var missing []BookID
+	if bookList != nil {
+		duplicates, missing = c.ucdb.loadDB(bookList)
+	} else {
+		if bookList, retErr = c.client.GetDeviceBookList(); retErr != nil {
+			return nil, fmt.Errorf("New: Error getting booklist from device: %w", retErr)
+		}
+		duplicates, missing = c.ucdb.initDB(bookList)
+	}
+	for _, dup := range duplicates {
+		c.warn(Warning{
+			Kind:    DuplicateUUID,
+			Message: fmt.Sprintf("%d books share the UUID '%s'. Only the first will be matched by UUID", len(dup), dup[0].UUID),
+			Books:   dup,
+		})
+	}
+	if len(missing) > 0 {
+		c.warn(Warning{
+			Kind:    MissingUUID,
+			Message: fmt.Sprintf("%d books have no UUID. UUIDs have been generated from their lpaths", len(missing)),
+			Books:   missing,
+		})
 	}
-	c.ucdb.initDB(bookList)
 	if c.deviceInfo, retErr = c.client.GetDeviceInfo(); retErr != nil {
 		return nil, fmt.Errorf("New: Error getting info from device: %w", retErr)
 	}
-	if c.clientOpts.DirectConnect.Host != "" && c.clientOpts.DirectConnect.TCPPort > 0 {
+	if c.clientOpts.Record != nil {
+		c.recorder = newSessionRecorder(c, c.clientOpts.Record)
+	}
+	if c.clientOpts.Replay != nil {
+		if c.replay, retErr = newReplayer(c.clientOpts.Replay); retErr != nil {
+			return nil, fmt.Errorf("New: %w", retErr)
+		}
+		// Reconnecting mustn't search the network either
+		c.clientOpts.DirectConnect = replayInstance
+		c.calibreInstance = replayInstance
+	} else if c.clientOpts.DirectConnect.Host != "" && c.clientOpts.DirectConnect.TCPPort > 0 {
 		ip := net.ParseIP(c.clientOpts.DirectConnect.Host)
 		if ip == nil {
 			hosts, err := net.LookupHost(c.clientOpts.DirectConnect.Host)
 			if err != nil {
 				return nil, fmt.Errorf("New: unable to resolve direct connection host: %w", err)
 			}
+			// Certificates are issued for the hostname, not the address
+			if c.clientOpts.DirectConnect.UseTLS && c.clientOpts.DirectConnect.TLS.ServerName == "" {
+				c.clientOpts.DirectConnect.TLS.ServerName = c.clientOpts.DirectConnect.Host
+			}
 			c.clientOpts.DirectConnect.Host = hosts[0]
 		}
 		c.calibreInstance = c.clientOpts.DirectConnect
 	} else {
-		// Calibre listens for a 'hello' UDP packet on the following
-		// five ports. We try all five ports concurrently
-		c.client.UpdateStatus(SearchingCalibre, -1)
-		instances, err := calibre.DiscoverSmartDevice(c)
+		// Calibre listens for a 'hello' UDP packet on one of several
+		// ports. We try all of them concurrently
+		c.updateStatus(SearchingCalibre, -1)
+		instances, err := calibre.DiscoverSmartDeviceWithOptions(c, c.clientOpts.Discovery)
 		if err != nil {
 			return nil, fmt.Errorf("New: error getting calibre instances: %w", err)
 		}
-		if len(instances) == 0 {
+		if instances = c.allowedInstances(instances); len(instances) == 0 {
 			return nil, fmt.Errorf("New: Could not find calibre instance: %w", CalibreNotFound)
 		}
-		c.calibreInstance = c.client.SelectCalibreInstance(instances)
+		c.instances = instances
+		c.recordFound(instances)
+		if inst, pinned := c.preferredInstance(instances); pinned {
+			c.calibreInstance = inst
+		} else {
+			c.calibreInstance = c.client.SelectCalibreInstance(instances)
+		}
 	}
 	return c, retErr
 }
@@ -138,6 +305,20 @@ func (ucdb *UncagedDB) find(searchType ucdbSearchType, value interface{}) (int,
 		} else {
 			err = fmt.Errorf("find: invalid type. Expecting string")
 		}
+	case UUID:
+		// If multiple books share a UUID, the first one in the booklist wins
+		if u, ok := value.(string); ok {
+			for i, b := range ucdb.booklist {
+				if b.UUID == u {
+					index = i
+					bd = b
+					err = nil
+					break
+				}
+			}
+		} else {
+			err = fmt.Errorf("find: invalid type. Expecting string")
+		}
 	}
 	return index, bd, err
 }
@@ -146,18 +327,81 @@ func (ucdb *UncagedDB) length() int {
 	return len(ucdb.booklist)
 }
 
-// addEntry adds a book to our internal "DB"
+// addEntry adds a book to our internal "DB". A book replacing one already at
+// the same lpath keeps its primary key.
 func (ucdb *UncagedDB) addEntry(md CalibreBookMeta) {
+	ucdb.mu.Lock()
+	defer ucdb.mu.Unlock()
 	bd := BookCountDetails{
-		PriKey: ucdb.newPriKey(),
-		UUID:   md.UUID,
-		Lpath:  md.Lpath,
+		UUID:  md.UUID,
+		Lpath: md.Lpath,
+	}
+	if bd.UUID == "" {
+		bd.UUID, bd.syntheticUUID = syntheticUUID(bd.Lpath), true
 	}
+	if i, existing, err := ucdb.find(Lpath, md.Lpath); err == nil {
+		bd.PriKey = existing.PriKey
+		ucdb.booklist[i] = bd
+		return
+	}
+	bd.PriKey = ucdb.newPriKey()
 	ucdb.booklist = append(ucdb.booklist, bd)
 }
 
+// addDetails adds a book the client describes with abridged metadata to our
+// internal "DB"
+func (ucdb *UncagedDB) addDetails(bd BookCountDetails) {
+	ucdb.mu.Lock()
+	defer ucdb.mu.Unlock()
+	if bd.UUID == "" {
+		bd.UUID, bd.syntheticUUID = syntheticUUID(bd.Lpath), true
+	}
+	bd.PriKey = ucdb.newPriKey()
+	ucdb.booklist = append(ucdb.booklist, bd)
+}
+
+// otherFormats returns the books sharing the UUID of md, stored at a different
+// lpath. These are other formats of the same book.
+func (ucdb *UncagedDB) otherFormats(md CalibreBookMeta) []BookCountDetails {
+	var formats []BookCountDetails
+	if md.UUID == "" {
+		return nil
+	}
+	for _, b := range ucdb.booklist {
+		if b.UUID == md.UUID && b.Lpath != md.Lpath && !b.syntheticUUID {
+			formats = append(formats, b)
+		}
+	}
+	return formats
+}
+
+// syntheticUUID generates a stable, UUID formatted string from an lpath, for
+// books that do not have a UUID of their own
+func syntheticUUID(lpath string) string {
+	h := sha1.Sum([]byte("uncaged:" + lpath))
+	// Format as a version 5 (SHA-1, name based) UUID
+	h[6] = (h[6] & 0x0f) | 0x50
+	h[8] = (h[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// fillUUID sets the UUID of metadata the client provided without one, to
+// the UUID UNCaGED generated for that book
+func (ucdb *UncagedDB) fillUUID(md *CalibreBookMeta) {
+	if md.UUID != "" {
+		return
+	}
+	if _, bd, err := ucdb.find(Lpath, md.Lpath); err == nil {
+		md.UUID = bd.UUID
+	} else {
+		md.UUID = syntheticUUID(md.Lpath)
+	}
+}
+
 // removeEntry removes a book from our internal "DB"
 func (ucdb *UncagedDB) removeEntry(searchType ucdbSearchType, value interface{}) error {
+	ucdb.mu.Lock()
+	defer ucdb.mu.Unlock()
 	index, _, err := ucdb.find(searchType, value)
 	if err != nil {
 		return fmt.Errorf("removeEntry: search failed: %w", err)
@@ -166,105 +410,327 @@ func (ucdb *UncagedDB) removeEntry(searchType ucdbSearchType, value interface{})
 	return nil
 }
 
-// initDB initialises the database with a new booklist
-func (ucdb *UncagedDB) initDB(bl []BookCountDetails) {
+// initDB initialises the database with a new booklist. Any books sharing a UUID
+// are returned grouped by UUID, in booklist order.
+// Duplicate UUIDs are disambiguated by keeping every book in the DB (lpaths and
+// primary keys remain unique), while lookups by UUID resolve to the book the
+// client listed first.
+// Books without a UUID are given one generated from their lpath, and are
+// returned in missing.
+func (ucdb *UncagedDB) initDB(bl []BookCountDetails) (duplicates [][]BookID, missing []BookID) {
+	ucdb.mu.Lock()
+	defer ucdb.mu.Unlock()
 	ucdb.booklist = bl
-	for i := range ucdb.booklist {
+	for i, b := range ucdb.booklist {
 		ucdb.booklist[i].PriKey = ucdb.newPriKey()
+		if b.UUID == "" {
+			ucdb.booklist[i].UUID, ucdb.booklist[i].syntheticUUID = syntheticUUID(b.Lpath), true
+		}
 	}
+	return ucdb.checkUUIDs()
+}
+
+// checkUUIDs returns the books sharing a UUID, grouped by UUID in booklist
+// order, and the books with a UUID generated from their lpath. The caller
+// must hold ucdb.mu.
+func (ucdb *UncagedDB) checkUUIDs() (duplicates [][]BookID, missing []BookID) {
+	seen := make(map[string]int)
+	for _, b := range ucdb.booklist {
+		bID := BookID{Lpath: b.Lpath, UUID: b.UUID}
+		if b.syntheticUUID {
+			missing = append(missing, bID)
+			continue
+		}
+		if d, exists := seen[b.UUID]; !exists {
+			seen[b.UUID] = -1
+		} else if d < 0 {
+			_, first, _ := ucdb.find(UUID, b.UUID)
+			seen[b.UUID] = len(duplicates)
+			duplicates = append(duplicates, []BookID{{Lpath: first.Lpath, UUID: first.UUID}, bID})
+		} else {
+			duplicates[d] = append(duplicates[d], bID)
+		}
+	}
+	return duplicates, missing
 }
 
 // Start starts a TCP connection with Calibre, then listens
 // for messages and pass them to the appropriate handler
-func (c *calConn) Start() (err error) {
+func (c *calConn) Start() error {
+	return c.StartContext(context.Background())
+}
+
+// StartContext is like Start, but stops the session when ctx is cancelled.
+// The current job is finished first, and StartContext returns a nil error
+// if no other errors were detected
+func (c *calConn) StartContext(ctx context.Context) (err error) {
 	exitChan := make(chan bool)
-	calPl := make(chan calPayload)
-	c.client.SetExitChannel(exitChan)
-	c.client.UpdateStatus(Connecting, -1)
+	// Buffered, so the reader isn't left blocked if we exit early
+	calPl := make(chan calPayload, 1)
+	if ec, ok := c.client.(ExitChannelReceiver); ok {
+		ec.SetExitChannel(exitChan)
+	}
+	c.ctx = ctx
+	c.eventsStalled = false
+	c.updateStats(func(s *SessionStats) { *s = SessionStats{Started: time.Now()} })
+	c.updateStatus(Connecting, -1)
+	defer c.updateStats(func(s *SessionStats) { s.Elapsed = time.Since(s.Started) })
 	err = c.establishTCP()
 	if err != nil {
+		if cancelled(ctx, err) {
+			c.LogPrintf("Session cancelled: %v\n", ctx.Err())
+			return nil
+		}
 		return fmt.Errorf("Start: establishing connection failed: %w", err)
 	}
-	defer c.tcpConn.Close()
+	reading := false
+	defer func() {
+		c.tcpConn.Close()
+		// Closing the connection ends any read in progress. Wait for it, so the
+		// reader doesn't outlive the session, and race with the next one.
+		if reading {
+			<-calPl
+		}
+		c.endSession()
+		c.emit(SessionEnded{Reason: err})
+		if c.clientOpts.Metrics != nil {
+			c.clientOpts.Metrics.SessionEnded(err)
+		}
+	}()
 	// Connect to Calibre
 	// Keep reading untill the connection is closed
 	for {
 		go c.readDecodeCalibrePayloadChan(calPl)
+		reading = true
 		select {
 		case <-exitChan:
 			return nil
+		case <-ctx.Done():
+			c.LogPrintf("Session cancelled: %v\n", ctx.Err())
+			return nil
 		case pl := <-calPl:
+			reading = false
+			if pl.err != nil && c.clientOpts.AutoReconnect && connectionLost(pl.err) {
+				c.LogPrintf("Connection lost, reconnecting: %v\n", pl.err)
+				if err = c.reconnect(); err != nil {
+					return fmt.Errorf("Start: reconnecting failed: %w", err)
+				}
+				continue
+			}
 			if pl.err != nil {
 				if pl.err == io.EOF {
 					c.LogPrintf("TCP Connection Closed")
 					return nil
 				}
-				return fmt.Errorf("Start: packet reading failed: %w", pl.err)
+				return &OpError{Phase: errorPhase(pl.err), Err: fmt.Errorf("Start: packet reading failed: %w", pl.err)}
 			}
-			c.LogPrintf("Calibre Opcode received: %v\n", pl.op)
-			switch pl.op {
-			case getInitializationInfo:
-				c.LogPrintf("Processing GET_INIT_INFO packet: %.40s\n", string(pl.payload))
-				err = c.getInitInfo(pl.payload)
-			case displayMessage:
-				c.LogPrintf("Processing DISPLAY_NESSAGE packet: %.40s\n", string(pl.payload))
-				err = c.handleMessage(pl.payload)
-			case getDeviceInformation:
-				c.LogPrintf("Processing GET_DEV_INFO packet: %.40s\n", string(pl.payload))
-				err = c.getDeviceInfo()
-			case setCalibreDeviceInfo:
-				c.LogPrintf("Processing SET_CAL_DEV_INFO packet: %.40s\n", string(pl.payload))
-				err = c.setDeviceInfo(pl.payload)
-			case freeSpace:
-				c.LogPrintf("Processing FREE_SPACE packet: %.40s\n", string(pl.payload))
-				err = c.getFreeSpace()
-			case getBookCount:
-				c.LogPrintf("Processing GET_BOOK_COUNT packet: %.40s\n", string(pl.payload))
-				err = c.getBookCount(pl.payload)
-			case sendBooklists:
-				c.LogPrintf("Processing SEND_BOOKLISTS packet: %.40s\n", string(pl.payload))
-				err = c.updateDeviceMetadata(pl.payload)
-			case setLibraryInfo:
-				c.LogPrintf("Processing SET_LIBRARY_INFO packet: %.40s\n", string(pl.payload))
-				err = c.setLibraryInfo(pl.payload)
-			case sendBook:
-				c.LogPrintf("Processing SEND_BOOK packet: %.40s\n", string(pl.payload))
-				err = c.sendBook(pl.payload)
-			case deleteBook:
-				c.LogPrintf("Processing DELETE_BOOK packet: %.40s\n", string(pl.payload))
-				err = c.deleteBook(pl.payload)
-			case getBookFileSegment:
-				c.LogPrintf("Processing GET_BOOK_FILE_SEGMENT packet: %.40s\n", string(pl.payload))
-				err = c.getBook(pl.payload)
-			case noop:
-				c.LogPrintf("Processing NOOP packet: %.40s\n", string(pl.payload))
-				err = c.handleNoop(pl.payload)
+			c.setLogOp(pl.op)
+			c.LogPrintf("Processing packet: %.40s\n", string(pl.payload))
+			var handled bool
+			handleStart := time.Now()
+			if handled, err = c.handleMiddleware(pl.op, pl.payload); !handled && err == nil {
+				err = c.handlePacket(pl.op, pl.payload)
+			}
+			c.packetHandled(pl.op, time.Since(handleStart), err)
+			if err != nil {
+				err = c.downgrade(pl.op, pl.payload, err)
 			}
 			if err != nil {
 				if err == io.EOF {
 					return nil
 				}
-				return fmt.Errorf("Start: exiting with error: %w", err)
+				if cancelled(ctx, err) {
+					c.LogPrintf("Session cancelled: %v\n", ctx.Err())
+					return nil
+				}
+				return opError(pl.op, fmt.Errorf("Start: exiting with error: %w", err))
+			}
+		}
+	}
+}
+
+// cancelled returns true if err was caused by ctx being cancelled
+func cancelled(ctx context.Context, err error) bool {
+	return ctx.Err() != nil && errors.Is(err, ctx.Err())
+}
+
+// sleep waits for d, or until ctx is cancelled, returning ctx's error if it
+// was. A nil ctx is never cancelled.
+func (c *calConn) sleep(ctx context.Context, d time.Duration) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handlePacket handles a packet Calibre sent to start a new operation
+func (c *calConn) handlePacket(op calOpCode, payload json.RawMessage) error {
+	var err error
+	switch op {
+	case getInitializationInfo:
+		err = c.getInitInfo(payload)
+	case displayMessage:
+		err = c.handleMessage(payload)
+	case getDeviceInformation:
+		err = c.getDeviceInfo()
+	case setCalibreDeviceInfo:
+		err = c.setDeviceInfo(payload)
+	case freeSpace:
+		err = c.getFreeSpace()
+	case totalSpace:
+		err = c.getTotalSpace()
+	case getBookCount:
+		err = c.getBookCount(payload)
+	case sendBooklists:
+		err = c.updateDeviceMetadata(payload)
+	case setLibraryInfo:
+		err = c.setLibraryInfo(payload)
+	case sendBook:
+		err = c.sendBook(payload)
+	case deleteBook:
+		err = c.deleteBook(payload)
+	case getBookFileSegment:
+		err = c.getBook(payload)
+	case noop:
+		err = c.handleNoop(payload)
+	case calibreBusy:
+		err = c.handleBusy()
+	}
+	return err
+}
+
+// downgradeOpcodes are the opcodes that can be safely acknowledged with a
+// generic OK if their payload can't be decoded. Nothing else in the session
+// depends on the information they carry.
+var downgradeOpcodes = map[calOpCode]bool{
+	displayMessage:       true,
+	setCalibreDeviceInfo: true,
+	setLibraryInfo:       true,
+}
+
+// downgrade deals with payloads for known opcodes that failed to decode, which
+// usually means Calibre has changed the packet format. Where it is safe to do so,
+// the packet is acknowledged and a ProtocolMismatch warning emitted, so that
+// syncing can continue. Otherwise, the original error is returned.
+func (c *calConn) downgrade(op calOpCode, payload json.RawMessage, err error) error {
+	var synErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if !downgradeOpcodes[op] || !(errors.As(err, &synErr) || errors.As(err, &typeErr)) {
+		return err
+	}
+	c.warn(Warning{
+		Kind:    ProtocolMismatch,
+		Message: fmt.Sprintf("could not decode packet for opcode %d, ignoring: %v", op, err),
+		Payload: append([]byte(nil), payload...),
+	})
+	if err = c.writeTCP([]byte(c.okStr)); err != nil {
+		return fmt.Errorf("downgrade: %w", err)
+	}
+	return nil
+}
+
+// connectionLost returns true if err indicates the connection with Calibre
+// was closed, or timed out
+func connectionLost(err error) bool {
+	var terr net.Error
+	return err == io.EOF || (errors.As(err, &terr) && terr.Timeout())
+}
+
+// reconnect re-establishes a lost connection with Calibre, keeping the
+// current session state. If the Calibre instance was discovered on the network,
+// discovery is repeated in case its address has changed.
+func (c *calConn) reconnect() error {
+	c.tcpConn.Close()
+	if c.clientOpts.DirectConnect.Host == "" {
+		c.updateStatus(SearchingCalibre, -1)
+		instances, err := calibre.DiscoverSmartDeviceWithOptions(c, c.clientOpts.Discovery)
+		if err != nil {
+			c.LogPrintf("reconnect: discovery failed, using previous address: %v\n", err)
+		}
+		for _, inst := range c.allowedInstances(instances) {
+			if inst.Name == c.calibreInstance.Name && inst.TCPPort == c.calibreInstance.TCPPort {
+				c.calibreInstance = inst
+				break
 			}
 		}
 	}
+	c.updateStatus(Connecting, -1)
+	if err := c.establishTCP(); err != nil {
+		return fmt.Errorf("reconnect: %w", err)
+	}
+	return nil
 }
 
+// LogPrintf logs debug messages, if debugging is enabled
 func (c *calConn) LogPrintf(format string, a ...interface{}) {
 	if c.debug {
-		c.client.LogPrintf(Debug, "[DEBUG] "+format, a...)
+		c.logf(Debug, format, a...)
+	}
+}
+
+// updateStatus informs the client what UNCaGED is doing, if it implements
+// StatusReporter
+func (c *calConn) updateStatus(status Status, progress int) {
+	if sr, ok := c.client.(StatusReporter); ok {
+		sr.UpdateStatus(status, progress)
+	}
+	c.emit(StatusChanged{Status: status, Progress: progress})
+}
+
+// warn sends a warning to the client, falling back to LogPrintf if the
+// client does not implement WarningReporter
+func (c *calConn) warn(w Warning) {
+	if wr, ok := c.client.(WarningReporter); ok {
+		wr.ReportWarning(w)
+		return
+	}
+	c.logf(Warn, "%s\n", w.Message)
+}
+
+// maxPacketSize limits the size of a packet from Calibre, so that a corrupt
+// length prefix can't exhaust the device's memory. Books are sent outside
+// packets, so even metadata with large covers comes nowhere near it.
+const maxPacketSize = 64 * 1024 * 1024
+
+// parsePacketSize parses the length prefix of a packet from Calibre, without
+// the trailing '['. The smallest valid packet is "[]".
+func parsePacketSize(prefix []byte) (int, error) {
+	if len(prefix) == 0 || len(prefix) > 9 {
+		return 0, fmt.Errorf("parsePacketSize: bad length prefix %.12q: %w", prefix, MalformedPacket)
 	}
+	for _, b := range prefix {
+		if b < '0' || b > '9' {
+			return 0, fmt.Errorf("parsePacketSize: bad length prefix %.12q: %w", prefix, MalformedPacket)
+		}
+	}
+	sz, _ := strconv.Atoi(string(prefix))
+	if sz < 2 || sz > maxPacketSize {
+		return 0, fmt.Errorf("parsePacketSize: packet size %d out of range: %w", sz, MalformedPacket)
+	}
+	return sz, nil
 }
 
-func (c *calConn) decodeCalibrePayload(payload []byte) (calOpCode, json.RawMessage, error) {
+// decodeCalibrePayload splits a packet from Calibre into its opcode and payload.
+// Packets look like [opcode,{...}]
+func decodeCalibrePayload(payload []byte) (calOpCode, json.RawMessage, error) {
 	var calibreDat []json.RawMessage
 	if err := json.Unmarshal(payload, &calibreDat); err != nil {
 		return -1, nil, fmt.Errorf("decodeCalibrePayload: could not unmarshal payload: %w", err)
 	}
+	if len(calibreDat) != 2 {
+		return -1, nil, fmt.Errorf("decodeCalibrePayload: expected 2 elements, got %d: %w", len(calibreDat), MalformedPacket)
+	}
 	// The first element should always be an opcode
 	opcode, err := strconv.Atoi(string(calibreDat[0]))
 	if err != nil {
-		return -1, nil, fmt.Errorf("decodeCalibrePayload: could not decode opcode: %w", err)
+		return -1, nil, fmt.Errorf("decodeCalibrePayload: could not decode opcode %.12q: %w", calibreDat[0], MalformedPacket)
 	}
 	return calOpCode(opcode), calibreDat[1], nil
 }
@@ -273,15 +739,16 @@ func (c *calConn) readDecodeCalibrePayload() (calOpCode, json.RawMessage, error)
 	payload, err := c.readTCP()
 	if err != nil {
 		if err == io.EOF {
-			c.client.UpdateStatus(Disconnected, -1)
+			c.updateStatus(Disconnected, -1)
 			return noop, nil, err
 		}
 		return noop, nil, fmt.Errorf("readDecodeCalibrePayload: connection closed: %w", err)
 	}
-	opcode, data, err := c.decodeCalibrePayload(payload)
+	opcode, data, err := decodeCalibrePayload(payload)
 	if err != nil {
 		return noop, nil, fmt.Errorf("readDecodeCalibrePayload: packet decoding failed: %w", err)
 	}
+	c.tapReceived(opcode, data)
 	return opcode, data, nil
 }
 func (c *calConn) readDecodeCalibrePayloadChan(calPl chan<- calPayload) {
@@ -290,6 +757,67 @@ func (c *calConn) readDecodeCalibrePayloadChan(calPl chan<- calPayload) {
 	calPl <- pl
 }
 
+// recordTransfer updates the bandwidth estimate with 'n' bytes that took
+// 'd' to transfer.
+func (c *calConn) recordTransfer(n int64, d time.Duration) {
+	if n <= 0 || d <= 0 {
+		return
+	}
+	rate := float64(n) / d.Seconds()
+	c.stateMu.Lock()
+	if c.bandwidth.BytesPerSecond == 0 {
+		c.bandwidth.BytesPerSecond = rate
+	} else {
+		// Weight recent transfers more heavily, as network conditions change
+		c.bandwidth.BytesPerSecond = 0.7*c.bandwidth.BytesPerSecond + 0.3*rate
+	}
+	c.bandwidth.Bytes += n
+	c.bandwidth.Duration += d
+	bw := c.bandwidth
+	c.stateMu.Unlock()
+	if br, ok := c.client.(BandwidthReporter); ok {
+		br.UpdateBandwidth(bw)
+	}
+}
+
+// updateStats changes the session stats
+func (c *calConn) updateStats(update func(s *SessionStats)) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	update(&c.stats)
+}
+
+// Stats returns a summary of the current session, or of the most recent session
+// once Start has returned. It is safe to call Stats while UNCaGED is running.
+func (c *calConn) Stats() SessionStats {
+	c.stateMu.RLock()
+	stats := c.stats
+	c.stateMu.RUnlock()
+	if stats.Elapsed == 0 && !stats.Started.IsZero() {
+		stats.Elapsed = time.Since(stats.Started)
+	}
+	return stats
+}
+
+// Bandwidth returns the current estimate of the connection throughput.
+// The estimate is not valid until a book or large packet has been transferred.
+// It is safe to call Bandwidth while UNCaGED is running.
+func (c *calConn) Bandwidth() BandwidthEstimate {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	return c.bandwidth
+}
+
+// passwordKey identifies the Calibre library currently connected to, for password
+// tracking purposes. Instances that don't report a library UUID are identified by
+// their name and address instead.
+func (c *calConn) passwordKey() string {
+	if c.calibreInfo.CurrentLibraryUUID != "" {
+		return c.calibreInfo.CurrentLibraryUUID
+	}
+	return c.calibreInstance.Name + "@" + net.JoinHostPort(c.calibreInstance.Host, strconv.Itoa(c.calibreInstance.TCPPort))
+}
+
 // hashCalPassword generates a string representation in hex of the password
 // hash Calibre expects. Yes, I know this is not the way password handling should
 // be done. Go take it up with the Calibre devs if you want better security...
@@ -303,23 +831,48 @@ func (c *calConn) hashCalPassword(challenge string) string {
 }
 
 func (c *calConn) setTCPDeadline() {
-	if c.tcpDeadline.altDuration > 0 {
-		c.LogPrintf("setTCPDeadline: setting TCP deadline to %d milliseconds", c.tcpDeadline.altDuration.Milliseconds())
-		c.tcpConn.SetDeadline(time.Now().Add(c.tcpDeadline.altDuration))
-		c.tcpDeadline.altDuration = 0
-	} else {
-		c.tcpConn.SetDeadline(time.Now().Add(c.tcpDeadline.stdDuration))
+	d, alt := c.tcpDeadline.next()
+	if alt {
+		c.LogPrintf("setTCPDeadline: setting TCP deadline to %d milliseconds", d.Milliseconds())
 	}
+	c.tcpConn.SetDeadline(time.Now().Add(d))
 }
 
 // establishTCP attempts to connect to Calibre on a port previously obtained from Calibre
+// Failed attempts are retried according to the client's retry policy
 func (c *calConn) establishTCP() error {
+	var conn net.Conn
 	var err error
+	policy := c.clientOpts.ConnectRetry
+	if c.replay != nil {
+		if conn, err = c.replay.next(); err != nil {
+			return fmt.Errorf("establishTCP: %w", err)
+		}
+	} else if !c.allowlist.allows(c.calibreInstance.Host) {
+		// The client may have selected an instance that isn't allowed
+		return fmt.Errorf("establishTCP: %s: %w", c.calibreInstance.Host, HostNotAllowed)
+	}
 	// Connect to Calibre
-	c.tcpConn, err = c.calibreInstance.Connect()
-	if err != nil {
-		return fmt.Errorf("establishTCP: %w", err)
+	for attempt := 1; conn == nil; attempt++ {
+		if conn, err = c.calibreInstance.Connect(); err == nil {
+			break
+		}
+		if attempt >= policy.Attempts {
+			return fmt.Errorf("establishTCP: %w", err)
+		}
+		delay := policy.Delay(attempt)
+		c.LogPrintf("establishTCP: connection attempt %d failed, retrying in %v: %v\n", attempt, delay, err)
+		if err = c.sleep(c.ctx, delay); err != nil {
+			return fmt.Errorf("establishTCP: %w", err)
+		}
+	}
+	if c.clientOpts.Metrics != nil {
+		conn = &meteredConn{Conn: conn, m: c.clientOpts.Metrics}
 	}
+	if c.recorder != nil {
+		conn = c.recorder.wrap(conn)
+	}
+	c.tcpConn = conn
 	c.setTCPDeadline()
 	c.tcpReader = bufio.NewReader(c.tcpConn)
 	return nil
@@ -327,18 +880,100 @@ func (c *calConn) establishTCP() error {
 
 // Convenience function to handle writing to our TCP connection, and manage the deadline
 func (c *calConn) writeTCP(payload []byte) error {
+	c.tapSent(payload)
+	return c.sendTCP(payload)
+}
+
+// sendTCP writes data to the TCP connection, without passing it to the middleware
+func (c *calConn) sendTCP(data []byte) error {
 	var terr net.Error
-	_, err := c.tcpConn.Write(payload)
+	_, err := c.tcpConn.Write(data)
 	if errors.As(err, &terr) && terr.Timeout() {
-		return fmt.Errorf("writeTCP: connection timed out: %w", err)
+		return fmt.Errorf("sendTCP: connection timed out: %w", asSentinel(ConnectionTimeout, err))
 	} else if err != nil {
 		if err == io.EOF {
 			return err
 		}
-		return fmt.Errorf("writeTCP: write to tcp connection failed: %w", err)
+		return fmt.Errorf("sendTCP: write to tcp connection failed: %w", connectionErr(err))
 	}
 	c.setTCPDeadline()
-	c.LogPrintf("Wrote TCP packet: %.40s\n", string(payload))
+	c.debugAttrs("Wrote TCP packet", slog.Int("bytes", len(data)), slog.String("payload", fmt.Sprintf("%.40s", data)))
+	return nil
+}
+
+// tcpWriter is an io.Writer for the TCP connection
+type tcpWriter struct {
+	c *calConn
+}
+
+func (w tcpWriter) Write(p []byte) (int, error) {
+	if err := w.c.sendTCP(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// booklistWriter sends the booklist to Calibre through a buffer, rather than a
+// packet at a time, which keeps very large libraries from generating thousands
+// of small writes. The buffer is written whenever it fills, which refreshes the
+// connection deadline, and is flushed after every chunk of packets to report
+// progress to the client.
+type booklistWriter struct {
+	c       *calConn
+	bw      *bufio.Writer
+	chunk   int
+	total   int
+	sent    int
+	pending int
+}
+
+func (c *calConn) newBooklistWriter(total int) *booklistWriter {
+	chunk := c.clientOpts.BooklistChunkSize
+	if chunk <= 0 {
+		chunk = defaultBooklistChunk
+	}
+	c.updateStatus(SendingBooklist, 0)
+	return &booklistWriter{c: c, bw: bufio.NewWriterSize(tcpWriter{c}, booklistBufSize), chunk: chunk, total: total}
+}
+
+// write queues a packet, flushing the buffer at the end of each chunk
+func (w *booklistWriter) write(payload []byte) error {
+	w.c.tapSent(payload)
+	if _, err := w.bw.Write(payload); err != nil {
+		return err
+	}
+	w.sent++
+	if w.pending++; w.pending >= w.chunk {
+		return w.flush()
+	}
+	return nil
+}
+
+// writeJSON encodes a payload, and queues it
+func (w *booklistWriter) writeJSON(data interface{}) error {
+	ep, err := encodeJSONpayload(data, ok)
+	if err != nil {
+		return err
+	}
+	defer ep.release()
+	return w.write(ep.bytes())
+}
+
+// flush sends any queued packets
+func (w *booklistWriter) flush() error {
+	if w.pending == 0 {
+		return nil
+	}
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+	w.pending = 0
+	if w.total > 0 {
+		w.c.updateStatus(SendingBooklist, (w.sent*100)/w.total)
+		w.c.emit(MetadataSyncProgress{Status: SendingBooklist, Done: w.sent, Total: w.total})
+	}
+	// Give the rest of the program a chance to run between chunks
+	runtime.Gosched()
 	return nil
 }
 
@@ -347,44 +982,48 @@ func (c *calConn) readTCP() ([]byte, error) {
 	var terr net.Error
 	// Read Size of the payload. The payload looks like
 	// 13[0,{"foo":1}]
-	msgSz, err := c.tcpReader.ReadBytes('[')
+	msgSz, err := c.tcpReader.ReadSlice('[')
 	if errors.As(err, &terr) && terr.Timeout() {
-		return nil, fmt.Errorf("readTCP: connection timed out: %w", err)
+		return nil, fmt.Errorf("readTCP: connection timed out: %w", asSentinel(ConnectionTimeout, err))
+	}
+	if err == bufio.ErrBufferFull {
+		// No length prefix is anywhere near that long
+		return nil, fmt.Errorf("readTCP: no packet start found: %w", MalformedPacket)
 	}
 	if err != nil {
 		if err == io.EOF {
 			return nil, err
 		}
-		return nil, fmt.Errorf("readTCP: ReadBytes failed: %w", err)
+		return nil, fmt.Errorf("readTCP: ReadSlice failed: %w", connectionErr(err))
 	}
-	buffLen := len(msgSz)
 	c.setTCPDeadline()
 	// Put that '[' character back into the buffer. Our JSON
 	// parser will need it later...
 	c.tcpReader.UnreadByte()
 	// We don't want a '[' when we try and convert the byteslice
 	// to a number
-	if msgSz[buffLen-1] == '[' {
-		msgSz = msgSz[:buffLen-1]
-	}
-	sz, err := strconv.Atoi(string(msgSz))
+	sz, err := parsePacketSize(msgSz[:len(msgSz)-1])
 	if err != nil {
-		return nil, fmt.Errorf("readTCP: error decoding payload size: %w", err)
+		return nil, fmt.Errorf("readTCP: %w", err)
 	}
 	// We have our payload size. Create the appropriate buffer.
 	// and read into it.
 	payload := make([]byte, sz)
-	io.ReadFull(c.tcpReader, payload)
+	readStart := time.Now()
+	_, err = io.ReadFull(c.tcpReader, payload)
 	if errors.As(err, &terr) && terr.Timeout() {
-		return nil, fmt.Errorf("readTCP: connection timed out: %w", err)
+		return nil, fmt.Errorf("readTCP: connection timed out: %w", asSentinel(ConnectionTimeout, err))
 	} else if err != nil {
 		if err == io.EOF {
 			return nil, err
 		}
-		return nil, fmt.Errorf("readTCP: did not receive full payload: %w", err)
+		return nil, fmt.Errorf("readTCP: did not receive full payload: %w", connectionErr(err))
+	}
+	if sz >= bandwidthSampleMin {
+		c.recordTransfer(int64(sz), time.Since(readStart))
 	}
 	c.setTCPDeadline()
-	c.LogPrintf("Read TCP packet: %.40s\n", string(payload))
+	c.debugAttrs("Read TCP packet", slog.Int("bytes", len(payload)), slog.String("payload", fmt.Sprintf("%.40s", payload)))
 	return payload, nil
 }
 
@@ -398,7 +1037,7 @@ func (c *calConn) handleNoop(dataBytes json.RawMessage) error {
 	// Calibre appears to use this opcode as a keep-alive signal
 	// We reply to tell callibre is all still good.
 	if len(data) == 0 {
-		c.client.UpdateStatus(Idle, -1)
+		c.updateStatus(Idle, -1)
 		err = c.writeTCP([]byte(c.okStr))
 		if err != nil {
 			return fmt.Errorf("handleNoop: %w", err)
@@ -406,27 +1045,32 @@ func (c *calConn) handleNoop(dataBytes json.RawMessage) error {
 		// Calibre also uses noops to request more metadata from books
 		// on device. We handle that case here.
 	} else if val, exist := data["count"]; exist {
-		count := int(val.(float64))
+		fcount, isNum := val.(float64)
+		count := int(fcount)
+		// Calibre can only ask for the books on the device
+		if !isNum || count < 0 || count > c.ucdb.length() {
+			return fmt.Errorf("handleNoop: bad book count %v: %w", val, MalformedPacket)
+		}
 		// We don't do anything if count is zero
 		if count == 0 {
 			return nil
 		}
-		c.client.UpdateStatus(SendingExtraMetadata, -1)
+		c.updateStatus(SendingExtraMetadata, -1)
 		bookList := make([]BookID, count)
 		for i := 0; i < count; i++ {
 			opcode, newdata, err := c.readDecodeCalibrePayload()
-			var pk struct {
-				PriKey int `json:"priKey"`
-			}
-			if err = json.Unmarshal(newdata, &pk); err != nil {
-				return fmt.Errorf("handleNoop: error getting primary key from calibre: %w", err)
-			}
 			if err != nil {
 				if err == io.EOF {
 					return err
 				}
 				return fmt.Errorf("handleNoop: packet reading failed: %w", err)
 			}
+			var pk struct {
+				PriKey int `json:"priKey"`
+			}
+			if err = json.Unmarshal(newdata, &pk); err != nil {
+				return fmt.Errorf("handleNoop: error getting primary key from calibre: %w", err)
+			}
 			if opcode != noop {
 				return fmt.Errorf("handleNoop: noop expected")
 			}
@@ -434,8 +1078,7 @@ func (c *calConn) handleNoop(dataBytes json.RawMessage) error {
 			if err != nil {
 				return fmt.Errorf("handleNoop: %w", err)
 			}
-			bID := BookID{Lpath: bd.Lpath, UUID: bd.UUID}
-			bookList[i] = bID
+			bookList[i] = bd.bookID()
 		}
 		err := c.resendMetadataList(bookList)
 		if err != nil {
@@ -444,7 +1087,7 @@ func (c *calConn) handleNoop(dataBytes json.RawMessage) error {
 		// For any other message we don't yet know about, send an ok packet.
 		// This fixes an issue of Calibre sending an unknown message and expecting some sort of response
 	} else {
-		c.client.UpdateStatus(Idle, -1)
+		c.updateStatus(Idle, -1)
 		err = c.writeTCP([]byte(c.okStr))
 		if err != nil {
 			return fmt.Errorf("handleNoop: %w", err)
@@ -454,13 +1097,16 @@ func (c *calConn) handleNoop(dataBytes json.RawMessage) error {
 }
 
 // handleMessage deals with message packets from Calibre, instead of the normal
-// opcode packets. We currently handle password error messages only.
+// opcode packets.
 func (c *calConn) handleMessage(data json.RawMessage) error {
 	var err error
 	var mk struct {
 		MessageKind calMsgCode `json:"messageKind"`
+		Message     string     `json:"message"`
+		// Calibre really does spell it this way
+		LatestVersion json.RawMessage `json:"lastestKnownAppVersion"`
 	}
-	if err = json.Unmarshal(data, &mk); err != nil {
+	if err = c.decodePacket(displayMessage, data, &mk); err != nil {
 		return fmt.Errorf("handleMessage: error getting message kind from calibre: %w", err)
 	}
 	switch mk.MessageKind {
@@ -468,67 +1114,177 @@ func (c *calConn) handleMessage(data json.RawMessage) error {
 		// Respond to calibre, then close the connection
 		c.writeTCP([]byte(c.okStr))
 		c.tcpConn.Close()
-		// Ask the user for a password
-		if c.serverPassword, err = c.client.GetPassword(c.calibreInfo); err != nil {
-			return fmt.Errorf("handleMessage: error retrieving password: %w", err)
+		key := c.passwordKey()
+		// The first failure is expected if we don't have a password for this library yet
+		policy := c.clientOpts.PasswordRetry
+		if policy.Attempts <= 0 {
+			policy = defaultPasswordRetry
 		}
-		if c.serverPassword == "" {
-			c.client.UpdateStatus(EmptyPasswordReceived, -1)
+		if _, tried := c.passwords[key]; tried {
+			c.passwordFailures[key]++
+			delete(c.passwords, key)
+			if c.passwordFailures[key] >= policy.Attempts {
+				c.updateStatus(EmptyPasswordReceived, -1)
+				return fmt.Errorf("handleMessage: giving up after %d password attempts: %w", c.passwordFailures[key], TooManyPasswordAttempts)
+			}
+			if rs, ok := c.client.(InstanceReselector); ok && len(c.instances) > 1 {
+				failure := PasswordFailure{
+					Instance:    c.calibreInstance,
+					LibraryName: c.calibreInfo.CurrentLibraryName,
+					LibraryUUID: c.calibreInfo.CurrentLibraryUUID,
+					Failures:    c.passwordFailures[key],
+				}
+				if inst, ok := rs.ReselectCalibreInstance(c.instances, failure); ok {
+					c.calibreInstance = inst
+					return c.establishTCP()
+				}
+			}
+		}
+		// Ask the user for a password, if the client can
+		var password string
+		if pp, ok := c.client.(PasswordProvider); ok {
+			if password, err = pp.GetPassword(c.calibreInfo); err != nil {
+				return fmt.Errorf("handleMessage: error retrieving password: %w", clientErr(err))
+			}
+		}
+		if password == "" {
+			c.updateStatus(EmptyPasswordReceived, -1)
+			if c.passwordFailures[key] > 0 {
+				return PasswordRejected
+			}
 			return NoPassword
 		}
+		c.passwords[key] = password
+		c.newPassword = true
+		// Back off after wrong passwords, so the server isn't hammered
+		if failures := c.passwordFailures[key]; failures > 0 {
+			delay := policy.Delay(failures)
+			c.LogPrintf("handleMessage: password rejected, reconnecting in %v\n", delay)
+			if err := c.sleep(c.ctx, delay); err != nil {
+				return fmt.Errorf("handleMessage: %w", err)
+			}
+		}
 		return c.establishTCP()
+	case updateNeeded:
+		msg := "Calibre reports that this device app needs updating"
+		if v := strings.Trim(string(mk.LatestVersion), `"`); v != "" && v != "null" {
+			msg += fmt.Sprintf(". The latest version known to Calibre is %s", v)
+		}
+		c.LogPrintf("handleMessage: %s\n", msg)
+		c.displayMessage(UpdateNeededMessage, msg)
+	case showToast:
+		// Calibre doesn't wait for a reply to these
+		c.displayMessage(ToastMessage, mk.Message)
 	}
 	return err
 }
 
+// displayMessage shows a message from Calibre with the client's MessageDisplayer,
+// or logs it if the client has none
+func (c *calConn) displayMessage(kind MessageKind, text string) {
+	if md, ok := c.client.(MessageDisplayer); ok {
+		md.DisplayMessage(kind, text)
+		return
+	}
+	c.logf(Info, "Message from Calibre: %s\n", text)
+}
+
 // getInitInfo handles the request from Calibre to send initialization info.
 func (c *calConn) getInitInfo(data json.RawMessage) error {
-	if err := json.Unmarshal(data, &c.calibreInfo); err != nil {
+	var info CalibreInitInfo
+	if err := c.decodePacket(getInitializationInfo, data, &info); err != nil {
 		return fmt.Errorf("getInitInfo: error decoding calibre data: %w", err)
 	}
+	c.stateMu.Lock()
+	c.calibreInfo = info
+	c.stateMu.Unlock()
+	c.features = negotiateFeatures(c.calibreInfo)
+	c.recordLibrary()
+	c.LogPrintf("Calibre %v (protocol %d) features: %+v\n", c.calibreInfo.CalibreVersion, c.calibreInfo.ServerProtocolVersion, c.features)
+	pathLen := c.clientOpts.PathLength
+	if pathLen <= 0 {
+		pathLen = defaultPathLength
+	}
 	extPathLen := make(map[string]int)
 	for _, e := range c.clientOpts.SupportedExt {
-		extPathLen[e] = 38
+		extPathLen[e] = pathLen
 	}
 	// Note, the first time we are challenged with a password, we respond
-	// with an incorrect password. This gives us the opportunity to close
-	// the connection, and spend as long as we need to gather a password from
-	// the client.
+	// with an incorrect password, unless the client has one stored. This gives
+	// us the opportunity to close the connection, and spend as long as we need
+	// to gather a password from the client.
 	passHash := ""
+	if c.calibreInfo.PasswordChallenge != "" {
+		c.storedPassword(c.passwordKey())
+	}
+	c.serverPassword = c.passwords[c.passwordKey()]
 	if c.calibreInfo.PasswordChallenge != "" {
 		passHash = c.hashCalPassword(c.calibreInfo.PasswordChallenge)
 	}
 	initInfo := CalibreInit{
-		VersionOK:               true,
-		MaxBookContentPacketLen: bookPacketContentLen,
-		AcceptedExtensions:      c.clientOpts.SupportedExt,
-		ExtensionPathLengths:    extPathLen,
-		PasswordHash:            passHash,
-		CcVersionNumber:         391,
-		CanStreamBooks:          true,
-		CanStreamMetadata:       true,
-		CanReceiveBookBinary:    true,
-		CanDeleteMultipleBooks:  true,
-		CanUseCachedMetadata:    true,
-		DeviceKind:              c.deviceInfo.DeviceVersion,
-		DeviceName:              c.deviceInfo.DevInfo.DeviceName,
-		CoverHeight:             c.clientOpts.CoverDims.Height,
-		AppName:                 c.clientOpts.ClientName,
-		CacheUsesLpaths:         true,
-		CanSendOkToSendbook:     true,
-		CanAcceptLibraryInfo:    true,
+		VersionOK:                     true,
+		MaxBookContentPacketLen:       bookPacketContentLen,
+		AcceptedExtensions:            c.clientOpts.SupportedExt,
+		ExtensionPathLengths:          extPathLen,
+		PasswordHash:                  passHash,
+		CcVersionNumber:               391,
+		CanStreamBooks:                true,
+		CanStreamMetadata:             true,
+		CanReceiveBookBinary:          c.features.binaryBooks,
+		CanDeleteMultipleBooks:        true,
+		CanUseCachedMetadata:          true,
+		UseUUIDFileNames:              c.clientOpts.UUIDFileNames,
+		DeviceKind:                    c.deviceInfo.DeviceVersion,
+		DeviceName:                    c.deviceInfo.DevInfo.DeviceName,
+		CoverHeight:                   c.clientOpts.CoverDims.Height,
+		AppName:                       c.clientOpts.ClientName,
+		CacheUsesLpaths:               true,
+		CanSendOkToSendbook:           true,
+		CanAcceptLibraryInfo:          c.features.libraryInfo,
+		WillAskForUpdateBooks:         c.updater() != nil,
+		SetTempMarkWhenReadInfoSynced: c.clientOpts.TempMarkReadSynced && c.readSyncer() != nil,
 	}
 	payload := buildJSONpayload(initInfo, ok)
 	return c.writeTCP(payload)
 }
 
+// handleBusy deals with Calibre reporting that it is busy, for example because it
+// is already communicating with another device. Calibre closes the connection after
+// sending this, so we wait and reconnect according to ClientOptions.BusyRetry.
+func (c *calConn) handleBusy() error {
+	c.tcpConn.Close()
+	policy := c.clientOpts.BusyRetry
+	if policy.Attempts <= 0 {
+		policy = defaultBusyRetry
+	}
+	c.busyRetries++
+	if c.busyRetries >= policy.Attempts {
+		return fmt.Errorf("handleBusy: giving up after %d attempts: %w", c.busyRetries, BusyTimeout)
+	}
+	delay := policy.Delay(c.busyRetries)
+	c.LogPrintf("handleBusy: calibre is busy, retrying in %v\n", delay)
+	c.updateStatus(CalibreBusy, -1)
+	if err := c.sleep(c.ctx, delay); err != nil {
+		return fmt.Errorf("handleBusy: %w", err)
+	}
+	c.updateStatus(Connecting, -1)
+	return c.establishTCP()
+}
+
 // getDeviceInfo handles the request from Calibre for the device (that's us!)
 // to send information about itself
 func (c *calConn) getDeviceInfo() error {
 	// By this point, we should have an initial connection to calibre
-	c.client.UpdateStatus(Connected, -1)
+	c.updateStatus(Connected, -1)
+	c.busyRetries = 0
+	// Calibre only asks for device info once it has accepted the password
+	c.savePassword()
+	c.stateMu.Lock()
 	c.deviceInfo.DeviceVersion = c.clientOpts.DeviceModel
 	c.deviceInfo.Version = "391"
+	c.deviceInfo.DevInfo.DateLastConnected = time.Now().UTC()
+	c.stateMu.Unlock()
+	c.connected = true
 	payload := buildJSONpayload(c.deviceInfo, ok)
 	return c.writeTCP(payload)
 }
@@ -537,18 +1293,68 @@ func (c *calConn) getDeviceInfo() error {
 // to place in the '.driveinfo.calibre' file
 func (c *calConn) setDeviceInfo(data json.RawMessage) error {
 	var devInfo DeviceInfo
-	if err := json.Unmarshal(data, &devInfo.DevInfo); err != nil {
+	if err := c.decodePacket(setCalibreDeviceInfo, data, &devInfo.DevInfo); err != nil {
 		return fmt.Errorf("setDeviceInfo: error decoding data: %w", err)
 	}
-	c.client.SetDeviceInfo(devInfo)
+	// Keep our copy in sync, so lpath prefix handling uses the values Calibre sent
+	c.stateMu.Lock()
+	c.deviceInfo.DevInfo = devInfo.DevInfo
+	c.stateMu.Unlock()
+	c.client.SetDeviceInfo(c.deviceInfo)
 	return c.writeTCP([]byte(c.okStr))
 }
 
+// endSession updates the date last connected at the end of a session,
+// and has the client persist it
+func (c *calConn) endSession() {
+	if !c.connected {
+		return
+	}
+	c.connected = false
+	c.saveBooks()
+	c.saveMetadataCache()
+	c.stateMu.Lock()
+	c.deviceInfo.DevInfo.DateLastConnected = time.Now().UTC()
+	c.stateMu.Unlock()
+	if err := c.client.SetDeviceInfo(c.deviceInfo); err != nil {
+		c.logf(Warn, "endSession: error saving device info: %v\n", err)
+	}
+}
+
+// CalibreInfo returns the information Calibre sent about itself when the current
+// session started, such as the date formats it uses. It is safe to call
+// CalibreInfo while UNCaGED is running.
+func (c *calConn) CalibreInfo() CalibreInitInfo {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	return c.calibreInfo
+}
+
+// LastConnected returns the time the device last connected to Calibre,
+// and false if it has never connected. It is safe to call LastConnected while
+// UNCaGED is running.
+func (c *calConn) LastConnected() (time.Time, bool) {
+	c.stateMu.RLock()
+	defer c.stateMu.RUnlock()
+	return c.deviceInfo.LastConnected()
+}
+
 // getFreeSpace tells Calibre how much space is available in our
 // book directory.
 func (c *calConn) getFreeSpace() error {
-	var space FreeSpace
-	space.FreeSpaceOnDevice = c.client.GetFreeSpace()
+	space := c.spaceReply("free_space_on_device", c.client.GetFreeSpace(), LocationSpaceReporter.LocationFreeSpace)
+	payload := buildJSONpayload(space, ok)
+	return c.writeTCP(payload)
+}
+
+// getTotalSpace tells Calibre the total storage capacity of the device. The
+// free space is reported if the client doesn't implement TotalSpaceReporter.
+func (c *calConn) getTotalSpace() error {
+	total := c.client.GetFreeSpace()
+	if ts, ok := c.client.(TotalSpaceReporter); ok {
+		total = ts.GetTotalSpace()
+	}
+	space := c.spaceReply("total_space_on_device", total, LocationSpaceReporter.LocationTotalSpace)
 	payload := buildJSONpayload(space, ok)
 	return c.writeTCP(payload)
 }
@@ -558,80 +1364,127 @@ func (c *calConn) getFreeSpace() error {
 func (c *calConn) getBookCount(data json.RawMessage) error {
 	var err error
 	var bcOpts BookCountReceive
-	if err = json.Unmarshal(data, &bcOpts); err != nil {
+	if err = c.decodePacket(getBookCount, data, &bcOpts); err != nil {
 		return fmt.Errorf("getBookCount: error decoding options: %w", err)
 	}
-	len := c.ucdb.length()
-	bc := BookCountSend{Count: len, WillStream: true, WillScan: true}
+	c.booksReceived = false
+	c.formatSync = bcOpts.CanSupportBookFormatSync
+	c.readSync = bcOpts.SupportsSync
+	c.addOffered()
+	missing := c.missingBooks()
+	booklist := c.cachedBooklist(missing)
+	c.logLocationCounts(booklist)
 	// when setting "willUseCachedMetadata" to true, Calibre is expecting a list
 	// of books with abridged metadata (the contents of the bookCountDetails struct)
 	if bcOpts.WillUseCachedMetadata {
-		payload := buildJSONpayload(bc, ok)
 		// Send our count
-		if err = c.writeTCP(payload); err != nil {
+		if err = c.writeTCP(bookCountPayload(len(booklist))); err != nil {
 			return fmt.Errorf("getBookCount: error sending count: %w", err)
 		}
-
-		for _, b := range c.ucdb.booklist {
-			payload = buildJSONpayload(b, ok)
-			if err = c.writeTCP(payload); err != nil {
-				return fmt.Errorf("getBookCount: error sending bookCountDetail: %w", err)
-			}
+		if err = c.sendBookCountDetails(booklist); err != nil {
+			return fmt.Errorf("getBookCount: %w", err)
 		}
 		// Otherwise, Calibre expects a full set of metadata for each book on the
 		// device. We get that from the client.
 	} else {
-		mdIter := c.client.GetMetadataIter([]BookID{})
-		bc.Count = mdIter.Count()
-		payload := buildJSONpayload(bc, ok)
+		mdIter := c.metadataIter(nil)
+		if len(missing) > 0 {
+			if mdIter, err = skipMissing(mdIter, missing); err != nil {
+				return fmt.Errorf("getBookCount: error retrieving book metadata: %w", clientErr(err))
+			}
+		}
 		// Send our count
-		if err = c.writeTCP(payload); err != nil {
+		if err = c.writeTCP(bookCountPayload(mdIter.Count())); err != nil {
 			return fmt.Errorf("getBookCount: error sending count: %w", err)
 		}
-		for mdIter.Next() {
-			md, err := mdIter.Get()
-			if err != nil {
-				return fmt.Errorf("getBookCount: error retrieving book metadata: %w", err)
-			}
-			// Ensure maps are empty, not nil
-			md.InitMaps()
-			payload := buildJSONpayload(md, ok)
-			if err = c.writeTCP(payload); err != nil {
-				return fmt.Errorf("getBookCount: error sending book metadata: %w", err)
-			}
+		if err = c.sendMetadata(mdIter); err != nil {
+			return fmt.Errorf("getBookCount: %w", err)
 		}
 	}
 	// Calibre can take a while to process large book lists (hundreds to thousands of books)
 	// So we increase the connection deadline to something reasonable.
-	c.tcpDeadline.altDuration = 300 * time.Second
+	c.tcpDeadline.setNext(300 * time.Second)
 	c.setTCPDeadline()
-	c.client.UpdateStatus(Waiting, -1)
+	c.updateStatus(Waiting, -1)
 	return nil
 }
 
+// MarkMissing flags books on the device as corrupt or missing. They are left out of
+// the booklist sent to Calibre, so Calibre treats them as not on the device, and
+// offers to send them again. Books remain marked until Calibre sends them. It is
+// safe to call MarkMissing while UNCaGED is running, books will be left out of the
+// next booklist Calibre asks for.
+func (c *calConn) MarkMissing(books []BookID) {
+	c.missingMu.Lock()
+	defer c.missingMu.Unlock()
+	if c.missing == nil {
+		c.missing = make(map[string]struct{})
+	}
+	for _, b := range books {
+		c.missing[b.Lpath] = struct{}{}
+	}
+}
+
+// missingBooks returns a copy of the set of lpaths marked missing
+func (c *calConn) missingBooks() map[string]struct{} {
+	c.missingMu.Lock()
+	defer c.missingMu.Unlock()
+	missing := make(map[string]struct{}, len(c.missing))
+	for lp := range c.missing {
+		missing[lp] = struct{}{}
+	}
+	return missing
+}
+
+// clearMissing unmarks a book, once Calibre has sent it again
+func (c *calConn) clearMissing(lpath string) {
+	c.missingMu.Lock()
+	defer c.missingMu.Unlock()
+	delete(c.missing, lpath)
+}
+
+// OfferBooks offers books on the device that are not in Calibre's library, such as
+// sideloaded books, to Calibre. They are added to the booklist Calibre next asks
+// for, after which Calibre shows them in its device view, and can add them to the
+// library. Calibre asks for the booklist when it connects, and after sending or
+// deleting books; the protocol does not allow the device to ask Calibre to refresh
+// it. Clients that don't set WillUseCachedMetadata must also return offered books
+// from GetMetadataIter. It is safe to call OfferBooks while UNCaGED is running.
+func (c *calConn) OfferBooks(books []BookCountDetails) {
+	c.offeredMu.Lock()
+	defer c.offeredMu.Unlock()
+	c.offered = append(c.offered, books...)
+}
+
+// addOffered adds books offered with OfferBooks to the booklist. Books already
+// on the booklist are ignored.
+func (c *calConn) addOffered() {
+	c.offeredMu.Lock()
+	offered := c.offered
+	c.offered = nil
+	c.offeredMu.Unlock()
+	for _, b := range offered {
+		if _, _, err := c.ucdb.find(Lpath, b.Lpath); err == nil {
+			continue
+		}
+		c.ucdb.addDetails(b)
+	}
+}
+
 // resendMetadataList is called whenever using cached metadata, and
 // Calibre requests a complete metadata listing (eg, when using a
 // different Calibre library)
 func (c *calConn) resendMetadataList(bookList []BookID) error {
-	mdIter := c.client.GetMetadataIter(bookList)
+	mdIter := c.metadataIter(bookList)
 	if mdIter.Count() == 0 {
 		return c.writeTCP([]byte(c.okStr))
 	}
-	for mdIter.Next() {
-		md, err := mdIter.Get()
-		if err != nil {
-			return fmt.Errorf("resendMetadataList: error retrieving book metadata: %w", err)
-		}
-		// Ensure maps are empty, not nil
-		md.InitMaps()
-		payload := buildJSONpayload(md, ok)
-		if err = c.writeTCP(payload); err != nil {
-			return fmt.Errorf("resendMetadataList: error sending book metadata: %w", err)
-		}
+	if err := c.sendMetadata(mdIter); err != nil {
+		return fmt.Errorf("resendMetadataList: %w", err)
 	}
-	c.tcpDeadline.altDuration = 300 * time.Second
+	c.tcpDeadline.setNext(300 * time.Second)
 	c.setTCPDeadline()
-	c.client.UpdateStatus(Waiting, -1)
+	c.updateStatus(Waiting, -1)
 	return nil
 }
 
@@ -640,17 +1493,29 @@ func (c *calConn) resendMetadataList(bookList []BookID) error {
 func (c *calConn) updateDeviceMetadata(data json.RawMessage) error {
 	var err error
 	var bld BookListsDetails
-	if err = json.Unmarshal(data, &bld); err != nil {
+	if err = c.decodePacket(sendBooklists, data, &bld); err != nil {
 		return fmt.Errorf("updateDeviceMetadata: error receiving count: %w", err)
 	}
 	// Double check that there will be new metadata incoming
 	if bld.Count == 0 {
-		return nil
+		return c.setCollections(bld.Collections)
 	}
+	// If no books have been sent since the booklist was requested, Calibre is only
+	// updating metadata (eg: after editing metadata or covers in the library). These
+	// syncs can involve the whole library, so we take a faster path: Calibre is given
+	// longer to send each record, and progress is only reported every 10%.
+	metadataOnly := !c.booksReceived
+	lastProgress := -1
+	c.updateStatus(UpdatingMetadata, 0)
 	// We read exactly 'count' metadata packets
 	md := make([]CalibreBookMeta, bld.Count)
+	var readSynced []BookID
 	for i := 0; i < bld.Count; i++ {
 		var bkMD MetadataUpdate
+		if metadataOnly {
+			c.tcpDeadline.setNext(metadataOnlyDeadline)
+			c.setTCPDeadline()
+		}
 		opcode, newdata, err := c.readDecodeCalibrePayload()
 		if err != nil {
 			if err == io.EOF {
@@ -664,22 +1529,78 @@ func (c *calConn) updateDeviceMetadata(data json.RawMessage) error {
 		if opcode != sendBookMetadata {
 			return fmt.Errorf("updateDeviceMetadata: unexpected calibre packet type")
 		}
-		if err = json.Unmarshal(newdata, &bkMD); err != nil {
+		if err = c.decodePacket(sendBookMetadata, newdata, &bkMD); err != nil {
 			return fmt.Errorf("updateDeviceMetadata: unable to decode metadata packet: %w", err)
 		}
+		bkMD.Data.Lpath = c.deviceInfo.Lpath(bkMD.Data.Lpath)
+		c.setLogBook(bkMD.Data.Lpath, i, bld.Count)
+		c.stripThumbnail(&bkMD.Data)
+		c.validateMetadata(bkMD.Data)
+		c.reportUnknown("SEND_BOOK_METADATA data", bkMD.Data.Extra)
+		if bkMD.SupportsSync {
+			if id, synced := c.setReadStatus(bkMD.Data); synced {
+				readSynced = append(readSynced, id)
+			}
+		}
 		md[i] = bkMD.Data
+		progress := ((i + 1) * 100) / bld.Count
+		if !metadataOnly || progress/10 > lastProgress/10 {
+			c.updateStatus(UpdatingMetadata, progress)
+			c.emit(MetadataSyncProgress{Status: UpdatingMetadata, Done: i + 1, Total: bld.Count})
+			lastProgress = progress
+		}
+	}
+	// The client receives all the updated metadata in a single batch
+	if du, ok := c.client.(MetadataDiffUpdater); ok {
+		err = du.UpdateMetadataDiff(md, c.metadataDiffs(md))
+	} else {
+		err = c.client.UpdateMetadata(md)
+	}
+	if err != nil {
+		return fmt.Errorf("updateDeviceMetadata: client error updating metadata: %w", clientErr(err))
+	}
+	c.cacheMetadata(md...)
+	for _, m := range md {
+		c.audit(AuditUpdate, m.Lpath)
+	}
+	if rr, ok := c.client.(ReadSyncReporter); ok && len(readSynced) > 0 {
+		rr.ReadStatusSynced(readSynced)
+	}
+	if err = c.setCollections(bld.Collections); err != nil {
+		return fmt.Errorf("updateDeviceMetadata: %w", err)
+	}
+	c.updateStatus(Waiting, -1)
+	return nil
+}
+
+// setCollections passes the collections Calibre sent to the client, if it
+// implements CollectionsReceiver
+func (c *calConn) setCollections(cols Collections) error {
+	cr, ok := c.client.(CollectionsReceiver)
+	if !ok {
+		return nil
+	}
+	// The client only deals with device relative lpaths
+	for _, lpaths := range cols {
+		for i, lp := range lpaths {
+			lpaths[i] = c.deviceInfo.Lpath(lp)
+		}
+	}
+	if err := cr.SetCollections(cols); err != nil {
+		return fmt.Errorf("setCollections: client error setting collections: %w", clientErr(err))
 	}
-	c.client.UpdateMetadata(md)
 	return nil
 }
 
 func (c *calConn) setLibraryInfo(data json.RawMessage) (err error) {
 	var libInfo CalibreLibraryInfo
-	if err = json.Unmarshal(data, &libInfo); err != nil {
+	if err = c.decodePacket(setLibraryInfo, data, &libInfo); err != nil {
 		return fmt.Errorf("setLibraryInfo: error decoding library info: %w", err)
 	}
-	if err = c.client.SetLibraryInfo(libInfo); err != nil {
-		return fmt.Errorf("setLibraryInfo: client error while sending library info: %w", err)
+	if lr, ok := c.client.(LibraryInfoReceiver); ok {
+		if err = lr.SetLibraryInfo(libInfo); err != nil {
+			return fmt.Errorf("setLibraryInfo: client error while sending library info: %w", clientErr(err))
+		}
 	}
 	return c.writeTCP([]byte(c.okStr))
 }
@@ -688,23 +1609,59 @@ func (c *calConn) setLibraryInfo(data json.RawMessage) (err error) {
 // or more books from calibre.
 func (c *calConn) sendBook(data json.RawMessage) (err error) {
 	var bookDet SendBook
-	if err = json.Unmarshal(data, &bookDet); err != nil {
+	if err = c.decodePacket(sendBook, data, &bookDet); err != nil {
 		return fmt.Errorf("sendBook: error decoding book details: %w", err)
 	}
 	c.LogPrintf("Send Book detail is: %+v\n", bookDet)
+	// The client only deals with device relative lpaths
+	bookDet.Lpath = c.deviceInfo.Lpath(bookDet.Lpath)
+	bookDet.Metadata.Lpath = c.deviceInfo.Lpath(bookDet.Metadata.Lpath)
+	c.setLogBook(bookDet.Lpath, bookDet.ThisBook, bookDet.TotalBooks)
+	c.stripThumbnail(&bookDet.Metadata)
+	c.validateMetadata(bookDet.Metadata)
+	c.reportUnknown("SEND_BOOK metadata", bookDet.Metadata.Extra)
+	calibreLpath := bookDet.Lpath
+	bq, hasQueue := c.client.(BookQueueReceiver)
 	if bookDet.ThisBook == 0 {
-		c.client.UpdateStatus(ReceivingBook, 0)
+		c.batchLpaths = make(map[string]bool)
+		if hasQueue {
+			bq.BookQueueStarted(bookDet.TotalBooks)
+		}
+		c.updateStatus(ReceivingBook, 0)
 	}
+	c.emit(BookReceiveStarted{
+		Index: bookDet.ThisBook,
+		Total: bookDet.TotalBooks,
+		Title: bookDet.Metadata.Title,
+		Lpath: bookDet.Lpath,
+	})
 	lastBook := false
 	if bookDet.ThisBook == (bookDet.TotalBooks - 1) {
 		lastBook = true
 	}
-	newLpath := c.client.CheckLpath(bookDet.Lpath)
+	if ba, ok := c.client.(BookAcceptor); ok {
+		if reason := ba.AcceptBook(bookDet); reason != nil {
+			return c.refuseBook(bookDet, reason)
+		}
+	}
+	renamed := bookDet
+	renamed.Lpath = c.uuidLpath(bookDet)
+	renamed.Metadata.Lpath = renamed.Lpath
+	renamed.Lpath = c.transformLpath(renamed.Metadata)
+	newLpath := c.checkLpath(c.selectStorage(renamed))
+	canChangeLpath := bookDet.WantsSendOkToSendbook && c.features.lpathChanges && bookDet.CanSupportLpathChanges
+	// A book whose lpath escapes the book directory can only be stored if
+	// Calibre can be told it's been stored somewhere else. Other lpaths are
+	// left to the client to check.
+	if !canChangeLpath && lpathEscapes(bookDet.Lpath) {
+		return c.refuseBook(bookDet, fmt.Errorf("unsafe lpath '%s'", bookDet.Lpath))
+	}
 	if bookDet.WantsSendOkToSendbook {
 		c.LogPrintf("Sending OK-to-send packet\n")
-		if bookDet.CanSupportLpathChanges && newLpath != bookDet.Lpath {
+		if canChangeLpath && newLpath != bookDet.Lpath {
 			bookDet.Lpath = newLpath
 			bookDet.Metadata.Lpath = newLpath
+			c.logCtx.Lpath = newLpath
 			newLP := NewLpath{Lpath: bookDet.Lpath}
 			payload := buildJSONpayload(newLP, ok)
 			if err = c.writeTCP(payload); err != nil {
@@ -716,17 +1673,108 @@ func (c *calConn) sendBook(data json.RawMessage) (err error) {
 			}
 		}
 	}
+	if hasQueue {
+		bq.BookQueued(bookDet.ThisBook, bookDet.TotalBooks, bookDet.Metadata)
+	}
 	// we need to give the client time to download and process the book. Let's be pessimistic and assume
 	// the process happens at 100KB/s
-	c.tcpDeadline.altDuration = time.Duration(int(float64(bookDet.Length)/float64(102400)+1)*2) * time.Second
+	c.tcpDeadline.setNext(time.Duration(int(float64(bookDet.Length)/float64(102400)+1)*2)*time.Second +
+		c.clientOpts.WritePacing.delay(bookDet.Length))
 	c.setTCPDeadline()
-	if err = c.client.SaveBook(bookDet.Metadata, c.tcpReader, bookDet.Length, lastBook); err != nil {
-		return fmt.Errorf("sendBook: client error saving book: %w", err)
+	var book io.Reader = c.tcpReader
+	if !bookDet.WillStreamBinary {
+		book = &bookDataReader{c: c}
+	}
+	if !c.approveUpdate(bookDet.Metadata) {
+		c.LogPrintf("sendBook: client declined update of '%s'\n", bookDet.Lpath)
+		if _, err = copyBook(ioutil.Discard, book, int64(bookDet.Length)); err != nil {
+			return fmt.Errorf("sendBook: error discarding declined book: %w", err)
+		}
+		c.setTCPDeadline()
+		progress := ((bookDet.ThisBook + 1) * 100) / bookDet.TotalBooks
+		c.updateStatus(ReceivingBook, progress)
+		return nil
+	}
+	// The client can't read past the end of the book, into the next packet
+	received := &countingReader{r: io.LimitReader(book, int64(bookDet.Length))}
+	book, done := c.cancellable(received)
+	defer done()
+	var hr *hashingReader
+	_, verify := c.client.(BookVerifier)
+	if c.clientOpts.Checksums != nil || verify {
+		hr = newHashingReader(book)
+		book = hr
+	}
+	book = c.progressReader(book, BookID{Lpath: bookDet.Lpath, UUID: bookDet.Metadata.UUID}, ReceivingBook, int64(bookDet.Length))
+	book = c.clientOpts.WritePacing.Reader(book)
+	oldFormats := c.ucdb.otherFormats(bookDet.Metadata)
+	saveStart := time.Now()
+	book, length, err := c.transform(&bookDet.Metadata, book, bookDet.Length)
+	if err == nil {
+		err = c.saveBook(BookDetails{
+			Metadata:     bookDet.Metadata,
+			Length:       length,
+			Index:        bookDet.ThisBook,
+			Total:        bookDet.TotalBooks,
+			LastBook:     lastBook,
+			CalibreLpath: calibreLpath,
+			LpathChanged: bookDet.Metadata.Lpath != calibreLpath,
+		}, book)
+	}
+	if errors.Is(err, BookCancelled) {
+		c.logf(Info, "sendBook: receiving '%s' was cancelled\n", bookDet.Lpath)
+		if _, err = copyBook(ioutil.Discard, received, int64(bookDet.Length)-received.n); err != nil {
+			return fmt.Errorf("sendBook: error discarding cancelled book: %w", err)
+		}
+		c.setTCPDeadline()
+		progress := ((bookDet.ThisBook + 1) * 100) / bookDet.TotalBooks
+		c.updateStatus(ReceivingBook, progress)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("sendBook: client error saving book: %w", clientErr(err))
+	}
+	saveTime := time.Since(saveStart)
+	c.recordTransfer(int64(bookDet.Length), saveTime)
+	c.bookTransferred(true, int64(bookDet.Length), saveTime)
+	if verify {
+		if err = c.verifyBook(bookDet.Metadata, hr, bookDet.Length, length); err != nil {
+			c.setTCPDeadline()
+			return c.rejectBook(bookDet.Metadata, err)
+		}
 	}
+	// Transforms and clients may not read all of the book. The rest is read
+	// through the hasher, so the checksum covers the whole book.
+	if unread := int64(bookDet.Length) - received.n; unread > 0 {
+		var rest io.Reader = received
+		if hr != nil {
+			rest = hr
+		}
+		if _, err = copyBook(ioutil.Discard, rest, unread); err != nil {
+			return fmt.Errorf("sendBook: error discarding unread book data: %w", err)
+		}
+	}
+	if c.clientOpts.Checksums != nil {
+		c.recordChecksum(hr.sum(), bookDet.Metadata, lastBook)
+	}
+	c.audit(AuditAdd, bookDet.Metadata.Lpath)
+	c.updateStats(func(s *SessionStats) {
+		s.BooksReceived++
+		s.BytesReceived += int64(bookDet.Length)
+		s.TransferTime += saveTime
+	})
+	c.debugAttrs("Received book", slog.Int("bytes", bookDet.Length), slog.Duration("duration", saveTime))
 	c.setTCPDeadline()
+	c.booksReceived = true
 	c.ucdb.addEntry(bookDet.Metadata)
+	c.cacheMetadata(bookDet.Metadata)
+	c.clearMissing(bookDet.Metadata.Lpath)
+	c.replaceFormats(oldFormats, bookDet.Metadata)
+	if c.batchLpaths == nil {
+		c.batchLpaths = make(map[string]bool)
+	}
+	c.batchLpaths[bookDet.Metadata.Lpath] = true
 	progress := ((bookDet.ThisBook + 1) * 100) / bookDet.TotalBooks
-	c.client.UpdateStatus(ReceivingBook, progress)
+	c.updateStatus(ReceivingBook, progress)
 	return nil
 }
 
@@ -737,47 +1785,301 @@ func (c *calConn) deleteBook(data json.RawMessage) error {
 		return fmt.Errorf("deleteBook: error writing ok string: %w", err)
 	}
 	var delBooks DeleteBooks
-	if err = json.Unmarshal(data, &delBooks); err != nil {
+	if err = c.decodePacket(deleteBook, data, &delBooks); err != nil {
 		return fmt.Errorf("deleteBook: error decoding delbooks: %w", err)
 	}
-	c.client.UpdateStatus(DeletingBook, 0)
+	c.updateStatus(DeletingBook, 0)
 	for i, lp := range delBooks.Lpaths {
+		lp = c.deviceInfo.Lpath(lp)
+		c.setLogBook(lp, i, len(delBooks.Lpaths))
 		_, bd, err := c.ucdb.find(Lpath, lp)
 		if err != nil {
 			return fmt.Errorf("deleteBook: lpath not in db to delete")
 		}
-		bID := BookID{Lpath: bd.Lpath, UUID: bd.UUID}
-		if err = c.client.DeleteBook(bID); err != nil {
-			return fmt.Errorf("deleteBook: client error deleting book: %w", err)
+		if err = c.client.DeleteBook(bd.bookID()); err != nil {
+			return fmt.Errorf("deleteBook: client error deleting book: %w", clientErr(err))
 		}
 		payload := buildJSONpayload(map[string]string{"uuid": bd.UUID}, ok)
 		c.writeTCP(payload)
 		c.ucdb.removeEntry(Lpath, lp)
+		c.uncacheMetadata(lp)
+		c.audit(AuditDelete, lp)
+		c.updateStats(func(s *SessionStats) { s.BooksDeleted++ })
+		if c.clientOpts.Checksums != nil {
+			c.clientOpts.Checksums.Remove(lp)
+		}
 		progress := ((i + 1) * 100) / len(delBooks.Lpaths)
-		c.client.UpdateStatus(DeletingBook, progress)
+		c.updateStatus(DeletingBook, progress)
+	}
+	if c.clientOpts.Checksums != nil {
+		if err = c.clientOpts.Checksums.Save(); err != nil {
+			c.logf(Warn, "deleteBook: error saving checksums: %v\n", err)
+		}
 	}
 	return nil
 }
 
+// audit records an operation on the book at lpath in the client's audit log, if it has one
+func (c *calConn) audit(op AuditOp, lpath string) {
+	if c.clientOpts.AuditLog == nil {
+		return
+	}
+	if err := c.clientOpts.AuditLog.Record(op, lpath, c.calibreInfo.CurrentLibraryUUID); err != nil {
+		c.logf(Warn, "audit: error recording %s of '%s': %v\n", op, lpath, err)
+	}
+}
+
+// uuidLpath returns the UUID based lpath of a book Calibre is sending, when the
+// client wants UUID file names. Calibre normally names the book this way itself,
+// in which case the lpath is returned unchanged. Books are only renamed when
+// Calibre can be told of the new lpath.
+func (c *calConn) uuidLpath(bookDet SendBook) string {
+	uuid := bookDet.Metadata.UUID
+	if !c.clientOpts.UUIDFileNames || uuid == "" {
+		return bookDet.Lpath
+	}
+	file := path.Base(bookDet.Lpath)
+	ext := path.Ext(file)
+	if strings.TrimSuffix(file, ext) == uuid {
+		return bookDet.Lpath
+	}
+	if !c.features.lpathChanges || !bookDet.CanSupportLpathChanges {
+		c.logf(Warn, "uuidLpath: calibre can't change the lpath of '%s', keeping it\n", bookDet.Lpath)
+		return bookDet.Lpath
+	}
+	// Like Calibre, UUID named books are placed in the root of the storage location
+	return uuid + ext
+}
+
+// refuseBook turns down a book the client does not want. Calibre drops the
+// rest of the batch if SEND_BOOK is answered with an error, so the book is
+// received and discarded instead. It is left out of the booklist, so Calibre
+// sees it isn't on the device, and the client is warned why.
+func (c *calConn) refuseBook(bookDet SendBook, reason error) error {
+	c.logf(Info, "refuseBook: client refused '%s': %v\n", bookDet.Lpath, reason)
+	if bookDet.WantsSendOkToSendbook {
+		if err := c.writeTCP([]byte(c.okStr)); err != nil {
+			return fmt.Errorf("refuseBook: error writing ok string: %w", err)
+		}
+	}
+	var book io.Reader = c.tcpReader
+	if !bookDet.WillStreamBinary {
+		book = &bookDataReader{c: c}
+	}
+	c.tcpDeadline.setNext(time.Duration(int(float64(bookDet.Length)/float64(102400)+1)*2) * time.Second)
+	c.setTCPDeadline()
+	if _, err := copyBook(ioutil.Discard, book, int64(bookDet.Length)); err != nil {
+		return fmt.Errorf("refuseBook: error discarding refused book: %w", err)
+	}
+	c.setTCPDeadline()
+	c.warn(Warning{
+		Kind:    BookRefused,
+		Message: fmt.Sprintf("'%s' was refused: %v", bookDet.Lpath, reason),
+		Books:   []BookID{{Lpath: bookDet.Lpath, UUID: bookDet.Metadata.UUID}},
+	})
+	progress := ((bookDet.ThisBook + 1) * 100) / bookDet.TotalBooks
+	c.updateStatus(ReceivingBook, progress)
+	return nil
+}
+
+// selectStorage asks the client which storage location an incoming book should be
+// saved to, if it implements StorageSelector, and returns the lpath of the book in
+// that location. Calibre is told of the new lpath, as with any other lpath change.
+func (c *calConn) selectStorage(bookDet SendBook) string {
+	ss, ok := c.client.(StorageSelector)
+	if !ok {
+		return bookDet.Lpath
+	}
+	loc := ss.SelectStorage(bookDet.Metadata, bookDet.Length)
+	if loc == "" || loc == mainLocation {
+		return bookDet.Lpath
+	}
+	if !c.hasLocation(loc) {
+		c.logf(Warn, "selectStorage: unknown storage location '%s', using main storage\n", loc)
+		return bookDet.Lpath
+	}
+	return path.Join(loc, bookDet.Lpath)
+}
+
+// syncTypeRead is the sync type reported to Calibre for books whose
+// read status changed on the device
+const syncTypeRead = "read"
+
+// readStatus returns the read status of book in the form Calibre expects, if the
+// client implements ReadSyncer, and Calibre has read sync enabled
+func (c *calConn) readStatus(book BookID) (isRead *bool, lastRead *CalibreTime, syncType *string) {
+	rs := c.readSyncer()
+	if rs == nil || !c.readSync {
+		return nil, nil, nil
+	}
+	status, ok := rs.GetReadStatus(book)
+	if !ok {
+		return nil, nil, nil
+	}
+	isRead = &status.IsRead
+	if !status.LastRead.IsZero() {
+		ct := ConvertTime(status.LastRead.UTC())
+		lastRead = &ct
+	}
+	if status.Changed {
+		st := syncTypeRead
+		syncType = &st
+	}
+	return isRead, lastRead, syncType
+}
+
+// readSyncer returns the client as a ReadSyncer, or nil if it does not
+// sync read status
+func (c *calConn) readSyncer() ReadSyncer {
+	if rs, ok := c.client.(ReadSyncer); ok {
+		return rs
+	}
+	return nil
+}
+
+// setReadStatus passes the read status Calibre sent with md to the client, if it
+// implements ReadSyncer. It returns the book, and true if its read status was set.
+func (c *calConn) setReadStatus(md CalibreBookMeta) (BookID, bool) {
+	rs := c.readSyncer()
+	if rs == nil || md.IsRead == nil {
+		return BookID{}, false
+	}
+	_, bd, err := c.ucdb.find(Lpath, md.Lpath)
+	if err != nil {
+		return BookID{}, false
+	}
+	status := ReadStatus{IsRead: *md.IsRead}
+	if t := md.LastReadDate.GetTime(); t != nil {
+		status.LastRead = *t
+	}
+	if err = rs.SetReadStatus(bd.bookID(), status); err != nil {
+		c.logf(Warn, "setReadStatus: error setting read status of '%s': %v\n", md.Lpath, err)
+		return BookID{}, false
+	}
+	return bd.bookID(), true
+}
+
+// stripThumbnail removes the thumbnail from md, if the client has asked to
+// skip thumbnails
+func (c *calConn) stripThumbnail(md *CalibreBookMeta) {
+	if c.clientOpts.SkipThumbnails {
+		md.Thumbnail = nil
+	}
+}
+
+// updater returns the client as a BookUpdater, or nil if it does not take
+// part in book updates
+func (c *calConn) updater() BookUpdater {
+	if bu, ok := c.client.(BookUpdater); ok {
+		return bu
+	}
+	return nil
+}
+
+// formatMtime returns when the file for book was last modified on the device, in
+// the form Calibre expects, if the client takes part in book updates, and Calibre
+// supports format sync
+func (c *calConn) formatMtime(book BookID) *CalibreTime {
+	bu := c.updater()
+	if bu == nil || !c.formatSync {
+		return nil
+	}
+	t, ok := bu.FormatModified(book)
+	if !ok {
+		return nil
+	}
+	ct := ConvertTime(t.UTC())
+	return &ct
+}
+
+// approveUpdate asks the client whether an incoming book may replace the copy
+// already on the device. New books are always approved.
+func (c *calConn) approveUpdate(md CalibreBookMeta) bool {
+	bu := c.updater()
+	if bu == nil {
+		return true
+	}
+	_, bd, err := c.ucdb.find(Lpath, md.Lpath)
+	if err != nil {
+		return true
+	}
+	return bu.ApproveUpdate(bd.bookID(), md)
+}
+
+// replaceFormats offers to remove other formats of a book Calibre has just sent,
+// if Calibre supports format sync, and the client implements FormatSyncer.
+// Formats the client approves are deleted from the device. Formats received
+// earlier in the batch are kept, as Calibre meant to send them all.
+func (c *calConn) replaceFormats(formats []BookCountDetails, md CalibreBookMeta) {
+	fs, ok := c.client.(FormatSyncer)
+	if !ok || !c.formatSync {
+		return
+	}
+	for _, bd := range formats {
+		if c.batchLpaths[bd.Lpath] {
+			continue
+		}
+		if !fs.ReplaceFormat(bd.bookID(), md, bookExt(bd.Lpath), bookExt(md.Lpath)) {
+			continue
+		}
+		if err := c.client.DeleteBook(bd.bookID()); err != nil {
+			c.logf(Warn, "replaceFormats: error deleting '%s': %v\n", bd.Lpath, err)
+			continue
+		}
+		c.ucdb.removeEntry(Lpath, bd.Lpath)
+		c.uncacheMetadata(bd.Lpath)
+		if c.clientOpts.Checksums != nil {
+			c.clientOpts.Checksums.Remove(bd.Lpath)
+		}
+		c.audit(AuditDelete, bd.Lpath)
+		c.LogPrintf("replaceFormats: replaced '%s' with '%s'\n", bd.Lpath, md.Lpath)
+	}
+}
+
+// bookExt returns the lower case extension of lpath, without the dot
+func bookExt(lpath string) string {
+	return strings.ToLower(strings.TrimPrefix(path.Ext(lpath), "."))
+}
+
+// recordChecksum adds a received book to the checksum store, warning the
+// client if an identical book is already on the device
+func (c *calConn) recordChecksum(hash string, md CalibreBookMeta, lastBook bool) {
+	store := c.clientOpts.Checksums
+	if lpath, exists := store.LookupHash(hash); exists && lpath != md.Lpath {
+		c.warn(Warning{
+			Kind:    DuplicateBook,
+			Message: fmt.Sprintf("'%s' is identical to '%s'", md.Lpath, lpath),
+			Books:   []BookID{{Lpath: lpath}, {Lpath: md.Lpath, UUID: md.UUID}},
+		})
+	}
+	store.Add(hash, md.Lpath)
+	if lastBook {
+		if err := store.Save(); err != nil {
+			c.logf(Warn, "recordChecksum: error saving checksums: %v\n", err)
+		}
+	}
+}
+
 // getBook will send the ebook requested by Calibre, to calibre
 func (c *calConn) getBook(data json.RawMessage) error {
 	var err error
 	var gbr GetBookReceive
-	if err = json.Unmarshal(data, &gbr); err != nil {
+	if err = c.decodePacket(getBookFileSegment, data, &gbr); err != nil {
 		return fmt.Errorf("getBook: error decoding calibre settings")
 	}
-	c.client.UpdateStatus(SendingBook, -1)
+	c.updateStatus(SendingBook, -1)
 	if !gbr.CanStreamBinary || !gbr.CanStream {
 		return fmt.Errorf("getBook: calibre version does not support binary streaming")
 	}
+	gbr.Lpath = c.deviceInfo.Lpath(gbr.Lpath)
+	c.setLogBook(gbr.Lpath, 0, 0)
 	_, bd, err := c.ucdb.find(Lpath, gbr.Lpath)
 	if err != nil {
 		return fmt.Errorf("getBook: could not get book from db: %w", err)
 	}
-	bID := BookID{Lpath: gbr.Lpath, UUID: bd.UUID}
-	bk, len, err := c.client.GetBook(bID, gbr.Position)
+	bk, len, err := c.client.GetBook(bd.bookID(), gbr.Position)
 	if err != nil {
-		return fmt.Errorf("getBook: could not open book file: %w", err)
+		return fmt.Errorf("getBook: could not open book file: %w", clientErr(err))
 	}
 	gb := GetBookSend{
 		WillStream:       true,
@@ -790,12 +2092,22 @@ func (c *calConn) getBook(data json.RawMessage) error {
 	}
 	// we need to make sure the TCP connection doesn't timeout for large books
 	// Let's be pessimistic and assume the process happens at 100KB/s
-	c.tcpDeadline.altDuration = time.Duration(int(float64(len)/float64(102400)+1)*2) * time.Second
+	c.tcpDeadline.setNext(time.Duration(int(float64(len)/float64(102400)+1)*2) * time.Second)
 	c.setTCPDeadline()
-	if _, err = io.CopyN(c.tcpConn, bk, len); err != nil {
+	sendStart := time.Now()
+	if _, err = c.sendBookData(bk, bd.bookID(), len); err != nil {
 		bk.Close()
 		return fmt.Errorf("getBook: error sending book to Calibre: %w", err)
 	}
+	sendTime := time.Since(sendStart)
+	c.recordTransfer(len, sendTime)
+	c.bookTransferred(false, len, sendTime)
+	c.updateStats(func(s *SessionStats) {
+		s.BooksSent++
+		s.BytesSent += len
+		s.TransferTime += sendTime
+	})
+	c.debugAttrs("Sent book", slog.Int64("bytes", len), slog.Duration("duration", sendTime))
 	bk.Close()
 	c.setTCPDeadline()
 	return nil
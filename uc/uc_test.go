@@ -0,0 +1,365 @@
+package uc
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInitDB(t *testing.T) {
+	bl := []BookCountDetails{
+		{UUID: "abc", Lpath: "a.epub"},
+		{UUID: "", Lpath: "b.epub"},
+		{UUID: "abc", Lpath: "c.epub"},
+		{UUID: "def", Lpath: "d.epub"},
+	}
+	ucdb := &UncagedDB{}
+	dups, missing := ucdb.initDB(bl)
+	if len(dups) != 1 || len(dups[0]) != 2 || dups[0][0].Lpath != "a.epub" || dups[0][1].Lpath != "c.epub" {
+		t.Errorf("Unexpected duplicates: %v", dups)
+	}
+	if len(missing) != 1 || missing[0].Lpath != "b.epub" {
+		t.Fatalf("Unexpected missing: %v", missing)
+	}
+	if _, bd, err := ucdb.find(UUID, "abc"); err != nil || bd.Lpath != "a.epub" {
+		t.Errorf("Expected UUID lookup to resolve to a.epub, got %s", bd.Lpath)
+	}
+	_, bd, err := ucdb.find(Lpath, "b.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bd.UUID != missing[0].UUID || bd.bookID().UUID != "" {
+		t.Errorf("Expected synthetic UUID %s hidden from client, got %s, %+v", missing[0].UUID, bd.UUID, bd.bookID())
+	}
+}
+
+func TestSyntheticUUID(t *testing.T) {
+	u := syntheticUUID("books/Test Author - Test Title.epub")
+	if u != syntheticUUID("books/Test Author - Test Title.epub") {
+		t.Errorf("Synthetic UUID is not stable")
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(u) {
+		t.Errorf("Synthetic UUID '%s' is not a valid UUID", u)
+	}
+}
+
+func TestAddEntryFormats(t *testing.T) {
+	ucdb := &UncagedDB{}
+	ucdb.initDB([]BookCountDetails{
+		{UUID: "abc", Lpath: "a.mobi"},
+		{UUID: "", Lpath: "b.epub"},
+	})
+	_, orig, _ := ucdb.find(Lpath, "a.mobi")
+	ucdb.addEntry(CalibreBookMeta{UUID: "abc", Lpath: "a.mobi"})
+	if _, bd, _ := ucdb.find(Lpath, "a.mobi"); ucdb.length() != 2 || bd.PriKey != orig.PriKey {
+		t.Errorf("Replacing a book should keep its entry, got %d entries, key %d", ucdb.length(), bd.PriKey)
+	}
+	md := CalibreBookMeta{UUID: "abc", Lpath: "a.epub"}
+	if f := ucdb.otherFormats(md); len(f) != 1 || f[0].Lpath != "a.mobi" {
+		t.Errorf("Expected a.mobi as other format, got %v", f)
+	}
+	ucdb.addEntry(md)
+	if ucdb.length() != 3 {
+		t.Errorf("Expected new format to be added, got %d entries", ucdb.length())
+	}
+	if f := ucdb.otherFormats(CalibreBookMeta{Lpath: "c.epub"}); f != nil {
+		t.Errorf("Books without a UUID should have no other formats, got %v", f)
+	}
+}
+
+func TestSkipMissing(t *testing.T) {
+	c := &calConn{}
+	c.MarkMissing([]BookID{{Lpath: "b.epub"}})
+	it := &sliceIter{md: []CalibreBookMeta{{Lpath: "a.epub"}, {Lpath: "b.epub"}, {Lpath: "c.epub"}}, pos: -1}
+	filtered, err := skipMissing(it, c.missingBooks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filtered.Count() != 2 {
+		t.Fatalf("Expected 2 books, got %d", filtered.Count())
+	}
+	for filtered.Next() {
+		if md, _ := filtered.Get(); md.Lpath == "b.epub" {
+			t.Errorf("Missing book was not skipped")
+		}
+	}
+	c.clearMissing("b.epub")
+	if len(c.missingBooks()) != 0 {
+		t.Errorf("Expected no missing books after clearing")
+	}
+}
+
+func TestLocationOf(t *testing.T) {
+	locs := []StorageLocation{{Code: "cardA"}, {Code: "cardB"}}
+	tests := []struct {
+		lpath, code, rel string
+	}{
+		{"Author/Title.epub", "main", "Author/Title.epub"},
+		{"cardA/Author/Title.epub", "cardA", "Author/Title.epub"},
+		{"cardB/Title.epub", "cardB", "Title.epub"},
+		{"cardAB/Title.epub", "main", "cardAB/Title.epub"},
+	}
+	for _, tt := range tests {
+		if code, rel := LocationOf(locs, tt.lpath); code != tt.code || rel != tt.rel {
+			t.Errorf("LocationOf(%q) = %q, %q, want %q, %q", tt.lpath, code, rel, tt.code, tt.rel)
+		}
+	}
+}
+
+// logClient is a Client that only supports logging
+type logClient struct{ Client }
+
+func (logClient) LogPrintf(logLevel LogLevel, format string, a ...interface{}) {}
+
+func TestUUIDLpath(t *testing.T) {
+	c := &calConn{client: logClient{}}
+	c.clientOpts.UUIDFileNames = true
+	c.features.lpathChanges = true
+	tests := []struct {
+		lpath, uuid string
+		canChange   bool
+		want        string
+	}{
+		{"Author/Title.epub", "abc", true, "abc.epub"},
+		{"abc.epub", "abc", true, "abc.epub"},
+		{"Author/Title.epub", "", true, "Author/Title.epub"},
+		{"Author/Title.epub", "abc", false, "Author/Title.epub"},
+	}
+	for _, tt := range tests {
+		bd := SendBook{Lpath: tt.lpath, CanSupportLpathChanges: tt.canChange}
+		bd.Metadata.UUID = tt.uuid
+		if got := c.uuidLpath(bd); got != tt.want {
+			t.Errorf("uuidLpath(%q, %q) = %q, want %q", tt.lpath, tt.uuid, got, tt.want)
+		}
+	}
+}
+
+// cardClient reports the space on an SD card
+type cardClient struct{ logClient }
+
+func (cardClient) LocationFreeSpace(code string) uint64  { return 100 }
+func (cardClient) LocationTotalSpace(code string) uint64 { return 1000 }
+
+func TestSpaceReply(t *testing.T) {
+	c := &calConn{client: logClient{}}
+	c.clientOpts.Locations = []StorageLocation{{Code: "cardA"}}
+	if r := c.spaceReply("free_space_on_device", 50, LocationSpaceReporter.LocationFreeSpace); len(r) != 1 || r["free_space_on_device"] != 50 {
+		t.Errorf("Expected main storage only, got %v", r)
+	}
+	c.client = cardClient{}
+	r := c.spaceReply("free_space_on_device", 50, LocationSpaceReporter.LocationFreeSpace)
+	if r["free_space_on_device"] != 150 || r["free_space_on_main"] != 50 || r["free_space_on_cardA"] != 100 {
+		t.Errorf("Unexpected free space reply %v", r)
+	}
+}
+
+// freeSpaceClient reports free space, but not the total
+type freeSpaceClient struct{ logClient }
+
+func (freeSpaceClient) GetFreeSpace() uint64 { return 50 }
+
+func TestTotalSpaceFallback(t *testing.T) {
+	c := newTestConn(freeSpaceClient{}, "")
+	if err := c.getTotalSpace(); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.tcpConn.(*countingConn).written.String(); !strings.Contains(got, `"total_space_on_device":50`) {
+		t.Errorf("Expected the free space reported as the total, got %s", got)
+	}
+	// Without a MessageDisplayer, messages are logged
+	c.displayMessage(ToastMessage, "hello")
+}
+
+func TestOfferBooks(t *testing.T) {
+	c := &calConn{ucdb: &UncagedDB{}}
+	c.ucdb.initDB([]BookCountDetails{{UUID: "abc", Lpath: "a.epub"}})
+	c.OfferBooks([]BookCountDetails{{Lpath: "a.epub"}, {Lpath: "sideloaded.epub", Extension: "epub"}})
+	c.addOffered()
+	if c.ucdb.length() != 2 {
+		t.Fatalf("Expected 2 books, got %d", c.ucdb.length())
+	}
+	_, bd, err := c.ucdb.find(Lpath, "sideloaded.epub")
+	if err != nil || bd.UUID == "" || bd.Extension != "epub" {
+		t.Errorf("Offered book not added correctly: %+v, %v", bd, err)
+	}
+	if c.addOffered(); c.ucdb.length() != 2 {
+		t.Errorf("Offered books should only be added once")
+	}
+}
+
+// countingConn counts the writes made to it, and keeps what was written
+type countingConn struct {
+	net.Conn
+	writes  int
+	bytes   int
+	written bytes.Buffer
+}
+
+func (cc *countingConn) Write(p []byte) (int, error) {
+	cc.writes++
+	cc.bytes += len(p)
+	cc.written.Write(p)
+	return len(p), nil
+}
+
+func (cc *countingConn) SetDeadline(t time.Time) error { return nil }
+
+func (cc *countingConn) Close() error { return nil }
+
+func TestBooklistWriter(t *testing.T) {
+	conn := &countingConn{}
+	rm := &sentMiddleware{}
+	c := &calConn{client: logClient{}, tcpConn: conn}
+	c.clientOpts.Middleware = []PacketMiddleware{rm}
+	c.clientOpts.BooklistChunkSize = 1000
+	bw := c.newBooklistWriter(2000)
+	pkt := buildJSONpayload(BookCountDetails{Lpath: "Author/Title.epub", UUID: "abc"}, ok)
+	for i := 0; i < 2000; i++ {
+		if err := bw.write(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bw.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if conn.bytes != 2000*len(pkt) {
+		t.Errorf("Expected %d bytes written, got %d", 2000*len(pkt), conn.bytes)
+	}
+	if max := conn.bytes/booklistBufSize + 2; conn.writes > max {
+		t.Errorf("Expected at most %d writes, got %d", max, conn.writes)
+	}
+	if rm.sent != 2000 {
+		t.Errorf("Expected middleware to see 2000 packets, got %d", rm.sent)
+	}
+}
+
+func TestEncodeJSONpayload(t *testing.T) {
+	tests := []interface{}{
+		map[string]string{},
+		BookCountDetails{Lpath: "Author/<Title> & more.epub", UUID: "abc"},
+		CalibreBookMeta{Title: strings.Repeat("long ", 10000)},
+	}
+	for _, data := range tests {
+		ep, err := encodeJSONpayload(data, sendBook)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := buildJSONpayload(data, sendBook); !bytes.Equal(ep.bytes(), want) {
+			t.Errorf("got %.60q, want %.60q", ep.bytes(), want)
+		}
+		ep.release()
+	}
+	if _, err := encodeJSONpayload(func() {}, ok); err == nil {
+		t.Errorf("Expected an error encoding a func")
+	}
+}
+
+// readClient syncs read status, recording the statuses Calibre sets
+type readClient struct {
+	logClient
+	set    map[string]ReadStatus
+	synced *[]BookID
+}
+
+func (rc readClient) UpdateMetadata(mdList []CalibreBookMeta) error { return nil }
+
+func (rc readClient) GetReadStatus(book BookID) (ReadStatus, bool) {
+	if book.Lpath != "a.epub" {
+		return ReadStatus{}, false
+	}
+	return ReadStatus{IsRead: true, LastRead: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Changed: true}, true
+}
+
+func (rc readClient) SetReadStatus(book BookID, status ReadStatus) error {
+	rc.set[book.Lpath] = status
+	return nil
+}
+
+func (rc readClient) ReadStatusSynced(books []BookID) { *rc.synced = books }
+
+func TestReadSync(t *testing.T) {
+	read, unread := true, false
+	lastRead := ConvertTime(time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC))
+	updates := []MetadataUpdate{
+		{SupportsSync: true, Data: CalibreBookMeta{Lpath: "a.epub", UUID: "abc", IsRead: &read, LastReadDate: &lastRead}},
+		{SupportsSync: true, Data: CalibreBookMeta{Lpath: "b.epub", UUID: "def"}},
+		{SupportsSync: false, Data: CalibreBookMeta{Lpath: "c.epub", UUID: "ghi", IsRead: &read}},
+		{SupportsSync: true, Data: CalibreBookMeta{Lpath: "missing.epub", UUID: "jkl", IsRead: &unread}},
+	}
+	var input string
+	for i, u := range updates {
+		u.Count, u.Index = len(updates), i
+		input += string(buildJSONpayload(u, sendBookMetadata))
+	}
+	var synced []BookID
+	rc := readClient{set: make(map[string]ReadStatus), synced: &synced}
+	c := newTestConn(rc, input)
+	c.ucdb.initDB([]BookCountDetails{{UUID: "abc", Lpath: "a.epub"}, {UUID: "def", Lpath: "b.epub"}, {UUID: "ghi", Lpath: "c.epub"}})
+	if err := c.updateDeviceMetadata([]byte(`{"count":4,"collections":{},"supportsSync":true}`)); err != nil {
+		t.Fatal(err)
+	}
+	// Only books on the device, with a read status sent for syncing, are set
+	if len(rc.set) != 1 || !rc.set["a.epub"].IsRead || !rc.set["a.epub"].LastRead.Equal(*lastRead.GetTime()) {
+		t.Errorf("Expected only a.epub marked read at %s, got %+v", lastRead, rc.set)
+	}
+	if len(synced) != 1 || synced[0].Lpath != "a.epub" {
+		t.Errorf("Expected a.epub reported synced, got %v", synced)
+	}
+	// The device's read status is only sent if Calibre has read sync enabled
+	if isRead, _, _ := c.readStatus(BookID{Lpath: "a.epub"}); isRead != nil {
+		t.Errorf("Expected no read status without read sync, got %v", *isRead)
+	}
+	c.readSync = true
+	isRead, when, syncType := c.readStatus(BookID{Lpath: "a.epub"})
+	if isRead == nil || !*isRead || when == nil || *when != "2020-01-02T03:04:05Z" || syncType == nil || *syncType != syncTypeRead {
+		t.Errorf("Unexpected read status %v, %v, %v", isRead, when, syncType)
+	}
+	if isRead, _, _ := c.readStatus(BookID{Lpath: "b.epub"}); isRead != nil {
+		t.Errorf("Expected no read status for a book the client doesn't know, got %v", *isRead)
+	}
+}
+
+// collectionsClient records the collections Calibre sends
+type collectionsClient struct {
+	logClient
+	cols *Collections
+}
+
+func (cc collectionsClient) UpdateMetadata(mdList []CalibreBookMeta) error { return nil }
+
+func (cc collectionsClient) SetCollections(cols Collections) error {
+	*cc.cols = cols
+	return nil
+}
+
+func TestSetCollections(t *testing.T) {
+	const booklists = `{"count":%d,"collections":{"Series A":["/mnt/onboard/a.epub","b.epub"],"Empty":[]}}`
+	md := string(buildJSONpayload(MetadataUpdate{Count: 1, Data: CalibreBookMeta{Lpath: "a.epub", UUID: "abc"}}, sendBookMetadata))
+	tests := []struct {
+		name  string
+		count int
+		input string
+	}{
+		{"collections only", 0, ""},
+		{"with metadata", 1, md},
+	}
+	for _, tt := range tests {
+		var cols Collections
+		c := newTestConn(collectionsClient{cols: &cols}, tt.input)
+		c.deviceInfo.DevInfo.Prefix = "/mnt/onboard/"
+		c.ucdb.initDB([]BookCountDetails{{UUID: "abc", Lpath: "a.epub"}, {UUID: "def", Lpath: "b.epub"}})
+		if err := c.updateDeviceMetadata([]byte(fmt.Sprintf(booklists, tt.count))); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		// Lpaths are made device relative, and every collection is passed on
+		want := Collections{"Series A": {"a.epub", "b.epub"}, "Empty": {}}
+		if !reflect.DeepEqual(cols, want) {
+			t.Errorf("%s: expected collections %v, got %v", tt.name, want, cols)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package uc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// hostAllowlist is the parsed form of ClientOptions.AllowedHosts
+type hostAllowlist struct {
+	nets  []*net.IPNet
+	hosts []string
+}
+
+// parseAllowlist parses the entries of ClientOptions.AllowedHosts. A nil
+// allowlist, which allows every host, is returned if there are no entries.
+func parseAllowlist(entries []string) (*hostAllowlist, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	al := &hostAllowlist{}
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if strings.Contains(e, "/") {
+			_, ipNet, err := net.ParseCIDR(e)
+			if err != nil {
+				return nil, fmt.Errorf("parseAllowlist: invalid CIDR '%s': %w", e, err)
+			}
+			al.nets = append(al.nets, ipNet)
+		} else if ip := net.ParseIP(e); ip != nil {
+			al.nets = append(al.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else if e != "" {
+			al.hosts = append(al.hosts, strings.ToLower(e))
+		}
+	}
+	return al, nil
+}
+
+// allows returns true if host (an IP address or host name) is in the
+// allowlist. Host names in the allowlist are resolved every time, so they
+// keep working if their address changes.
+func (al *hostAllowlist) allows(host string) bool {
+	if al == nil {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range al.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		for _, h := range al.hosts {
+			addrs, err := net.LookupIP(h)
+			if err != nil {
+				continue
+			}
+			for _, addr := range addrs {
+				if addr.Equal(ip) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	host = strings.ToLower(host)
+	for _, h := range al.hosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedInstances returns the Calibre instances in the allowlist, logging
+// any that aren't
+func (c *calConn) allowedInstances(instances []CalInstance) []CalInstance {
+	if c.allowlist == nil {
+		return instances
+	}
+	allowed := instances[:0:0]
+	for _, inst := range instances {
+		if c.allowlist.allows(inst.Host) {
+			allowed = append(allowed, inst)
+		} else {
+			c.logf(Warn, "Ignoring Calibre instance '%s' at %s, which is not in the allowed hosts\n", inst.Name, inst.Host)
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,52 @@
+package uc
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHostAllowlist(t *testing.T) {
+	al, err := parseAllowlist([]string{"192.168.1.0/24", "10.0.0.5", "fd00::/8", "Calibre.local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"192.168.1.20", true},
+		{"192.168.2.20", false},
+		{"10.0.0.5", true},
+		{"10.0.0.6", false},
+		{"fd12::1", true},
+		{"calibre.local", true},
+		{"evil.local", false},
+	}
+	for _, tt := range tests {
+		if got := al.allows(tt.host); got != tt.allowed {
+			t.Errorf("allows(%q) = %v, want %v", tt.host, got, tt.allowed)
+		}
+	}
+	if al, _ = parseAllowlist(nil); !al.allows("203.0.113.1") {
+		t.Errorf("Expected an empty allowlist to allow every host")
+	}
+	if _, err = parseAllowlist([]string{"192.168.1.0/33"}); err == nil {
+		t.Errorf("Expected an error for an invalid CIDR")
+	}
+}
+
+func TestAllowedInstances(t *testing.T) {
+	c := &calConn{client: logClient{}}
+	c.allowlist, _ = parseAllowlist([]string{"127.0.0.1"})
+	instances := []CalInstance{{Host: "192.168.1.20", Name: "fake"}, {Host: "127.0.0.1", Name: "real"}}
+	if allowed := c.allowedInstances(instances); len(allowed) != 1 || allowed[0].Name != "real" {
+		t.Errorf("Unexpected allowed instances %v", allowed)
+	}
+	if len(instances) != 2 {
+		t.Errorf("Discovered instances were modified")
+	}
+	c.calibreInstance = instances[0]
+	if err := c.establishTCP(); !errors.Is(err, HostNotAllowed) {
+		t.Errorf("Expected HostNotAllowed, got %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package uc
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditOp is the type of operation recorded in an audit log
+type AuditOp string
+
+// Operations recorded in the audit log
+const (
+	AuditAdd    AuditOp = "add"
+	AuditDelete AuditOp = "delete"
+	AuditUpdate AuditOp = "update"
+)
+
+// AuditRecord is a single entry in an audit log. Each record includes the hash
+// of the record before it, so a corrupted or partly overwritten record breaks
+// the chain. The hashes aren't keyed, so they don't protect against deliberate
+// edits: anyone able to change the log can recompute every hash after the
+// change, and records removed from the end of the log aren't detected.
+type AuditRecord struct {
+	Time        time.Time `json:"time"`
+	Op          AuditOp   `json:"op"`
+	Lpath       string    `json:"lpath"`
+	LibraryUUID string    `json:"library_uuid"`
+	Prev        string    `json:"prev"`
+	Hash        string    `json:"hash"`
+}
+
+// sum calculates the hash of the record, covering every field except Hash
+func (r AuditRecord) sum() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n%s", r.Prev, r.Time.UTC().Format(time.RFC3339Nano), r.Op, r.Lpath, r.LibraryUUID)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// AuditLog records every book added, deleted or updated on the device. Clients
+// may provide an implementation in ClientOptions, for devices where a record of
+// what was synced, and from which library, is required.
+type AuditLog interface {
+	// Record appends an operation on the book at lpath to the log
+	Record(op AuditOp, lpath, libraryUUID string) error
+}
+
+// FileAuditLog is an append only, hash chained AuditLog stored as a file of
+// JSON records, one per line. Use VerifyAuditLog to check it hasn't been
+// corrupted.
+type FileAuditLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	last string
+}
+
+// OpenFileAuditLog opens the audit log at path, creating it if it doesn't exist.
+// Existing records are verified before any new records are appended.
+func OpenFileAuditLog(path string) (*FileAuditLog, error) {
+	last, _, err := verifyAudit(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("OpenFileAuditLog: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("OpenFileAuditLog: error opening log: %w", err)
+	}
+	return &FileAuditLog{f: f, last: last}, nil
+}
+
+// Record appends a new record to the log. The record is synced to disk before
+// Record returns.
+func (l *FileAuditLog) Record(op AuditOp, lpath, libraryUUID string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := AuditRecord{Time: time.Now().UTC(), Op: op, Lpath: lpath, LibraryUUID: libraryUUID, Prev: l.last}
+	r.Hash = r.sum()
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("Record: error encoding record: %w", err)
+	}
+	if _, err = l.f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("Record: error writing record: %w", err)
+	}
+	if err = l.f.Sync(); err != nil {
+		return fmt.Errorf("Record: error syncing log: %w", err)
+	}
+	l.last = r.Hash
+	return nil
+}
+
+// Close closes the log file
+func (l *FileAuditLog) Close() error {
+	return l.f.Close()
+}
+
+// VerifyAuditLog checks that every record in the audit log at path is intact, and
+// correctly chained to the record before it. It returns the number of records verified.
+// It detects accidental corruption only; see AuditRecord.
+func VerifyAuditLog(path string) (int, error) {
+	_, n, err := verifyAudit(path)
+	if err != nil {
+		return n, fmt.Errorf("VerifyAuditLog: %w", err)
+	}
+	return n, nil
+}
+
+// verifyAudit verifies the log at path, returning the hash of the last record,
+// and the number of valid records
+func verifyAudit(path string) (last string, n int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	return verifyAuditRecords(f)
+}
+
+func verifyAuditRecords(r io.Reader) (last string, n int, err error) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		var rec AuditRecord
+		if err = json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return last, n, fmt.Errorf("record %d: invalid record: %w", n+1, err)
+		}
+		if rec.Prev != last {
+			return last, n, fmt.Errorf("record %d: chain broken", n+1)
+		}
+		if rec.sum() != rec.Hash {
+			return last, n, fmt.Errorf("record %d: hash mismatch", n+1)
+		}
+		last = rec.Hash
+		n++
+	}
+	return last, n, sc.Err()
+}
@@ -0,0 +1,43 @@
+package uc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "audit.log")
+	l, err := OpenFileAuditLog(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Record(AuditAdd, "one.epub", "lib-uuid")
+	l.Record(AuditUpdate, "one.epub", "lib-uuid")
+	l.Close()
+	// Reopening should continue the existing chain
+	if l, err = OpenFileAuditLog(logPath); err != nil {
+		t.Fatal(err)
+	}
+	l.Record(AuditDelete, "one.epub", "lib-uuid")
+	l.Close()
+	if n, err := VerifyAuditLog(logPath); err != nil || n != 3 {
+		t.Fatalf("VerifyAuditLog: %d records, %v", n, err)
+	}
+	data, _ := ioutil.ReadFile(logPath)
+	tampered := strings.Replace(string(data), `"op":"delete"`, `"op":"add"`, 1)
+	ioutil.WriteFile(logPath, []byte(tampered), 0644)
+	if n, err := VerifyAuditLog(logPath); err == nil || n != 2 {
+		t.Errorf("tampered log verified: %d records, %v", n, err)
+	}
+	if _, err = OpenFileAuditLog(logPath); err == nil {
+		t.Error("tampered log was opened for appending")
+	}
+}
@@ -0,0 +1,104 @@
+package uc
+
+import "io"
+
+// BaseClient implements Client with defaults that suit most devices. Embed it
+// in a client, and override the methods the device needs. At a minimum that is
+// usually GetClientOptions, GetDeviceBookList, GetMetadataIter, GetFreeSpace,
+// SaveBook, GetBook and DeleteBook.
+//
+// BaseClient also implements the optional LibraryInfoReceiver, PasswordProvider,
+// LpathChecker and StatusReporter interfaces, with the same behaviour as a
+// client that doesn't implement them.
+type BaseClient struct{}
+
+// SelectCalibreInstance selects the first Calibre instance found
+func (BaseClient) SelectCalibreInstance(calInstances []CalInstance) CalInstance {
+	return calInstances[0]
+}
+
+// GetClientOptions returns options for a generic device that supports epub books
+func (BaseClient) GetClientOptions() (ClientOptions, error) {
+	return ClientOptions{
+		ClientName:   "UNCaGED",
+		DeviceName:   "UNCaGED",
+		DeviceModel:  "UNCaGED",
+		SupportedExt: []string{"epub"},
+	}, nil
+}
+
+// GetDeviceBookList reports an empty device
+func (BaseClient) GetDeviceBookList() ([]BookCountDetails, error) {
+	return nil, nil
+}
+
+// GetMetadataIter returns an iterator with no books
+func (BaseClient) GetMetadataIter(books []BookID) MetadataIter {
+	return &sliceIter{pos: -1}
+}
+
+// GetDeviceInfo returns device info for the main storage. Calibre assigns the
+// device a new store UUID each session, unless the client overrides
+// GetDeviceInfo and SetDeviceInfo to keep the info Calibre sends.
+func (BaseClient) GetDeviceInfo() (DeviceInfo, error) {
+	var di DeviceInfo
+	di.DevInfo.DeviceName = "UNCaGED"
+	di.DevInfo.LocationCode = "main"
+	return di, nil
+}
+
+// SetDeviceInfo discards the device info
+func (BaseClient) SetDeviceInfo(devInfo DeviceInfo) error {
+	return nil
+}
+
+// UpdateMetadata discards the updated metadata
+func (BaseClient) UpdateMetadata(mdList []CalibreBookMeta) error {
+	return nil
+}
+
+// UnknownFreeSpace is the free space BaseClient reports. It is large enough
+// that Calibre never refuses to send books, rather than showing a full device.
+const UnknownFreeSpace uint64 = 1 << 40
+
+// GetFreeSpace reports UnknownFreeSpace. Override it to report the real space,
+// so Calibre can warn before the device fills up.
+func (BaseClient) GetFreeSpace() uint64 {
+	return UnknownFreeSpace
+}
+
+// SaveBook returns NotImplemented
+func (BaseClient) SaveBook(md CalibreBookMeta, book io.Reader, len int, lastBook bool) error {
+	return NotImplemented
+}
+
+// GetBook returns NotImplemented
+func (BaseClient) GetBook(book BookID, filePos int64) (io.ReadCloser, int64, error) {
+	return nil, -1, NotImplemented
+}
+
+// DeleteBook returns NotImplemented
+func (BaseClient) DeleteBook(book BookID) error {
+	return NotImplemented
+}
+
+// LogPrintf discards log messages
+func (BaseClient) LogPrintf(logLevel LogLevel, format string, a ...interface{}) {}
+
+// SetLibraryInfo discards the library info
+func (BaseClient) SetLibraryInfo(libInfo CalibreLibraryInfo) error {
+	return nil
+}
+
+// GetPassword returns no password
+func (BaseClient) GetPassword(calibreInfo CalibreInitInfo) (string, error) {
+	return "", nil
+}
+
+// CheckLpath sanitizes the lpath with SanitizeLpath
+func (BaseClient) CheckLpath(lpath string) string {
+	return SanitizeLpath(lpath)
+}
+
+// UpdateStatus discards status updates
+func (BaseClient) UpdateStatus(status Status, progress int) {}
@@ -0,0 +1,39 @@
+package uc
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// savingClient only overrides SaveBook
+type savingClient struct {
+	BaseClient
+	saved []string
+}
+
+func (sc *savingClient) SaveBook(md CalibreBookMeta, book io.Reader, len int, lastBook bool) error {
+	sc.saved = append(sc.saved, md.Lpath)
+	_, err := io.CopyN(ioutil.Discard, book, int64(len))
+	return err
+}
+
+func TestBaseClient(t *testing.T) {
+	var client Client = &savingClient{}
+	if _, ok := client.(PasswordProvider); !ok {
+		t.Errorf("Expected BaseClient to provide the optional interfaces")
+	}
+	if err := client.SaveBook(CalibreBookMeta{Lpath: "a.epub"}, nil, 0, true); err != nil {
+		t.Errorf("Expected the overridden SaveBook to be used, got %v", err)
+	}
+	if err := client.DeleteBook(BookID{Lpath: "a.epub"}); !errors.Is(err, NotImplemented) {
+		t.Errorf("Expected NotImplemented, got %v", err)
+	}
+	if it := client.GetMetadataIter(nil); it.Count() != 0 || it.Next() {
+		t.Errorf("Expected no metadata")
+	}
+	if free := client.GetFreeSpace(); free == 0 {
+		t.Errorf("Expected the device not to be reported as full")
+	}
+}
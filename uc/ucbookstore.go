@@ -0,0 +1,98 @@
+package uc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// BookStore persists UNCaGED's internal book DB between sessions. With a
+// BookStore in ClientOptions, the books and primary keys saved at the end of
+// one session are loaded at the start of the next, and GetDeviceBookList is
+// only called when the store is empty.
+// Clients that add or remove books outside of UNCaGED should not use a
+// BookStore, or should clear it when they do.
+type BookStore interface {
+	// Load returns the books last saved, or nil if there are none
+	Load() ([]BookCountDetails, error)
+	// Save replaces the saved books
+	Save(books []BookCountDetails) error
+}
+
+// FileBookStore is a BookStore persisted as a JSON file. It is intended to be
+// stored alongside the client's metadata.
+type FileBookStore struct {
+	path string
+}
+
+// NewFileBookStore creates a FileBookStore saved at path
+func NewFileBookStore(path string) *FileBookStore {
+	return &FileBookStore{path: path}
+}
+
+// Load reads the books from the file. A missing file is an empty store.
+func (s *FileBookStore) Load() ([]BookCountDetails, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Load: error reading book store: %w", err)
+	}
+	var books []BookCountDetails
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if err = json.Unmarshal(data, &books); err != nil {
+		return nil, fmt.Errorf("Load: error decoding book store: %w", err)
+	}
+	return books, nil
+}
+
+// Save writes the books to the file, replacing its contents
+func (s *FileBookStore) Save(books []BookCountDetails) error {
+	data, err := json.Marshal(books)
+	if err != nil {
+		return fmt.Errorf("Save: error encoding book store: %w", err)
+	}
+	// Write to a temporary file first, so a failed save doesn't lose the store
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("Save: error writing book store: %w", err)
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("Save: error replacing book store: %w", err)
+	}
+	return nil
+}
+
+// loadDB initialises the database with books saved by a BookStore, keeping
+// their primary keys. Like initDB, it returns the books sharing a UUID, and
+// the books with a UUID generated from their lpath.
+func (ucdb *UncagedDB) loadDB(bl []BookCountDetails) (duplicates [][]BookID, missing []BookID) {
+	ucdb.mu.Lock()
+	defer ucdb.mu.Unlock()
+	ucdb.booklist = bl
+	for i, b := range ucdb.booklist {
+		if b.UUID == "" {
+			ucdb.booklist[i].UUID = syntheticUUID(b.Lpath)
+		}
+		// Generated UUIDs can be recognised, as they are derived from the lpath
+		ucdb.booklist[i].syntheticUUID = ucdb.booklist[i].UUID == syntheticUUID(b.Lpath)
+		if b.PriKey >= ucdb.nextKey {
+			ucdb.nextKey = b.PriKey + 1
+		}
+	}
+	return ucdb.checkUUIDs()
+}
+
+// saveBooks saves the internal book DB, if the client provided a BookStore
+func (c *calConn) saveBooks() {
+	if c.clientOpts.BookStore == nil {
+		return
+	}
+	if err := c.clientOpts.BookStore.Save(c.ucdb.booklist); err != nil {
+		c.logf(Warn, "saveBooks: error saving books: %v\n", err)
+	}
+}
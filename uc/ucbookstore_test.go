@@ -0,0 +1,89 @@
+package uc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// storeClient fails the test if the booklist is read from the client
+type storeClient struct {
+	BaseClient
+	t        *testing.T
+	store    BookStore
+	warnings *[]Warning
+}
+
+func (sc storeClient) ReportWarning(w Warning) { *sc.warnings = append(*sc.warnings, w) }
+
+func (sc storeClient) GetClientOptions() (ClientOptions, error) {
+	opts, _ := sc.BaseClient.GetClientOptions()
+	opts.BookStore = sc.store
+	opts.DirectConnect = CalInstance{Host: "127.0.0.1", TCPPort: 9090}
+	return opts, nil
+}
+
+func (sc storeClient) GetDeviceBookList() ([]BookCountDetails, error) {
+	sc.t.Errorf("Expected the booklist to be loaded from the store")
+	return nil, nil
+}
+
+func TestFileBookStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uncaged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileBookStore(filepath.Join(dir, "books.json"))
+	if books, err := store.Load(); err != nil || books != nil {
+		t.Fatalf("Expected an empty store, got %v, %v", books, err)
+	}
+	ucdb := &UncagedDB{}
+	ucdb.initDB([]BookCountDetails{{UUID: "abc", Lpath: "a.epub"}, {Lpath: "b.epub"}})
+	ucdb.removeEntry(Lpath, "a.epub")
+	ucdb.addEntry(CalibreBookMeta{UUID: "def", Lpath: "c.epub"})
+	if err = store.Save(ucdb.booklist); err != nil {
+		t.Fatal(err)
+	}
+	var warnings []Warning
+	c, err := New(storeClient{t: t, store: store, warnings: &warnings}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Books loaded from the store are checked as the client's booklist would be
+	if len(warnings) != 1 || warnings[0].Kind != MissingUUID || len(warnings[0].Books) != 1 || warnings[0].Books[0].Lpath != "b.epub" {
+		t.Errorf("Expected a missing UUID warning for b.epub, got %+v", warnings)
+	}
+	if c.ucdb.length() != 2 {
+		t.Fatalf("Expected 2 books, got %d", c.ucdb.length())
+	}
+	if _, bd, _ := c.ucdb.find(Lpath, "b.epub"); bd.PriKey != 1 || bd.bookID().UUID != "" {
+		t.Errorf("Expected b.epub to keep its key and synthetic UUID, got %+v", bd)
+	}
+	if _, bd, _ := c.ucdb.find(Lpath, "c.epub"); bd.PriKey != 2 || bd.UUID != "def" {
+		t.Errorf("Expected c.epub to keep its key, got %+v", bd)
+	}
+	if c.ucdb.newPriKey() != 3 {
+		t.Errorf("Expected new keys to follow the loaded keys")
+	}
+}
+
+func TestLoadDB(t *testing.T) {
+	ucdb := &UncagedDB{}
+	dups, missing := ucdb.loadDB([]BookCountDetails{
+		{UUID: "abc", Lpath: "a.epub", PriKey: 1},
+		{UUID: syntheticUUID("b.epub"), Lpath: "b.epub", PriKey: 2},
+		{UUID: "abc", Lpath: "c.epub", PriKey: 3},
+		{Lpath: "d.epub", PriKey: 4},
+	})
+	if len(dups) != 1 || len(dups[0]) != 2 || dups[0][0].Lpath != "a.epub" || dups[0][1].Lpath != "c.epub" {
+		t.Errorf("Unexpected duplicates: %v", dups)
+	}
+	if len(missing) != 2 || missing[0].Lpath != "b.epub" || missing[1].Lpath != "d.epub" {
+		t.Errorf("Unexpected missing: %v", missing)
+	}
+	if _, bd, err := ucdb.find(Lpath, "d.epub"); err != nil || bd.UUID != syntheticUUID("d.epub") {
+		t.Errorf("Expected d.epub given a UUID from its lpath, got %+v, %v", bd, err)
+	}
+}
@@ -0,0 +1,48 @@
+package uc
+
+import (
+	"context"
+	"io"
+)
+
+// cancelReader stops reading once its context is cancelled
+type cancelReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *cancelReader) Read(p []byte) (int, error) {
+	if cr.ctx.Err() != nil {
+		return 0, BookCancelled
+	}
+	return cr.r.Read(p)
+}
+
+// cancellable wraps r so that reading from it can be stopped with CancelBook.
+// The returned function must be called once the book has been read.
+func (c *calConn) cancellable(r io.Reader) (io.Reader, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancelMu.Lock()
+	c.cancelBook = cancel
+	c.cancelMu.Unlock()
+	return &cancelReader{ctx: ctx, r: r}, func() {
+		c.cancelMu.Lock()
+		c.cancelBook = nil
+		c.cancelMu.Unlock()
+		cancel()
+	}
+}
+
+// CancelBook cancels receiving the book currently being received from Calibre.
+// Reads from the book passed to SaveBook fail with BookCancelled, and the rest
+// of the book is discarded. The session then continues with the next book.
+// Books being sent to Calibre can't be cancelled, as Calibre expects the whole
+// file. It is safe to call CancelBook while UNCaGED is running, and it does
+// nothing if no book is being received.
+func (c *calConn) CancelBook() {
+	c.cancelMu.Lock()
+	defer c.cancelMu.Unlock()
+	if c.cancelBook != nil {
+		c.cancelBook()
+	}
+}
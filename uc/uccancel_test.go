@@ -0,0 +1,22 @@
+package uc
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCancelBook(t *testing.T) {
+	c := &calConn{}
+	c.CancelBook()
+	r, done := c.cancellable(strings.NewReader("0123456789"))
+	defer done()
+	buf := make([]byte, 4)
+	if _, err := r.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	c.CancelBook()
+	if _, err := r.Read(buf); !errors.Is(err, BookCancelled) {
+		t.Errorf("Expected BookCancelled after cancelling, got %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package uc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// ChecksumStore is a content addressed store, mapping the hash of a book
+// file to the lpath it is stored at. Clients may provide an implementation
+// in ClientOptions to allow UNCaGED to detect duplicate and changed books.
+// Hashes are hex encoded SHA-256 sums, as produced by HashReader.
+type ChecksumStore interface {
+	// Add records that the book at lpath has the provided hash, replacing
+	// any previous hash for lpath
+	Add(hash, lpath string)
+	// LookupHash returns the lpath of a book with the provided hash
+	LookupHash(hash string) (lpath string, ok bool)
+	// LookupLpath returns the hash of the book at lpath
+	LookupLpath(lpath string) (hash string, ok bool)
+	// Remove removes the book at lpath from the store
+	Remove(lpath string)
+	// Save persists the store
+	Save() error
+}
+
+// FileChecksumStore is a ChecksumStore persisted as a JSON file. It is
+// intended to be stored alongside the client's metadata.
+type FileChecksumStore struct {
+	path   string
+	mu     sync.Mutex
+	hashes map[string]string // hash -> lpath
+	lpaths map[string]string // lpath -> hash
+}
+
+// NewFileChecksumStore creates a FileChecksumStore saved at path, loading
+// any existing contents
+func NewFileChecksumStore(path string) (*FileChecksumStore, error) {
+	s := &FileChecksumStore{
+		path:   path,
+		hashes: make(map[string]string),
+		lpaths: make(map[string]string),
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("NewFileChecksumStore: error reading store: %w", err)
+	}
+	if len(data) == 0 {
+		return s, nil
+	}
+	if err = json.Unmarshal(data, &s.lpaths); err != nil {
+		return nil, fmt.Errorf("NewFileChecksumStore: error decoding store: %w", err)
+	}
+	for lpath, h := range s.lpaths {
+		s.hashes[h] = lpath
+	}
+	return s, nil
+}
+
+// Add records that the book at lpath has the provided hash
+func (s *FileChecksumStore) Add(hash, lpath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, exists := s.lpaths[lpath]; exists && s.hashes[old] == lpath {
+		delete(s.hashes, old)
+	}
+	s.lpaths[lpath] = hash
+	s.hashes[hash] = lpath
+}
+
+// LookupHash returns the lpath of a book with the provided hash
+func (s *FileChecksumStore) LookupHash(hash string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lpath, ok := s.hashes[hash]
+	return lpath, ok
+}
+
+// LookupLpath returns the hash of the book at lpath
+func (s *FileChecksumStore) LookupLpath(lpath string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.lpaths[lpath]
+	return h, ok
+}
+
+// Remove removes the book at lpath from the store
+func (s *FileChecksumStore) Remove(lpath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h, exists := s.lpaths[lpath]; exists {
+		delete(s.lpaths, lpath)
+		if s.hashes[h] == lpath {
+			delete(s.hashes, h)
+			// Another copy of the same book may still be on the device
+			for lp, other := range s.lpaths {
+				if other == h {
+					s.hashes[h] = lp
+					break
+				}
+			}
+		}
+	}
+}
+
+// Save writes the store to disk
+func (s *FileChecksumStore) Save() error {
+	s.mu.Lock()
+	data, err := json.MarshalIndent(s.lpaths, "", "    ")
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("Save: error encoding store: %w", err)
+	}
+	if err = ioutil.WriteFile(s.path, data, 0644); err != nil {
+		return fmt.Errorf("Save: error writing store: %w", err)
+	}
+	return nil
+}
+
+// HashReader returns the hash of everything read from r, in the format
+// used by ChecksumStore, along with the number of bytes read
+func HashReader(r io.Reader) (string, int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// hashingReader hashes data as it is read
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, h: sha256.New()}
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	hr.n += int64(n)
+	return n, err
+}
+
+// sum returns the hash of the data read so far
+func (hr *hashingReader) sum() string {
+	return hex.EncodeToString(hr.h.Sum(nil))
+}
+
+// verifyBook checks the 'length' byte book read through hr was received in full,
+// and that the client saved what was received. savedLen is the length of the book
+// after any transforms, which also prevent the hashes from being compared. Any part
+// of the book the client left unread is discarded, so the connection stays in step
+// with Calibre.
+func (c *calConn) verifyBook(md CalibreBookMeta, hr *hashingReader, length, savedLen int) error {
+	if hr.n < int64(length) {
+		if _, err := copyBook(ioutil.Discard, hr, int64(length)-hr.n); err != nil {
+			return fmt.Errorf("verifyBook: error discarding unread book data: %w", err)
+		}
+		return fmt.Errorf("verifyBook: client read %d of %d bytes", hr.n, length)
+	}
+	saved, err := c.client.(BookVerifier).VerifyBook(md)
+	if err != nil {
+		return fmt.Errorf("verifyBook: %w", err)
+	}
+	if saved.Size != int64(savedLen) {
+		return fmt.Errorf("verifyBook: saved %d of %d bytes", saved.Size, savedLen)
+	}
+	if sum := hr.sum(); len(c.clientOpts.Transforms) == 0 && saved.Hash != "" && saved.Hash != sum {
+		return fmt.Errorf("verifyBook: saved book hash %s does not match received hash %s", saved.Hash, sum)
+	}
+	return nil
+}
+
+// rejectBook deletes a book that failed verification, and lets the client know
+func (c *calConn) rejectBook(md CalibreBookMeta, verr error) error {
+	id := BookID{Lpath: md.Lpath, UUID: md.UUID}
+	c.warn(Warning{
+		Kind:    TransferFailed,
+		Message: fmt.Sprintf("'%s' failed verification and was deleted: %v", md.Lpath, verr),
+		Books:   []BookID{id},
+	})
+	if err := c.client.DeleteBook(id); err != nil {
+		return fmt.Errorf("rejectBook: client error deleting book: %w", clientErr(err))
+	}
+	// The rejected book may have replaced one already on the device
+	c.ucdb.removeEntry(Lpath, md.Lpath)
+	c.uncacheMetadata(md.Lpath)
+	return nil
+}
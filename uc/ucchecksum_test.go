@@ -0,0 +1,91 @@
+package uc
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileChecksumStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storePath := filepath.Join(dir, ".checksums.calibre")
+	s, err := NewFileChecksumStore(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h1, n, err := HashReader(strings.NewReader("book one"))
+	if err != nil || n != 8 {
+		t.Fatalf("HashReader: %v, %d bytes", err, n)
+	}
+	h2, _, _ := HashReader(strings.NewReader("book two"))
+	s.Add(h1, "one.epub")
+	s.Add(h2, "two.epub")
+	// Replacing a book should forget its old hash
+	s.Add(h1, "two.epub")
+	if lp, ok := s.LookupHash(h2); ok {
+		t.Errorf("Expected stale hash to be removed, got %s", lp)
+	}
+	if err = s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewFileChecksumStore(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, ok := s.LookupLpath("one.epub"); !ok || h != h1 {
+		t.Errorf("Expected %s for one.epub, got %s", h1, h)
+	}
+	s.Remove("one.epub")
+	if _, ok := s.LookupLpath("one.epub"); ok {
+		t.Errorf("Expected one.epub to be removed")
+	}
+	if lp, ok := s.LookupHash(h1); !ok || lp != "two.epub" {
+		t.Errorf("Expected two.epub to remain, got %s", lp)
+	}
+}
+
+// verifyClient reports a saved digest for verification
+type verifyClient struct {
+	logClient
+	saved BookDigest
+}
+
+func (vc verifyClient) VerifyBook(md CalibreBookMeta) (BookDigest, error) {
+	return vc.saved, nil
+}
+
+func TestVerifyBook(t *testing.T) {
+	book := "0123456789"
+	hash, _, _ := HashReader(strings.NewReader(book))
+	tests := []struct {
+		name  string
+		read  int64
+		saved BookDigest
+		ok    bool
+	}{
+		{"intact", 10, BookDigest{Size: 10, Hash: hash}, true},
+		{"size only", 10, BookDigest{Size: 10}, true},
+		{"truncated read", 4, BookDigest{Size: 4}, false},
+		{"truncated save", 10, BookDigest{Size: 9}, false},
+		{"corrupt", 10, BookDigest{Size: 10, Hash: "bad"}, false},
+	}
+	for _, tt := range tests {
+		c := &calConn{client: verifyClient{saved: tt.saved}}
+		r := strings.NewReader(book)
+		hr := newHashingReader(r)
+		io.CopyN(ioutil.Discard, hr, tt.read)
+		if err := c.verifyBook(CalibreBookMeta{}, hr, len(book), len(book)); (err == nil) != tt.ok {
+			t.Errorf("%s: unexpected result %v", tt.name, err)
+		}
+		if r.Len() != 0 {
+			t.Errorf("%s: %d bytes of the book left unread", tt.name, r.Len())
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package uc
+
+import (
+	"net"
+	"strconv"
+)
+
+// CredentialKey identifies the Calibre library a password is for. Calibre
+// only sends the library details after connecting, so stores should prefer
+// LibraryUUID, and fall back to Host and Name.
+type CredentialKey struct {
+	LibraryUUID string
+	LibraryName string
+	Host        string // The host and port of the Calibre instance
+	Name        string // The name of the Calibre instance
+}
+
+// CredentialStore may optionally be implemented by a Client to remember the
+// passwords of Calibre libraries, such as in the device's keychain. Stored
+// passwords are used when Calibre first challenges for a password, so the
+// client can connect without asking the user. If Calibre rejects the stored
+// password, the client's PasswordProvider is asked instead.
+type CredentialStore interface {
+	// LookupPassword returns the stored password for a library, and false if
+	// there is none
+	LookupPassword(key CredentialKey) (password string, found bool)
+	// SavePassword is called once Calibre accepts a password from the
+	// PasswordProvider
+	SavePassword(key CredentialKey, password string) error
+}
+
+// credentialKey returns the CredentialKey of the current Calibre library
+func (c *calConn) credentialKey() CredentialKey {
+	return CredentialKey{
+		LibraryUUID: c.calibreInfo.CurrentLibraryUUID,
+		LibraryName: c.calibreInfo.CurrentLibraryName,
+		Host:        net.JoinHostPort(c.calibreInstance.Host, strconv.Itoa(c.calibreInstance.TCPPort)),
+		Name:        c.calibreInstance.Name,
+	}
+}
+
+// storedPassword loads the password for the current library from the client's
+// CredentialStore. The store is only used until Calibre rejects a password.
+func (c *calConn) storedPassword(key string) {
+	cs, ok := c.client.(CredentialStore)
+	if !ok || c.passwordFailures[key] > 0 {
+		return
+	}
+	if _, tried := c.passwords[key]; tried {
+		return
+	}
+	if password, found := cs.LookupPassword(c.credentialKey()); found && password != "" {
+		c.passwords[key] = password
+	}
+}
+
+// savePassword saves a password from the PasswordProvider to the client's
+// CredentialStore, once Calibre has accepted it
+func (c *calConn) savePassword() {
+	if !c.newPassword {
+		return
+	}
+	c.newPassword = false
+	if cs, ok := c.client.(CredentialStore); ok {
+		if err := cs.SavePassword(c.credentialKey(), c.serverPassword); err != nil {
+			c.logf(Warn, "savePassword: error saving password: %v\n", clientErr(err))
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package uc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// keychainClient stores passwords by library UUID
+type keychainClient struct {
+	logClient
+	passwords map[string]string
+}
+
+func (kc keychainClient) LookupPassword(key CredentialKey) (string, bool) {
+	password, found := kc.passwords[key.LibraryUUID]
+	return password, found
+}
+
+func (kc keychainClient) SavePassword(key CredentialKey, password string) error {
+	kc.passwords[key.LibraryUUID] = password
+	return nil
+}
+
+func TestCredentialStore(t *testing.T) {
+	const initInfo = `{"passwordChallenge":"123","currentLibraryUUID":"lib-uuid","currentLibraryName":"Library"}`
+	kc := keychainClient{passwords: map[string]string{"lib-uuid": "stored"}}
+	c := newTestConn(kc, "")
+	c.passwords = make(map[string]string)
+	c.passwordFailures = make(map[string]int)
+	if err := c.getInitInfo([]byte(initInfo)); err != nil {
+		t.Fatal(err)
+	}
+	if c.serverPassword != "stored" {
+		t.Errorf("Expected the stored password to be used, got %q", c.serverPassword)
+	}
+	// Calibre rejected the stored password
+	c.passwordFailures["lib-uuid"]++
+	delete(c.passwords, "lib-uuid")
+	if c.getInitInfo([]byte(initInfo)); c.serverPassword != "" {
+		t.Errorf("Expected a rejected password not to be reused, got %q", c.serverPassword)
+	}
+	// The user entered a new password, which Calibre accepts
+	c.passwords["lib-uuid"] = "entered"
+	c.newPassword = true
+	c.getInitInfo([]byte(initInfo))
+	if err := c.getDeviceInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if kc.passwords["lib-uuid"] != "entered" {
+		t.Errorf("Expected the accepted password to be saved, got %q", kc.passwords["lib-uuid"])
+	}
+}
+
+// wrongPasswordClient always provides the wrong password
+type wrongPasswordClient struct{ logClient }
+
+func (wrongPasswordClient) GetPassword(calibreInfo CalibreInitInfo) (string, error) {
+	return "wrong", nil
+}
+
+func TestPasswordRetryLimit(t *testing.T) {
+	c := newTestConn(wrongPasswordClient{}, "")
+	c.calibreInfo.CurrentLibraryUUID = "lib-uuid"
+	c.passwords = map[string]string{"lib-uuid": "wrong"}
+	c.passwordFailures = map[string]int{"lib-uuid": 1}
+	c.clientOpts.PasswordRetry = RetryPolicy{Attempts: 2}
+	err := c.handleMessage([]byte(`{"messageKind":1}`))
+	if !errors.Is(err, TooManyPasswordAttempts) {
+		t.Errorf("Expected TooManyPasswordAttempts, got %v", err)
+	}
+	if _, tried := c.passwords["lib-uuid"]; tried {
+		t.Errorf("Expected the rejected password to be forgotten")
+	}
+}
+
+func TestPasswordBackoffCancelled(t *testing.T) {
+	c := newTestConn(wrongPasswordClient{}, "")
+	c.calibreInfo.CurrentLibraryUUID = "lib-uuid"
+	c.passwords = map[string]string{"lib-uuid": "wrong"}
+	c.passwordFailures = map[string]int{"lib-uuid": 1}
+	c.clientOpts.PasswordRetry = RetryPolicy{Attempts: 3, InitialDelay: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.ctx = ctx
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := c.handleMessage([]byte(`{"messageKind":1}`)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the backoff to be cancelled, got %v", err)
+	}
+}
@@ -89,6 +89,14 @@ type CalCustomColDisplayEnum struct {
 	EnumColors     []string `json:"enum_colors"`
 }
 
+// formatSeries formats a series name and index the way Calibre does
+func formatSeries(series string, index *float64) string {
+	if index == nil {
+		return series
+	}
+	return fmt.Sprintf("%s [%s]", series, strconv.FormatFloat(*index, 'f', -1, 64))
+}
+
 // CalCustomColDisplayDateTime is the display type for datetime custom columns
 type CalCustomColDisplayDateTime struct {
 	Description string  `json:"description"`
@@ -257,7 +265,7 @@ func (u *CalibreCustomColumn) ContextualString() string {
 	case "series":
 		if u.Extra != nil {
 			if e, ok := u.Extra.(float64); ok {
-				return u.Value.(string) + fmt.Sprintf(" [%s]", strconv.FormatFloat(e, 'f', -1, 64))
+				return formatSeries(u.Value.(string), &e)
 			}
 		}
 		return u.String()
@@ -0,0 +1,123 @@
+package uc
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// DiagFileOptions controls how diagnostic output files (session transcripts,
+// protocol dumps etc.) are written
+type DiagFileOptions struct {
+	// Compress writes the file with gzip compression. ".gz" is appended to the filename
+	Compress bool
+	// MaxSize is the number of (uncompressed) bytes written to a file before it is
+	// rotated. Zero disables rotation.
+	MaxSize int64
+	// MaxFiles is the number of rotated files to keep, in addition to the current file.
+	// Rotated files are named <path>.1, <path>.2 etc, with <path>.1 being the most recent.
+	MaxFiles int
+}
+
+// DiagFile is an io.WriteCloser for diagnostic output, supporting optional
+// gzip compression and size based rotation. It is safe for concurrent use.
+type DiagFile struct {
+	path    string
+	opts    DiagFileOptions
+	mu      sync.Mutex
+	file    *os.File
+	gz      *gzip.Writer
+	w       io.Writer
+	written int64
+}
+
+// NewDiagFile creates a new diagnostic file at path, truncating any existing file
+func NewDiagFile(path string, opts DiagFileOptions) (*DiagFile, error) {
+	if opts.Compress {
+		path += ".gz"
+	}
+	d := &DiagFile{path: path, opts: opts}
+	if err := d.open(); err != nil {
+		return nil, fmt.Errorf("NewDiagFile: %w", err)
+	}
+	return d, nil
+}
+
+// Path returns the path of the file currently being written to
+func (d *DiagFile) Path() string {
+	return d.path
+}
+
+func (d *DiagFile) open() error {
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	d.file, d.w, d.written = f, f, 0
+	if d.opts.Compress {
+		d.gz = gzip.NewWriter(f)
+		d.w = d.gz
+	}
+	return nil
+}
+
+func (d *DiagFile) close() error {
+	if d.gz != nil {
+		if err := d.gz.Close(); err != nil {
+			d.file.Close()
+			return err
+		}
+		d.gz = nil
+	}
+	return d.file.Close()
+}
+
+// rotate closes the current file, shifts the rotated files along, and opens a new file
+func (d *DiagFile) rotate() error {
+	if err := d.close(); err != nil {
+		return err
+	}
+	if d.opts.MaxFiles <= 0 {
+		os.Remove(d.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", d.path, d.opts.MaxFiles))
+		for i := d.opts.MaxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", d.path, i), fmt.Sprintf("%s.%d", d.path, i+1))
+		}
+		if err := os.Rename(d.path, d.path+".1"); err != nil {
+			return err
+		}
+	}
+	return d.open()
+}
+
+// Write writes p to the file, rotating it first if MaxSize would be exceeded
+func (d *DiagFile) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		return 0, os.ErrClosed
+	}
+	if d.opts.MaxSize > 0 && d.written > 0 && d.written+int64(len(p)) > d.opts.MaxSize {
+		if err := d.rotate(); err != nil {
+			return 0, fmt.Errorf("Write: error rotating file: %w", err)
+		}
+	}
+	n, err := d.w.Write(p)
+	d.written += int64(n)
+	return n, err
+}
+
+// Close flushes and closes the file
+func (d *DiagFile) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		return os.ErrClosed
+	}
+	err := d.close()
+	d.file = nil
+	return err
+}
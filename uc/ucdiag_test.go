@@ -0,0 +1,47 @@
+package uc
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiagFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := NewDiagFile(filepath.Join(dir, "transcript"), DiagFileOptions{Compress: true, MaxSize: 10, MaxFiles: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"aaaaaaaa", "bbbbbbbb", "cccccccc"} {
+		if _, err = d.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(d.Path() + ".2"); !os.IsNotExist(err) {
+		t.Errorf("Expected only one rotated file to be kept")
+	}
+	for fn, expected := range map[string]string{d.Path(): "cccccccc", d.Path() + ".1": "bbbbbbbb"} {
+		f, err := os.Open(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(gz)
+		f.Close()
+		if string(b) != expected {
+			t.Errorf("%s: got '%s', expected '%s'", fn, b, expected)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package uc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+// ErrorPhase is the part of handling a packet from Calibre where an error occurred
+type ErrorPhase int
+
+// Phases of packet handling
+const (
+	// ProtocolPhase errors are Calibre doing something UNCaGED did not expect
+	ProtocolPhase ErrorPhase = iota
+	// DecodePhase errors are packets from Calibre that could not be decoded
+	DecodePhase
+	// ClientPhase errors were returned by a client callback
+	ClientPhase
+	// NetworkPhase errors are failures of the connection with Calibre. These are
+	// usually worth retrying.
+	NetworkPhase
+)
+
+func (p ErrorPhase) String() string {
+	switch p {
+	case DecodePhase:
+		return "decode"
+	case ClientPhase:
+		return "client"
+	case NetworkPhase:
+		return "network"
+	}
+	return "protocol"
+}
+
+// OpError is returned by Start when handling a packet from Calibre fails. Op is the
+// name Calibre uses for the operation, eg: "SEND_BOOK", and is empty if the error
+// occurred reading a packet.
+type OpError struct {
+	Op    string
+	Phase ErrorPhase
+	Err   error
+}
+
+func (e *OpError) Error() string {
+	if e.Op == "" {
+		return fmt.Sprintf("%s error: %v", e.Phase, e.Err)
+	}
+	return fmt.Sprintf("%s %s error: %v", e.Op, e.Phase, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable returns true if the operation may succeed if retried, such as after
+// reconnecting to Calibre
+func (e *OpError) Retryable() bool {
+	return e.Phase == NetworkPhase
+}
+
+// clientError marks an error returned by a client callback
+type clientError struct {
+	err error
+}
+
+func (e *clientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *clientError) Unwrap() error {
+	return e.err
+}
+
+// clientErr marks err as having been returned by a client callback
+func clientErr(err error) error {
+	return &clientError{err: err}
+}
+
+// errorPhase works out which phase of packet handling err occurred in
+func errorPhase(err error) ErrorPhase {
+	var synErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var cErr *clientError
+	var netErr net.Error
+	var pktErr *PacketError
+	// Clients saving books read them from the connection, so network errors
+	// take precedence over client errors
+	switch {
+	case errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return NetworkPhase
+	case errors.As(err, &synErr) || errors.As(err, &typeErr) || errors.As(err, &pktErr) || errors.Is(err, MalformedPacket):
+		return DecodePhase
+	case errors.As(err, &cErr):
+		return ClientPhase
+	}
+	return ProtocolPhase
+}
+
+// opError wraps an error that occurred handling a packet with opcode op
+func opError(op calOpCode, err error) *OpError {
+	return &OpError{Op: op.String(), Phase: errorPhase(err), Err: err}
+}
+
+// sentinelError wraps an error so that errors.Is also matches a CalError
+type sentinelError struct {
+	sentinel CalError
+	err      error
+}
+
+func (e *sentinelError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sentinelError) Unwrap() error {
+	return e.err
+}
+
+func (e *sentinelError) Is(target error) bool {
+	return target == e.sentinel
+}
+
+// asSentinel wraps err so that errors.Is matches sentinel
+func asSentinel(sentinel CalError, err error) error {
+	return &sentinelError{sentinel: sentinel, err: err}
+}
+
+// connectionErr marks err as CalibreClosedConnection if it was caused by the
+// connection being closed or reset
+func connectionErr(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return asSentinel(CalibreClosedConnection, err)
+	}
+	return err
+}
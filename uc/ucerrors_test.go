@@ -0,0 +1,37 @@
+package uc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestErrorPhase(t *testing.T) {
+	var v struct{ A int }
+	decodeErr := json.Unmarshal([]byte(`{"A":"x"}`), &v)
+	tests := []struct {
+		err   error
+		phase ErrorPhase
+	}{
+		{fmt.Errorf("sendBook: %w", clientErr(errors.New("disk full"))), ClientPhase},
+		{fmt.Errorf("getInitInfo: %w", decodeErr), DecodePhase},
+		{fmt.Errorf("sendBook: %w", clientErr(io.ErrUnexpectedEOF)), NetworkPhase},
+		{errors.New("getBook: calibre version does not support binary streaming"), ProtocolPhase},
+	}
+	for _, tt := range tests {
+		if e := opError(sendBook, tt.err); e.Phase != tt.phase || e.Op != "SEND_BOOK" {
+			t.Errorf("Expected %s phase for '%v', got %s", tt.phase, tt.err, e.Phase)
+		}
+	}
+}
+
+func TestConnectionErr(t *testing.T) {
+	if err := fmt.Errorf("readTCP: %w", connectionErr(io.ErrUnexpectedEOF)); !errors.Is(err, CalibreClosedConnection) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected unexpected EOF to match CalibreClosedConnection")
+	}
+	if err := connectionErr(errors.New("other")); errors.Is(err, CalibreClosedConnection) {
+		t.Errorf("Unexpected match of CalibreClosedConnection")
+	}
+}
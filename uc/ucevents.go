@@ -0,0 +1,79 @@
+package uc
+
+import "time"
+
+// Event is sent on ClientOptions.Events as UNCaGED works. It is one of
+// StatusChanged, BookReceiveStarted, MetadataSyncProgress or SessionEnded, and
+// carries the details a UI needs that UpdateStatus can't provide.
+type Event interface {
+	event()
+}
+
+// StatusChanged is sent whenever UNCaGED would call UpdateStatus
+type StatusChanged struct {
+	Status Status
+	// Progress is between 0 & 100, or negative if Status has no progress
+	Progress int
+}
+
+// BookReceiveStarted is sent as Calibre starts sending a book
+type BookReceiveStarted struct {
+	// Index is the position of this book in the current batch, starting from 0
+	Index int
+	Total int
+	Title string
+	Lpath string
+}
+
+// MetadataSyncProgress is sent as the booklist is sent to Calibre, and as
+// updated metadata is received from Calibre
+type MetadataSyncProgress struct {
+	// Status is SendingBooklist or UpdatingMetadata
+	Status Status
+	Done   int
+	Total  int
+}
+
+// SessionEnded is sent when the session with Calibre ends. It is named to avoid
+// clashing with the Disconnected status
+type SessionEnded struct {
+	// Reason is the error that ended the session, or nil if Calibre
+	// disconnected or the session was cancelled
+	Reason error
+}
+
+func (StatusChanged) event()        {}
+func (BookReceiveStarted) event()   {}
+func (MetadataSyncProgress) event() {}
+func (SessionEnded) event()         {}
+
+// eventTimeout is how long emit waits for the client to receive an event
+const eventTimeout = time.Second
+
+// emit sends an event to the client, if it asked for events. If the client
+// doesn't receive it within eventTimeout, the event is dropped and counted in
+// SessionStats.EventsDropped, so a client that stops receiving can't stall
+// the session. After a drop, events are only sent if the client is ready for
+// them, until one is received again.
+func (c *calConn) emit(e Event) {
+	if c.clientOpts.Events == nil {
+		return
+	}
+	select {
+	case c.clientOpts.Events <- e:
+		c.eventsStalled = false
+		return
+	default:
+	}
+	if !c.eventsStalled {
+		t := time.NewTimer(eventTimeout)
+		defer t.Stop()
+		select {
+		case c.clientOpts.Events <- e:
+			return
+		case <-t.C:
+		}
+	}
+	c.eventsStalled = true
+	c.updateStats(func(s *SessionStats) { s.EventsDropped++ })
+}
@@ -0,0 +1,76 @@
+package uc
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	events := make(chan Event, 10)
+	c := &calConn{client: logClient{}}
+	c.clientOpts.Events = events
+	conn, calibre := net.Pipe()
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, calibre)
+	c.tcpConn = conn
+	c.tcpDeadline.std = time.Minute
+	w := c.newBooklistWriter(3)
+	w.chunk = 2
+	for i := 0; i < 3; i++ {
+		if err := w.write([]byte("6[0,{}]")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	close(events)
+	want := []Event{
+		StatusChanged{Status: SendingBooklist, Progress: 0},
+		StatusChanged{Status: SendingBooklist, Progress: 66},
+		MetadataSyncProgress{Status: SendingBooklist, Done: 2, Total: 3},
+		StatusChanged{Status: SendingBooklist, Progress: 100},
+		MetadataSyncProgress{Status: SendingBooklist, Done: 3, Total: 3},
+	}
+	var got []Event
+	for e := range events {
+		got = append(got, e)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d events, got %v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Event %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestEventsDropped(t *testing.T) {
+	events := make(chan Event, 1)
+	c := &calConn{client: logClient{}}
+	c.clientOpts.Events = events
+	// Nothing is receiving, so only the first event fits, and the session
+	// only waits for the second
+	c.emit(StatusChanged{Status: Connecting, Progress: -1})
+	start := time.Now()
+	c.emit(StatusChanged{Status: Connected, Progress: -1})
+	c.emit(SessionEnded{})
+	if elapsed := time.Since(start); elapsed > eventTimeout+eventTimeout/2 {
+		t.Errorf("Expected to wait for one event at most, waited %v", elapsed)
+	}
+	if got := <-events; got != (StatusChanged{Status: Connecting, Progress: -1}) {
+		t.Errorf("Expected the first event to be sent, got %+v", got)
+	}
+	if dropped := c.Stats().EventsDropped; dropped != 2 {
+		t.Errorf("Expected 2 dropped events, got %d", dropped)
+	}
+	// Once the client receives again, events are sent
+	c.emit(SessionEnded{})
+	if got := <-events; got != (SessionEnded{}) {
+		t.Errorf("Expected SessionEnded, got %+v", got)
+	}
+}
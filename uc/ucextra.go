@@ -0,0 +1,155 @@
+package uc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Newer versions of Calibre may add fields to the packets they send. UNCaGED
+// warns the client about fields it doesn't know, so they can be added, and
+// keeps unknown book metadata fields so they are sent back to Calibre intact.
+
+// jsonFieldCache caches the JSON field names of each struct type
+var jsonFieldCache sync.Map
+
+// jsonFields returns the lower cased JSON field names of struct type t,
+// including the fields of embedded structs
+func jsonFields(t reflect.Type) map[string]bool {
+	if f, ok := jsonFieldCache.Load(t); ok {
+		return f.(map[string]bool)
+	}
+	fields := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			for n := range jsonFields(sf.Type) {
+				fields[n] = true
+			}
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		// encoding/json matches field names case insensitively
+		fields[strings.ToLower(name)] = true
+	}
+	jsonFieldCache.Store(t, fields)
+	return fields
+}
+
+// unknownFields returns the fields of the JSON object data that struct type t
+// doesn't have, or nil if there are none
+func unknownFields(data []byte, t reflect.Type) map[string]json.RawMessage {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(data, &obj) != nil {
+		return nil
+	}
+	known := jsonFields(t)
+	var unknown map[string]json.RawMessage
+	for name, v := range obj {
+		if !known[strings.ToLower(name)] {
+			if unknown == nil {
+				unknown = make(map[string]json.RawMessage)
+			}
+			unknown[name] = v
+		}
+	}
+	return unknown
+}
+
+// calibreBookMeta has the fields of CalibreBookMeta, without its JSON methods
+type calibreBookMeta CalibreBookMeta
+
+// UnmarshalJSON decodes book metadata, keeping any fields UNCaGED doesn't know
+// in Extra
+func (m *CalibreBookMeta) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*calibreBookMeta)(m)); err != nil {
+		return err
+	}
+	m.Extra = unknownFields(data, reflect.TypeOf(*m))
+	return nil
+}
+
+// MarshalJSON encodes book metadata, including the fields in Extra
+func (m CalibreBookMeta) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(calibreBookMeta(m))
+	if err != nil || len(m.Extra) == 0 {
+		return data, err
+	}
+	known := jsonFields(reflect.TypeOf(m))
+	names := make([]string, 0, len(m.Extra))
+	for name := range m.Extra {
+		// Known fields are always encoded from the struct
+		if !known[strings.ToLower(name)] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	buf.Write(data[:len(data)-1])
+	for _, name := range names {
+		key, _ := json.Marshal(name)
+		buf.WriteByte(',')
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(m.Extra[name])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// decodePacket decodes the payload of a packet from Calibre into v, warning
+// the client about any fields v doesn't have. In strict mode, the payload is
+// validated first.
+func (c *calConn) decodePacket(op calOpCode, data json.RawMessage, v interface{}) error {
+	if c.clientOpts.StrictPackets {
+		if err := validatePacket(op, data); err != nil {
+			return err
+		}
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	if t := reflect.TypeOf(v); t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct {
+		c.reportUnknown(op.String(), unknownFields(data, t.Elem()))
+	}
+	return nil
+}
+
+// reportUnknown warns the client about unknown fields in part of a packet
+// from Calibre. Each field is only reported once per connection.
+func (c *calConn) reportUnknown(part string, fields map[string]json.RawMessage) {
+	var names []string
+	for name := range fields {
+		key := part + "." + name
+		if !c.unknownSeen[key] {
+			if c.unknownSeen == nil {
+				c.unknownSeen = make(map[string]bool)
+			}
+			c.unknownSeen[key] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+	payload, _ := json.Marshal(fields)
+	c.warn(Warning{
+		Kind:    UnknownFields,
+		Message: fmt.Sprintf("%s has fields UNCaGED doesn't know: %s", part, strings.Join(names, ", ")),
+		Payload: payload,
+	})
+}
@@ -0,0 +1,64 @@
+package uc
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMetadataExtraFields(t *testing.T) {
+	data := `{"uuid":"abc","lpath":"a.epub","title":"Title","new_field":{"a":1},"Another":[1,2]}`
+	var md CalibreBookMeta
+	if err := json.Unmarshal([]byte(data), &md); err != nil {
+		t.Fatal(err)
+	}
+	if md.Title != "Title" || len(md.Extra) != 2 || string(md.Extra["new_field"]) != `{"a":1}` {
+		t.Fatalf("Unexpected metadata %+v, extra %v", md, md.Extra)
+	}
+	out, err := json.Marshal(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(out, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if string(fields["new_field"]) != `{"a":1}` || string(fields["Another"]) != `[1,2]` || string(fields["uuid"]) != `"abc"` {
+		t.Errorf("Extra fields not re-emitted: %s", out)
+	}
+	// Extra can't override known fields
+	md.Extra["title"] = json.RawMessage(`"Other"`)
+	out, _ = json.Marshal(&md)
+	if strings.Contains(string(out), "Other") {
+		t.Errorf("Known field was overridden by Extra: %s", out)
+	}
+	var plain CalibreBookMeta
+	json.Unmarshal([]byte(`{"uuid":"abc","Title":"Title"}`), &plain)
+	if plain.Extra != nil {
+		t.Errorf("Expected no extra fields, got %v", plain.Extra)
+	}
+}
+
+func TestReportUnknown(t *testing.T) {
+	wc := &warnClient{}
+	c := &calConn{client: wc}
+	var bld BookListsDetails
+	for i := 0; i < 2; i++ {
+		if err := c.decodePacket(sendBooklists, json.RawMessage(`{"count":1,"newOption":true,"collections":{}}`), &bld); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bld.Count != 1 {
+		t.Errorf("Packet not decoded: %+v", bld)
+	}
+	if len(wc.warnings) != 1 || wc.warnings[0].Kind != UnknownFields || !strings.Contains(wc.warnings[0].Message, "newOption") {
+		t.Fatalf("Expected a single UnknownFields warning, got %+v", wc.warnings)
+	}
+	if string(wc.warnings[0].Payload) != `{"newOption":true}` {
+		t.Errorf("Unexpected payload %s", wc.warnings[0].Payload)
+	}
+	var libInfo CalibreLibraryInfo
+	if err := c.decodePacket(setLibraryInfo, json.RawMessage(`{"bad`), &libInfo); err == nil {
+		t.Errorf("Expected a decoding error")
+	}
+}
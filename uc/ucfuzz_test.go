@@ -0,0 +1,108 @@
+package uc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+)
+
+// packetTargets creates the value each handler decodes a packet's payload into
+var packetTargets = map[calOpCode]func() interface{}{
+	getInitializationInfo: func() interface{} { return &CalibreInitInfo{} },
+	displayMessage: func() interface{} {
+		return &struct {
+			MessageKind calMsgCode `json:"messageKind"`
+			Message     string     `json:"message"`
+		}{}
+	},
+	setCalibreDeviceInfo: func() interface{} { return &DeviceInfo{} },
+	getBookCount:         func() interface{} { return &BookCountReceive{} },
+	sendBooklists:        func() interface{} { return &BookListsDetails{} },
+	sendBookMetadata:     func() interface{} { return &MetadataUpdate{} },
+	setLibraryInfo:       func() interface{} { return &CalibreLibraryInfo{} },
+	sendBook:             func() interface{} { return &SendBook{} },
+	deleteBook:           func() interface{} { return &DeleteBooks{} },
+	getBookFileSegment:   func() interface{} { return &GetBookReceive{} },
+}
+
+func TestMalformedPackets(t *testing.T) {
+	tests := []string{
+		"",
+		"13",
+		"-5[0,{}]",
+		"1[",
+		"99999999999[0,{}]",
+		"abc[0,{}]",
+		"3[0]",
+		"2[]",
+		"8[\"x\",{}]",
+		"10[0,{},{}]",
+		"7[0,{}]",
+		string(bytes.Repeat([]byte("1"), 5000)),
+	}
+	for _, tt := range tests {
+		c := &calConn{client: logClient{}}
+		c.tcpConn = &replayConn{rd: bytes.NewReader([]byte(tt))}
+		c.tcpReader = bufio.NewReader(c.tcpConn)
+		_, _, err := c.readDecodeCalibrePayload()
+		if err == nil {
+			t.Errorf("Expected an error reading %.20q", tt)
+		} else if err != io.EOF && !errors.Is(err, MalformedPacket) && errorPhase(err) != NetworkPhase {
+			t.Errorf("Expected a malformed packet or network error reading %.20q, got %v", tt, err)
+		}
+	}
+}
+
+func FuzzParsePacketSize(f *testing.F) {
+	for _, seed := range []string{"13", "0", "2", "-1", "+5", "99999999999", "067108864", ""} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, prefix []byte) {
+		sz, err := parsePacketSize(prefix)
+		if err == nil && (sz < 2 || sz > maxPacketSize) {
+			t.Errorf("parsePacketSize(%q) = %d, out of range", prefix, sz)
+		}
+	})
+}
+
+func FuzzDecodeCalibrePayload(f *testing.F) {
+	for _, seed := range []string{`[0,{}]`, `[9,{"calibre_version":[5,0,0]}]`, `[]`, `[9]`, `["a",{}]`, `[1.5,{}]`, `[1,2,3]`, `null`} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		op, data, err := decodeCalibrePayload(payload)
+		if err == nil && data == nil {
+			t.Errorf("decodeCalibrePayload(%q) = %d, nil payload", payload, op)
+		}
+	})
+}
+
+// FuzzReadPacket feeds a stream from Calibre through the packet reader, and
+// decodes each packet as its handler would
+func FuzzReadPacket(f *testing.F) {
+	f.Add([]byte(`6[0,{}]`), false)
+	f.Add([]byte(`31[9,{"calibre_version":[5,0,0]}]16[12,{"count":1}]`), true)
+	f.Add([]byte(`69[8,{"lpath":"a.epub","length":5,"metadata":{"title":"T","uuid":"u"}}]`), true)
+	f.Add([]byte(`35[13,{"lpaths":["a.epub","b.epub"]}]`), false)
+	f.Add([]byte(`66[16,{"index":0,"count":1,"data":{"title":"T","series_index":"x"}}]`), true)
+	f.Fuzz(func(t *testing.T, stream []byte, strict bool) {
+		c := &calConn{client: logClient{}}
+		c.clientOpts.StrictPackets = strict
+		c.tcpConn = &replayConn{rd: bytes.NewReader(stream)}
+		c.tcpReader = bufio.NewReader(c.tcpConn)
+		for i := 0; i < 16; i++ {
+			op, data, err := c.readDecodeCalibrePayload()
+			if err != nil {
+				return
+			}
+			if target, ok := packetTargets[op]; ok {
+				c.decodePacket(op, data, target())
+			}
+			var raw json.RawMessage
+			c.decodePacket(op, data, &raw)
+		}
+	})
+}
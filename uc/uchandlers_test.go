@@ -0,0 +1,292 @@
+package uc_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shermp/UNCaGED/calibre/calibretest"
+	"github.com/shermp/UNCaGED/uc"
+	"github.com/shermp/UNCaGED/uc/uctest"
+)
+
+// startSession starts a UNCaGED session for client against srv, and returns
+// the server side of it, and a channel receiving the result of the session
+func startSession(t *testing.T, srv *calibretest.Server, client *uctest.MockClient) (*calibretest.Session, <-chan error) {
+	client.Options.DirectConnect = srv.ConnectionInfo()
+	ucc, err := uc.New(client, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- ucc.Start() }()
+	ss, err := srv.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ss, done
+}
+
+func TestHandlers(t *testing.T) {
+	srv, err := calibretest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Password = "secret"
+	client := uctest.NewMockClient()
+	client.Passwords = []string{"secret"}
+	client.AddBook(uc.CalibreBookMeta{Lpath: "Old/Book.epub", UUID: "old", Title: "Old Book"}, []byte("old book"))
+	ss, done := startSession(t, srv, client)
+	defer ss.Close()
+
+	if _, err = ss.DeviceInfo("Test Device"); err != nil {
+		t.Fatal(err)
+	}
+	if client.DeviceInfo.DevInfo.DeviceName != "Test Device" {
+		t.Errorf("Expected device info from Calibre to be set, got %+v", client.DeviceInfo.DevInfo)
+	}
+	if space, err := ss.FreeSpace(); err != nil || space != client.FreeSpace {
+		t.Errorf("FreeSpace = %d, %v, want %d", space, err, client.FreeSpace)
+	}
+	book := []byte("not really an epub")
+	lpath, err := ss.SendBook("Author/Title.epub", map[string]interface{}{"title": "Title"}, book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The book count is only answered once the book is saved
+	books, err := ss.BookCount(false)
+	if err != nil || len(books) != 2 || books[0].Lpath != "Author/Title.epub" || books[1].UUID != "old" {
+		t.Errorf("Unexpected books %v: %v", books, err)
+	}
+	if b, ok := client.Book(lpath); !ok || !bytes.Equal(b.Data, book) || b.Meta.Title != "Title" {
+		t.Errorf("Expected book saved at %s, got %+v", lpath, b)
+	}
+	if calls := client.Calls("SaveBook"); len(calls) != 1 || calls[0].Args[2] != true {
+		t.Errorf("Expected one SaveBook call for the last book, got %v", calls)
+	}
+	if got, err := ss.GetBook("Old/Book.epub"); err != nil || string(got) != "old book" {
+		t.Errorf("GetBook = %q, %v", got, err)
+	}
+	if uuids, err := ss.DeleteBooks("Old/Book.epub"); err != nil || len(uuids) != 1 || uuids[0] != "old" {
+		t.Errorf("DeleteBooks = %v, %v", uuids, err)
+	}
+	if books := client.Books(); len(books) != 1 || books[0].Meta.Lpath != lpath {
+		t.Errorf("Expected only %s left, got %v", lpath, books)
+	}
+	ss.Close()
+	if err = <-done; err != nil {
+		t.Errorf("Session failed: %v", err)
+	}
+	if calls := client.Calls("GetPassword"); len(calls) != 1 {
+		t.Errorf("Expected the password asked for once, got %d", len(calls))
+	}
+}
+
+func TestConcurrentQueries(t *testing.T) {
+	srv, err := calibretest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := uctest.NewMockClient()
+	client.Options.DirectConnect = srv.ConnectionInfo()
+	ucc, err := uc.New(client, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- ucc.Start() }()
+	// Query the session the way a UI goroutine would, while books are sent
+	stop := make(chan struct{})
+	queried := make(chan struct{})
+	go func() {
+		defer close(queried)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			ucc.Stats()
+			ucc.Bandwidth()
+			ucc.CalibreInfo()
+			ucc.LastConnected()
+			ucc.AllBooks()
+			ucc.BookByLpath("Author/Title.epub")
+		}
+	}()
+	ss, err := srv.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ss.DeviceInfo("Test Device"); err != nil {
+		t.Fatal(err)
+	}
+	for _, lpath := range []string{"Author/Title.epub", "Author/Other.epub"} {
+		if _, err = ss.SendBook(lpath, nil, bytes.Repeat([]byte("x"), 64*1024)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = ss.BookCount(true); err != nil {
+		t.Fatal(err)
+	}
+	ss.Close()
+	if err = <-done; err != nil {
+		t.Errorf("Session failed: %v", err)
+	}
+	close(stop)
+	<-queried
+	if stats := ucc.Stats(); stats.BooksReceived != 2 {
+		t.Errorf("Expected 2 books received, got %+v", stats)
+	}
+}
+
+// refusingClient refuses books with lpaths in refuse
+type refusingClient struct {
+	*uctest.MockClient
+	refuse map[string]bool
+}
+
+func (rc refusingClient) AcceptBook(book uc.SendBook) error {
+	if rc.refuse[book.Lpath] {
+		return errors.New("unwanted")
+	}
+	return nil
+}
+
+func TestRefusedBook(t *testing.T) {
+	srv, err := calibretest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	mock := uctest.NewMockClient()
+	mock.Options.DirectConnect = srv.ConnectionInfo()
+	ucc, err := uc.New(refusingClient{mock, map[string]bool{"Refused.epub": true}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- ucc.Start() }()
+	ss, err := srv.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+	// Calibre carries on with the batch after a refused book
+	for _, lpath := range []string{"Refused.epub", "Accepted.epub"} {
+		if _, err = ss.SendBook(lpath, nil, []byte("not really an epub")); err != nil {
+			t.Fatalf("Sending %s: %v", lpath, err)
+		}
+	}
+	if books, err := ss.BookCount(false); err != nil || len(books) != 1 || books[0].Lpath != "Accepted.epub" {
+		t.Errorf("Expected only the accepted book on the device, got %v: %v", books, err)
+	}
+	ss.Close()
+	if err = <-done; err != nil {
+		t.Errorf("Session failed: %v", err)
+	}
+}
+
+func TestAutoReconnect(t *testing.T) {
+	srv, err := calibretest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Password = "secret"
+	client := uctest.NewMockClient()
+	client.Passwords = []string{"secret"}
+	client.Options.DirectConnect = srv.ConnectionInfo()
+	client.Options.AutoReconnect = true
+	ucc, err := uc.New(client, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- ucc.StartContext(ctx) }()
+	ss, err := srv.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ss.DeviceInfo("Test Device"); err != nil {
+		t.Fatal(err)
+	}
+	lpath, err := ss.SendBook("Author/Title.epub", nil, []byte("not really an epub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Drop the connection mid-session, as Calibre does when the device is ejected
+	ss.Close()
+	if ss, err = srv.Accept(); err != nil {
+		t.Fatalf("Expected UNCaGED to reconnect: %v", err)
+	}
+	defer ss.Close()
+	if books, err := ss.BookCount(false); err != nil || len(books) != 1 || books[0].Lpath != lpath {
+		t.Errorf("Expected %s still on the device after reconnecting, got %v: %v", lpath, books, err)
+	}
+	if calls := client.Calls("GetPassword", "GetDeviceBookList"); len(calls) != 2 {
+		t.Errorf("Expected the password and book list fetched once, got %v", calls)
+	}
+	if stats := ucc.Stats(); stats.BooksReceived != 1 {
+		t.Errorf("Expected session stats kept across the reconnect, got %+v", stats)
+	}
+	cancel()
+	if err = <-done; err != nil {
+		t.Errorf("Session failed: %v", err)
+	}
+}
+
+func TestCalibreBusy(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		wantErr  error
+	}{
+		{"retried", 3, nil},
+		{"gave up", 1, uc.BusyTimeout},
+	}
+	for _, tt := range tests {
+		srv, err := calibretest.NewServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		client := uctest.NewMockClient()
+		client.Options.BusyRetry = uc.RetryPolicy{Attempts: tt.attempts, InitialDelay: 10 * time.Millisecond}
+		ss, done := startSession(t, srv, client)
+		// Calibre says it is busy, then closes the connection
+		if err = ss.Send(calibretest.OpCalibreBusy, map[string]interface{}{}); err != nil {
+			t.Fatal(err)
+		}
+		ss.Close()
+		if tt.wantErr != nil {
+			if err = <-done; !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: expected %v, got %v", tt.name, tt.wantErr, err)
+			}
+			continue
+		}
+		if ss, err = srv.Accept(); err != nil {
+			t.Fatalf("%s: expected UNCaGED to reconnect: %v", tt.name, err)
+		}
+		if _, err = ss.DeviceInfo("Test Device"); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		ss.Close()
+		if err = <-done; err != nil {
+			t.Errorf("%s: session failed: %v", tt.name, err)
+		}
+		busy := false
+		for _, call := range client.Calls("UpdateStatus") {
+			busy = busy || call.Args[0] == uc.CalibreBusy
+		}
+		if !busy {
+			t.Errorf("%s: expected the CalibreBusy status reported", tt.name)
+		}
+	}
+}
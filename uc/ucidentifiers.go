@@ -0,0 +1,105 @@
+package uc
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// identifierURLs are the URL templates Calibre uses to link to a book's
+// identifiers, with %s replaced by the (escaped) identifier value
+var identifierURLs = map[string]struct{ name, template string }{
+	"isbn":      {"ISBN", "https://www.worldcat.org/isbn/%s"},
+	"issn":      {"ISSN", "https://www.worldcat.org/issn/%s"},
+	"oclc":      {"OCLC", "https://www.worldcat.org/oclc/%s"},
+	"doi":       {"DOI", "https://dx.doi.org/%s"},
+	"arxiv":     {"arXiv", "https://arxiv.org/abs/%s"},
+	"amazon":    {"Amazon", "https://www.amazon.com/dp/%s"},
+	"mobi-asin": {"Amazon", "https://www.amazon.com/dp/%s"},
+	"amazon_uk": {"Amazon UK", "https://www.amazon.co.uk/dp/%s"},
+	"amazon_de": {"Amazon DE", "https://www.amazon.de/dp/%s"},
+	"amazon_fr": {"Amazon FR", "https://www.amazon.fr/dp/%s"},
+	"amazon_it": {"Amazon IT", "https://www.amazon.it/dp/%s"},
+	"amazon_es": {"Amazon ES", "https://www.amazon.es/dp/%s"},
+	"amazon_jp": {"Amazon JP", "https://www.amazon.co.jp/dp/%s"},
+	"amazon_ca": {"Amazon CA", "https://www.amazon.ca/dp/%s"},
+	"google":    {"Google Books", "https://books.google.com/books?id=%s"},
+	"goodreads": {"Goodreads", "https://www.goodreads.com/book/show/%s"},
+	"isfdb":     {"ISFDB", "http://www.isfdb.org/cgi-bin/pl.cgi?%s"},
+	"edelweiss": {"Edelweiss", "https://www.edelweiss.plus/#sku=%s&page=1"},
+}
+
+// IdentifierURL is a link to a book on a site Calibre knows about
+type IdentifierURL struct {
+	Scheme string
+	Name   string
+	URL    string
+}
+
+// Identifier returns the value of the identifier with the provided scheme
+// (such as "isbn" or "goodreads"), or the empty string if it isn't set
+func (m *CalibreBookMeta) Identifier(scheme string) string {
+	return strings.TrimSpace(m.Identifiers[strings.ToLower(scheme)])
+}
+
+// ISBN returns the book's ISBN without any hyphens or spaces, or the empty
+// string if it doesn't have one
+func (m *CalibreBookMeta) ISBN() string {
+	return strings.NewReplacer("-", "", " ", "").Replace(m.Identifier("isbn"))
+}
+
+// ASIN returns the book's Amazon ASIN, or the empty string if it doesn't have
+// one. Calibre stores ASINs read from MOBI files as "mobi-asin".
+func (m *CalibreBookMeta) ASIN() string {
+	if asin := m.Identifier("amazon"); asin != "" {
+		return asin
+	}
+	return m.Identifier("mobi-asin")
+}
+
+// IdentifierURLs returns links for the book's identifiers, sorted by scheme.
+// Identifiers Calibre has no URL template for are left out, except for "url"
+// identifiers which are links already. Only one Amazon link is returned if the
+// book has both an "amazon" and "mobi-asin" identifier.
+func (m *CalibreBookMeta) IdentifierURLs() []IdentifierURL {
+	var urls []IdentifierURL
+	for scheme, value := range m.Identifiers {
+		scheme, value = strings.ToLower(scheme), strings.TrimSpace(value)
+		if value == "" || (scheme == "mobi-asin" && m.Identifier("amazon") != "") {
+			continue
+		}
+		if scheme == "url" {
+			urls = append(urls, IdentifierURL{Scheme: scheme, Name: "URL", URL: value})
+			continue
+		}
+		tmpl, ok := identifierURLs[scheme]
+		if !ok {
+			continue
+		}
+		if scheme == "isbn" {
+			value = m.ISBN()
+		}
+		u := strings.Replace(tmpl.template, "%s", url.PathEscape(value), 1)
+		urls = append(urls, IdentifierURL{Scheme: scheme, Name: tmpl.name, URL: u})
+	}
+	sort.Slice(urls, func(i, j int) bool { return urls[i].Scheme < urls[j].Scheme })
+	return urls
+}
+
+// MergeIdentifiers adds ids to the book's identifiers. If overwrite is false,
+// identifiers the book already has are kept. Empty values are ignored.
+func (m *CalibreBookMeta) MergeIdentifiers(ids map[string]string, overwrite bool) {
+	for scheme, value := range ids {
+		scheme, value = strings.ToLower(scheme), strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if m.Identifiers == nil {
+			m.Identifiers = make(map[string]string)
+		}
+		if _, exists := m.Identifiers[scheme]; exists && !overwrite {
+			continue
+		}
+		m.Identifiers[scheme] = value
+	}
+}
@@ -0,0 +1,51 @@
+package uc
+
+import "testing"
+
+func TestIdentifiers(t *testing.T) {
+	md := CalibreBookMeta{Identifiers: map[string]string{
+		"isbn":      "978-0-14-044913-6",
+		"mobi-asin": "B000FC0PDA",
+		"goodreads": "1234",
+		"url":       "https://example.com/book",
+		"unknown":   "xyz",
+		"google":    "",
+	}}
+	if md.ISBN() != "9780140449136" {
+		t.Errorf("Unexpected ISBN %q", md.ISBN())
+	}
+	if md.ASIN() != "B000FC0PDA" {
+		t.Errorf("Expected ASIN from mobi-asin, got %q", md.ASIN())
+	}
+	want := []IdentifierURL{
+		{"goodreads", "Goodreads", "https://www.goodreads.com/book/show/1234"},
+		{"isbn", "ISBN", "https://www.worldcat.org/isbn/9780140449136"},
+		{"mobi-asin", "Amazon", "https://www.amazon.com/dp/B000FC0PDA"},
+		{"url", "URL", "https://example.com/book"},
+	}
+	got := md.IdentifierURLs()
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d URLs, got %v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Got %+v, want %+v", got[i], want[i])
+		}
+	}
+	md.MergeIdentifiers(map[string]string{"Amazon": "B00ABC", "isbn": "123", "doi": " "}, false)
+	if md.ASIN() != "B00ABC" || md.Identifier("isbn") != "978-0-14-044913-6" || md.Identifier("doi") != "" {
+		t.Errorf("Unexpected identifiers after merge: %v", md.Identifiers)
+	}
+	if urls := md.IdentifierURLs(); len(urls) != 4 || urls[0].Scheme != "amazon" {
+		t.Errorf("Expected a single Amazon link, got %v", urls)
+	}
+	md.MergeIdentifiers(map[string]string{"isbn": "123"}, true)
+	if md.ISBN() != "123" {
+		t.Errorf("Expected ISBN to be overwritten, got %q", md.ISBN())
+	}
+	var empty CalibreBookMeta
+	empty.MergeIdentifiers(map[string]string{"isbn": "123"}, false)
+	if empty.ISBN() != "123" {
+		t.Errorf("Expected identifiers to be initialized by merge")
+	}
+}
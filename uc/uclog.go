@@ -0,0 +1,153 @@
+package uc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// opcodeNames are the names Calibre uses for each opcode
+var opcodeNames = map[calOpCode]string{
+	noop:                  "NOOP",
+	ok:                    "OK",
+	bookData:              "BOOK_DATA",
+	bookDone:              "BOOK_DONE",
+	calibreBusy:           "CALIBRE_BUSY",
+	setLibraryInfo:        "SET_LIBRARY_INFO",
+	deleteBook:            "DELETE_BOOK",
+	errorOp:               "ERROR",
+	displayMessage:        "DISPLAY_MESSAGE",
+	freeSpace:             "FREE_SPACE",
+	getBookFileSegment:    "GET_BOOK_FILE_SEGMENT",
+	getBookMetadata:       "GET_BOOK_METADATA",
+	getBookCount:          "GET_BOOK_COUNT",
+	getDeviceInformation:  "GET_DEVICE_INFORMATION",
+	getInitializationInfo: "GET_INITIALIZATION_INFO",
+	sendBooklists:         "SEND_BOOKLISTS",
+	sendBook:              "SEND_BOOK",
+	sendBookMetadata:      "SEND_BOOK_METADATA",
+	setCalibreDeviceInfo:  "SET_CALIBRE_DEVICE_INFO",
+	setCalibreDeviceName:  "SET_CALIBRE_DEVICE_NAME",
+	totalSpace:            "TOTAL_SPACE",
+}
+
+func (op calOpCode) String() string {
+	if name, exists := opcodeNames[op]; exists {
+		return name
+	}
+	return fmt.Sprintf("OPCODE_%d", int(op))
+}
+
+// LogContext describes the operation UNCaGED was performing when a message was
+// logged, allowing clients to group log output by operation
+type LogContext struct {
+	// Opcode is the name of the Calibre request being processed, or empty
+	// outside of a request
+	Opcode string
+	// Lpath is the book being processed, if any
+	Lpath string
+	// Index and Total are the position of the book in a batch of books. Total
+	// is zero outside of a batch.
+	Index int
+	Total int
+}
+
+// String formats the context as a log message prefix, such as
+// "[SEND_BOOK 2/10 author/book.epub] "
+func (lc LogContext) String() string {
+	if lc.Opcode == "" {
+		return ""
+	}
+	parts := []string{lc.Opcode}
+	if lc.Total > 0 {
+		parts = append(parts, fmt.Sprintf("%d/%d", lc.Index+1, lc.Total))
+	}
+	if lc.Lpath != "" {
+		parts = append(parts, lc.Lpath)
+	}
+	return "[" + strings.Join(parts, " ") + "] "
+}
+
+// attrs returns the context as structured log attributes, leaving out unset fields
+func (lc LogContext) attrs() []slog.Attr {
+	var attrs []slog.Attr
+	if lc.Opcode != "" {
+		attrs = append(attrs, slog.String("opcode", lc.Opcode))
+	}
+	if lc.Total > 0 {
+		attrs = append(attrs, slog.Int("index", lc.Index), slog.Int("total", lc.Total))
+	}
+	if lc.Lpath != "" {
+		attrs = append(attrs, slog.String("lpath", lc.Lpath))
+	}
+	return attrs
+}
+
+// slogLevels maps UNCaGED log levels to slog levels
+var slogLevels = map[LogLevel]slog.Level{
+	Info:  slog.LevelInfo,
+	Warn:  slog.LevelWarn,
+	Debug: slog.LevelDebug,
+}
+
+// ContextLogger may optionally be implemented by a Client to receive log messages
+// along with the context they were logged in. Clients that do not implement it
+// receive messages via LogPrintf, prefixed with the context.
+type ContextLogger interface {
+	LogContextPrintf(ctx LogContext, logLevel LogLevel, format string, a ...interface{})
+}
+
+// setLogOp starts a new log context for the request op
+func (c *calConn) setLogOp(op calOpCode) {
+	c.logCtx = LogContext{Opcode: op.String()}
+}
+
+// setLogBook sets the book being processed in the current log context. Pass
+// a total of zero for books that aren't part of a batch.
+func (c *calConn) setLogBook(lpath string, index, total int) {
+	c.logCtx.Lpath, c.logCtx.Index, c.logCtx.Total = lpath, index, total
+}
+
+// logf sends a message to the client log, along with the current log context
+func (c *calConn) logf(logLevel LogLevel, format string, a ...interface{}) {
+	if c.clientOpts.Logger != nil {
+		msg := strings.TrimSuffix(fmt.Sprintf(format, a...), "\n")
+		c.clientOpts.Logger.LogAttrs(context.Background(), slogLevels[logLevel], msg, c.logCtx.attrs()...)
+		return
+	}
+	tag := ""
+	switch logLevel {
+	case Warn:
+		tag = "[WARN] "
+	case Debug:
+		tag = "[DEBUG] "
+	}
+	if cl, ok := c.client.(ContextLogger); ok {
+		cl.LogContextPrintf(c.logCtx, logLevel, tag+format, a...)
+		return
+	}
+	c.client.LogPrintf(logLevel, tag+c.logCtx.String()+format, a...)
+}
+
+// logAttrs logs msg with structured attributes. Clients without a Logger receive
+// the attributes formatted as key=value pairs after msg.
+func (c *calConn) logAttrs(logLevel LogLevel, msg string, attrs ...slog.Attr) {
+	if c.clientOpts.Logger != nil {
+		c.clientOpts.Logger.LogAttrs(context.Background(), slogLevels[logLevel], msg, append(c.logCtx.attrs(), attrs...)...)
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for _, a := range attrs {
+		sb.WriteString(" " + a.String())
+	}
+	c.logf(logLevel, "%s\n", sb.String())
+}
+
+// debugAttrs is logAttrs for debug messages, which are only logged with debugging enabled
+func (c *calConn) debugAttrs(msg string, attrs ...slog.Attr) {
+	if c.debug {
+		c.logAttrs(Debug, msg, attrs...)
+	}
+}
@@ -0,0 +1,64 @@
+package uc
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"testing"
+)
+
+func TestLogContextString(t *testing.T) {
+	tests := []struct {
+		lc   LogContext
+		want string
+	}{
+		{LogContext{}, ""},
+		{LogContext{Opcode: sendBooklists.String()}, "[SEND_BOOKLISTS] "},
+		{LogContext{Opcode: sendBook.String(), Lpath: "a/b.epub", Index: 1, Total: 10}, "[SEND_BOOK 2/10 a/b.epub] "},
+		{LogContext{Opcode: getBookFileSegment.String(), Lpath: "a/b.epub"}, "[GET_BOOK_FILE_SEGMENT a/b.epub] "},
+		{LogContext{Opcode: calOpCode(99).String()}, "[OPCODE_99] "},
+	}
+	for _, tt := range tests {
+		if got := tt.lc.String(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+// bufClient records LogPrintf output
+type bufClient struct {
+	logClient
+	buf *bytes.Buffer
+}
+
+func (bc bufClient) LogPrintf(logLevel LogLevel, format string, a ...interface{}) {
+	fmt.Fprintf(bc.buf, format, a...)
+}
+
+func TestLogAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	c := &calConn{client: bufClient{buf: &buf}, debug: true}
+	c.setLogOp(sendBook)
+	c.setLogBook("a/b.epub", 0, 2)
+	c.debugAttrs("Received book", slog.Int("bytes", 42))
+	if want := "[DEBUG] [SEND_BOOK 1/2 a/b.epub] Received book bytes=42\n"; buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+	buf.Reset()
+	c.clientOpts.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	c.debugAttrs("Received book", slog.Int("bytes", 42))
+	c.logf(Warn, "Low space\n")
+	want := "level=DEBUG msg=\"Received book\" opcode=SEND_BOOK index=0 total=2 lpath=a/b.epub bytes=42\n" +
+		"level=WARN msg=\"Low space\" opcode=SEND_BOOK index=0 total=2 lpath=a/b.epub\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
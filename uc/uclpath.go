@@ -0,0 +1,88 @@
+package uc
+
+import (
+	"strings"
+)
+
+// lpathReserved replaces characters that can't be used in file names on the
+// filesystems e-readers commonly use
+var lpathReserved = strings.NewReplacer(
+	`<`, "_", `>`, "_", `:`, "_", `"`, "_", `|`, "_", `?`, "_", `*`, "_",
+)
+
+// reservedNames are file names Windows (and FAT) won't create
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeLpath returns a version of lpath that is safe to join onto the
+// directory books are stored in. Absolute paths, drive letters and "." or ".."
+// elements are removed, so the lpath can't point outside the book directory.
+// Backslashes are treated as path separators. Characters FAT filesystems
+// don't allow, and control characters, are replaced with "_", as are names
+// Windows reserves for devices.
+//
+// SanitizeLpath is used for clients that don't implement LpathChecker.
+// Clients implementing it should usually call SanitizeLpath themselves.
+func SanitizeLpath(lpath string) string {
+	lpath = strings.ReplaceAll(lpath, `\`, "/")
+	// Drive letters, eg: "C:/books"
+	if len(lpath) >= 2 && lpath[1] == ':' && isASCIILetter(lpath[0]) {
+		lpath = lpath[2:]
+	}
+	var elems []string
+	for _, elem := range strings.Split(lpath, "/") {
+		elem = strings.Map(func(r rune) rune {
+			if r < 0x20 || r == 0x7f {
+				return '_'
+			}
+			return r
+		}, lpathReserved.Replace(elem))
+		// Windows silently drops trailing dots and spaces
+		elem = strings.TrimRight(elem, ". ")
+		if elem == "" {
+			continue
+		}
+		if base, _, _ := strings.Cut(elem, "."); reservedNames[strings.ToUpper(base)] {
+			elem = "_" + elem
+		}
+		elems = append(elems, elem)
+	}
+	if len(elems) == 0 {
+		return "_"
+	}
+	return strings.Join(elems, "/")
+}
+
+// lpathEscapes returns true if lpath could point outside the book directory,
+// because it's absolute, starts with a drive letter or has a ".." element
+func lpathEscapes(lpath string) bool {
+	lpath = strings.ReplaceAll(lpath, `\`, "/")
+	if strings.HasPrefix(lpath, "/") || (len(lpath) >= 2 && lpath[1] == ':' && isASCIILetter(lpath[0])) {
+		return true
+	}
+	for _, elem := range strings.Split(lpath, "/") {
+		if elem == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func isASCIILetter(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// checkLpath returns the lpath a book to be received should be stored under,
+// asking the client if it implements LpathChecker, and sanitizing the lpath
+// otherwise
+func (c *calConn) checkLpath(lpath string) string {
+	if lc, ok := c.client.(LpathChecker); ok {
+		return lc.CheckLpath(lpath)
+	}
+	return SanitizeLpath(lpath)
+}
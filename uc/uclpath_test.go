@@ -0,0 +1,106 @@
+package uc
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSanitizeLpath(t *testing.T) {
+	tests := []struct {
+		lpath, want string
+	}{
+		{"Author/Title.epub", "Author/Title.epub"},
+		{"../../etc/passwd", "etc/passwd"},
+		{"/etc/passwd", "etc/passwd"},
+		{`..\..\Windows\win.ini`, "Windows/win.ini"},
+		{"C:/books/Title.epub", "books/Title.epub"},
+		{"Author/./Title: Part 2?.epub", "Author/Title_ Part 2_.epub"},
+		{"Author./Title.epub ", "Author/Title.epub"},
+		{"Author/CON.epub", "Author/_CON.epub"},
+		{"Author/Title\x00.epub", "Author/Title_.epub"},
+		{"../..", "_"},
+	}
+	for _, tt := range tests {
+		if got := SanitizeLpath(tt.lpath); got != tt.want {
+			t.Errorf("SanitizeLpath(%q) = %q, want %q", tt.lpath, got, tt.want)
+		}
+	}
+}
+
+func TestLpathEscapes(t *testing.T) {
+	tests := []struct {
+		lpath   string
+		escapes bool
+	}{
+		{"Author/Title.epub", false},
+		{"Author/Title: Part 2?.epub", false},
+		{"Author/CON.epub", false},
+		{"Author/..Title.epub", false},
+		{"../escape.epub", true},
+		{`Author\..\..\escape.epub`, true},
+		{"/etc/passwd", true},
+		{"C:/books/Title.epub", true},
+	}
+	for _, tt := range tests {
+		if got := lpathEscapes(tt.lpath); got != tt.escapes {
+			t.Errorf("lpathEscapes(%q) = %v, want %v", tt.lpath, got, tt.escapes)
+		}
+	}
+}
+
+// plainSaver saves books with SaveBookDetails, leaving lpaths to UNCaGED
+type plainSaver struct {
+	logClient
+	details *BookDetails
+}
+
+func (ps plainSaver) SaveBookDetails(details BookDetails, book io.Reader) error {
+	*ps.details = details
+	_, err := io.CopyN(ioutil.Discard, book, int64(details.Length))
+	return err
+}
+
+func TestUnsafeLpath(t *testing.T) {
+	const payload = `{"lpath":%[1]q,"length":10,"totalBooks":1,"thisBook":0,"willStreamBinary":true,` +
+		`"canSupportLpathChanges":%[2]s,"wantsSendOkToSendbook":true,"metadata":{"lpath":%[1]q,"uuid":"abc","title":"T"}}`
+	tests := []struct {
+		lpath     string
+		canChange string
+		saved     string
+	}{
+		{"../escape.epub", "true", "escape.epub"},
+		{"../escape.epub", "false", ""},
+		// Characters some filesystems don't allow are left to the client
+		{"Title: Part 2?.epub", "false", "Title: Part 2?.epub"},
+	}
+	for _, tt := range tests {
+		var details BookDetails
+		wc := &warnClient{}
+		c := newTestConn(struct {
+			plainSaver
+			WarningReporter
+		}{plainSaver{details: &details}, wc}, "0123456789")
+		c.features.lpathChanges = true
+		if err := c.sendBook([]byte(fmt.Sprintf(payload, tt.lpath, tt.canChange))); err != nil {
+			t.Fatal(err)
+		}
+		if details.Metadata.Lpath != tt.saved {
+			t.Errorf("%s, canSupportLpathChanges %s: expected book saved as %q, got %q", tt.lpath, tt.canChange, tt.saved, details.Metadata.Lpath)
+		}
+		if tt.saved == "" {
+			// Calibre carries on with the batch after an OK, so the book
+			// has to be read and thrown away
+			if rest, _ := ioutil.ReadAll(c.tcpReader); len(rest) != 0 {
+				t.Errorf("Expected refused book to be discarded, got %q left", rest)
+			}
+			if c.ucdb.length() != 0 {
+				t.Errorf("Expected refused book left out of the booklist")
+			}
+			if len(wc.warnings) != 1 || wc.warnings[0].Kind != BookRefused {
+				t.Errorf("Expected a BookRefused warning, got %+v", wc.warnings)
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package uc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// MetadataCache keeps the full metadata Calibre sends with each book, and with
+// metadata updates, between sessions. When Calibre asks for the metadata of books
+// on the device, cached metadata is sent, and GetMetadataIter is only called
+// for books that aren't in the cache. Clients with a slow metadata store can
+// provide one in ClientOptions.
+type MetadataCache interface {
+	// Get returns the metadata of the book at lpath
+	Get(lpath string) (CalibreBookMeta, bool)
+	// Put adds or replaces the metadata of the book at md.Lpath
+	Put(md CalibreBookMeta)
+	// Remove removes the book at lpath from the cache
+	Remove(lpath string)
+	// Save persists the cache
+	Save() error
+}
+
+// FileMetadataCache is a MetadataCache persisted as a JSON file. It is intended
+// to be stored alongside the client's metadata.
+type FileMetadataCache struct {
+	path string
+	mu   sync.Mutex
+	md   map[string]CalibreBookMeta // lpath -> metadata
+}
+
+// NewFileMetadataCache creates a FileMetadataCache saved at path, loading any
+// existing contents
+func NewFileMetadataCache(path string) (*FileMetadataCache, error) {
+	mc := &FileMetadataCache{path: path, md: make(map[string]CalibreBookMeta)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return mc, nil
+		}
+		return nil, fmt.Errorf("NewFileMetadataCache: error reading cache: %w", err)
+	}
+	if len(data) == 0 {
+		return mc, nil
+	}
+	if err = json.Unmarshal(data, &mc.md); err != nil {
+		return nil, fmt.Errorf("NewFileMetadataCache: error decoding cache: %w", err)
+	}
+	return mc, nil
+}
+
+// Get returns the metadata of the book at lpath
+func (mc *FileMetadataCache) Get(lpath string) (CalibreBookMeta, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	md, exists := mc.md[lpath]
+	return md, exists
+}
+
+// Put adds or replaces the metadata of the book at md.Lpath
+func (mc *FileMetadataCache) Put(md CalibreBookMeta) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.md[md.Lpath] = md
+}
+
+// Remove removes the book at lpath from the cache
+func (mc *FileMetadataCache) Remove(lpath string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	delete(mc.md, lpath)
+}
+
+// Save writes the cache to its file
+func (mc *FileMetadataCache) Save() error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	data, err := json.Marshal(mc.md)
+	if err != nil {
+		return fmt.Errorf("Save: error encoding cache: %w", err)
+	}
+	// Write to a temporary file first, so a failed save doesn't lose the cache
+	tmp := mc.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("Save: error writing cache: %w", err)
+	}
+	if err = os.Rename(tmp, mc.path); err != nil {
+		return fmt.Errorf("Save: error replacing cache: %w", err)
+	}
+	return nil
+}
+
+// cacheMetadata adds metadata from Calibre to the cache, if there is one
+func (c *calConn) cacheMetadata(md ...CalibreBookMeta) {
+	if c.clientOpts.MetadataCache == nil {
+		return
+	}
+	for _, m := range md {
+		c.clientOpts.MetadataCache.Put(m)
+	}
+}
+
+// uncacheMetadata removes a book from the cache, if there is one
+func (c *calConn) uncacheMetadata(lpath string) {
+	if c.clientOpts.MetadataCache != nil {
+		c.clientOpts.MetadataCache.Remove(lpath)
+	}
+}
+
+// saveMetadataCache saves the cache, if there is one
+func (c *calConn) saveMetadataCache() {
+	if c.clientOpts.MetadataCache == nil {
+		return
+	}
+	if err := c.clientOpts.MetadataCache.Save(); err != nil {
+		c.logf(Warn, "saveMetadataCache: error saving metadata cache: %v\n", err)
+	}
+}
+
+// metadataIter returns an iterator over the metadata of books, or of every book
+// on the device if books is empty. Cached metadata is used where possible, and
+// only the remaining books are requested from the client.
+func (c *calConn) metadataIter(books []BookID) MetadataIter {
+	cache := c.clientOpts.MetadataCache
+	if cache == nil {
+		return c.client.GetMetadataIter(books)
+	}
+	if len(books) == 0 {
+		for _, b := range c.ucdb.booklist {
+			books = append(books, b.bookID())
+		}
+	}
+	cached := &sliceIter{pos: -1}
+	var uncached []BookID
+	for _, b := range books {
+		if md, exists := cache.Get(b.Lpath); exists && (b.UUID == "" || b.UUID == md.UUID) {
+			cached.md = append(cached.md, md)
+		} else {
+			uncached = append(uncached, b)
+		}
+	}
+	c.LogPrintf("metadataIter: %d books cached, %d requested from client\n", len(cached.md), len(uncached))
+	if len(uncached) == 0 {
+		return cached
+	}
+	return &chainIter{iters: []MetadataIter{cached, c.client.GetMetadataIter(uncached)}}
+}
+
+// chainIter iterates over several MetadataIters in turn
+type chainIter struct {
+	iters []MetadataIter
+}
+
+func (it *chainIter) Next() bool {
+	for len(it.iters) > 0 {
+		if it.iters[0].Next() {
+			return true
+		}
+		it.iters = it.iters[1:]
+	}
+	return false
+}
+
+func (it *chainIter) Count() int {
+	n := 0
+	for _, i := range it.iters {
+		n += i.Count()
+	}
+	return n
+}
+
+func (it *chainIter) Get() (CalibreBookMeta, error) {
+	return it.iters[0].Get()
+}
@@ -0,0 +1,74 @@
+package uc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// iterClient records the books it is asked for metadata for
+type iterClient struct {
+	logClient
+	requested *[]BookID
+	unknown   map[string]bool
+}
+
+func (ic iterClient) GetMetadataIter(books []BookID) MetadataIter {
+	*ic.requested = append(*ic.requested, books...)
+	it := &sliceIter{pos: -1}
+	for _, b := range books {
+		if ic.unknown[b.Lpath] {
+			continue
+		}
+		it.md = append(it.md, CalibreBookMeta{Lpath: b.Lpath, Title: "from client"})
+	}
+	return it
+}
+
+func TestMetadataCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uncaged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata.json")
+	mc, err := NewFileMetadataCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requested []BookID
+	c := &calConn{client: iterClient{requested: &requested}, ucdb: &UncagedDB{}}
+	c.clientOpts.MetadataCache = mc
+	c.ucdb.initDB([]BookCountDetails{{UUID: "abc", Lpath: "a.epub"}, {UUID: "def", Lpath: "b.epub"}, {Lpath: "c.epub"}})
+	c.cacheMetadata(CalibreBookMeta{UUID: "abc", Lpath: "a.epub", Title: "cached"}, CalibreBookMeta{UUID: "old", Lpath: "b.epub"})
+	c.saveMetadataCache()
+	// The cache is replaced in one go, rather than written in place
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary file renamed, got %v", err)
+	}
+	if c.clientOpts.MetadataCache, err = NewFileMetadataCache(path); err != nil {
+		t.Fatal(err)
+	}
+	it := c.metadataIter(nil)
+	if it.Count() != 3 {
+		t.Errorf("Expected 3 books, got %d", it.Count())
+	}
+	var titles []string
+	for it.Next() {
+		md, _ := it.Get()
+		titles = append(titles, md.Lpath+":"+md.Title)
+	}
+	if len(titles) != 3 || titles[0] != "a.epub:cached" || titles[1] != "b.epub:from client" || titles[2] != "c.epub:from client" {
+		t.Errorf("Unexpected metadata %v", titles)
+	}
+	// b.epub's cached metadata is for a different book
+	if len(requested) != 2 || requested[0].Lpath != "b.epub" || requested[1].Lpath != "c.epub" {
+		t.Errorf("Expected b.epub and c.epub requested from the client, got %v", requested)
+	}
+	requested = nil
+	c.uncacheMetadata("b.epub")
+	if it = c.metadataIter([]BookID{{Lpath: "a.epub"}}); it.Count() != 1 || len(requested) != 0 {
+		t.Errorf("Expected a.epub from the cache only")
+	}
+}
@@ -0,0 +1,103 @@
+package uc
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+)
+
+// MetadataDiff describes how a metadata update changed a book
+type MetadataDiff struct {
+	Lpath string
+	// Previous is the book's metadata before the update, or nil if it is not
+	// available. It is found by UUID if the book moved to a new lpath.
+	Previous *CalibreBookMeta
+	// Changed are the JSON names of the changed fields, such as "title" or
+	// "series_index". Changed custom columns are listed by their lookup name,
+	// such as "#genre". Changed is nil if the book's previous metadata is not
+	// available, in which case every field should be treated as changed.
+	Changed []string
+}
+
+// MetadataDiffUpdater may optionally be implemented by a Client that stores
+// metadata by field, such as in a device database. When Calibre sends updated
+// metadata, UpdateMetadataDiff is called instead of UpdateMetadata, with the
+// fields changed in each book, and its previous metadata. The previous metadata
+// is taken from the MetadataCache if there is one, otherwise from GetMetadataIter.
+type MetadataDiffUpdater interface {
+	// UpdateMetadataDiff is UpdateMetadata, with a diff for each book in mdList
+	UpdateMetadataDiff(mdList []CalibreBookMeta, diffs []MetadataDiff) error
+}
+
+// metadataDiffs compares updated metadata with the metadata previously on the device
+func (c *calConn) metadataDiffs(mdList []CalibreBookMeta) []MetadataDiff {
+	books := make([]BookID, 0, len(mdList))
+	for _, md := range mdList {
+		books = append(books, BookID{Lpath: md.Lpath, UUID: md.UUID})
+		// The book may have been stored at another lpath
+		if _, bd, err := c.ucdb.find(UUID, md.UUID); err == nil && md.UUID != "" && bd.Lpath != md.Lpath {
+			books = append(books, bd.bookID())
+		}
+	}
+	prev := make(map[string]CalibreBookMeta, len(books))
+	prevByUUID := make(map[string]CalibreBookMeta, len(books))
+	for it := c.metadataIter(books); it.Next(); {
+		md, err := it.Get()
+		if err != nil {
+			c.logf(Warn, "metadataDiffs: error retrieving previous metadata: %v\n", err)
+			break
+		}
+		prev[md.Lpath] = md
+		if md.UUID != "" {
+			prevByUUID[md.UUID] = md
+		}
+	}
+	diffs := make([]MetadataDiff, len(mdList))
+	for i, md := range mdList {
+		diffs[i].Lpath = md.Lpath
+		old, exists := prev[md.Lpath]
+		if !exists && md.UUID != "" {
+			old, exists = prevByUUID[md.UUID]
+		}
+		if exists {
+			diffs[i].Previous = &old
+			diffs[i].Changed = changedFields(old, md)
+		}
+	}
+	return diffs
+}
+
+// changedFields returns the JSON names of the fields that differ between old and md
+func changedFields(old, md CalibreBookMeta) []string {
+	oldFields, newFields := metadataFields(old), metadataFields(md)
+	changed := []string{}
+	for name, v := range newFields {
+		if !bytes.Equal(v, oldFields[name]) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range oldFields {
+		if _, exists := newFields[name]; !exists {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// metadataFields returns the encoded value of each metadata field, with custom
+// columns listed separately
+func metadataFields(md CalibreBookMeta) map[string]json.RawMessage {
+	// Nil and empty maps are the same to Calibre
+	md.InitMaps()
+	var fields map[string]json.RawMessage
+	data, _ := json.Marshal(md)
+	json.Unmarshal(data, &fields)
+	var custom map[string]json.RawMessage
+	json.Unmarshal(fields["user_metadata"], &custom)
+	delete(fields, "user_metadata")
+	for name, v := range custom {
+		fields[name] = v
+	}
+	return fields
+}
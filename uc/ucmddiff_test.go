@@ -0,0 +1,57 @@
+package uc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChangedFields(t *testing.T) {
+	series, idx := "Series", 2.0
+	old := CalibreBookMeta{Lpath: "a.epub", Title: "Title", Series: &series}
+	old.UserMetadata = map[string]CalibreCustomColumn{"#genre": {}}
+	tests := []struct {
+		name   string
+		update func(md *CalibreBookMeta)
+		want   []string
+	}{
+		{"unchanged", func(md *CalibreBookMeta) {}, []string{}},
+		{"title", func(md *CalibreBookMeta) { md.Title = "New Title" }, []string{"title"}},
+		{"series", func(md *CalibreBookMeta) { md.Series, md.SeriesIndex = nil, &idx }, []string{"series", "series_index"}},
+		{"nil maps", func(md *CalibreBookMeta) { md.Identifiers = nil }, []string{}},
+		{"custom column removed", func(md *CalibreBookMeta) { md.UserMetadata = nil }, []string{"#genre"}},
+	}
+	for _, tt := range tests {
+		md := old
+		tt.update(&md)
+		if got := changedFields(old, md); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMetadataDiffs(t *testing.T) {
+	var requested []BookID
+	c := &calConn{client: iterClient{requested: &requested, unknown: map[string]bool{"new/c.epub": true}}, ucdb: &UncagedDB{}}
+	c.clientOpts.MetadataCache = &FileMetadataCache{md: map[string]CalibreBookMeta{
+		"a.epub": {Lpath: "a.epub", Title: "Old"},
+	}}
+	c.clientOpts.MetadataCache.Put(CalibreBookMeta{Lpath: "old/c.epub", UUID: "ccc", Title: "C"})
+	c.ucdb.initDB([]BookCountDetails{{Lpath: "a.epub"}, {Lpath: "b.epub"}, {Lpath: "old/c.epub", UUID: "ccc"}})
+	diffs := c.metadataDiffs([]CalibreBookMeta{
+		{Lpath: "a.epub", Title: "New"},
+		{Lpath: "b.epub", Title: "from client"},
+		{Lpath: "new/c.epub", UUID: "ccc", Title: "C"},
+	})
+	if len(diffs) != 3 || !reflect.DeepEqual(diffs[0].Changed, []string{"title"}) || diffs[0].Previous.Title != "Old" {
+		t.Errorf("Unexpected diff for a.epub %+v", diffs[0])
+	}
+	if len(diffs[1].Changed) != 0 || diffs[1].Changed == nil || diffs[1].Previous == nil {
+		t.Errorf("Expected b.epub unchanged, got %+v", diffs[1])
+	}
+	if !reflect.DeepEqual(diffs[2].Changed, []string{"lpath"}) || diffs[2].Previous.Lpath != "old/c.epub" {
+		t.Errorf("Expected new/c.epub to be moved from old/c.epub, got %+v", diffs[2])
+	}
+	if len(requested) != 2 || requested[0].Lpath != "b.epub" || requested[1].Lpath != "new/c.epub" {
+		t.Errorf("Expected only b.epub and new/c.epub requested from the client, got %v", requested)
+	}
+}
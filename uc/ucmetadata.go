@@ -0,0 +1,115 @@
+package uc
+
+import "fmt"
+
+// This file prepares the booklist UNCaGED sends Calibre, in response to
+// GET_BOOK_COUNT, and when Calibre asks for metadata to be resent.
+
+// bookCountPayload builds the reply to GET_BOOK_COUNT, announcing that count
+// books will be streamed
+func bookCountPayload(count int) []byte {
+	return buildJSONpayload(BookCountSend{Count: count, WillStream: true, WillScan: true}, ok)
+}
+
+// cachedBooklist returns the abridged metadata of every book on the device, leaving
+// out any book in missing
+func (c *calConn) cachedBooklist(missing map[string]struct{}) []BookCountDetails {
+	if len(missing) == 0 {
+		return c.ucdb.booklist
+	}
+	booklist := make([]BookCountDetails, 0, c.ucdb.length())
+	for _, b := range c.ucdb.booklist {
+		if _, skip := missing[b.Lpath]; !skip {
+			booklist = append(booklist, b)
+		}
+	}
+	return booklist
+}
+
+// prepareBookCount fills in the sync fields of abridged metadata before
+// it is sent to Calibre
+func (c *calConn) prepareBookCount(b *BookCountDetails) {
+	b.FormatMtime = c.formatMtime(b.bookID())
+	b.IsRead, b.LastReadDate, b.SyncType = c.readStatus(b.bookID())
+}
+
+// prepareMetadata readies metadata provided by the client to be sent to Calibre
+func (c *calConn) prepareMetadata(md *CalibreBookMeta) {
+	// Ensure maps are empty, not nil
+	md.InitMaps()
+	// The client knows the book by the UUID it provided
+	id := BookID{Lpath: md.Lpath, UUID: md.UUID}
+	c.ucdb.fillUUID(md)
+	c.stripThumbnail(md)
+	md.FormatMtime = c.formatMtime(id)
+	md.IsRead, md.LastReadDate, md.SyncType = c.readStatus(id)
+}
+
+// sendBookCountDetails sends Calibre the abridged metadata of each book in booklist
+func (c *calConn) sendBookCountDetails(booklist []BookCountDetails) error {
+	bw := c.newBooklistWriter(len(booklist))
+	for _, b := range booklist {
+		c.prepareBookCount(&b)
+		if err := bw.writeJSON(b); err != nil {
+			return fmt.Errorf("sendBookCountDetails: error sending bookCountDetail: %w", err)
+		}
+	}
+	if err := bw.flush(); err != nil {
+		return fmt.Errorf("sendBookCountDetails: error sending bookCountDetail: %w", err)
+	}
+	return nil
+}
+
+// sendMetadata sends Calibre the full metadata of each book in mdIter
+func (c *calConn) sendMetadata(mdIter MetadataIter) error {
+	bw := c.newBooklistWriter(mdIter.Count())
+	for mdIter.Next() {
+		md, err := mdIter.Get()
+		if err != nil {
+			return fmt.Errorf("sendMetadata: error retrieving book metadata: %w", clientErr(err))
+		}
+		c.prepareMetadata(&md)
+		if err = bw.writeJSON(md); err != nil {
+			return fmt.Errorf("sendMetadata: error sending book metadata: %w", err)
+		}
+	}
+	if err := bw.flush(); err != nil {
+		return fmt.Errorf("sendMetadata: error sending book metadata: %w", err)
+	}
+	return nil
+}
+
+// sliceIter is a MetadataIter over a slice of metadata
+type sliceIter struct {
+	md  []CalibreBookMeta
+	pos int
+}
+
+func (it *sliceIter) Next() bool {
+	it.pos++
+	return it.pos < len(it.md)
+}
+
+func (it *sliceIter) Count() int {
+	return len(it.md)
+}
+
+func (it *sliceIter) Get() (CalibreBookMeta, error) {
+	return it.md[it.pos], nil
+}
+
+// skipMissing returns an iterator over the metadata from mdIter, leaving out
+// any book in missing
+func skipMissing(mdIter MetadataIter, missing map[string]struct{}) (MetadataIter, error) {
+	it := &sliceIter{md: make([]CalibreBookMeta, 0, mdIter.Count()), pos: -1}
+	for mdIter.Next() {
+		md, err := mdIter.Get()
+		if err != nil {
+			return nil, err
+		}
+		if _, skip := missing[md.Lpath]; !skip {
+			it.md = append(it.md, md)
+		}
+	}
+	return it, nil
+}
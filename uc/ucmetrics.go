@@ -0,0 +1,81 @@
+package uc
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// Metrics receives measurements of UNCaGED's activity, for monitoring devices
+// that sync unattended. Set it in ClientOptions. Methods are called from the
+// goroutine running Start, except BytesRead, which is also called from the
+// goroutine reading packets. See the ucprom package for a Prometheus adapter.
+type Metrics interface {
+	// PacketHandled is called after each packet Calibre sends to start an
+	// operation is handled, with the name of the operation, eg: "SEND_BOOK",
+	// how long it took, and any error as an *OpError. Errors UNCaGED recovered
+	// from are included.
+	PacketHandled(op string, d time.Duration, err error)
+	// BytesRead and BytesWritten are called with the number of bytes read from,
+	// and written to, the connection with Calibre
+	BytesRead(n int)
+	BytesWritten(n int)
+	// BookTransferred is called after a book is received from Calibre, or sent
+	// to it, with its size and how long the transfer took
+	BookTransferred(received bool, size int64, d time.Duration)
+	// SessionEnded is called when Start returns, with the error it returns
+	SessionEnded(err error)
+}
+
+// meteredConn reports the data read and written through a connection to Metrics
+type meteredConn struct {
+	net.Conn
+	m Metrics
+}
+
+func (mc *meteredConn) Read(p []byte) (int, error) {
+	n, err := mc.Conn.Read(p)
+	if n > 0 {
+		mc.m.BytesRead(n)
+	}
+	return n, err
+}
+
+func (mc *meteredConn) Write(p []byte) (int, error) {
+	n, err := mc.Conn.Write(p)
+	if n > 0 {
+		mc.m.BytesWritten(n)
+	}
+	return n, err
+}
+
+// ReadFrom passes r to the connection's ReadFrom, if it has one, so that
+// metering doesn't stop books being sent with sendfile
+func (mc *meteredConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := mc.Conn.(io.ReaderFrom); ok {
+		n, err := rf.ReadFrom(r)
+		if n > 0 {
+			mc.m.BytesWritten(int(n))
+		}
+		return n, err
+	}
+	return io.Copy(writerOnly{mc}, r)
+}
+
+// packetHandled reports a handled packet to the client's Metrics
+func (c *calConn) packetHandled(op calOpCode, d time.Duration, err error) {
+	if c.clientOpts.Metrics == nil {
+		return
+	}
+	if err != nil {
+		err = opError(op, err)
+	}
+	c.clientOpts.Metrics.PacketHandled(op.String(), d, err)
+}
+
+// bookTransferred reports a book transfer to the client's Metrics
+func (c *calConn) bookTransferred(received bool, size int64, d time.Duration) {
+	if c.clientOpts.Metrics != nil {
+		c.clientOpts.Metrics.BookTransferred(received, size, d)
+	}
+}
@@ -0,0 +1,60 @@
+package uc
+
+import "encoding/json"
+
+// Packet is a packet received from Calibre
+type Packet struct {
+	Opcode  int
+	Name    string // The name Calibre uses for the opcode, eg: "SEND_BOOK"
+	Payload json.RawMessage
+}
+
+// PacketWriter sends a packet with the provided opcode and payload to Calibre
+type PacketWriter func(opcode int, payload interface{}) error
+
+// PacketMiddleware sees the packets exchanged with Calibre, for protocol debugging,
+// traffic capture, or handling opcodes UNCaGED does not support. Middleware is
+// listed in ClientOptions, and called in order.
+type PacketMiddleware interface {
+	// Received is called with every packet received from Calibre, including those
+	// read while handling another packet, such as metadata following SEND_BOOKLISTS
+	Received(pkt Packet)
+	// Sent is called with every packet before it is written to Calibre. Book data
+	// sent to Calibre is not included
+	Sent(raw []byte)
+	// Handle is called before UNCaGED handles a packet Calibre sent to start a new
+	// operation. Return true if the middleware handled the packet, in which case
+	// UNCaGED does not. Replies are sent with reply.
+	Handle(pkt Packet, reply PacketWriter) (bool, error)
+}
+
+func newPacket(op calOpCode, payload json.RawMessage) Packet {
+	return Packet{Opcode: int(op), Name: op.String(), Payload: payload}
+}
+
+// tapReceived passes a packet received from Calibre to the middleware
+func (c *calConn) tapReceived(op calOpCode, payload json.RawMessage) {
+	for _, m := range c.clientOpts.Middleware {
+		m.Received(newPacket(op, payload))
+	}
+}
+
+// tapSent passes a packet being sent to Calibre to the middleware
+func (c *calConn) tapSent(raw []byte) {
+	for _, m := range c.clientOpts.Middleware {
+		m.Sent(raw)
+	}
+}
+
+// handleMiddleware offers a packet to each middleware in turn, until one handles it
+func (c *calConn) handleMiddleware(op calOpCode, payload json.RawMessage) (bool, error) {
+	reply := func(opcode int, v interface{}) error {
+		return c.writeJSON(v, calOpCode(opcode))
+	}
+	for _, m := range c.clientOpts.Middleware {
+		if handled, err := m.Handle(newPacket(op, payload), reply); handled || err != nil {
+			return handled, err
+		}
+	}
+	return false, nil
+}
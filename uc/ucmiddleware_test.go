@@ -0,0 +1,41 @@
+package uc
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// recordingMiddleware records packets, and handles an opcode UNCaGED doesn't
+type recordingMiddleware struct {
+	received []Packet
+}
+
+func (rm *recordingMiddleware) Received(pkt Packet) { rm.received = append(rm.received, pkt) }
+func (rm *recordingMiddleware) Sent(raw []byte)     {}
+func (rm *recordingMiddleware) Handle(pkt Packet, reply PacketWriter) (bool, error) {
+	return pkt.Opcode == 99, nil
+}
+
+func TestMiddleware(t *testing.T) {
+	rm := &recordingMiddleware{}
+	c := &calConn{}
+	c.clientOpts.Middleware = []PacketMiddleware{rm}
+	c.tapReceived(sendBook, json.RawMessage(`{}`))
+	if len(rm.received) != 1 || rm.received[0].Name != "SEND_BOOK" || rm.received[0].Opcode != 8 {
+		t.Errorf("Unexpected received packets %+v", rm.received)
+	}
+	if handled, err := c.handleMiddleware(calOpCode(99), nil); !handled || err != nil {
+		t.Errorf("Expected opcode 99 handled by middleware")
+	}
+	if handled, _ := c.handleMiddleware(sendBook, nil); handled {
+		t.Errorf("Expected SEND_BOOK left to UNCaGED")
+	}
+}
+
+// sentMiddleware counts the packets sent to Calibre
+type sentMiddleware struct {
+	recordingMiddleware
+	sent int
+}
+
+func (sm *sentMiddleware) Sent(raw []byte) { sm.sent++ }
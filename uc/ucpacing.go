@@ -0,0 +1,102 @@
+package uc
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// WritePacing trades transfer throughput for device responsiveness. On devices
+// with slow eMMC or SD storage, writing a large book in one go can saturate the
+// storage and stall the UI while it's being flushed.
+type WritePacing struct {
+	// ChunkSize is the largest number of bytes handed to SaveBook's writes in one go.
+	// Zero disables pacing.
+	ChunkSize int
+	// Pause is how long to wait between chunks, giving other I/O a chance to run
+	Pause time.Duration
+	// SyncBytes is how many bytes a Writer returned by WritePacing.Writer accepts
+	// before syncing them to storage. Zero leaves flushing to the OS.
+	SyncBytes int64
+}
+
+// enabled returns true if books should be paced
+func (p WritePacing) enabled() bool {
+	return p.ChunkSize > 0
+}
+
+// delay returns the total time spent pausing while reading 'len' bytes
+func (p WritePacing) delay(len int) time.Duration {
+	if !p.enabled() {
+		return 0
+	}
+	return time.Duration(len/p.ChunkSize) * p.Pause
+}
+
+// Reader limits reads from r to ChunkSize bytes, pausing after every ChunkSize
+// bytes read, however small the reads are. UNCaGED paces the book passed to
+// SaveBook with this when ClientOptions.WritePacing is set.
+func (p WritePacing) Reader(r io.Reader) io.Reader {
+	if !p.enabled() {
+		return r
+	}
+	return &pacedReader{r: r, p: p}
+}
+
+// Writer returns a writer that syncs w every SyncBytes bytes, if w has a Sync
+// method such as *os.File has. Clients may use this in SaveBook to limit how
+// much unflushed data builds up.
+func (p WritePacing) Writer(w io.Writer) io.Writer {
+	s, ok := w.(syncer)
+	if !ok || p.SyncBytes <= 0 {
+		return w
+	}
+	return &syncWriter{w: s, every: p.SyncBytes}
+}
+
+type pacedReader struct {
+	r io.Reader
+	p WritePacing
+	// chunk is the number of bytes read since the last pause
+	chunk int
+}
+
+func (pr *pacedReader) Read(b []byte) (int, error) {
+	// Pausing once per chunk, rather than once per read, keeps the total
+	// pause to what WritePacing.delay allows for
+	if pr.chunk >= pr.p.ChunkSize {
+		if pr.p.Pause > 0 {
+			time.Sleep(pr.p.Pause)
+		}
+		pr.chunk = 0
+	}
+	if rest := pr.p.ChunkSize - pr.chunk; len(b) > rest {
+		b = b[:rest]
+	}
+	n, err := pr.r.Read(b)
+	pr.chunk += n
+	return n, err
+}
+
+type syncer interface {
+	io.Writer
+	Sync() error
+}
+
+type syncWriter struct {
+	w       syncer
+	every   int64
+	pending int64
+}
+
+func (sw *syncWriter) Write(b []byte) (int, error) {
+	n, err := sw.w.Write(b)
+	sw.pending += int64(n)
+	if err == nil && sw.pending >= sw.every {
+		sw.pending = 0
+		if err = sw.w.Sync(); err != nil {
+			err = fmt.Errorf("syncWriter: error syncing: %w", err)
+		}
+	}
+	return n, err
+}
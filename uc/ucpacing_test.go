@@ -0,0 +1,76 @@
+package uc
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+type recordingReader struct {
+	r     io.Reader
+	reads []int
+}
+
+func (cr *recordingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.reads = append(cr.reads, len(b))
+	return n, err
+}
+
+type syncBuffer struct {
+	bytes.Buffer
+	syncs int
+}
+
+func (sb *syncBuffer) Sync() error {
+	sb.syncs++
+	return nil
+}
+
+func TestWritePacing(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1000)
+	cr := &recordingReader{r: bytes.NewReader(data)}
+	p := WritePacing{ChunkSize: 300, SyncBytes: 500}
+	sb := &syncBuffer{}
+	n, err := io.Copy(p.Writer(sb), p.Reader(cr))
+	if err != nil || n != 1000 {
+		t.Fatalf("Copied %d bytes: %v", n, err)
+	}
+	for _, r := range cr.reads {
+		if r > 300 {
+			t.Errorf("Read of %d bytes exceeds chunk size", r)
+		}
+	}
+	if sb.syncs != 1 {
+		t.Errorf("Expected 1 sync, got %d", sb.syncs)
+	}
+	if r := (WritePacing{}).Reader(cr); r != io.Reader(cr) {
+		t.Errorf("Expected unpaced reader when pacing is disabled")
+	}
+}
+
+func TestWritePacingSmallReads(t *testing.T) {
+	p := WritePacing{ChunkSize: 300, Pause: 20 * time.Millisecond}
+	r := p.Reader(bytes.NewReader(bytes.Repeat([]byte("x"), 1000)))
+	start := time.Now()
+	// Reading 10 bytes at a time should still only pause after each chunk
+	buf := make([]byte, 10)
+	total := 0
+	for {
+		n, err := r.Read(buf)
+		total += n
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	if total != 1000 {
+		t.Fatalf("Read %d bytes, want 1000", total)
+	}
+	if d := p.delay(1000); elapsed < d || elapsed > 2*d+50*time.Millisecond {
+		t.Errorf("Reading took %v, expected about %v", elapsed, d)
+	}
+}
@@ -0,0 +1,147 @@
+package uc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PreferredInstance pins the Calibre instance UNCaGED connects to when
+// discovery finds several, such as a desktop and a laptop. Discovered
+// instances are matched against Host and Name first, then LibraryUUID. If
+// none match, the client's SelectCalibreInstance is used as usual.
+type PreferredInstance struct {
+	// Host is the IP address or host name of the instance, optionally with the
+	// port (eg: "192.168.1.10:9090")
+	Host string
+	// Name is the name Calibre announces, usually the computer's host name
+	Name string
+	// LibraryUUID is the UUID of the library the instance has open. Calibre
+	// only sends this once connected, so UNCaGED briefly connects to each
+	// instance to read it.
+	LibraryUUID string
+}
+
+// peekTimeout is how long UNCaGED waits for an instance's initialization info
+// when matching PreferredInstance.LibraryUUID
+const peekTimeout = 5 * time.Second
+
+// matches returns true if inst matches the pinned host or name
+func (p PreferredInstance) matches(inst CalInstance) bool {
+	if p.Name != "" && strings.EqualFold(p.Name, inst.Name) {
+		return true
+	}
+	if p.Host == "" {
+		return false
+	}
+	host, port := p.Host, ""
+	if h, pt, err := net.SplitHostPort(p.Host); err == nil {
+		host, port = h, pt
+	}
+	if port != "" && port != strconv.Itoa(inst.TCPPort) {
+		return false
+	}
+	if strings.EqualFold(host, inst.Host) {
+		return true
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if a == inst.Host {
+			return true
+		}
+	}
+	return false
+}
+
+// preferredInstance returns the instance matching ClientOptions.PreferredInstance,
+// and false if there is none
+func (c *calConn) preferredInstance(instances []CalInstance) (CalInstance, bool) {
+	pin := c.clientOpts.PreferredInstance
+	for _, inst := range instances {
+		if pin.matches(inst) {
+			return inst, true
+		}
+	}
+	// With only one instance, there's nothing to choose between
+	if pin.LibraryUUID == "" || len(instances) < 2 {
+		return CalInstance{}, false
+	}
+	reg := c.clientOpts.Registry
+	if reg != nil {
+		if inst, ok := reg.LibraryServer(pin.LibraryUUID, instances); ok {
+			return inst, true
+		}
+	}
+	// Connecting looks like a device to Calibre, so is only done when the
+	// registry doesn't know which instance has the library
+	defer c.saveRegistry()
+	for _, inst := range instances {
+		info, err := peekInitInfo(inst)
+		if err != nil {
+			c.LogPrintf("preferredInstance: unable to read library of '%s': %v\n", inst.Name, err)
+			continue
+		}
+		if reg != nil {
+			reg.SetLibrary(inst, info.CurrentLibraryUUID)
+		}
+		if info.CurrentLibraryUUID == pin.LibraryUUID {
+			return inst, true
+		}
+	}
+	return CalInstance{}, false
+}
+
+// recordFound records the instances found by discovery in the client's Registry,
+// so it knows when each was last seen
+func (c *calConn) recordFound(instances []CalInstance) {
+	if c.clientOpts.Registry == nil {
+		return
+	}
+	c.clientOpts.Registry.Merge(instances)
+	c.saveRegistry()
+}
+
+// recordLibrary records the instance connected to, and the library it has
+// open, in the client's Registry. Replayed sessions aren't recorded.
+func (c *calConn) recordLibrary() {
+	reg := c.clientOpts.Registry
+	if reg == nil || c.replay != nil {
+		return
+	}
+	reg.MarkConnected(c.calibreInstance)
+	reg.SetLibrary(c.calibreInstance, c.calibreInfo.CurrentLibraryUUID)
+	c.saveRegistry()
+}
+
+// saveRegistry saves the client's Registry, if it has one
+func (c *calConn) saveRegistry() {
+	if c.clientOpts.Registry == nil {
+		return
+	}
+	if err := c.clientOpts.Registry.Save(); err != nil {
+		c.logf(Warn, "saveRegistry: %v\n", err)
+	}
+}
+
+// peekInitInfo connects to a Calibre instance, and reads the initialization
+// info it sends, without starting a session
+func peekInitInfo(inst CalInstance) (CalibreInitInfo, error) {
+	var info CalibreInitInfo
+	ctx, cancel := context.WithTimeout(context.Background(), peekTimeout)
+	defer cancel()
+	res, err := inst.Ping(ctx, true)
+	if err != nil {
+		return info, fmt.Errorf("peekInitInfo: %w", err)
+	}
+	if err = json.Unmarshal(res.InitInfo, &info); err != nil {
+		return info, fmt.Errorf("peekInitInfo: error decoding initialization info: %w", err)
+	}
+	return info, nil
+}
@@ -0,0 +1,114 @@
+package uc
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/shermp/UNCaGED/calibre"
+)
+
+// fakeCalibre accepts connections, and sends each the initialization info of
+// a library with the provided UUID
+func fakeCalibre(t *testing.T, libraryUUID string) (CalInstance, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			pkt := fmt.Sprintf(`[9,{"currentLibraryUUID":"%s"}]`, libraryUUID)
+			fmt.Fprintf(conn, "%d%s", len(pkt), pkt)
+			conn.Close()
+		}
+	}()
+	return CalInstance{Host: "127.0.0.1", TCPPort: ln.Addr().(*net.TCPAddr).Port, Name: libraryUUID + "-pc"}, func() { ln.Close() }
+}
+
+func TestPreferredInstance(t *testing.T) {
+	desktop, closeDesktop := fakeCalibre(t, "desktop")
+	defer closeDesktop()
+	laptop, closeLaptop := fakeCalibre(t, "laptop")
+	defer closeLaptop()
+	instances := []CalInstance{desktop, laptop}
+	tests := []struct {
+		pin  PreferredInstance
+		want string
+	}{
+		{PreferredInstance{Name: "LAPTOP-pc"}, "laptop-pc"},
+		{PreferredInstance{Host: fmt.Sprintf("localhost:%d", laptop.TCPPort)}, "laptop-pc"},
+		{PreferredInstance{Host: "127.0.0.1"}, "desktop-pc"},
+		{PreferredInstance{LibraryUUID: "laptop"}, "laptop-pc"},
+		{PreferredInstance{Name: "other-pc", LibraryUUID: "other"}, ""},
+		{PreferredInstance{}, ""},
+	}
+	for _, tt := range tests {
+		c := &calConn{client: logClient{}}
+		c.clientOpts.PreferredInstance = tt.pin
+		inst, pinned := c.preferredInstance(instances)
+		if pinned != (tt.want != "") || inst.Name != tt.want {
+			t.Errorf("%+v: got %q, %v, want %q", tt.pin, inst.Name, pinned, tt.want)
+		}
+	}
+}
+
+// memRegistryStore is a calibre.RegistryStore kept in memory
+type memRegistryStore struct {
+	servers []calibre.KnownServer
+}
+
+func (cs *memRegistryStore) Load() ([]calibre.KnownServer, error) { return cs.servers, nil }
+
+func (cs *memRegistryStore) Save(servers []calibre.KnownServer) error {
+	cs.servers = append([]calibre.KnownServer(nil), servers...)
+	return nil
+}
+
+func TestPreferredInstanceRegistry(t *testing.T) {
+	desktop, closeDesktop := fakeCalibre(t, "desktop")
+	defer closeDesktop()
+	laptop, closeLaptop := fakeCalibre(t, "laptop")
+	instances := []CalInstance{desktop, laptop}
+	store := &memRegistryStore{}
+	reg, err := calibre.NewRegistry(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &calConn{client: logClient{}}
+	c.clientOpts.PreferredInstance = PreferredInstance{LibraryUUID: "laptop"}
+	c.clientOpts.Registry = reg
+	if inst, ok := c.preferredInstance(instances); !ok || inst.Name != "laptop-pc" {
+		t.Fatalf("Expected the laptop, got %q, %v", inst.Name, ok)
+	}
+	if len(store.servers) != 2 {
+		t.Errorf("Expected the libraries of both instances saved, got %+v", store.servers)
+	}
+	// The laptop can no longer be connected to, so it can only be found in
+	// the registry
+	closeLaptop()
+	if inst, ok := c.preferredInstance(instances); !ok || inst.Name != "laptop-pc" {
+		t.Errorf("Expected the laptop from the registry, got %q, %v", inst.Name, ok)
+	}
+}
+
+func TestRecordFound(t *testing.T) {
+	store := &memRegistryStore{}
+	reg, err := calibre.NewRegistry(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &calConn{client: logClient{}}
+	c.recordFound([]CalInstance{{Host: "192.168.1.10", TCPPort: 9090, Name: "desktop"}})
+	c.clientOpts.Registry = reg
+	c.recordFound([]CalInstance{{Host: "192.168.1.20", TCPPort: 9090, Name: "laptop"}})
+	if servers := reg.Servers(); len(servers) != 1 || servers[0].Name != "laptop" || servers[0].LastSeen.IsZero() {
+		t.Errorf("Expected the laptop recorded as seen, got %+v", servers)
+	}
+	if len(store.servers) != 1 {
+		t.Errorf("Expected the registry saved, got %+v", store.servers)
+	}
+}
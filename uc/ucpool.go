@@ -0,0 +1,52 @@
+package uc
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// transferBufSize is the size of the buffers books are copied with. It is a
+// multiple of the book packet length Calibre is told to use.
+const transferBufSize = 8 * bookPacketContentLen
+
+// transferPool holds the buffers books are copied with, so that transferring a
+// batch of books doesn't allocate a new buffer for each book
+var transferPool = sync.Pool{New: func() interface{} {
+	buf := make([]byte, transferBufSize)
+	return &buf
+}}
+
+// writerOnly hides any ReadFrom method of the writer it wraps, which would
+// otherwise be used instead of the pooled buffer
+type writerOnly struct {
+	io.Writer
+}
+
+// copyBook copies n bytes of a book from src to dst, using a pooled buffer
+func copyBook(dst io.Writer, src io.Reader, n int64) (int64, error) {
+	buf := transferPool.Get().(*[]byte)
+	defer transferPool.Put(buf)
+	written, err := io.CopyBuffer(writerOnly{dst}, io.LimitReader(src, n), *buf)
+	if err == nil && written < n {
+		err = io.EOF
+	}
+	return written, err
+}
+
+// sendBookData sends n bytes of a book to Calibre. Books the client provides as
+// an *os.File are passed to the connection's ReadFrom, which can use sendfile to
+// avoid copying the book through UNCaGED. This isn't possible if the client
+// follows transfer progress, the connection uses TLS, or the session is recorded.
+func (c *calConn) sendBookData(bk io.Reader, book BookID, n int64) (int64, error) {
+	f, isFile := bk.(*os.File)
+	rf, canReadFrom := c.tcpConn.(io.ReaderFrom)
+	if _, followsProgress := c.client.(TransferProgressReporter); isFile && canReadFrom && !followsProgress {
+		written, err := rf.ReadFrom(io.LimitReader(f, n))
+		if err == nil && written < n {
+			err = io.EOF
+		}
+		return written, err
+	}
+	return copyBook(c.tcpConn, c.progressReader(bk, book, SendingBook, n), n)
+}
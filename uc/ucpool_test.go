@@ -0,0 +1,109 @@
+package uc
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCopyBook(t *testing.T) {
+	book := strings.Repeat("x", transferBufSize*2+10)
+	var dst bytes.Buffer
+	n, err := copyBook(&dst, strings.NewReader(book), int64(len(book)-5))
+	if err != nil || n != int64(len(book)-5) || dst.String() != book[:len(book)-5] {
+		t.Errorf("Expected %d bytes copied, got %d, %v", len(book)-5, n, err)
+	}
+	if n, err = copyBook(&dst, strings.NewReader("short"), 10); err != io.EOF || n != 5 {
+		t.Errorf("Expected EOF after 5 bytes, got %d, %v", n, err)
+	}
+}
+
+func TestSendBookData(t *testing.T) {
+	f, err := ioutil.TempFile("", "uncaged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	book := strings.Repeat("book data ", 10000)
+	f.WriteString(book)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan []byte)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		received <- data
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &calConn{client: logClient{}, tcpConn: conn}
+	for _, r := range []io.Reader{f, strings.NewReader(book)} {
+		f.Seek(0, io.SeekStart)
+		if n, err := c.sendBookData(r, BookID{}, int64(len(book)-10)); err != nil || n != int64(len(book)-10) {
+			t.Errorf("Expected %d bytes sent, got %d, %v", len(book)-10, n, err)
+		}
+	}
+	if _, err = c.sendBookData(strings.NewReader("short"), BookID{}, 10); err != io.EOF {
+		t.Errorf("Expected EOF for a short book, got %v", err)
+	}
+	conn.Close()
+	if data := <-received; string(data) != book[:len(book)-10]+book[:len(book)-10]+"short" {
+		t.Errorf("Calibre received %d unexpected bytes", len(data))
+	}
+}
+
+// byteMetrics counts the bytes written to Calibre
+type byteMetrics struct {
+	written int
+}
+
+func (m *byteMetrics) PacketHandled(op string, d time.Duration, err error)        {}
+func (m *byteMetrics) BytesRead(n int)                                            {}
+func (m *byteMetrics) BytesWritten(n int)                                         { m.written += n }
+func (m *byteMetrics) BookTransferred(received bool, size int64, d time.Duration) {}
+func (m *byteMetrics) SessionEnded(err error)                                     {}
+
+func TestMeteredReadFrom(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			io.Copy(ioutil.Discard, conn)
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m := &byteMetrics{}
+	var mc net.Conn = &meteredConn{Conn: conn, m: m}
+	// Metering mustn't hide the connection's ReadFrom, or sendfile isn't used
+	rf, ok := mc.(io.ReaderFrom)
+	if !ok {
+		t.Fatal("Expected a metered connection to implement io.ReaderFrom")
+	}
+	if n, err := rf.ReadFrom(strings.NewReader("book data")); err != nil || n != 9 || m.written != 9 {
+		t.Errorf("Expected 9 bytes sent and metered, got %d sent, %d metered: %v", n, m.written, err)
+	}
+}
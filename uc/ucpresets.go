@@ -0,0 +1,92 @@
+package uc
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultPathLength is the path length reported to Calibre for each extension,
+// if the client does not set one. It matches what Calibre Companion reports.
+const defaultPathLength = 38
+
+// DevicePreset bundles sensible option values for a class of device, giving
+// new clients a working starting point. Presets are selected by name with
+// ClientOptions.Preset, and only fill in options the client has left unset.
+type DevicePreset struct {
+	Name         string
+	DeviceModel  string
+	SupportedExt []string
+	CoverWidth   int
+	CoverHeight  int
+	PathLength   int
+	ConnectRetry RetryPolicy
+}
+
+// wakeRetry retries connections for long enough for the Wi-Fi stack of
+// a device waking from sleep to become available
+var wakeRetry = RetryPolicy{Attempts: 5, InitialDelay: 500 * time.Millisecond, MaxDelay: 4 * time.Second, Jitter: 0.2}
+
+// Built in device presets
+var (
+	PresetKoboClara = DevicePreset{
+		Name:         "kobo-clara",
+		DeviceModel:  "Kobo Clara HD",
+		SupportedExt: []string{"kepub", "epub", "pdf", "mobi", "cbz", "cbr", "txt", "html", "rtf"},
+		CoverWidth:   1072,
+		CoverHeight:  1448,
+		PathLength:   len("/mnt/onboard/"),
+		ConnectRetry: wakeRetry,
+	}
+	PresetKindlePaperwhite = DevicePreset{
+		Name:         "kindle-pw",
+		DeviceModel:  "Kindle Paperwhite",
+		SupportedExt: []string{"azw3", "mobi", "azw", "pdf", "txt"},
+		CoverWidth:   1072,
+		CoverHeight:  1448,
+		PathLength:   len("/mnt/us/documents/"),
+		ConnectRetry: wakeRetry,
+	}
+	PresetGenericAndroid = DevicePreset{
+		Name:         "android",
+		DeviceModel:  "Android",
+		SupportedExt: []string{"epub", "pdf", "mobi", "azw3", "cbz", "txt"},
+		CoverWidth:   600,
+		CoverHeight:  800,
+		PathLength:   defaultPathLength,
+		ConnectRetry: RetryPolicy{Attempts: 3, InitialDelay: time.Second},
+	}
+)
+
+// Presets returns all built in device presets
+func Presets() []DevicePreset {
+	return []DevicePreset{PresetKoboClara, PresetKindlePaperwhite, PresetGenericAndroid}
+}
+
+// PresetByName finds a built in preset by its name
+func PresetByName(name string) (DevicePreset, error) {
+	for _, p := range Presets() {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return DevicePreset{}, fmt.Errorf("PresetByName: unknown preset '%s'", name)
+}
+
+// Apply fills any unset fields of opts with the values from the preset
+func (p DevicePreset) Apply(opts *ClientOptions) {
+	if opts.DeviceModel == "" {
+		opts.DeviceModel = p.DeviceModel
+	}
+	if len(opts.SupportedExt) == 0 {
+		opts.SupportedExt = append([]string(nil), p.SupportedExt...)
+	}
+	if opts.CoverDims.Width == 0 && opts.CoverDims.Height == 0 {
+		opts.CoverDims.Width, opts.CoverDims.Height = p.CoverWidth, p.CoverHeight
+	}
+	if opts.PathLength == 0 {
+		opts.PathLength = p.PathLength
+	}
+	if opts.ConnectRetry.Attempts == 0 {
+		opts.ConnectRetry = p.ConnectRetry
+	}
+}
@@ -0,0 +1,46 @@
+package uc
+
+import "io"
+
+// progressStep is the number of bytes transferred between progress reports
+const progressStep = 64 * 1024
+
+// TransferProgressReporter may optionally be implemented by a Client to follow the
+// progress of each book sent or received, for example to show a progress bar for
+// large books. UpdateStatus only reports progress a book at a time.
+type TransferProgressReporter interface {
+	// TransferProgress is called periodically while a book is transferred, and once
+	// it is complete. status is ReceivingBook or SendingBook
+	TransferProgress(book BookID, status Status, transferred, total int64)
+}
+
+// progressReader reports the progress of reading a book to the client
+type progressReader struct {
+	r        io.Reader
+	tp       TransferProgressReporter
+	book     BookID
+	status   Status
+	n        int64
+	total    int64
+	reported int64
+}
+
+// progressReader wraps r so that reading from it reports progress, if the client
+// implements TransferProgressReporter
+func (c *calConn) progressReader(r io.Reader, book BookID, status Status, total int64) io.Reader {
+	tp, ok := c.client.(TransferProgressReporter)
+	if !ok {
+		return r
+	}
+	return &progressReader{r: r, tp: tp, book: book, status: status, total: total}
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.n += int64(n)
+	if pr.n-pr.reported >= progressStep || (pr.n == pr.total && pr.reported != pr.n) {
+		pr.reported = pr.n
+		pr.tp.TransferProgress(pr.book, pr.status, pr.n, pr.total)
+	}
+	return n, err
+}
@@ -0,0 +1,31 @@
+package uc
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// progressClient records transfer progress reports
+type progressClient struct {
+	logClient
+	reports []int64
+}
+
+func (pc *progressClient) TransferProgress(book BookID, status Status, transferred, total int64) {
+	pc.reports = append(pc.reports, transferred)
+}
+
+func TestProgressReader(t *testing.T) {
+	pc := &progressClient{}
+	c := &calConn{client: pc}
+	total := int64(progressStep*2 + 100)
+	r := c.progressReader(bytes.NewReader(make([]byte, total)), BookID{}, ReceivingBook, total)
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(pc.reports) != 3 || pc.reports[2] != total {
+		t.Errorf("Expected 3 reports ending at %d, got %v", total, pc.reports)
+	}
+}
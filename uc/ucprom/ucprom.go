@@ -0,0 +1,237 @@
+// Package ucprom provides an implementation of uc.Metrics that exports the
+// measurements to Prometheus, for monitoring devices syncing with Calibre
+// unattended. It writes the Prometheus text format itself, so using it doesn't
+// pull the Prometheus client library into the client.
+//
+// Serve the metrics by registering a Metrics as an HTTP handler:
+//
+//	metrics := ucprom.New()
+//	http.Handle("/metrics", metrics)
+//	opts.Metrics = metrics
+package ucprom
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// summary is the count and total of a set of observations
+type summary struct {
+	count uint64
+	sum   float64
+}
+
+func (s *summary) observe(v float64) {
+	s.count++
+	s.sum += v
+}
+
+// direction labels a book transfer
+func direction(received bool) string {
+	if received {
+		return "received"
+	}
+	return "sent"
+}
+
+// errorPhase returns the phase label for err
+func errorPhase(err error) string {
+	var opErr *uc.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Phase.String()
+	}
+	return "connect"
+}
+
+// Metrics implements uc.Metrics, and serves the metrics recorded in the
+// Prometheus text format. It may be shared by several sessions, and is safe for
+// concurrent use.
+type Metrics struct {
+	mu            sync.Mutex
+	packets       map[string]*summary
+	packetErrors  map[[2]string]uint64
+	bytesRead     uint64
+	bytesWritten  uint64
+	books         map[string]*summary
+	bookBytes     map[string]uint64
+	sessions      uint64
+	sessionErrors map[string]uint64
+	lastSuccess   time.Time
+}
+
+// New returns Metrics with nothing recorded
+func New() *Metrics {
+	return &Metrics{
+		packets:       make(map[string]*summary),
+		packetErrors:  make(map[[2]string]uint64),
+		books:         make(map[string]*summary),
+		bookBytes:     make(map[string]uint64),
+		sessionErrors: make(map[string]uint64),
+	}
+}
+
+// PacketHandled counts the packet, and its duration and error
+func (m *Metrics) PacketHandled(op string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.packets[op]
+	if s == nil {
+		s = &summary{}
+		m.packets[op] = s
+	}
+	s.observe(d.Seconds())
+	if err != nil {
+		m.packetErrors[[2]string{op, errorPhase(err)}]++
+	}
+}
+
+// BytesRead counts the bytes read from Calibre
+func (m *Metrics) BytesRead(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytesRead += uint64(n)
+}
+
+// BytesWritten counts the bytes written to Calibre
+func (m *Metrics) BytesWritten(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytesWritten += uint64(n)
+}
+
+// BookTransferred counts the book, its size, and the transfer time
+func (m *Metrics) BookTransferred(received bool, size int64, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir := direction(received)
+	s := m.books[dir]
+	if s == nil {
+		s = &summary{}
+		m.books[dir] = s
+	}
+	s.observe(d.Seconds())
+	m.bookBytes[dir] += uint64(size)
+}
+
+// SessionEnded counts the session, and the phase of its error, if any
+func (m *Metrics) SessionEnded(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions++
+	if err != nil {
+		m.sessionErrors[errorPhase(err)]++
+	} else {
+		m.lastSuccess = time.Now()
+	}
+}
+
+// metricWriter writes metrics in the Prometheus text format
+type metricWriter struct {
+	w *bytes.Buffer
+}
+
+func (mw metricWriter) header(name, typ, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample, with labels given as name, value pairs
+func (mw metricWriter) sample(name string, v interface{}, labels ...string) {
+	mw.w.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1])))
+		}
+		fmt.Fprintf(mw.w, "{%s}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(mw.w, " %v\n", v)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys(m map[string]*summary) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format. The metrics
+// are formatted before writing, so a slow reader doesn't hold up UNCaGED.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	m.format(&buf)
+	return buf.WriteTo(w)
+}
+
+// format formats the metrics in the Prometheus text format
+func (m *Metrics) format(buf *bytes.Buffer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mw := metricWriter{w: buf}
+
+	mw.header("uncaged_packets_handled_seconds", "summary", "Time taken to handle packets from Calibre, by operation.")
+	for _, op := range sortedKeys(m.packets) {
+		mw.sample("uncaged_packets_handled_seconds_sum", m.packets[op].sum, "op", op)
+		mw.sample("uncaged_packets_handled_seconds_count", m.packets[op].count, "op", op)
+	}
+	mw.header("uncaged_packet_errors_total", "counter", "Errors handling packets from Calibre, by operation and phase.")
+	errKeys := make([][2]string, 0, len(m.packetErrors))
+	for k := range m.packetErrors {
+		errKeys = append(errKeys, k)
+	}
+	sort.Slice(errKeys, func(i, j int) bool {
+		if errKeys[i][0] != errKeys[j][0] {
+			return errKeys[i][0] < errKeys[j][0]
+		}
+		return errKeys[i][1] < errKeys[j][1]
+	})
+	for _, k := range errKeys {
+		mw.sample("uncaged_packet_errors_total", m.packetErrors[k], "op", k[0], "phase", k[1])
+	}
+	mw.header("uncaged_read_bytes_total", "counter", "Bytes read from Calibre.")
+	mw.sample("uncaged_read_bytes_total", m.bytesRead)
+	mw.header("uncaged_written_bytes_total", "counter", "Bytes written to Calibre.")
+	mw.sample("uncaged_written_bytes_total", m.bytesWritten)
+	mw.header("uncaged_book_transfer_seconds", "summary", "Time taken to transfer books, by direction.")
+	for _, dir := range sortedKeys(m.books) {
+		mw.sample("uncaged_book_transfer_seconds_sum", m.books[dir].sum, "direction", dir)
+		mw.sample("uncaged_book_transfer_seconds_count", m.books[dir].count, "direction", dir)
+	}
+	mw.header("uncaged_book_bytes_total", "counter", "Size of the books transferred, by direction.")
+	for _, dir := range sortedKeys(m.books) {
+		mw.sample("uncaged_book_bytes_total", m.bookBytes[dir], "direction", dir)
+	}
+	mw.header("uncaged_sessions_total", "counter", "Sessions with Calibre that have ended.")
+	mw.sample("uncaged_sessions_total", m.sessions)
+	mw.header("uncaged_session_errors_total", "counter", "Sessions with Calibre that ended with an error, by phase.")
+	phases := make([]string, 0, len(m.sessionErrors))
+	for p := range m.sessionErrors {
+		phases = append(phases, p)
+	}
+	sort.Strings(phases)
+	for _, p := range phases {
+		mw.sample("uncaged_session_errors_total", m.sessionErrors[p], "phase", p)
+	}
+	if !m.lastSuccess.IsZero() {
+		mw.header("uncaged_last_success_timestamp_seconds", "gauge", "When the last session without errors ended.")
+		mw.sample("uncaged_last_success_timestamp_seconds", m.lastSuccess.Unix())
+	}
+}
+
+// ServeHTTP serves the metrics to Prometheus
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
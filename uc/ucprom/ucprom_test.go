@@ -0,0 +1,92 @@
+package ucprom
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shermp/UNCaGED/calibre/calibretest"
+	"github.com/shermp/UNCaGED/uc"
+	"github.com/shermp/UNCaGED/uc/uctest"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	m.PacketHandled("SEND_BOOK", time.Second, nil)
+	m.PacketHandled("SEND_BOOK", time.Second, &uc.OpError{Op: "SEND_BOOK", Phase: uc.ClientPhase})
+	m.BookTransferred(true, 100, 2*time.Second)
+	m.SessionEnded(errors.New("connection refused"))
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`uncaged_packets_handled_seconds_sum{op="SEND_BOOK"} 2`,
+		`uncaged_packets_handled_seconds_count{op="SEND_BOOK"} 2`,
+		`uncaged_packet_errors_total{op="SEND_BOOK",phase="client"} 1`,
+		`uncaged_book_bytes_total{direction="received"} 100`,
+		`uncaged_session_errors_total{phase="connect"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("Expected %q in:\n%s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "uncaged_last_success_timestamp_seconds") {
+		t.Errorf("Expected no successful session")
+	}
+}
+
+func TestSessionMetrics(t *testing.T) {
+	srv, err := calibretest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	m := New()
+	client := uctest.NewMockClient()
+	client.Options.DirectConnect = srv.ConnectionInfo()
+	client.Options.Metrics = m
+	ucc, err := uc.New(client, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- ucc.Start() }()
+	ss, err := srv.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ss.SendBook("Author/Title.epub", nil, []byte("not really an epub")); err == nil {
+		_, err = ss.GetBook("Author/Title.epub")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss.Close()
+	if err = <-done; err != nil {
+		t.Fatalf("Session failed: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	for _, want := range []string{
+		`uncaged_packets_handled_seconds_count{op="SEND_BOOK"} 1`,
+		`uncaged_packets_handled_seconds_count{op="GET_BOOK_FILE_SEGMENT"} 1`,
+		`uncaged_book_transfer_seconds_count{direction="received"} 1`,
+		`uncaged_book_transfer_seconds_count{direction="sent"} 1`,
+		`uncaged_sessions_total 1`,
+		`uncaged_last_success_timestamp_seconds `,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Expected %q in:\n%s", want, body)
+		}
+	}
+	if m.bytesRead == 0 || m.bytesWritten == 0 {
+		t.Errorf("Expected bytes counted, got %d read, %d written", m.bytesRead, m.bytesWritten)
+	}
+}
@@ -0,0 +1,62 @@
+package uc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// minServerProtocolVersion is the oldest smart device protocol version that
+// supports any of the optional protocol features
+const minServerProtocolVersion = 1
+
+// protocolFeatures are the optional protocol features negotiated with the
+// connected Calibre instance
+type protocolFeatures struct {
+	binaryBooks  bool
+	libraryInfo  bool
+	lpathChanges bool
+}
+
+// negotiateFeatures determines which optional features may be used with a Calibre
+// instance. Calibre reports whether it can change lpaths, and ignores the
+// features it doesn't know about that the device offers, so binary books and
+// library info are always offered. Only instances reporting an older protocol
+// version than any that had the optional features are offered none.
+func negotiateFeatures(info CalibreInitInfo) protocolFeatures {
+	if len(info.CalibreVersion) > 0 && info.ServerProtocolVersion < minServerProtocolVersion {
+		return protocolFeatures{}
+	}
+	return protocolFeatures{binaryBooks: true, libraryInfo: true, lpathChanges: info.CanSupportLpathChanges}
+}
+
+// bookDataReader reads a book sent by Calibre as a series of base64 encoded
+// BOOK_DATA packets. Older Calibre releases that can't stream binary data use this.
+type bookDataReader struct {
+	c   *calConn
+	buf []byte
+}
+
+func (r *bookDataReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		opcode, data, err := r.c.readDecodeCalibrePayload()
+		if err != nil {
+			return 0, err
+		}
+		if opcode != bookData {
+			return 0, fmt.Errorf("bookDataReader: expected book data, got opcode %d", opcode)
+		}
+		var bd struct {
+			Data string `json:"data"`
+		}
+		if err = json.Unmarshal(data, &bd); err != nil {
+			return 0, fmt.Errorf("bookDataReader: error decoding book data: %w", err)
+		}
+		if r.buf, err = base64.StdEncoding.DecodeString(bd.Data); err != nil {
+			return 0, fmt.Errorf("bookDataReader: error decoding book data: %w", err)
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
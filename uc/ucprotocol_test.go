@@ -0,0 +1,61 @@
+package uc
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"testing"
+)
+
+func TestNegotiateFeatures(t *testing.T) {
+	tests := []struct {
+		name string
+		info CalibreInitInfo
+		want protocolFeatures
+	}{
+		{"unknown version", CalibreInitInfo{}, protocolFeatures{binaryBooks: true, libraryInfo: true}},
+		{"modern", CalibreInitInfo{CalibreVersion: []int{5, 12, 0}, ServerProtocolVersion: 1, CanSupportLpathChanges: true},
+			protocolFeatures{binaryBooks: true, libraryInfo: true, lpathChanges: true}},
+		{"no lpath changes", CalibreInitInfo{CalibreVersion: []int{1, 48}, ServerProtocolVersion: 1},
+			protocolFeatures{binaryBooks: true, libraryInfo: true}},
+		{"old protocol", CalibreInitInfo{CalibreVersion: []int{5, 0, 0}}, protocolFeatures{}},
+	}
+	for _, tt := range tests {
+		if got := negotiateFeatures(tt.info); got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReceiveBookData(t *testing.T) {
+	const next = "6[0,{}]"
+	const payload = `{"lpath":"Author/Title.epub","length":10,"totalBooks":1,"thisBook":0,"willStreamBinary":false,` +
+		`"metadata":{"lpath":"Author/Title.epub","uuid":"abc","title":"T"}}`
+	// Calibre sends the book as several base64 encoded BOOK_DATA packets
+	var input string
+	for _, chunk := range []string{"0123", "456", "789"} {
+		input += string(buildJSONpayload(map[string]string{"data": base64.StdEncoding.EncodeToString([]byte(chunk))}, bookData))
+	}
+	tests := []struct {
+		name string
+		read int
+		want string
+	}{
+		{"reads the book", 10, "0123456789"},
+		{"reads too little", 5, "01234"},
+	}
+	for _, tt := range tests {
+		var saved []byte
+		c := newTestConn(greedyClient{read: tt.read, saved: &saved}, input+next)
+		c.features.binaryBooks = true
+		if err := c.sendBook([]byte(payload)); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(saved) != tt.want {
+			t.Errorf("%s: expected %q saved, got %q", tt.name, tt.want, saved)
+		}
+		// Unread packets are drained, so the next packet can be read
+		if rest, _ := ioutil.ReadAll(c.tcpReader); string(rest) != next {
+			t.Errorf("%s: expected %q left, got %q", tt.name, next, rest)
+		}
+	}
+}
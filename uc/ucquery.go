@@ -0,0 +1,51 @@
+package uc
+
+// These methods let the client look up the books UNCaGED knows about in the
+// current session, such as books just received from Calibre. They may be
+// called from any goroutine. UUIDs UNCaGED generated for books without one
+// are left out, so books are described as the client knows them.
+
+// BookByLpath returns the book at lpath, and false if there is no such book
+func (c *calConn) BookByLpath(lpath string) (BookCountDetails, bool) {
+	return c.ucdb.lookup(Lpath, lpath)
+}
+
+// BookByUUID returns the book with the provided UUID, and false if there is
+// no such book. If several books share the UUID, the first is returned.
+func (c *calConn) BookByUUID(uuid string) (BookCountDetails, bool) {
+	if uuid == "" {
+		return BookCountDetails{}, false
+	}
+	bd, found := c.ucdb.lookup(UUID, uuid)
+	return bd, found && bd.UUID != ""
+}
+
+// AllBooks returns a copy of every book known to the session
+func (c *calConn) AllBooks() []BookCountDetails {
+	c.ucdb.mu.RLock()
+	defer c.ucdb.mu.RUnlock()
+	books := make([]BookCountDetails, len(c.ucdb.booklist))
+	for i, b := range c.ucdb.booklist {
+		books[i] = b.public()
+	}
+	return books
+}
+
+// lookup finds a book for the client
+func (ucdb *UncagedDB) lookup(searchType ucdbSearchType, value string) (BookCountDetails, bool) {
+	ucdb.mu.RLock()
+	defer ucdb.mu.RUnlock()
+	_, bd, err := ucdb.find(searchType, value)
+	if err != nil {
+		return BookCountDetails{}, false
+	}
+	return bd.public(), true
+}
+
+// public returns the book as the client knows it
+func (bd BookCountDetails) public() BookCountDetails {
+	if bd.syntheticUUID {
+		bd.UUID, bd.syntheticUUID = "", false
+	}
+	return bd
+}
@@ -0,0 +1,30 @@
+package uc
+
+import "testing"
+
+func TestQueryBooks(t *testing.T) {
+	c := &calConn{ucdb: &UncagedDB{}}
+	c.ucdb.initDB([]BookCountDetails{{UUID: "abc", Lpath: "a.epub"}, {Lpath: "b.epub"}})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.ucdb.addEntry(CalibreBookMeta{UUID: "def", Lpath: "c.epub"})
+	}()
+	c.AllBooks()
+	<-done
+	if bd, ok := c.BookByLpath("b.epub"); !ok || bd.UUID != "" {
+		t.Errorf("Expected b.epub without a generated UUID, got %+v, %v", bd, ok)
+	}
+	if bd, ok := c.BookByUUID("def"); !ok || bd.Lpath != "c.epub" {
+		t.Errorf("Expected c.epub, got %+v, %v", bd, ok)
+	}
+	if _, ok := c.BookByUUID(syntheticUUID("b.epub")); ok {
+		t.Errorf("Generated UUIDs should not be found")
+	}
+	if _, ok := c.BookByLpath("missing.epub"); ok {
+		t.Errorf("Expected missing.epub not to be found")
+	}
+	if books := c.AllBooks(); len(books) != 3 || books[1].UUID != "" {
+		t.Errorf("Unexpected books %+v", books)
+	}
+}
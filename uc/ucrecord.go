@@ -0,0 +1,183 @@
+package uc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Frame directions in a session recording
+const (
+	FrameConnect  = "connect"  // A new connection with Calibre was established
+	FrameReceived = "received" // Data was read from Calibre
+	FrameSent     = "sent"     // Data was written to Calibre
+)
+
+// Frame is an entry in a session recording. Each connection starts with a
+// FrameConnect frame, followed by the data read from and written to Calibre, in
+// the order it was read or written. Data is recorded as text where it is valid
+// UTF-8, as protocol packets are, and base64 encoded otherwise, as book data
+// usually is.
+type Frame struct {
+	Dir     string        `json:"dir"`
+	Elapsed time.Duration `json:"elapsed"` // Time since the session started
+	Text    string        `json:"text,omitempty"`
+	Data    []byte        `json:"data,omitempty"`
+}
+
+// Bytes returns the data of the frame
+func (f Frame) Bytes() []byte {
+	if f.Text != "" {
+		return []byte(f.Text)
+	}
+	return f.Data
+}
+
+// ReadRecording reads the frames of a session recorded with ClientOptions.Record
+func ReadRecording(r io.Reader) ([]Frame, error) {
+	var frames []Frame
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var f Frame
+		if err := dec.Decode(&f); err == io.EOF {
+			return frames, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("ReadRecording: frame %d: %w", len(frames)+1, err)
+		}
+		frames = append(frames, f)
+	}
+}
+
+// sessionRecorder writes the frames of a session to the client's writer. Once
+// a write fails, recording stops, as a partial recording can't be replayed anyway.
+type sessionRecorder struct {
+	c     *calConn
+	mu    sync.Mutex
+	enc   *json.Encoder
+	start time.Time
+	err   error
+}
+
+func newSessionRecorder(c *calConn, w io.Writer) *sessionRecorder {
+	return &sessionRecorder{c: c, enc: json.NewEncoder(w), start: time.Now()}
+}
+
+// passwordHashField matches the password hash UNCaGED sends Calibre. It is
+// redacted from recordings, as it could be brute-forced to find the password.
+var passwordHashField = regexp.MustCompile(`"passwordHash"\s*:\s*"[^"]*"`)
+
+func (r *sessionRecorder) record(dir string, p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	f := Frame{Dir: dir, Elapsed: time.Since(r.start)}
+	if utf8.Valid(p) {
+		f.Text = string(p)
+		if dir == FrameSent {
+			f.Text = passwordHashField.ReplaceAllString(f.Text, `"passwordHash":"REDACTED"`)
+		}
+	} else {
+		f.Data = p
+	}
+	if r.err = r.enc.Encode(f); r.err != nil {
+		r.c.logf(Warn, "Session recording stopped: %v\n", r.err)
+	}
+}
+
+// wrap returns conn, recording the data read and written through it. The
+// wrapped conn doesn't implement io.ReaderFrom, so books aren't sent with
+// sendfile, bypassing the recording.
+func (r *sessionRecorder) wrap(conn net.Conn) net.Conn {
+	r.record(FrameConnect, nil)
+	return &recordingConn{Conn: conn, r: r}
+}
+
+type recordingConn struct {
+	net.Conn
+	r *sessionRecorder
+}
+
+func (rc *recordingConn) Read(p []byte) (int, error) {
+	n, err := rc.Conn.Read(p)
+	if n > 0 {
+		rc.r.record(FrameReceived, p[:n])
+	}
+	return n, err
+}
+
+func (rc *recordingConn) Write(p []byte) (int, error) {
+	n, err := rc.Conn.Write(p)
+	if n > 0 {
+		rc.r.record(FrameSent, p[:n])
+	}
+	return n, err
+}
+
+// replayInstance is the Calibre instance a replayed session appears to be
+// connected to
+var replayInstance = CalInstance{Host: "replay", Name: "replay"}
+
+// replayer provides a connection for each connection in a recorded session
+type replayer struct {
+	conns [][]byte
+}
+
+func newReplayer(r io.Reader) (*replayer, error) {
+	frames, err := ReadRecording(r)
+	if err != nil {
+		return nil, err
+	}
+	rp := &replayer{}
+	for _, f := range frames {
+		switch {
+		case f.Dir == FrameConnect:
+			rp.conns = append(rp.conns, nil)
+		case f.Dir == FrameReceived && len(rp.conns) > 0:
+			rp.conns[len(rp.conns)-1] = append(rp.conns[len(rp.conns)-1], f.Bytes()...)
+		}
+	}
+	if len(rp.conns) == 0 {
+		return nil, fmt.Errorf("newReplayer: recording has no connections")
+	}
+	return rp, nil
+}
+
+// next returns a connection replaying the next recorded connection
+func (rp *replayer) next() (net.Conn, error) {
+	if len(rp.conns) == 0 {
+		return nil, fmt.Errorf("replay: no more connections were recorded: %w", CalibreNotFound)
+	}
+	conn := &replayConn{rd: bytes.NewReader(rp.conns[0])}
+	rp.conns = rp.conns[1:]
+	return conn, nil
+}
+
+// replayConn is a net.Conn reading what Calibre sent on a recorded connection.
+// Writes are discarded, and reads return io.EOF at the end of the recording,
+// as if Calibre closed the connection.
+type replayConn struct {
+	rd *bytes.Reader
+}
+
+func (rc *replayConn) Read(p []byte) (int, error)         { return rc.rd.Read(p) }
+func (rc *replayConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (rc *replayConn) Close() error                       { return nil }
+func (rc *replayConn) LocalAddr() net.Addr                { return replayAddr{} }
+func (rc *replayConn) RemoteAddr() net.Addr               { return replayAddr{} }
+func (rc *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (rc *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (rc *replayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
@@ -0,0 +1,92 @@
+package uc_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shermp/UNCaGED/calibre/calibretest"
+	"github.com/shermp/UNCaGED/uc"
+	"github.com/shermp/UNCaGED/uc/uctest"
+)
+
+func TestRecordReplay(t *testing.T) {
+	srv, err := calibretest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Password = "secret"
+	var rec bytes.Buffer
+	newClient := func() *uctest.MockClient {
+		client := uctest.NewMockClient()
+		client.Passwords = []string{"secret"}
+		client.Options.PasswordRetry = uc.RetryPolicy{Attempts: 3, InitialDelay: time.Millisecond}
+		client.AddBook(uc.CalibreBookMeta{Lpath: "Old/Book.epub", UUID: "old", Title: "Old Book"}, []byte("old book"))
+		return client
+	}
+	client := newClient()
+	client.Options.Record = &rec
+	ss, done := startSession(t, srv, client)
+	book := []byte{0x50, 0x4b, 0x03, 0x04, 0xff, 0xfe}
+	_, err = ss.SendBook("Author/Title.epub", nil, book)
+	if err == nil {
+		_, err = ss.DeleteBooks("Old/Book.epub")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss.Close()
+	if err = <-done; err != nil {
+		t.Fatalf("Session failed: %v", err)
+	}
+
+	frames, err := uc.ReadRecording(bytes.NewReader(rec.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns int
+	var binary bool
+	for _, f := range frames {
+		if f.Dir == uc.FrameConnect {
+			conns++
+		}
+		binary = binary || f.Data != nil
+	}
+	if conns != 2 {
+		t.Errorf("Expected the password challenge to take 2 connections, got %d", conns)
+	}
+	if !binary {
+		t.Errorf("Expected the book data to be recorded as binary")
+	}
+	var redacted int
+	for _, f := range frames {
+		if f.Dir == uc.FrameSent && strings.Contains(f.Text, `"passwordHash"`) {
+			if !strings.Contains(f.Text, `"passwordHash":"REDACTED"`) {
+				t.Errorf("Expected the password hash to be redacted, got %s", f.Text)
+			}
+			redacted++
+		}
+	}
+	if redacted == 0 {
+		t.Errorf("Expected the password hash sent to be recorded, redacted")
+	}
+
+	replayed := newClient()
+	replayed.Options.Replay = bytes.NewReader(rec.Bytes())
+	ucc, err := uc.New(replayed, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ucc.Start(); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	books := replayed.Books()
+	if len(books) != 1 || books[0].Meta.Lpath != "Author/Title.epub" || !bytes.Equal(books[0].Data, book) {
+		t.Errorf("Expected the replay to leave only the sent book, got %+v", books)
+	}
+	if calls := replayed.Calls("GetPassword"); len(calls) != 1 {
+		t.Errorf("Expected the password asked for once, got %d", len(calls))
+	}
+}
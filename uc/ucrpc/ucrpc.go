@@ -0,0 +1,250 @@
+// Package ucrpc lets applications not written in Go control UNCaGED, by
+// running it as a sidecar process serving JSON-RPC. The Go side provides the
+// uc.Client that stores books. The application finds Calibre instances,
+// starts and stops sessions, and follows their progress.
+//
+// The service is registered as "UNCaGED", and speaks JSON-RPC 1.0 as
+// implemented by net/rpc/jsonrpc, one request per line:
+//
+//	{"method":"UNCaGED.Discover","params":[{}],"id":1}
+//	{"method":"UNCaGED.Start","params":[{"instance":{"host":"192.168.1.10","port":9090}}],"id":2}
+//	{"method":"UNCaGED.Status","params":[{}],"id":3}
+//	{"method":"UNCaGED.Stop","params":[{}],"id":4}
+package ucrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sync"
+	"time"
+
+	"github.com/shermp/UNCaGED/calibre"
+	"github.com/shermp/UNCaGED/uc"
+	"github.com/shermp/UNCaGED/uc/ucstatus"
+)
+
+// SessionRunning is returned by Start when a session is already running
+var SessionRunning = errors.New("a session is already running")
+
+// logLines is the number of log messages kept for Status
+const logLines = 50
+
+// eventTimeout is how long an event is held for the client, as UNCaGED does
+const eventTimeout = time.Second
+
+// DiscoverArgs are the arguments of Discover
+type DiscoverArgs struct{}
+
+// DiscoverReply lists the Calibre instances found
+type DiscoverReply struct {
+	Instances []uc.CalInstance `json:"instances"`
+}
+
+// StartArgs are the arguments of Start
+type StartArgs struct {
+	// Instance is the Calibre instance to connect to. If nil, the client's
+	// options decide, as they do for uc.New.
+	Instance *uc.CalInstance `json:"instance"`
+}
+
+// StartReply is the reply to Start
+type StartReply struct{}
+
+// StopArgs are the arguments of Stop
+type StopArgs struct{}
+
+// StopReply is the reply to Stop
+type StopReply struct {
+	// Stopped is true if a session was running
+	Stopped bool `json:"stopped"`
+}
+
+// StatusArgs are the arguments of Status
+type StatusArgs struct{}
+
+// StatusReply describes the current, or most recent, session
+type StatusReply struct {
+	Running bool `json:"running"`
+	// State is the zero value if no session has been started
+	State ucstatus.State `json:"state"`
+}
+
+// Server runs sessions for a client on behalf of RPC callers. Its exported
+// methods taking args and reply are the RPC methods.
+type Server struct {
+	client uc.Client
+	debug  bool
+	rpc    *rpc.Server
+
+	mu     sync.Mutex
+	dash   *ucstatus.Dashboard
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewServer returns a Server running sessions with client. If debug is true,
+// sessions log debug messages.
+func NewServer(client uc.Client, debug bool) (*Server, error) {
+	s := &Server{client: client, debug: debug, rpc: rpc.NewServer()}
+	if err := s.rpc.RegisterName("UNCaGED", s); err != nil {
+		return nil, fmt.Errorf("NewServer: %w", err)
+	}
+	return s, nil
+}
+
+// ServeConn serves RPC requests on conn until it is closed, such as the stdin
+// and stdout of a sidecar process
+func (s *Server) ServeConn(conn io.ReadWriteCloser) {
+	s.rpc.ServeCodec(jsonrpc.NewServerCodec(conn))
+}
+
+// Serve serves RPC requests on each connection accepted by ln, until ln is closed
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return fmt.Errorf("Serve: %w", err)
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// discoveryLogger passes discovery log messages to the client
+type discoveryLogger struct {
+	client uc.Client
+}
+
+func (dl discoveryLogger) LogPrintf(format string, a ...interface{}) {
+	dl.client.LogPrintf(uc.Debug, format, a...)
+}
+
+// Discover searches the network for Calibre instances, with the client's
+// discovery options
+func (s *Server) Discover(args DiscoverArgs, reply *DiscoverReply) error {
+	opts, err := s.client.GetClientOptions()
+	if err != nil {
+		return fmt.Errorf("Discover: %w", err)
+	}
+	if reply.Instances, err = calibre.DiscoverSmartDeviceWithOptions(discoveryLogger{s.client}, opts.Discovery); err != nil {
+		return fmt.Errorf("Discover: %w", err)
+	}
+	return nil
+}
+
+// Start starts a session in the background. Follow it with Status.
+func (s *Server) Start(args StartArgs, reply *StartReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done != nil {
+		return fmt.Errorf("Start: %w", SessionRunning)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.dash = ucstatus.New(logLines)
+	s.cancel, s.done = cancel, make(chan struct{})
+	go s.run(ctx, args.Instance, s.dash, s.done)
+	return nil
+}
+
+// run runs a session, updating dash, and closes done when it ends
+func (s *Server) run(ctx context.Context, instance *uc.CalInstance, dash *ucstatus.Dashboard, done chan struct{}) {
+	defer func() {
+		s.mu.Lock()
+		s.cancel()
+		s.cancel, s.done = nil, nil
+		s.mu.Unlock()
+		close(done)
+	}()
+	events := make(chan uc.Event)
+	watched := make(chan struct{})
+	watch := func(clientEvents chan<- uc.Event) {
+		defer close(watched)
+		stalled := false
+		for e := range events {
+			dash.Handle(e)
+			// The client still receives events, if it asked for them
+			if clientEvents != nil {
+				stalled = forward(clientEvents, e, stalled)
+			}
+		}
+	}
+	watching := false
+	ucc, err := uc.NewWithOptions(s.client, s.debug, func(opts *uc.ClientOptions) {
+		if instance != nil {
+			opts.DirectConnect = *instance
+		}
+		go watch(opts.Events)
+		watching, opts.Events = true, events
+	})
+	if watching {
+		defer func() {
+			close(events)
+			<-watched
+		}()
+	}
+	if err == nil {
+		// Stop may have been called while searching for Calibre
+		err = ctx.Err()
+	}
+	if err != nil {
+		dash.Handle(uc.SessionEnded{Reason: err})
+		return
+	}
+	dash.SetSession(ucc)
+	// The SessionEnded event may have been dropped
+	dash.Handle(uc.SessionEnded{Reason: ucc.StartContext(ctx)})
+}
+
+// forward sends e to the client, dropping it if the client doesn't receive it
+// within eventTimeout, so a client that stops receiving events can't stall the
+// dashboard. Once one is dropped (stalled is true), events are only sent if the
+// client is ready for them. forward returns whether the client is stalled.
+func forward(events chan<- uc.Event, e uc.Event, stalled bool) bool {
+	select {
+	case events <- e:
+		return false
+	default:
+	}
+	if stalled {
+		return true
+	}
+	t := time.NewTimer(eventTimeout)
+	defer t.Stop()
+	select {
+	case events <- e:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// Stop ends the running session, once the current operation is done, and waits
+// for it to end
+func (s *Server) Stop(args StopArgs, reply *StopReply) error {
+	s.mu.Lock()
+	cancel, done := s.cancel, s.done
+	s.mu.Unlock()
+	if done == nil {
+		return nil
+	}
+	cancel()
+	<-done
+	reply.Stopped = true
+	return nil
+}
+
+// Status returns the state of the current, or most recent, session
+func (s *Server) Status(args StatusArgs, reply *StatusReply) error {
+	s.mu.Lock()
+	dash := s.dash
+	reply.Running = s.done != nil
+	s.mu.Unlock()
+	if dash != nil {
+		reply.State = dash.State()
+	}
+	return nil
+}
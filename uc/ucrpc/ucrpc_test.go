@@ -0,0 +1,120 @@
+package ucrpc
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/rpc/jsonrpc"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shermp/UNCaGED/calibre/calibretest"
+	"github.com/shermp/UNCaGED/uc"
+	"github.com/shermp/UNCaGED/uc/uctest"
+)
+
+func TestServer(t *testing.T) {
+	srv, err := calibretest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	s, err := NewServer(uctest.NewMockClient(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, serverConn := net.Pipe()
+	go s.ServeConn(serverConn)
+	rc := jsonrpc.NewClient(conn)
+	defer rc.Close()
+
+	inst := srv.ConnectionInfo()
+	if err = rc.Call("UNCaGED.Start", StartArgs{Instance: &inst}, &StartReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = rc.Call("UNCaGED.Start", StartArgs{Instance: &inst}, &StartReply{}); err == nil || !strings.Contains(err.Error(), SessionRunning.Error()) {
+		t.Errorf("Expected a second session to be refused, got %v", err)
+	}
+	ss, err := srv.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+	if _, err = ss.SendBook("Author/Title.epub", nil, []byte("not really an epub")); err == nil {
+		_, err = ss.BookCount(true)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status StatusReply
+	if err = rc.Call("UNCaGED.Status", StatusArgs{}, &status); err != nil || !status.Running {
+		t.Errorf("Expected a running session, got %+v, %v", status, err)
+	}
+	var stop StopReply
+	if err = rc.Call("UNCaGED.Stop", StopArgs{}, &stop); err != nil || !stop.Stopped {
+		t.Errorf("Expected the session stopped, got %+v, %v", stop, err)
+	}
+	if err = rc.Call("UNCaGED.Status", StatusArgs{}, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Running || !status.State.Ended || status.State.Stats == nil || status.State.Stats.BooksReceived != 1 {
+		t.Errorf("Unexpected status after stopping: %+v", status)
+	}
+	if err = rc.Call("UNCaGED.Stop", StopArgs{}, &stop); err != nil || stop.Stopped {
+		t.Errorf("Expected nothing to stop, got %+v, %v", stop, err)
+	}
+}
+
+func TestSessionError(t *testing.T) {
+	srv, err := calibretest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst := srv.ConnectionInfo()
+	srv.Close()
+	// A client that never receives its events mustn't stall the dashboard
+	client := uctest.NewMockClient()
+	client.Options.Events = make(chan uc.Event)
+	s, err := NewServer(client, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(StartArgs{Instance: &inst}, &StartReply{}); err != nil {
+		t.Fatal(err)
+	}
+	var status StatusReply
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if s.Status(StatusArgs{}, &status); !status.Running {
+			break
+		}
+	}
+	// Connecting failed before SessionEnded could be sent
+	if status.Running || !status.State.Ended || status.State.Error == "" {
+		t.Errorf("Expected the session ended with an error, got %+v", status)
+	}
+}
+
+// TestWireFormat checks the requests shown in the package documentation work
+func TestWireFormat(t *testing.T) {
+	s, err := NewServer(uctest.NewMockClient(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, serverConn := net.Pipe()
+	go s.ServeConn(serverConn)
+	defer conn.Close()
+	fmt.Fprintln(conn, `{"method":"UNCaGED.Status","params":[{}],"id":3}`)
+	var resp struct {
+		ID     int             `json:"id"`
+		Result json.RawMessage `json:"result"`
+		Error  interface{}     `json:"error"`
+	}
+	if err = json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != 3 || resp.Error != nil || !strings.Contains(string(resp.Result), `"running":false`) {
+		t.Errorf("Unexpected response %+v, result %s", resp, resp.Result)
+	}
+}
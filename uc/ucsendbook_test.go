@@ -0,0 +1,231 @@
+package uc
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// greedyClient reads as much as it can from the book, and records what it saved
+type greedyClient struct {
+	logClient
+	read  int
+	saved *[]byte
+}
+
+func (gc greedyClient) SaveBook(md CalibreBookMeta, book io.Reader, len int, lastBook bool) error {
+	data, err := ioutil.ReadAll(io.LimitReader(book, int64(gc.read)))
+	*gc.saved = data
+	return err
+}
+
+// newTestConn returns a connection to a client, reading input as if Calibre sent it
+func newTestConn(client Client, input string) *calConn {
+	c := &calConn{client: client, ucdb: &UncagedDB{}, okStr: "6[0,{}]"}
+	c.tcpConn = &countingConn{}
+	c.tcpReader = bufio.NewReader(strings.NewReader(input))
+	return c
+}
+
+func TestSendBookBounded(t *testing.T) {
+	const next = "6[0,{}]"
+	dir, err := ioutil.TempDir("", "uncaged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sum := sha256.Sum256([]byte("0123456789"))
+	tests := []struct {
+		name string
+		read int
+	}{
+		{"reads too much", 100},
+		{"reads too little", 4},
+		{"reads the book", 10},
+	}
+	for _, tt := range tests {
+		var saved []byte
+		c := newTestConn(greedyClient{read: tt.read, saved: &saved}, "0123456789"+next)
+		if c.clientOpts.Checksums, err = NewFileChecksumStore(filepath.Join(dir, tt.name)); err != nil {
+			t.Fatal(err)
+		}
+		payload := `{"lpath":"a.epub","length":10,"totalBooks":1,"thisBook":0,"willStreamBinary":true,` +
+			`"metadata":{"lpath":"a.epub","uuid":"abc","title":"T"}}`
+		if err := c.sendBook([]byte(payload)); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if want := "0123456789"[:min(tt.read, 10)]; string(saved) != want {
+			t.Errorf("%s: client saved %q, want %q", tt.name, saved, want)
+		}
+		if rest, _ := ioutil.ReadAll(c.tcpReader); string(rest) != next {
+			t.Errorf("%s: expected the next packet to be intact, got %q", tt.name, rest)
+		}
+		// The checksum covers the whole book, not just what the client read
+		if hash, _ := c.clientOpts.Checksums.LookupLpath("a.epub"); hash != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: recorded hash %s, want the hash of the whole book", tt.name, hash)
+		}
+	}
+}
+
+// detailClient saves books with SaveBookDetails, and renames every book
+type detailClient struct {
+	logClient
+	details *BookDetails
+}
+
+func (dc detailClient) CheckLpath(lpath string) string { return "renamed/" + lpath }
+
+func (dc detailClient) SaveBookDetails(details BookDetails, book io.Reader) error {
+	*dc.details = details
+	_, err := io.CopyN(ioutil.Discard, book, int64(details.Length))
+	return err
+}
+
+func TestSaveBookDetails(t *testing.T) {
+	var details BookDetails
+	c := newTestConn(detailClient{details: &details}, "0123456789")
+	c.features.lpathChanges = true
+	payload := `{"lpath":"a.epub","length":10,"totalBooks":3,"thisBook":1,"willStreamBinary":true,` +
+		`"canSupportLpathChanges":true,"wantsSendOkToSendbook":true,"metadata":{"lpath":"a.epub","uuid":"abc","title":"T"}}`
+	if err := c.sendBook([]byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+	d := details
+	if d.Length != 10 || d.Index != 1 || d.Total != 3 || d.LastBook || d.CalibreLpath != "a.epub" || !d.LpathChanged {
+		t.Errorf("Unexpected details %+v", d)
+	}
+	if d.Metadata.Lpath != "renamed/a.epub" {
+		t.Errorf("Expected book saved to renamed/a.epub, got %s", d.Metadata.Lpath)
+	}
+}
+
+// formatClient saves books, and replaces every other format it is asked about
+type formatClient struct {
+	logClient
+	replaced *[]string
+}
+
+func (fc formatClient) SaveBook(md CalibreBookMeta, book io.Reader, len int, lastBook bool) error {
+	_, err := io.Copy(ioutil.Discard, book)
+	return err
+}
+
+func (fc formatClient) DeleteBook(book BookID) error { return nil }
+
+func (fc formatClient) ReplaceFormat(old BookID, md CalibreBookMeta, oldExt, newExt string) bool {
+	*fc.replaced = append(*fc.replaced, oldExt+">"+newExt)
+	return true
+}
+
+func TestReplaceFormats(t *testing.T) {
+	const payload = `{"lpath":"%s","length":4,"totalBooks":%d,"thisBook":%d,"willStreamBinary":true,` +
+		`"metadata":{"lpath":"%s","uuid":"abc","title":"T"}}`
+	tests := []struct {
+		name     string
+		onDevice []BookCountDetails
+		batch    []string
+		replaced string
+		left     int
+	}{
+		{"replaces older format", []BookCountDetails{{UUID: "abc", Lpath: "Title.mobi"}}, []string{"Title.epub"}, "mobi>epub", 1},
+		{"keeps formats in the same batch", nil, []string{"Title.epub", "Title.MOBI"}, "", 2},
+		{"keeps other books", []BookCountDetails{{UUID: "def", Lpath: "Other.mobi"}}, []string{"Title.epub"}, "", 2},
+	}
+	for _, tt := range tests {
+		var replaced []string
+		c := newTestConn(formatClient{replaced: &replaced}, strings.Repeat("book", len(tt.batch)))
+		c.formatSync = true
+		c.ucdb.initDB(tt.onDevice)
+		for i, lpath := range tt.batch {
+			if err := c.sendBook([]byte(fmt.Sprintf(payload, lpath, len(tt.batch), i, lpath))); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		if got := strings.Join(replaced, ","); got != tt.replaced {
+			t.Errorf("%s: replaced %q, want %q", tt.name, got, tt.replaced)
+		}
+		if c.ucdb.length() != tt.left {
+			t.Errorf("%s: expected %d books left, got %d", tt.name, tt.left, c.ucdb.length())
+		}
+	}
+}
+
+// updateClient takes part in book updates, approving them if approve is set
+type updateClient struct {
+	greedyClient
+	approve bool
+	asked   *[]string
+}
+
+func (uc updateClient) FormatModified(book BookID) (time.Time, bool) {
+	return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), true
+}
+
+func (uc updateClient) ApproveUpdate(book BookID, md CalibreBookMeta) bool {
+	*uc.asked = append(*uc.asked, book.Lpath)
+	return uc.approve
+}
+
+func TestDeclinedUpdate(t *testing.T) {
+	const next = "6[0,{}]"
+	const payload = `{"lpath":"a.epub","length":10,"totalBooks":1,"thisBook":0,"willStreamBinary":%t,` +
+		`"metadata":{"lpath":"a.epub","uuid":"abc","title":"T"}}`
+	var packets string
+	for _, chunk := range []string{"0123", "456", "789"} {
+		packets += string(buildJSONpayload(map[string]string{"data": base64.StdEncoding.EncodeToString([]byte(chunk))}, bookData))
+	}
+	tests := []struct {
+		name    string
+		binary  bool
+		approve bool
+		onDev   bool
+		saved   string
+		asked   int
+	}{
+		{"declined", true, false, true, "", 1},
+		{"declined as BOOK_DATA", false, false, true, "", 1},
+		{"approved", true, true, true, "0123456789", 1},
+		{"new book", true, false, false, "0123456789", 0},
+	}
+	for _, tt := range tests {
+		var saved []byte
+		var asked []string
+		input := "0123456789"
+		if !tt.binary {
+			input = packets
+		}
+		c := newTestConn(updateClient{greedyClient{read: 100, saved: &saved}, tt.approve, &asked}, input+next)
+		c.features.binaryBooks = true
+		if tt.onDev {
+			c.ucdb.initDB([]BookCountDetails{{UUID: "abc", Lpath: "a.epub"}})
+		}
+		if err := c.sendBook([]byte(fmt.Sprintf(payload, tt.binary))); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(saved) != tt.saved || len(asked) != tt.asked {
+			t.Errorf("%s: expected %q saved after %d approvals, got %q after %v", tt.name, tt.saved, tt.asked, saved, asked)
+		}
+		// A declined book is drained, so the next packet can be read
+		if rest, _ := ioutil.ReadAll(c.tcpReader); string(rest) != next {
+			t.Errorf("%s: expected %q left, got %q", tt.name, next, rest)
+		}
+	}
+	// Modification times are only sent if Calibre supports format sync
+	c := newTestConn(updateClient{}, "")
+	if mtime := c.formatMtime(BookID{Lpath: "a.epub"}); mtime != nil {
+		t.Errorf("Expected no modification time without format sync, got %v", mtime)
+	}
+	c.formatSync = true
+	if mtime := c.formatMtime(BookID{Lpath: "a.epub"}); mtime == nil || mtime.GetTime() == nil || mtime.GetTime().Year() != 2020 {
+		t.Errorf("Expected the modification time from FormatModified, got %v", mtime)
+	}
+}
@@ -0,0 +1,303 @@
+// Package ucstatus serves the state of a UNCaGED session over HTTP, as JSON and
+// as a minimal HTML page, for devices with no display of their own, such as a
+// Raspberry Pi acting as a virtual device.
+//
+// A Dashboard follows the session through the events UNCaGED sends, and keeps
+// the most recent log messages:
+//
+//	dash := ucstatus.New(50)
+//	events := make(chan uc.Event)
+//	go dash.Watch(events)
+//	opts.Events = events
+//	opts.Logger = slog.New(dash.LogHandler(nil))
+//	...
+//	ucc, err := uc.New(client, false)
+//	dash.SetSession(ucc)
+//	http.Handle("/", dash)
+package ucstatus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// Session is the part of a UNCaGED session the dashboard queries. The value
+// returned by uc.New implements it.
+type Session interface {
+	Stats() uc.SessionStats
+	CalibreInfo() uc.CalibreInitInfo
+}
+
+// Book is the book currently being received
+type Book struct {
+	Index int    `json:"index"` // Position in the batch, starting from 0
+	Total int    `json:"total"`
+	Title string `json:"title"`
+	Lpath string `json:"lpath"`
+}
+
+// Sync is the progress of a metadata exchange
+type Sync struct {
+	Status string `json:"status"`
+	Done   int    `json:"done"`
+	Total  int    `json:"total"`
+}
+
+// Stats summarises the session
+type Stats struct {
+	BooksReceived  int     `json:"books_received"`
+	BooksSent      int     `json:"books_sent"`
+	BooksDeleted   int     `json:"books_deleted"`
+	BytesReceived  int64   `json:"bytes_received"`
+	BytesSent      int64   `json:"bytes_sent"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+}
+
+// LogEntry is a log message
+type LogEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// State is the state of the session, as served by the dashboard
+type State struct {
+	Status   string    `json:"status"`
+	Progress int       `json:"progress"` // Between 0 & 100, or negative if the status has no progress
+	Since    time.Time `json:"since"`    // When the status last changed
+	// Library, LibraryUUID and CalibreVersion describe the Calibre library
+	// connected to, once Calibre has sent them
+	Library        string `json:"library,omitempty"`
+	LibraryUUID    string `json:"library_uuid,omitempty"`
+	CalibreVersion string `json:"calibre_version,omitempty"`
+	Book           *Book  `json:"book,omitempty"`
+	Sync           *Sync  `json:"sync,omitempty"`
+	Stats          *Stats `json:"stats,omitempty"`
+	// Ended is set once the session has ended, or Calibre has disconnected, with
+	// the error that ended the session, if any
+	Ended bool       `json:"ended"`
+	Error string     `json:"error,omitempty"`
+	Log   []LogEntry `json:"log"`
+}
+
+// Dashboard keeps the state of a session, and serves it over HTTP. It is safe
+// for concurrent use.
+type Dashboard struct {
+	mu       sync.Mutex
+	session  Session
+	state    State
+	logLines int
+}
+
+// New returns a Dashboard keeping the last logLines log messages
+func New(logLines int) *Dashboard {
+	return &Dashboard{
+		logLines: logLines,
+		state:    State{Status: uc.SearchingCalibre.String(), Progress: -1, Since: time.Now()},
+	}
+}
+
+// SetSession sets the session queried for the library details and stats
+func (d *Dashboard) SetSession(s Session) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.session = s
+}
+
+// Watch updates the dashboard with each event received, until events is closed.
+// Run it in its own goroutine. UNCaGED drops events that aren't received within
+// a second, so the dashboard may miss some if Watch falls behind.
+func (d *Dashboard) Watch(events <-chan uc.Event) {
+	for e := range events {
+		d.Handle(e)
+	}
+}
+
+// Handle updates the dashboard with an event. Use it instead of Watch when
+// the client handles events itself.
+func (d *Dashboard) Handle(e uc.Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch e := e.(type) {
+	case uc.StatusChanged:
+		if e.Status.String() != d.state.Status {
+			d.state.Since = time.Now()
+		}
+		d.state.Status, d.state.Progress = e.Status.String(), e.Progress
+		switch e.Status {
+		case uc.ReceivingBook:
+		case uc.SendingBooklist, uc.UpdatingMetadata:
+			d.state.Book = nil
+		default:
+			d.state.Book, d.state.Sync = nil, nil
+		}
+		switch e.Status {
+		case uc.Connecting:
+			d.state.Ended, d.state.Error = false, ""
+		case uc.Disconnected:
+			// In case SessionEnded is dropped
+			d.state.Ended = true
+		}
+	case uc.BookReceiveStarted:
+		d.state.Book = &Book{Index: e.Index, Total: e.Total, Title: e.Title, Lpath: e.Lpath}
+	case uc.MetadataSyncProgress:
+		d.state.Sync = &Sync{Status: e.Status.String(), Done: e.Done, Total: e.Total}
+	case uc.SessionEnded:
+		d.state.Ended, d.state.Book, d.state.Sync = true, nil, nil
+		if e.Reason != nil {
+			d.state.Error = e.Reason.Error()
+		}
+	}
+}
+
+// Log adds a message to the recent log. Clients logging through LogPrintf,
+// rather than a slog.Logger, can call it from LogPrintf.
+func (d *Dashboard) Log(level uc.LogLevel, format string, a ...interface{}) {
+	levels := map[uc.LogLevel]string{uc.Info: "INFO", uc.Warn: "WARN", uc.Debug: "DEBUG"}
+	d.addLog(LogEntry{Time: time.Now(), Level: levels[level], Message: strings.TrimSuffix(fmt.Sprintf(format, a...), "\n")})
+}
+
+func (d *Dashboard) addLog(entry LogEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.logLines <= 0 {
+		return
+	}
+	d.state.Log = append(d.state.Log, entry)
+	if over := len(d.state.Log) - d.logLines; over > 0 {
+		d.state.Log = append(d.state.Log[:0], d.state.Log[over:]...)
+	}
+}
+
+// State returns the current state of the session
+func (d *Dashboard) State() State {
+	d.mu.Lock()
+	state := d.state
+	session := d.session
+	state.Log = append([]LogEntry(nil), d.state.Log...)
+	d.mu.Unlock()
+	if session == nil {
+		return state
+	}
+	info := session.CalibreInfo()
+	state.Library, state.LibraryUUID = info.CurrentLibraryName, info.CurrentLibraryUUID
+	version := make([]string, len(info.CalibreVersion))
+	for i, v := range info.CalibreVersion {
+		version[i] = strconv.Itoa(v)
+	}
+	state.CalibreVersion = strings.Join(version, ".")
+	stats := session.Stats()
+	state.Stats = &Stats{
+		BooksReceived:  stats.BooksReceived,
+		BooksSent:      stats.BooksSent,
+		BooksDeleted:   stats.BooksDeleted,
+		BytesReceived:  stats.BytesReceived,
+		BytesSent:      stats.BytesSent,
+		ElapsedSeconds: stats.Elapsed.Seconds(),
+	}
+	return state
+}
+
+// ServeHTTP serves the state as JSON if the request path ends in ".json", or
+// the client asks for JSON, and as an HTML page otherwise
+func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	state := d.State()
+	if strings.HasSuffix(r.URL.Path, ".json") || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := page.Execute(w, state); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var page = template.Must(template.New("status").Funcs(template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="2">
+<title>UNCaGED: {{.Status}}</title>
+<style>body{font-family:sans-serif;margin:1em 2em}td{padding:0 1em 0 0}pre{background:#eee;padding:.5em;overflow-x:auto}</style>
+</head>
+<body>
+<h1>{{.Status}}{{if ge .Progress 0}} ({{.Progress}}%){{end}}</h1>
+<table>
+<tr><td>Since</td><td>{{.Since.Format "15:04:05"}}</td></tr>
+{{if .Library}}<tr><td>Library</td><td>{{.Library}}{{if .CalibreVersion}} (calibre {{.CalibreVersion}}){{end}}</td></tr>{{end}}
+{{with .Book}}<tr><td>Book</td><td>{{.Title}} ({{.Lpath}}), {{.Index | inc}} of {{.Total}}</td></tr>{{end}}
+{{with .Sync}}<tr><td>Metadata</td><td>{{.Status}}: {{.Done}} of {{.Total}}</td></tr>{{end}}
+{{with .Stats}}<tr><td>Books</td><td>{{.BooksReceived}} received, {{.BooksSent}} sent, {{.BooksDeleted}} deleted</td></tr>{{end}}
+{{if .Ended}}<tr><td>Session</td><td>ended{{if .Error}}: {{.Error}}{{end}}</td></tr>{{end}}
+</table>
+{{if .Log}}<h2>Log</h2>
+<pre>{{range .Log}}{{.Time.Format "15:04:05"}} {{.Level}} {{.Message}}
+{{end}}</pre>{{end}}
+</body>
+</html>
+`))
+
+// LogHandler returns a slog.Handler adding messages to the recent log, then
+// passing them to next, if it isn't nil. Messages below the Info level are
+// only passed to next.
+func (d *Dashboard) LogHandler(next slog.Handler) slog.Handler {
+	return &logHandler{d: d, next: next}
+}
+
+type logHandler struct {
+	d     *Dashboard
+	next  slog.Handler
+	attrs []slog.Attr
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo || (h.next != nil && h.next.Enabled(ctx, level))
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelInfo {
+		var sb strings.Builder
+		sb.WriteString(r.Message)
+		for _, a := range h.attrs {
+			fmt.Fprintf(&sb, " %s", a)
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			fmt.Fprintf(&sb, " %s", a)
+			return true
+		})
+		h.d.addLog(LogEntry{Time: r.Time, Level: r.Level.String(), Message: sb.String()})
+	}
+	if h.next != nil && h.next.Enabled(ctx, r.Level) {
+		return h.next.Handle(ctx, r)
+	}
+	return nil
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := &logHandler{d: h.d, attrs: append(append([]slog.Attr(nil), h.attrs...), attrs...)}
+	if h.next != nil {
+		nh.next = h.next.WithAttrs(attrs)
+	}
+	return nh
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	nh := &logHandler{d: h.d, attrs: h.attrs}
+	if h.next != nil {
+		nh.next = h.next.WithGroup(name)
+	}
+	return nh
+}
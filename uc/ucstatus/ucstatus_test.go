@@ -0,0 +1,107 @@
+package ucstatus
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shermp/UNCaGED/calibre/calibretest"
+	"github.com/shermp/UNCaGED/uc"
+	"github.com/shermp/UNCaGED/uc/uctest"
+)
+
+func TestHandle(t *testing.T) {
+	d := New(2)
+	d.Handle(uc.StatusChanged{Status: uc.ReceivingBook, Progress: 0})
+	d.Handle(uc.BookReceiveStarted{Index: 1, Total: 3, Title: "Title", Lpath: "Author/Title.epub"})
+	if s := d.State(); s.Status != "receiving book" || s.Book == nil || s.Book.Lpath != "Author/Title.epub" {
+		t.Errorf("Expected the book being received, got %+v", s)
+	}
+	d.Handle(uc.StatusChanged{Status: uc.Idle, Progress: -1})
+	if s := d.State(); s.Book != nil {
+		t.Errorf("Expected no book once idle, got %+v", s.Book)
+	}
+	d.Handle(uc.SessionEnded{Reason: errors.New("connection reset")})
+	for _, msg := range []string{"one", "two", "three"} {
+		d.Log(uc.Info, "%s\n", msg)
+	}
+	s := d.State()
+	if !s.Ended || s.Error != "connection reset" {
+		t.Errorf("Expected the session ended with an error, got %+v", s)
+	}
+	if len(s.Log) != 2 || s.Log[0].Message != "two" || s.Log[1].Message != "three" {
+		t.Errorf("Expected the last 2 log messages, got %+v", s.Log)
+	}
+	// The session is seen to end even if SessionEnded is dropped
+	d.Handle(uc.StatusChanged{Status: uc.Connecting, Progress: -1})
+	if s = d.State(); s.Ended || s.Error != "" {
+		t.Errorf("Expected a new session once connecting, got %+v", s)
+	}
+	d.Handle(uc.StatusChanged{Status: uc.Disconnected, Progress: -1})
+	if s = d.State(); !s.Ended {
+		t.Errorf("Expected the session ended once disconnected, got %+v", s)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	srv, err := calibretest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	d := New(100)
+	events := make(chan uc.Event)
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		d.Watch(events)
+	}()
+	client := uctest.NewMockClient()
+	client.Options.DirectConnect = srv.ConnectionInfo()
+	client.Options.Events = events
+	client.Options.Logger = slog.New(d.LogHandler(nil))
+	ucc, err := uc.New(client, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetSession(ucc)
+	done := make(chan error, 1)
+	go func() { done <- ucc.Start() }()
+	ss, err := srv.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ss.SendBook("Author/Title.epub", map[string]interface{}{"title": "Title"}, []byte("not really an epub")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ss.BookCount(true); err != nil {
+		t.Fatal(err)
+	}
+	ss.Close()
+	if err = <-done; err != nil {
+		t.Fatalf("Session failed: %v", err)
+	}
+	close(events)
+	<-watched
+
+	rec := httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest("GET", "/status.json", nil))
+	var state State
+	if err = json.NewDecoder(rec.Body).Decode(&state); err != nil {
+		t.Fatal(err)
+	}
+	if !state.Ended || state.Library != "Test Library" || state.CalibreVersion != "5.0.0" {
+		t.Errorf("Unexpected state %+v", state)
+	}
+	if state.Stats == nil || state.Stats.BooksReceived != 1 {
+		t.Errorf("Expected 1 book received, got %+v", state.Stats)
+	}
+	rec = httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "Test Library") || !strings.Contains(body, "1 received") {
+		t.Errorf("Unexpected status page:\n%s", body)
+	}
+}
@@ -0,0 +1,90 @@
+package uc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StorageLocation describes a storage location on the device other than its main
+// storage, such as an SD card. Books stored in a location have lpaths prefixed with
+// the location code, eg: "cardA/Author/Title.epub"
+type StorageLocation struct {
+	// Code identifies the location, and prefixes the lpath of books stored in it.
+	// Calibre's own drivers use "cardA" and "cardB".
+	Code string
+}
+
+// LocationSpaceReporter may optionally be implemented by a Client that has storage
+// locations, to report the space in each location separately. GetFreeSpace and
+// TotalSpaceReporter's GetTotalSpace then report the space in the main storage only.
+type LocationSpaceReporter interface {
+	// LocationFreeSpace returns the free space in the location with code
+	LocationFreeSpace(code string) uint64
+	// LocationTotalSpace returns the total capacity of the location with code
+	LocationTotalSpace(code string) uint64
+}
+
+// LocationOf splits lpath into the code of the storage location the book is stored
+// in, and the path of the book within that location. Books in the main storage
+// return "main" and the unmodified lpath.
+func LocationOf(locations []StorageLocation, lpath string) (code, rel string) {
+	for _, loc := range locations {
+		if strings.HasPrefix(lpath, loc.Code+"/") {
+			return loc.Code, strings.TrimPrefix(lpath, loc.Code+"/")
+		}
+	}
+	return mainLocation, lpath
+}
+
+// hasLocation returns true if code is the main location, or one of the
+// client's storage locations
+func (c *calConn) hasLocation(code string) bool {
+	if code == mainLocation {
+		return true
+	}
+	for _, loc := range c.clientOpts.Locations {
+		if loc.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// spaceReply builds the reply to FREE_SPACE or TOTAL_SPACE. key is the reply key
+// for the whole device, eg: "free_space_on_device". If the client reports the space
+// in each location, the space in every location is added to mainSpace, and also sent
+// separately, keyed by location code, eg: "free_space_on_cardA". Calibre itself only
+// reads the whole device key, as books may be sent to any location.
+func (c *calConn) spaceReply(key string, mainSpace uint64, locSpace func(LocationSpaceReporter, string) uint64) map[string]uint64 {
+	reply := map[string]uint64{key: mainSpace}
+	lr, ok := c.client.(LocationSpaceReporter)
+	if !ok || len(c.clientOpts.Locations) == 0 {
+		return reply
+	}
+	prefix := strings.TrimSuffix(key, "device")
+	reply[prefix+mainLocation] = mainSpace
+	for _, loc := range c.clientOpts.Locations {
+		space := locSpace(lr, loc.Code)
+		reply[prefix+loc.Code] = space
+		reply[key] += space
+	}
+	return reply
+}
+
+// logLocationCounts logs how many books in booklist are stored in each location
+func (c *calConn) logLocationCounts(booklist []BookCountDetails) {
+	if len(c.clientOpts.Locations) == 0 {
+		return
+	}
+	counts := make(map[string]int)
+	for _, b := range booklist {
+		code, _ := LocationOf(c.clientOpts.Locations, b.Lpath)
+		counts[code]++
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s: %d", mainLocation, counts[mainLocation])
+	for _, loc := range c.clientOpts.Locations {
+		fmt.Fprintf(&sb, ", %s: %d", loc.Code, counts[loc.Code])
+	}
+	c.logf(Info, "Books per storage location: %s\n", sb.String())
+}
@@ -0,0 +1,219 @@
+package uc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// In strict mode (ClientOptions.StrictPackets), the payload of each packet
+// from Calibre is checked against the fields UNCaGED expects before it is
+// decoded. This is intended for debugging against new Calibre releases, or
+// servers that emulate Calibre, and fails the session on the first bad packet.
+
+// jsonKind is the type of a JSON value
+type jsonKind string
+
+// JSON value types
+const (
+	jsonString jsonKind = "string"
+	jsonNumber jsonKind = "number"
+	jsonBool   jsonKind = "bool"
+	jsonObject jsonKind = "object"
+	jsonArray  jsonKind = "array"
+	jsonNull   jsonKind = "null"
+)
+
+// kindOf returns the type of the JSON value v
+func kindOf(v json.RawMessage) jsonKind {
+	v = bytes.TrimSpace(v)
+	if len(v) == 0 {
+		return ""
+	}
+	switch v[0] {
+	case '"':
+		return jsonString
+	case '{':
+		return jsonObject
+	case '[':
+		return jsonArray
+	case 't', 'f':
+		return jsonBool
+	case 'n':
+		return jsonNull
+	}
+	return jsonNumber
+}
+
+// fieldRule is a field a packet must have, and the type of its value
+type fieldRule struct {
+	name string
+	kind jsonKind
+}
+
+// packetRule describes the payload of a packet. The fields are checked first,
+// then check is called, if set, to check the decoded values. Fields listed in
+// nullable may also be null.
+type packetRule struct {
+	fields   []fieldRule
+	nullable []string
+	check    func(fields map[string]json.RawMessage) []string
+}
+
+// packetRules are the payloads UNCaGED expects for each opcode. Opcodes that
+// aren't listed aren't checked.
+var packetRules = map[calOpCode]packetRule{
+	getInitializationInfo: {fields: []fieldRule{
+		{"serverProtocolVersion", jsonNumber},
+		{"calibre_version", jsonArray},
+		{"canSupportLpathChanges", jsonBool},
+		{"currentLibraryName", jsonString},
+		{"currentLibraryUUID", jsonString},
+	}},
+	displayMessage: {fields: []fieldRule{{"messageKind", jsonNumber}}},
+	getBookCount: {fields: []fieldRule{
+		{"canStream", jsonBool},
+		{"canScan", jsonBool},
+		{"willUseCachedMetadata", jsonBool},
+	}},
+	sendBooklists: {
+		fields: []fieldRule{{"count", jsonNumber}, {"collections", jsonObject}},
+		check:  nonNegative("count"),
+	},
+	sendBookMetadata: {
+		fields: []fieldRule{{"count", jsonNumber}, {"index", jsonNumber}, {"data", jsonObject}},
+		check:  checkIndex("index", "count"),
+	},
+	setLibraryInfo: {fields: []fieldRule{
+		{"libraryName", jsonString},
+		{"libraryUuid", jsonString},
+		{"fieldMetadata", jsonObject},
+	}},
+	sendBook: {
+		fields: []fieldRule{
+			{"lpath", jsonString},
+			{"length", jsonNumber},
+			{"thisBook", jsonNumber},
+			{"totalBooks", jsonNumber},
+			{"willStreamBooks", jsonBool},
+			{"metadata", jsonObject},
+		},
+		check: func(fields map[string]json.RawMessage) []string {
+			return append(nonNegative("length")(fields), checkIndex("thisBook", "totalBooks")(fields)...)
+		},
+	},
+	deleteBook: {
+		fields: []fieldRule{{"lpaths", jsonArray}},
+		check: func(fields map[string]json.RawMessage) []string {
+			var lpaths []json.RawMessage
+			json.Unmarshal(fields["lpaths"], &lpaths)
+			var problems []string
+			for i, lp := range lpaths {
+				if k := kindOf(lp); k != jsonString {
+					problems = append(problems, fmt.Sprintf("lpaths[%d] is %s, expected string", i, k))
+				}
+			}
+			return problems
+		},
+	},
+	getBookFileSegment: {
+		fields: []fieldRule{
+			{"lpath", jsonString},
+			{"position", jsonNumber},
+			{"thisBook", jsonNumber},
+			{"totalBooks", jsonNumber},
+		},
+		// Calibre sends null for these when fetching a single book
+		nullable: []string{"thisBook", "totalBooks"},
+		check: func(fields map[string]json.RawMessage) []string {
+			return append(nonNegative("position")(fields), checkIndex("thisBook", "totalBooks")(fields)...)
+		},
+	},
+}
+
+// isNullable returns true if the field may be null
+func (r packetRule) isNullable(field string) bool {
+	for _, f := range r.nullable {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// nonNegative checks that the number field isn't negative
+func nonNegative(field string) func(map[string]json.RawMessage) []string {
+	return func(fields map[string]json.RawMessage) []string {
+		var n float64
+		if json.Unmarshal(fields[field], &n) == nil && n < 0 {
+			return []string{fmt.Sprintf("%s is negative (%v)", field, n)}
+		}
+		return nil
+	}
+}
+
+// checkIndex checks that the number field index is within [0, count). It
+// isn't checked if either field is null.
+func checkIndex(index, count string) func(map[string]json.RawMessage) []string {
+	return func(fields map[string]json.RawMessage) []string {
+		if kindOf(fields[index]) == jsonNull || kindOf(fields[count]) == jsonNull {
+			return nil
+		}
+		var i, n float64
+		if json.Unmarshal(fields[index], &i) != nil || json.Unmarshal(fields[count], &n) != nil {
+			return nil
+		}
+		if i < 0 || i >= n {
+			return []string{fmt.Sprintf("%s %v is out of range for %s %v", index, i, count, n)}
+		}
+		return nil
+	}
+}
+
+// PacketError is returned by Start in strict mode, when a packet from Calibre
+// doesn't have the fields UNCaGED expects
+type PacketError struct {
+	Op       string   // The name Calibre uses for the opcode, eg: "SEND_BOOK"
+	Problems []string // Each problem found with the packet
+	Payload  []byte   // The payload of the packet
+}
+
+func (e *PacketError) Error() string {
+	return fmt.Sprintf("invalid %s packet: %s", e.Op, strings.Join(e.Problems, "; "))
+}
+
+// validatePacket checks the payload of a packet for opcode op against
+// packetRules, returning a *PacketError describing any problems
+func validatePacket(op calOpCode, data json.RawMessage) error {
+	rule, exists := packetRules[op]
+	if !exists {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		problem := fmt.Sprintf("payload is %s, expected object", kindOf(data))
+		var synErr *json.SyntaxError
+		if errors.As(err, &synErr) {
+			problem = fmt.Sprintf("payload is not valid JSON: %v", err)
+		}
+		return &PacketError{Op: op.String(), Problems: []string{problem}, Payload: append([]byte(nil), data...)}
+	}
+	var problems []string
+	for _, f := range rule.fields {
+		v, exists := fields[f.name]
+		if !exists {
+			problems = append(problems, fmt.Sprintf("missing field %s", f.name))
+		} else if k := kindOf(v); k != f.kind && !(k == jsonNull && rule.isNullable(f.name)) {
+			problems = append(problems, fmt.Sprintf("%s is %s, expected %s", f.name, k, f.kind))
+		}
+	}
+	if len(problems) == 0 && rule.check != nil {
+		problems = rule.check(fields)
+	}
+	if len(problems) > 0 {
+		return &PacketError{Op: op.String(), Problems: problems, Payload: append([]byte(nil), data...)}
+	}
+	return nil
+}
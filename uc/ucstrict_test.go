@@ -0,0 +1,59 @@
+package uc
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestValidatePacket(t *testing.T) {
+	tests := []struct {
+		op       calOpCode
+		payload  string
+		problems []string
+	}{
+		{sendBooklists, `{"count":2,"collections":{}}`, nil},
+		{sendBooklists, `{"count":"2"}`, []string{"count is string, expected number", "missing field collections"}},
+		{sendBooklists, `{"count":-1,"collections":{}}`, []string{"count is negative (-1)"}},
+		{sendBookMetadata, `{"count":2,"index":2,"data":{}}`, []string{"index 2 is out of range for count 2"}},
+		{deleteBook, `{"lpaths":["a.epub",1]}`, []string{"lpaths[1] is number, expected string"}},
+		{sendBook, `{"lpath":"a.epub","length":-5,"thisBook":0,"totalBooks":1,"willStreamBooks":true,"metadata":null}`,
+			[]string{"metadata is null, expected object"}},
+		{sendBook, `{"lpath":"a.epub","length":-5,"thisBook":1,"totalBooks":1,"willStreamBooks":true,"metadata":{}}`,
+			[]string{"length is negative (-5)", "thisBook 1 is out of range for totalBooks 1"}},
+		{getBookFileSegment, `{"lpath":"a.epub","position":0,"thisBook":null,"totalBooks":null}`, nil},
+		{getBookFileSegment, `{"lpath":"a.epub","position":0,"thisBook":2,"totalBooks":2}`,
+			[]string{"thisBook 2 is out of range for totalBooks 2"}},
+		{sendBook, `{"lpath":"a.epub","length":1,"thisBook":null,"totalBooks":1,"willStreamBooks":true,"metadata":{}}`,
+			[]string{"thisBook is null, expected number"}},
+		{sendBooklists, `[]`, []string{"payload is array, expected object"}},
+		{noop, `{"anything":1}`, nil},
+	}
+	for _, tt := range tests {
+		err := validatePacket(tt.op, json.RawMessage(tt.payload))
+		var pe *PacketError
+		if tt.problems == nil {
+			if err != nil {
+				t.Errorf("%s: expected a valid packet, got %v", tt.payload, err)
+			}
+		} else if !errors.As(err, &pe) || !reflect.DeepEqual(pe.Problems, tt.problems) || pe.Op != tt.op.String() {
+			t.Errorf("%s: expected problems %q, got %v", tt.payload, tt.problems, err)
+		}
+	}
+}
+
+func TestStrictPackets(t *testing.T) {
+	c := &calConn{client: logClient{}}
+	payload := json.RawMessage(`{"lpaths":"a.epub"}`)
+	var delBooks DeleteBooks
+	if err := c.decodePacket(deleteBook, payload, &delBooks); err == nil {
+		t.Errorf("Expected a decoding error")
+	}
+	c.clientOpts.StrictPackets = true
+	err := opError(deleteBook, c.decodePacket(deleteBook, payload, &delBooks))
+	var pe *PacketError
+	if !errors.As(err, &pe) || err.Phase != DecodePhase {
+		t.Errorf("Expected a PacketError in the decode phase, got %v", err)
+	}
+}
@@ -0,0 +1,379 @@
+// Package uctest provides MockClient, a uc.Client that keeps its books in
+// memory and records how UNCaGED calls it. It is intended for testing clients'
+// glue code, and UNCaGED itself.
+package uctest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// Call is a recorded call of a MockClient method
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+// Book is a book stored by a MockClient
+type Book struct {
+	Meta uc.CalibreBookMeta
+	Data []byte
+}
+
+// MockClient is a uc.Client storing books in memory. Set its fields before
+// passing it to uc.New. It is safe to inspect it from another goroutine while
+// a session is running.
+type MockClient struct {
+	// Options is returned by GetClientOptions
+	Options uc.ClientOptions
+	// Instance, if set, is selected by SelectCalibreInstance in place of the first instance
+	Instance *uc.CalInstance
+	// DeviceInfo is returned by GetDeviceInfo, and replaced by SetDeviceInfo
+	DeviceInfo uc.DeviceInfo
+	// FreeSpace and TotalSpace are reported to Calibre
+	FreeSpace  uint64
+	TotalSpace uint64
+	// Passwords are returned by successive calls of GetPassword. Once they run
+	// out, GetPassword returns no password.
+	Passwords []string
+	// Errors makes the named methods fail with the error given, for example
+	// Errors["SaveBook"] = errors.New("disk full")
+	Errors map[string]error
+	// LibraryInfo is the library info last received from Calibre
+	LibraryInfo uc.CalibreLibraryInfo
+	// Logf, if set, receives log messages, for example testing.T.Logf
+	Logf func(format string, a ...interface{})
+
+	mu    sync.Mutex
+	books map[string]*Book
+	calls []Call
+}
+
+// NewMockClient returns a MockClient with the default options for a device
+// supporting epub books, and 1GB free
+func NewMockClient() *MockClient {
+	mc := &MockClient{
+		Options: uc.ClientOptions{
+			ClientName:   "uctest",
+			DeviceName:   "uctest",
+			DeviceModel:  "MockClient",
+			SupportedExt: []string{"epub"},
+		},
+		FreeSpace:  1 << 30,
+		TotalSpace: 1 << 31,
+		books:      make(map[string]*Book),
+	}
+	mc.DeviceInfo.DevInfo.DeviceName = mc.Options.DeviceName
+	mc.DeviceInfo.DevInfo.LocationCode = "main"
+	return mc
+}
+
+// AddBook puts a book on the device, without recording a call
+func (mc *MockClient) AddBook(md uc.CalibreBookMeta, data []byte) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.books == nil {
+		mc.books = make(map[string]*Book)
+	}
+	mc.books[md.Lpath] = &Book{Meta: md, Data: data}
+}
+
+// Book returns the book stored at lpath, if any
+func (mc *MockClient) Book(lpath string) (Book, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if b, ok := mc.books[lpath]; ok {
+		return *b, true
+	}
+	return Book{}, false
+}
+
+// Books returns the books on the device, sorted by lpath
+func (mc *MockClient) Books() []Book {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	books := make([]Book, 0, len(mc.books))
+	for _, b := range mc.books {
+		books = append(books, *b)
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].Meta.Lpath < books[j].Meta.Lpath })
+	return books
+}
+
+// Calls returns the recorded calls of the methods named, or of all methods if
+// none are named
+func (mc *MockClient) Calls(methods ...string) []Call {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	var calls []Call
+	for _, call := range mc.calls {
+		if len(methods) == 0 || contains(methods, call.Method) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Reset forgets the recorded calls
+func (mc *MockClient) Reset() {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.calls = nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// record records a call, and returns the error configured for the method.
+// The caller must hold mc.mu.
+func (mc *MockClient) record(method string, args ...interface{}) error {
+	mc.calls = append(mc.calls, Call{Method: method, Args: args})
+	return mc.Errors[method]
+}
+
+// SelectCalibreInstance selects Instance if set, or else the first instance
+func (mc *MockClient) SelectCalibreInstance(calInstances []uc.CalInstance) uc.CalInstance {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.record("SelectCalibreInstance", calInstances)
+	if mc.Instance != nil {
+		return *mc.Instance
+	}
+	return calInstances[0]
+}
+
+// GetClientOptions returns Options
+func (mc *MockClient) GetClientOptions() (uc.ClientOptions, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.Options, mc.record("GetClientOptions")
+}
+
+// GetDeviceBookList lists the books on the device, sorted by lpath
+func (mc *MockClient) GetDeviceBookList() ([]uc.BookCountDetails, error) {
+	mc.mu.Lock()
+	err := mc.record("GetDeviceBookList")
+	mc.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var bl []uc.BookCountDetails
+	for _, b := range mc.Books() {
+		bd := uc.BookCountDetails{
+			UUID:      b.Meta.UUID,
+			Lpath:     b.Meta.Lpath,
+			Extension: strings.TrimPrefix(path.Ext(b.Meta.Lpath), "."),
+		}
+		if t := b.Meta.LastModified.GetTime(); t != nil {
+			bd.LastModified = *t
+		}
+		bl = append(bl, bd)
+	}
+	return bl, nil
+}
+
+// GetMetadataIter returns the metadata of the books, or of every book on the
+// device if books is nil
+func (mc *MockClient) GetMetadataIter(books []uc.BookID) uc.MetadataIter {
+	mc.mu.Lock()
+	err := mc.record("GetMetadataIter", books)
+	mc.mu.Unlock()
+	it := &mdIter{pos: -1, err: err}
+	if books == nil {
+		for _, b := range mc.Books() {
+			it.md = append(it.md, b.Meta)
+		}
+		return it
+	}
+	for _, id := range books {
+		if b, ok := mc.Book(id.Lpath); ok {
+			it.md = append(it.md, b.Meta)
+		}
+	}
+	return it
+}
+
+// mdIter is a MetadataIter over a slice of metadata
+type mdIter struct {
+	md  []uc.CalibreBookMeta
+	pos int
+	err error
+}
+
+func (it *mdIter) Next() bool {
+	it.pos++
+	return it.pos < len(it.md)
+}
+
+func (it *mdIter) Count() int {
+	return len(it.md)
+}
+
+func (it *mdIter) Get() (uc.CalibreBookMeta, error) {
+	if it.err != nil {
+		return uc.CalibreBookMeta{}, it.err
+	}
+	return it.md[it.pos], nil
+}
+
+// GetDeviceInfo returns DeviceInfo
+func (mc *MockClient) GetDeviceInfo() (uc.DeviceInfo, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.DeviceInfo, mc.record("GetDeviceInfo")
+}
+
+// SetDeviceInfo replaces DeviceInfo
+func (mc *MockClient) SetDeviceInfo(devInfo uc.DeviceInfo) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if err := mc.record("SetDeviceInfo", devInfo); err != nil {
+		return err
+	}
+	mc.DeviceInfo = devInfo
+	return nil
+}
+
+// UpdateMetadata replaces the metadata of books on the device
+func (mc *MockClient) UpdateMetadata(mdList []uc.CalibreBookMeta) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if err := mc.record("UpdateMetadata", mdList); err != nil {
+		return err
+	}
+	for _, md := range mdList {
+		if b, ok := mc.books[md.Lpath]; ok {
+			b.Meta = md
+		}
+	}
+	return nil
+}
+
+// GetFreeSpace returns FreeSpace
+func (mc *MockClient) GetFreeSpace() uint64 {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.record("GetFreeSpace")
+	return mc.FreeSpace
+}
+
+// GetTotalSpace returns TotalSpace
+func (mc *MockClient) GetTotalSpace() uint64 {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.record("GetTotalSpace")
+	return mc.TotalSpace
+}
+
+// SaveBook stores the book in memory
+func (mc *MockClient) SaveBook(md uc.CalibreBookMeta, book io.Reader, len int, lastBook bool) error {
+	data, err := ioutil.ReadAll(io.LimitReader(book, int64(len)))
+	if err != nil {
+		return fmt.Errorf("SaveBook: %w", err)
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if err = mc.record("SaveBook", md, len, lastBook); err != nil {
+		return err
+	}
+	mc.books[md.Lpath] = &Book{Meta: md, Data: data}
+	return nil
+}
+
+// GetBook returns the book at book.Lpath, from filePos
+func (mc *MockClient) GetBook(book uc.BookID, filePos int64) (io.ReadCloser, int64, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if err := mc.record("GetBook", book, filePos); err != nil {
+		return nil, -1, err
+	}
+	b, ok := mc.books[book.Lpath]
+	if !ok {
+		return nil, -1, fmt.Errorf("GetBook: no book at '%s'", book.Lpath)
+	}
+	if filePos > int64(len(b.Data)) {
+		filePos = int64(len(b.Data))
+	}
+	data := b.Data[filePos:]
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+// DeleteBook removes the book at book.Lpath
+func (mc *MockClient) DeleteBook(book uc.BookID) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if err := mc.record("DeleteBook", book); err != nil {
+		return err
+	}
+	delete(mc.books, book.Lpath)
+	return nil
+}
+
+// LogPrintf passes log messages to Logf, if set. It is not recorded.
+func (mc *MockClient) LogPrintf(logLevel uc.LogLevel, format string, a ...interface{}) {
+	if mc.Logf != nil {
+		mc.Logf(format, a...)
+	}
+}
+
+// DisplayMessage records the message from Calibre
+func (mc *MockClient) DisplayMessage(kind uc.MessageKind, text string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.record("DisplayMessage", kind, text)
+}
+
+// SetLibraryInfo stores the library info in LibraryInfo
+func (mc *MockClient) SetLibraryInfo(libInfo uc.CalibreLibraryInfo) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if err := mc.record("SetLibraryInfo", libInfo); err != nil {
+		return err
+	}
+	mc.LibraryInfo = libInfo
+	return nil
+}
+
+// GetPassword returns the next of Passwords
+func (mc *MockClient) GetPassword(calibreInfo uc.CalibreInitInfo) (string, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if err := mc.record("GetPassword", calibreInfo); err != nil {
+		return "", err
+	}
+	if len(mc.Passwords) == 0 {
+		return "", nil
+	}
+	password := mc.Passwords[0]
+	mc.Passwords = mc.Passwords[1:]
+	return password, nil
+}
+
+// CheckLpath sanitizes the lpath with uc.SanitizeLpath
+func (mc *MockClient) CheckLpath(lpath string) string {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.record("CheckLpath", lpath)
+	return uc.SanitizeLpath(lpath)
+}
+
+// UpdateStatus records the status update
+func (mc *MockClient) UpdateStatus(status uc.Status, progress int) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.record("UpdateStatus", status, progress)
+}
@@ -0,0 +1,74 @@
+package uc
+
+import "time"
+
+// isoLayouts are the layouts Calibre writes ISO timestamps in, depending on how
+// the date was stored. Timestamps without a time zone are UTC.
+var isoLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// parseISOTime parses a timestamp in any of the ISO formats Calibre uses
+func parseISOTime(timestamp string) (time.Time, bool) {
+	for _, layout := range isoLayouts {
+		if t, err := time.Parse(layout, timestamp); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// TimeField is a metadata date field Calibre announces a display format for
+type TimeField int
+
+// Date fields with formats in CalibreInitInfo
+const (
+	TimestampField TimeField = iota
+	PubdateField
+	LastModifiedField
+)
+
+// timeFormat returns the format Calibre announced for field
+func (ci CalibreInitInfo) timeFormat(field TimeField) string {
+	switch field {
+	case PubdateField:
+		return ci.PubdateFormat
+	case LastModifiedField:
+		return ci.LastModifiedFormat
+	}
+	return ci.TimestampFormat
+}
+
+// ParseTime parses a date from the metadata field. ISO timestamps are tried
+// first, then the format Calibre announced for field. Returns nil if ct is nil
+// or could not be parsed.
+func (ci CalibreInitInfo) ParseTime(field TimeField, ct *CalibreTime) *time.Time {
+	if ct == nil {
+		return nil
+	}
+	if t, ok := parseISOTime(string(*ct)); ok {
+		return &t
+	}
+	if calFmt := ci.timeFormat(field); calFmt != "" {
+		layout, _ := parseCalDateTimeFmtStr(calFmt)
+		if t, err := time.Parse(layout, string(*ct)); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+// FormatTime formats t as Calibre displays the metadata field, using the format
+// Calibre announced. RFC3339 is used if Calibre didn't announce a format.
+func (ci CalibreInitInfo) FormatTime(field TimeField, t time.Time) string {
+	calFmt := ci.timeFormat(field)
+	if calFmt == "" {
+		return t.Format(time.RFC3339)
+	}
+	layout, _ := parseCalDateTimeFmtStr(calFmt)
+	return t.Format(layout)
+}
@@ -0,0 +1,48 @@
+package uc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCalibreTime(t *testing.T) {
+	ci := CalibreInitInfo{PubdateFormat: "MMM yyyy", TimestampFormat: "dd MMM yyyy"}
+	tests := []struct {
+		field TimeField
+		ct    string
+		want  string // RFC3339, or empty if the time shouldn't parse
+	}{
+		{TimestampField, "2019-05-01T12:34:56+00:00", "2019-05-01T12:34:56Z"},
+		{TimestampField, "2019-05-01T12:34:56.123456+00:00", "2019-05-01T12:34:56Z"},
+		{TimestampField, "2019-05-01 12:34:56+02:00", "2019-05-01T12:34:56+02:00"},
+		{TimestampField, "2019-05-01T12:34:56", "2019-05-01T12:34:56Z"},
+		{TimestampField, "2019-05-01", "2019-05-01T00:00:00Z"},
+		{PubdateField, "May 2019", "2019-05-01T00:00:00Z"},
+		{TimestampField, "01 May 2019", "2019-05-01T00:00:00Z"},
+		{PubdateField, "01 May 2019", ""},
+		{LastModifiedField, "May 2019", ""},
+	}
+	for _, tt := range tests {
+		ct := CalibreTime(tt.ct)
+		got := ci.ParseTime(tt.field, &ct)
+		if tt.want == "" {
+			if got != nil {
+				t.Errorf("%q: expected no time, got %v", tt.ct, got)
+			}
+			continue
+		}
+		if got == nil || got.Format(time.RFC3339) != tt.want {
+			t.Errorf("%q: got %v, want %s", tt.ct, got, tt.want)
+		}
+	}
+	if ci.ParseTime(PubdateField, nil) != nil {
+		t.Errorf("Expected nil for a nil time")
+	}
+	date := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	if got := ci.FormatTime(PubdateField, date); got != "May 2019" {
+		t.Errorf("Expected pubdate formatted as 'May 2019', got %q", got)
+	}
+	if got := ci.FormatTime(LastModifiedField, date); got != "2019-05-01T00:00:00Z" {
+		t.Errorf("Expected RFC3339 without an announced format, got %q", got)
+	}
+}
@@ -0,0 +1,214 @@
+package uc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// PartialTransfer describes a book that SaveBook failed to finish saving
+type PartialTransfer struct {
+	Lpath  string `json:"lpath"`
+	UUID   string `json:"uuid"`
+	Length int    `json:"length"`
+	// Written is the number of bytes of the book the client had read when
+	// SaveBook failed. The client may have stored fewer, so this is only an
+	// upper bound on where saving resumes.
+	Written int64 `json:"written"`
+}
+
+// matches returns true if a book Calibre is sending is the same book as
+// the partial transfer
+func (pt PartialTransfer) matches(md CalibreBookMeta, length int) bool {
+	return pt.UUID == md.UUID && pt.Length == length && pt.Written < int64(length)
+}
+
+// TransferJournal records books that failed to save partway through, so that
+// saving can resume when Calibre sends the book again. Clients may provide an
+// implementation in ClientOptions. Resuming requires the client to implement
+// BookAppender.
+//
+// Calibre always sends the whole book again, and the bytes already stored are
+// read and discarded, so resuming saves writes to the device's storage, not
+// network transfer.
+type TransferJournal interface {
+	// Record records a partial transfer, replacing any previous one for the same lpath
+	Record(pt PartialTransfer)
+	// Lookup returns the partial transfer of the book at lpath
+	Lookup(lpath string) (PartialTransfer, bool)
+	// Remove removes the partial transfer of the book at lpath
+	Remove(lpath string)
+	// Save persists the journal
+	Save() error
+}
+
+// BookAppender may optionally be implemented by a Client to resume saving books
+// that SaveBook failed to finish. Note that Calibre always sends the whole book,
+// so resuming saves writes to the device's storage rather than network transfer.
+type BookAppender interface {
+	// StoredLength returns how many bytes of a partially saved book are stored on
+	// the device. A failed SaveBook may have read more of the book than it stored,
+	// so saving resumes from here. An error, or zero, saves the book from the start.
+	StoredLength(md CalibreBookMeta) (int64, error)
+	// AppendBook continues saving a book. The first 'offset' bytes of the book are
+	// stored, as reported by StoredLength, and book provides the remaining bytes of
+	// the 'len' byte book. Clients should truncate any partially saved file to
+	// 'offset' bytes before appending.
+	AppendBook(md CalibreBookMeta, book io.Reader, offset int64, len int, lastBook bool) error
+}
+
+// FileTransferJournal is a TransferJournal persisted as a JSON file. It is
+// intended to be stored alongside the client's metadata.
+type FileTransferJournal struct {
+	path      string
+	mu        sync.Mutex
+	transfers map[string]PartialTransfer
+}
+
+// NewFileTransferJournal creates a FileTransferJournal saved at path, loading
+// any existing contents
+func NewFileTransferJournal(path string) (*FileTransferJournal, error) {
+	j := &FileTransferJournal{path: path, transfers: make(map[string]PartialTransfer)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return j, nil
+		}
+		return nil, fmt.Errorf("NewFileTransferJournal: error reading journal: %w", err)
+	}
+	if len(data) == 0 {
+		return j, nil
+	}
+	if err = json.Unmarshal(data, &j.transfers); err != nil {
+		return nil, fmt.Errorf("NewFileTransferJournal: error decoding journal: %w", err)
+	}
+	return j, nil
+}
+
+// Record records a partial transfer
+func (j *FileTransferJournal) Record(pt PartialTransfer) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.transfers[pt.Lpath] = pt
+}
+
+// Lookup returns the partial transfer of the book at lpath
+func (j *FileTransferJournal) Lookup(lpath string) (PartialTransfer, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	pt, ok := j.transfers[lpath]
+	return pt, ok
+}
+
+// Remove removes the partial transfer of the book at lpath
+func (j *FileTransferJournal) Remove(lpath string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.transfers, lpath)
+}
+
+// Save writes the journal to disk
+func (j *FileTransferJournal) Save() error {
+	j.mu.Lock()
+	data, err := json.MarshalIndent(j.transfers, "", "    ")
+	j.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("Save: error encoding journal: %w", err)
+	}
+	// Write to a temporary file first, so a failed save doesn't lose the journal
+	tmp := j.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("Save: error writing journal: %w", err)
+	}
+	if err = os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("Save: error replacing journal: %w", err)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// saveBook passes a book to the client to save. If the client has a TransferJournal,
+// books that fail to save are recorded in it, and resumed with BookAppender when
+// Calibre sends them again.
+func (c *calConn) saveBook(d BookDetails, book io.Reader) error {
+	md, length := d.Metadata, d.Length
+	j := c.clientOpts.Transfers
+	if j == nil {
+		return c.clientSaveBook(d, book)
+	}
+	cr := &countingReader{r: book}
+	var err error
+	pt, resume := j.Lookup(md.Lpath)
+	ba, canAppend := c.client.(BookAppender)
+	var stored int64
+	if resume && canAppend && pt.matches(md, length) {
+		stored = c.storedLength(ba, md, pt)
+	}
+	if stored > 0 {
+		c.logf(Info, "saveBook: resuming '%s' from byte %d\n", md.Lpath, stored)
+		if _, err = copyBook(ioutil.Discard, cr, stored); err != nil {
+			return fmt.Errorf("saveBook: error skipping saved bytes: %w", err)
+		}
+		err = ba.AppendBook(md, cr, stored, length, d.LastBook)
+	} else {
+		err = c.clientSaveBook(d, cr)
+	}
+	if err != nil {
+		if cr.n > 0 && !errors.Is(err, BookCancelled) {
+			j.Record(PartialTransfer{Lpath: md.Lpath, UUID: md.UUID, Length: length, Written: cr.n})
+			c.saveJournal()
+		}
+		return err
+	}
+	if resume {
+		j.Remove(md.Lpath)
+		c.saveJournal()
+	}
+	return nil
+}
+
+// storedLength asks the client how much of the partial transfer pt it stored,
+// returning 0 if saving can't resume
+func (c *calConn) storedLength(ba BookAppender, md CalibreBookMeta, pt PartialTransfer) int64 {
+	stored, err := ba.StoredLength(md)
+	if err != nil {
+		c.logf(Warn, "saveBook: can't resume '%s', saving it again: %v\n", md.Lpath, err)
+		return 0
+	}
+	// The client can't have stored more than it read
+	if stored < 0 || stored > pt.Written {
+		c.logf(Warn, "saveBook: can't resume '%s' from byte %d of %d read, saving it again\n", md.Lpath, stored, pt.Written)
+		return 0
+	}
+	return stored
+}
+
+// clientSaveBook calls SaveBookDetails if the client implements it, and SaveBook otherwise
+func (c *calConn) clientSaveBook(d BookDetails, book io.Reader) error {
+	if ds, ok := c.client.(DetailedBookSaver); ok {
+		return ds.SaveBookDetails(d, book)
+	}
+	return c.client.SaveBook(d.Metadata, book, d.Length, d.LastBook)
+}
+
+// saveJournal persists the transfer journal, logging any failure
+func (c *calConn) saveJournal() {
+	if err := c.clientOpts.Transfers.Save(); err != nil {
+		c.logf(Warn, "saveJournal: error saving transfer journal: %v\n", err)
+	}
+}
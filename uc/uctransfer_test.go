@@ -0,0 +1,74 @@
+package uc
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// flakyClient fails to save books after reading 5 bytes, having only stored
+// 3 of them, and appends the rest when resuming
+type flakyClient struct {
+	logClient
+	offset   int64
+	appended string
+}
+
+func (fc *flakyClient) StoredLength(md CalibreBookMeta) (int64, error) {
+	return 3, nil
+}
+
+func (fc *flakyClient) SaveBook(md CalibreBookMeta, book io.Reader, len int, lastBook bool) error {
+	io.CopyN(ioutil.Discard, book, 5)
+	return errors.New("out of space")
+}
+
+func (fc *flakyClient) AppendBook(md CalibreBookMeta, book io.Reader, offset int64, len int, lastBook bool) error {
+	rest, err := ioutil.ReadAll(book)
+	fc.offset, fc.appended = offset, string(rest)
+	return err
+}
+
+func TestResumeTransfer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "transfers.json")
+	j, err := NewFileTransferJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := &flakyClient{}
+	c := &calConn{client: fc}
+	c.clientOpts.Transfers = j
+	md := CalibreBookMeta{Lpath: "a.epub", UUID: "abc"}
+	book := "0123456789"
+	if err = c.saveBook(BookDetails{Metadata: md, Length: len(book), LastBook: true}, strings.NewReader(book)); err == nil {
+		t.Fatal("Expected save to fail")
+	}
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary file renamed, got %v", err)
+	}
+	// The journal should survive a restart
+	if c.clientOpts.Transfers, err = NewFileTransferJournal(path); err != nil {
+		t.Fatal(err)
+	}
+	if pt, ok := c.clientOpts.Transfers.Lookup("a.epub"); !ok || pt.Written != 5 {
+		t.Fatalf("Expected 5 bytes journaled, got %+v", pt)
+	}
+	if err = c.saveBook(BookDetails{Metadata: md, Length: len(book), LastBook: true}, strings.NewReader(book)); err != nil {
+		t.Fatal(err)
+	}
+	if fc.offset != 3 || fc.appended != "3456789" {
+		t.Errorf("Expected resume at 3 with '3456789', got %d with '%s'", fc.offset, fc.appended)
+	}
+	if _, ok := c.clientOpts.Transfers.Lookup("a.epub"); ok {
+		t.Errorf("Expected completed transfer removed from journal")
+	}
+}
@@ -0,0 +1,53 @@
+package uc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// BookTransform converts books as they are received, before they reach SaveBook.
+// Examples include converting EPUBs to KEPUBs, or injecting CSS. Transforms are
+// listed in ClientOptions, and applied in order.
+type BookTransform interface {
+	// Lpath returns the lpath the book described by md will have once transformed,
+	// such as with a different extension. It is called before the book is received,
+	// so Calibre can be told of the new lpath. If Calibre doesn't support lpath
+	// changes, the book keeps its original lpath.
+	Lpath(md CalibreBookMeta) string
+	// Transform returns a reader producing the transformed book, and its length.
+	// book is 'length' bytes long. Return a negative length if it isn't known
+	// until the book has been transformed, and UNCaGED will buffer the transformed
+	// book in memory to find it.
+	Transform(md CalibreBookMeta, book io.Reader, length int) (io.Reader, int, error)
+}
+
+// transformLpath returns the lpath of a book after every transform is applied
+func (c *calConn) transformLpath(md CalibreBookMeta) string {
+	for _, t := range c.clientOpts.Transforms {
+		md.Lpath = t.Lpath(md)
+	}
+	return md.Lpath
+}
+
+// transform applies every transform to a book, returning the transformed book and
+// its length. The size in md is updated to match.
+func (c *calConn) transform(md *CalibreBookMeta, book io.Reader, length int) (io.Reader, int, error) {
+	var err error
+	for _, t := range c.clientOpts.Transforms {
+		if book, length, err = t.Transform(*md, book, length); err != nil {
+			return nil, 0, fmt.Errorf("transform: %w", err)
+		}
+		if length < 0 {
+			var buf bytes.Buffer
+			if _, err = buf.ReadFrom(book); err != nil {
+				return nil, 0, fmt.Errorf("transform: error buffering transformed book: %w", err)
+			}
+			book, length = &buf, buf.Len()
+		}
+	}
+	if len(c.clientOpts.Transforms) > 0 {
+		md.Size = length
+	}
+	return book, length, nil
+}
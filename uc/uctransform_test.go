@@ -0,0 +1,41 @@
+package uc
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// upperTransform converts books to upper case, and changes their extension
+type upperTransform struct{ knownLength bool }
+
+func (upperTransform) Lpath(md CalibreBookMeta) string {
+	return strings.TrimSuffix(md.Lpath, ".txt") + ".TXT"
+}
+
+func (ut upperTransform) Transform(md CalibreBookMeta, book io.Reader, length int) (io.Reader, int, error) {
+	b, err := ioutil.ReadAll(book)
+	out := strings.NewReader(strings.ToUpper(string(b)) + "!")
+	if !ut.knownLength {
+		return out, -1, err
+	}
+	return out, length + 1, err
+}
+
+func TestTransform(t *testing.T) {
+	c := &calConn{}
+	c.clientOpts.Transforms = []BookTransform{upperTransform{knownLength: true}, upperTransform{}}
+	md := CalibreBookMeta{Lpath: "book.txt"}
+	if lp := c.transformLpath(md); lp != "book.TXT.TXT" {
+		t.Errorf("Unexpected transformed lpath %s", lp)
+	}
+	r, length, err := c.transform(&md, strings.NewReader("abc"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	if string(b) != "ABC!!" || length != 5 || md.Size != 5 {
+		t.Errorf("Unexpected transformed book '%s', length %d, size %d", b, length, md.Size)
+	}
+}
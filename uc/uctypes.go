@@ -22,10 +22,17 @@ package uc
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"io"
+	"log/slog"
+	"math"
+	"math/rand"
 	"net"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/shermp/UNCaGED/calibre"
@@ -41,6 +48,12 @@ type LogLevel int
 // Status is a set of pre-defined status codes to be sent to the client
 type Status int
 
+// MessageKind identifies the type of message Calibre has asked the client to display
+type MessageKind int
+
+// WarningKind identifies the type of problem a Warning describes
+type WarningKind int
+
 // CalError is the type of Calibre specific errors the client should check for
 type CalError string
 
@@ -48,10 +61,40 @@ type CalError string
 // from having to import another package
 type CalInstance = calibre.ConnectionInfo
 
+// Registry is an alias for calibre.Registry. It saves the client from having
+// to import another package
+type Registry = calibre.Registry
+
+// DiscoveryOptions is an alias for calibre.DiscoveryOptions. It saves the client
+// from having to import another package
+type DiscoveryOptions = calibre.DiscoveryOptions
+
 // Specific Calibre errors that should be handled
 const (
 	CalibreNotFound CalError = "calibre server not found"
 	NoPassword      CalError = "no password found"
+	BusyTimeout     CalError = "calibre remained busy"
+	BookCancelled   CalError = "book transfer cancelled"
+	// CalibreClosedConnection is matched by errors caused by Calibre closing the
+	// connection in the middle of an operation
+	CalibreClosedConnection CalError = "calibre closed the connection"
+	// ConnectionTimeout is matched by errors caused by Calibre not responding in time
+	ConnectionTimeout CalError = "connection with calibre timed out"
+	// PasswordRejected is returned when Calibre rejected the password, and the
+	// client provided no other password
+	PasswordRejected CalError = "calibre rejected the password"
+	// NotImplemented is returned by BaseClient methods the client must override
+	// to support an operation
+	NotImplemented CalError = "not implemented by the client"
+	// HostNotAllowed is returned when connecting to a Calibre instance that isn't
+	// in ClientOptions.AllowedHosts
+	HostNotAllowed CalError = "calibre host is not allowed"
+	// TooManyPasswordAttempts is returned when Calibre has rejected as many
+	// passwords as ClientOptions.PasswordRetry allows
+	TooManyPasswordAttempts CalError = "too many password attempts"
+	// MalformedPacket is matched by errors caused by a packet from Calibre that
+	// couldn't be framed or split into its opcode and payload
+	MalformedPacket CalError = "malformed packet from calibre"
 )
 
 func (ce CalError) Error() string {
@@ -73,12 +116,14 @@ const (
 	getBookCount          calOpCode = 6
 	getDeviceInformation  calOpCode = 3
 	getInitializationInfo calOpCode = 9
+	bookData              calOpCode = 10
 	sendBooklists         calOpCode = 7
 	sendBook              calOpCode = 8
 	sendBookMetadata      calOpCode = 16
 	setCalibreDeviceInfo  calOpCode = 1
 	setCalibreDeviceName  calOpCode = 2
 	totalSpace            calOpCode = 4
+	errorOp               calOpCode = 20
 )
 
 // Calibre essage codes
@@ -92,6 +137,7 @@ const (
 const (
 	PriKey ucdbSearchType = iota
 	Lpath
+	UUID
 )
 
 // UNCaGED log levels
@@ -114,10 +160,93 @@ const (
 	SendingExtraMetadata
 	EmptyPasswordReceived
 	Waiting
+	UpdatingMetadata
+	CalibreBusy
+	SendingBooklist
 )
 
+var statusNames = [...]string{
+	SearchingCalibre:      "searching for calibre",
+	Connecting:            "connecting",
+	Connected:             "connected",
+	Disconnected:          "disconnected",
+	Idle:                  "idle",
+	ReceivingBook:         "receiving book",
+	SendingBook:           "sending book",
+	DeletingBook:          "deleting book",
+	SendingExtraMetadata:  "sending extra metadata",
+	EmptyPasswordReceived: "empty password received",
+	Waiting:               "waiting",
+	UpdatingMetadata:      "updating metadata",
+	CalibreBusy:           "calibre busy",
+	SendingBooklist:       "sending booklist",
+}
+
+func (s Status) String() string {
+	if s >= 0 && int(s) < len(statusNames) {
+		return statusNames[s]
+	}
+	return "status " + strconv.Itoa(int(s))
+}
+
+// UNCaGED warning kinds
+const (
+	// DuplicateUUID indicates more than one book on the device shares the same UUID
+	DuplicateUUID WarningKind = iota
+	// MissingUUID indicates one or more books on the device have no UUID. UNCaGED
+	// generates a stable UUID from the lpath for these books. The generated UUIDs
+	// are provided in the warning, should the client wish to save them.
+	MissingUUID
+	// DuplicateBook indicates a book was received that is identical to a book
+	// already stored on the device under a different lpath
+	DuplicateBook
+	// ProtocolMismatch indicates a packet from Calibre could not be decoded, most
+	// likely because a newer version of Calibre changed its format. The packet
+	// was acknowledged so the session could continue. The raw packet is provided
+	// in the warning's Payload.
+	ProtocolMismatch
+	// TransferFailed indicates a received book failed verification, and was deleted
+	// from the device. Calibre will see that the book is not on the device, and offer
+	// to send it again.
+	TransferFailed
+	// InvalidMetadata indicates Calibre sent metadata that is missing required
+	// fields, or has invalid values. The metadata is still passed to the client.
+	InvalidMetadata
+	// UnknownFields indicates a packet from Calibre had fields UNCaGED doesn't
+	// know, most likely because a newer version of Calibre added them. Each
+	// field is reported once per connection, with the fields in Payload.
+	UnknownFields
+	// BookRefused indicates a book Calibre sent was discarded, because the
+	// client refused it, or its lpath was unsafe. Calibre sees the book is not
+	// on the device, and carries on with the rest of the batch.
+	BookRefused
+)
+
+// Kinds of message Calibre may ask the client to display
+const (
+	// ToastMessage is a short notification, such as "Metadata sync complete"
+	ToastMessage MessageKind = iota
+	// UpdateNeededMessage informs the user that Calibre considers the device app
+	// outdated. If Calibre reported the latest version it knows about, the message
+	// includes it.
+	UpdateNeededMessage
+)
+
+// Warning describes a non-fatal problem UNCaGED encountered, that the client
+// may wish to act on, or display to the user
+type Warning struct {
+	Kind    WarningKind
+	Message string
+	Books   []BookID
+	Payload []byte
+}
+
 // UncagedDB is the structure used by UNCaGED's internal database
 type UncagedDB struct {
+	// mu guards changes to the booklist against the client's queries. The
+	// session only changes the booklist from one goroutine, so its own reads
+	// aren't locked.
+	mu       sync.RWMutex
 	nextKey  int
 	booklist []BookCountDetails
 }
@@ -135,7 +264,8 @@ type MetadataIter interface {
 }
 
 // Client is the interface that specific implementations of UNCaGED must implement.
-// Errors will be returned as-is.
+// Errors will be returned as-is. Optional features, such as passwords and status
+// updates, are provided by implementing the capability interfaces below.
 type Client interface {
 	// SelectCalibreInstance allows the client to choose a calibre instance if multiple
 	// are found on the network
@@ -157,18 +287,11 @@ type Client interface {
 	// SetDeviceInfo sets the new device info, as comes from calibre. Only the nested
 	// struct DevInfo is modified.
 	SetDeviceInfo(devInfo DeviceInfo) error
-	// SetLibraryInfo provides the client with some information about the currently connected library
-	SetLibraryInfo(libInfo CalibreLibraryInfo) error
 	// UpdateMetadata instructs the client to update their metadata according to the
 	// new slice of metadata maps
 	UpdateMetadata(mdList []CalibreBookMeta) error
-	// GetPassword gets a password from the user.
-	GetPassword(calibreInfo CalibreInitInfo) (password string, err error)
 	// GetFreeSpace reports the amount of free storage space to Calibre
 	GetFreeSpace() uint64
-	// CheckLpath asks the client to verify a provided Lpath, and change it if required
-	// Return the original string if the Lpath does not need changing
-	CheckLpath(lpath string) (newLpath string)
 	// SaveBook saves a book with the provided metadata to the disk.
 	// Implementations saves the book from the provided io.Reader, which will be 'len' bytes long
 	// lastBook informs the client that this is the last book for this transfer
@@ -182,38 +305,347 @@ type Client interface {
 	// DeleteBook instructs the client to delete the specified book on the device
 	// Error is returned if the book was unable to be deleted
 	DeleteBook(book BookID) error
-	// UpdateStatus informs the client what UNCaGED is doing. It is purely informational,
-	// and it's implementation may be empty
+	// Instructs the client to log informational and debug info, that aren't errors
+	LogPrintf(logLevel LogLevel, format string, a ...interface{})
+}
+
+// TotalSpaceReporter may optionally be implemented by a Client to report the
+// total storage capacity of the device. Without it, Calibre is told the free
+// space is the total.
+type TotalSpaceReporter interface {
+	// GetTotalSpace reports the total storage capacity of the device to Calibre
+	GetTotalSpace() uint64
+}
+
+// MessageDisplayer may optionally be implemented by a Client to show messages
+// from Calibre to the user. Without it, the messages are logged.
+type MessageDisplayer interface {
+	// DisplayMessage asks the client to show a message from Calibre to the user
+	DisplayMessage(kind MessageKind, text string)
+}
+
+// LibraryInfoReceiver may optionally be implemented by a Client that wants
+// to know about the connected Calibre library
+type LibraryInfoReceiver interface {
+	// SetLibraryInfo provides the client with some information about the currently connected library
+	SetLibraryInfo(libInfo CalibreLibraryInfo) error
+}
+
+// PasswordProvider may optionally be implemented by a Client that can connect
+// to password protected Calibre instances. Without it, UNCaGED stops with
+// NoPassword when Calibre asks for a password.
+type PasswordProvider interface {
+	// GetPassword gets a password from the user.
+	GetPassword(calibreInfo CalibreInitInfo) (password string, err error)
+}
+
+// LpathChecker may optionally be implemented by a Client that can't store
+// books under every lpath Calibre sends. Clients that don't implement it have
+// lpaths sanitized with SanitizeLpath.
+type LpathChecker interface {
+	// CheckLpath asks the client to verify a provided Lpath, and change it if required
+	// Return the original string if the Lpath does not need changing
+	CheckLpath(lpath string) (newLpath string)
+}
+
+// StatusReporter may optionally be implemented by a Client that shows the user
+// what UNCaGED is doing
+type StatusReporter interface {
+	// UpdateStatus informs the client what UNCaGED is doing. It is purely informational.
 	// status: What UC is currently doing (eg: receiving book(s))
 	// progress: If the current status has a progress associated with it, progress will be
 	//           between 0 & 100. Otherwise progress will be negative
 	UpdateStatus(status Status, progress int)
-	// Instructs the client to log informational and debug info, that aren't errors
-	LogPrintf(logLevel LogLevel, format string, a ...interface{})
+}
+
+// ExitChannelReceiver may optionally be implemented by a Client that stops
+// UNCaGED with a channel. New clients should use StartContext instead.
+type ExitChannelReceiver interface {
 	// SetExitChannel provides the client with a channel to prematurely stop UNCaGED.
 	// when true is sent on the channel, UNCaGED will stop after finishing the current job.
 	// UNCaGED will exit Start() with a nil error if no other errors were detected
 	SetExitChannel(exitChan chan<- bool)
 }
 
+// BookAcceptor may optionally be implemented by a Client to refuse books before they
+// are transferred, such as unwanted formats, oversized files or duplicates.
+type BookAcceptor interface {
+	// AcceptBook is called before a book is received, with the details Calibre sent.
+	// Return a non-nil error to refuse the book. The book is discarded, and reported
+	// with a BookRefused warning. The session continues after a book is refused.
+	AcceptBook(book SendBook) error
+}
+
+// BookDetails describes a book being saved, for clients implementing DetailedBookSaver
+type BookDetails struct {
+	Metadata CalibreBookMeta
+	// Length is the number of bytes to save
+	Length int
+	// Index and Total are the position of the book in the batch Calibre is
+	// sending, with Index starting from 0
+	Index    int
+	Total    int
+	LastBook bool
+	// CalibreLpath is the lpath Calibre sent the book with. Metadata.Lpath is
+	// where the book should be saved.
+	CalibreLpath string
+	// LpathChanged is true if the book is saved at a different lpath than the one
+	// Calibre sent, such as when the client's CheckLpath changed it
+	LpathChanged bool
+}
+
+// DetailedBookSaver may optionally be implemented by a Client that needs more
+// details about each book than SaveBook provides, such as for batch progress or
+// renaming. SaveBookDetails is called instead of SaveBook.
+type DetailedBookSaver interface {
+	// SaveBookDetails saves a book from book, which will be details.Length bytes long
+	SaveBookDetails(details BookDetails, book io.Reader) error
+}
+
+// BookUpdater may optionally be implemented by a Client to take part in Calibre's
+// book update handshake. UNCaGED tells Calibre it will ask for updated books, and
+// reports when each book file on the device was last modified. Calibre then sends
+// the library copy of any book that is newer than the copy on the device.
+type BookUpdater interface {
+	// FormatModified returns when the file for book was last modified on the device.
+	// Return false if this is unknown, and Calibre will not update the book.
+	FormatModified(book BookID) (modified time.Time, ok bool)
+	// ApproveUpdate is called before a newer copy of book from the library replaces
+	// the copy on the device. md is the metadata of the new copy. Return false to
+	// keep the copy on the device.
+	ApproveUpdate(book BookID, md CalibreBookMeta) bool
+}
+
+// mainLocation is the location code of the device's main storage
+const mainLocation = "main"
+
+// ReadStatus is the read status of a book, as synced with Calibre's read
+// and read date sync columns
+type ReadStatus struct {
+	IsRead bool
+	// LastRead is when the book was last read. The zero time means unknown
+	LastRead time.Time
+	// Changed is set by the client if the read status has changed on the device
+	// since it was last synced, so Calibre should update its columns
+	Changed bool
+}
+
+// ReadSyncer may optionally be implemented by a Client to sync the read status of
+// books with Calibre, when Calibre has read sync columns configured
+type ReadSyncer interface {
+	// GetReadStatus returns the read status of book. Return false if the read status
+	// of the book is unknown.
+	GetReadStatus(book BookID) (status ReadStatus, ok bool)
+	// SetReadStatus updates the read status of book with the status from Calibre
+	SetReadStatus(book BookID, status ReadStatus) error
+}
+
+// CollectionsReceiver may optionally be implemented by a Client to receive the
+// collections Calibre builds for the books on the device, such as from their series
+// or tags. Readers can use these to build shelves.
+type CollectionsReceiver interface {
+	// SetCollections is called each time Calibre sends updated metadata, with every
+	// collection on the device. Books not in any collection are not listed.
+	SetCollections(cols Collections) error
+}
+
+// BookDigest describes the content of a book file
+type BookDigest struct {
+	// Size is the length of the book in bytes
+	Size int64
+	// Hash is the hex encoded SHA-256 sum of the book, as produced by HashReader
+	Hash string
+}
+
+// BookVerifier may optionally be implemented by a Client to check books were saved
+// intact. Books that fail verification are deleted before their metadata is added
+// to the booklist.
+type BookVerifier interface {
+	// VerifyBook is called after SaveBook returns, and returns the digest of the book
+	// as saved. An empty Hash skips comparing hashes. Return an error to reject the book
+	VerifyBook(md CalibreBookMeta) (BookDigest, error)
+}
+
+// ReadSyncReporter may optionally be implemented by a Client that implements
+// ReadSyncer, to learn which books had their read status synced in a session
+type ReadSyncReporter interface {
+	// ReadStatusSynced is called after Calibre has sent updated metadata, with the
+	// books whose read status was set from Calibre. Clients should clear the Changed
+	// flag of these books, as Calibre is now up to date.
+	ReadStatusSynced(books []BookID)
+}
+
+// StorageSelector may optionally be implemented by a Client to choose where each book
+// Calibre sends is stored, such as sending comics to an SD card, and novels to the
+// main storage. Books stored anywhere other than the main location have the location
+// code prepended to their lpath (eg: "cardA/Author/Title.epub"), which is reported
+// back to Calibre. This requires Calibre to support lpath changes. If it doesn't,
+// books are always stored in the main location. Locations other than the main
+// location must be listed in ClientOptions.Locations.
+type StorageSelector interface {
+	// SelectStorage returns the location code of the storage the book described by
+	// md, and 'len' bytes long, should be saved to. Return "main" or an empty
+	// string for the main storage.
+	SelectStorage(md CalibreBookMeta, len int) (location string)
+}
+
+// FormatSyncer may optionally be implemented by a Client to take part in book format
+// sync. When Calibre sends a book in a different format to a copy already on the
+// device (eg: an epub, when the mobi is on the device), the client is asked whether
+// the new format replaces the old one. Formats sent in the same batch never replace
+// each other. Calibre learns of a replaced format at its next book count.
+type FormatSyncer interface {
+	// ReplaceFormat is called after md has been saved, for each other format of the
+	// same book on the device. oldExt and newExt are the lower case extensions of the
+	// old and new formats, without the dot (eg: "mobi" and "epub"). Return true to
+	// have UNCaGED delete the old format.
+	ReplaceFormat(old BookID, md CalibreBookMeta, oldExt, newExt string) bool
+}
+
+// BookQueueReceiver may optionally be implemented by a Client to learn about the
+// books Calibre is going to send, before they arrive
+type BookQueueReceiver interface {
+	// BookQueueStarted is called when Calibre starts sending a batch of 'total' books
+	BookQueueStarted(total int)
+	// BookQueued is called with the metadata of each book in the batch as Calibre
+	// announces it, before the book itself is received
+	BookQueued(index, total int, md CalibreBookMeta)
+}
+
+// BandwidthReporter may optionally be implemented by a Client to be informed
+// each time UNCaGED updates its estimate of the connection throughput
+type BandwidthReporter interface {
+	// UpdateBandwidth provides the latest throughput estimate
+	UpdateBandwidth(est BandwidthEstimate)
+}
+
+// WarningReporter may optionally be implemented by a Client to receive structured
+// warnings. Clients that do not implement it receive warnings via LogPrintf instead.
+type WarningReporter interface {
+	// ReportWarning informs the client of a non-fatal problem
+	ReportWarning(w Warning)
+}
+
+// PasswordFailure describes a failed attempt to authenticate with a Calibre instance
+type PasswordFailure struct {
+	Instance    CalInstance
+	LibraryName string
+	LibraryUUID string
+	// Failures is the number of passwords that have been rejected by this library
+	Failures int
+}
+
+// InstanceReselector may optionally be implemented by a Client, to choose a different
+// Calibre instance after the password for the selected instance is rejected. This
+// allows networks with several password protected instances to be handled without
+// restarting discovery.
+type InstanceReselector interface {
+	// ReselectCalibreInstance is called with the instances originally found, and details
+	// of the failure. It returns the instance to use, and false to instead keep the
+	// current instance and ask for its password again with GetPassword.
+	ReselectCalibreInstance(calInstances []CalInstance, failure PasswordFailure) (CalInstance, bool)
+}
+
 // calConn holds all parameters required to implement a calibre connection
 type calConn struct {
 	clientOpts      ClientOptions
 	calibreInstance CalInstance
 	calibreInfo     CalibreInitInfo
+	features        protocolFeatures
 	deviceInfo      DeviceInfo
 	okStr           string
 	serverPassword  string
 	tcpConn         net.Conn
 	tcpReader       *bufio.Reader
-	tcpDeadline     struct {
-		stdDuration time.Duration
-		altDuration time.Duration
-	}
+	tcpDeadline     connDeadline
+	// ucdb is only changed by the session goroutine, under the lock in UncagedDB
 	ucdb          *UncagedDB
 	client        Client
 	transferCount int
 	debug         bool
+	bandwidth     BandwidthEstimate
+	connected     bool
+	// booksReceived is set if any books have been received since
+	// Calibre last requested the booklist
+	booksReceived bool
+	// instances are the Calibre instances found during discovery
+	instances []CalInstance
+	// passwords and passwordFailures track authentication state for each
+	// Calibre library, keyed by passwordKey()
+	passwords        map[string]string
+	passwordFailures map[string]int
+	// newPassword is set when the current password came from the client's
+	// PasswordProvider, and hasn't been saved to its CredentialStore
+	newPassword bool
+	// missing are the lpaths of books the client has marked as missing
+	missing   map[string]struct{}
+	missingMu sync.Mutex
+	// readSync is set if Calibre has read sync columns configured
+	readSync bool
+	// formatSync is set if Calibre supports book format sync
+	formatSync bool
+	// batchLpaths are the books received in the current SEND_BOOK batch. They
+	// are never replaced by other formats sent in the same batch.
+	batchLpaths map[string]bool
+	// logCtx is the context of the operation currently being performed
+	logCtx LogContext
+	// busyRetries is the number of times in a row Calibre has reported it is busy
+	busyRetries int
+	// stateMu guards the state the client may query while the session is
+	// running: stats, bandwidth, calibreInfo and deviceInfo. As with ucdb, only
+	// the session goroutine changes them, so its own reads aren't locked.
+	stateMu sync.RWMutex
+	// stats summarises the current, or most recent, session
+	stats SessionStats
+	// offered are books the client has offered to Calibre, that have not been
+	// added to the booklist yet
+	offered   []BookCountDetails
+	offeredMu sync.Mutex
+	// ctx is the context of the running session, given to StartContext
+	ctx context.Context
+	// eventsStalled is set when an event is dropped, because the client
+	// stopped receiving them
+	eventsStalled bool
+	// cancelBook cancels the book currently being received
+	cancelBook context.CancelFunc
+	cancelMu   sync.Mutex
+	// unknownSeen are the unknown packet fields the client has been warned about
+	unknownSeen map[string]bool
+	// allowlist limits the hosts UNCaGED connects to. Nil allows every host.
+	allowlist *hostAllowlist
+	// recorder records the session, if the client asked for it
+	recorder *sessionRecorder
+	// replay provides the connections of a replayed session
+	replay *replayer
+}
+
+// connDeadline is how long the connection with Calibre may be idle. Operations
+// expected to take longer, such as receiving a large book, set a longer
+// deadline for the next read or write.
+type connDeadline struct {
+	mu  sync.Mutex
+	std time.Duration
+	alt time.Duration
+}
+
+// setNext sets the deadline used for the next read or write only
+func (d *connDeadline) setNext(alt time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.alt = alt
+}
+
+// next returns the deadline to use for the next read or write, and whether
+// it is one set by setNext
+func (d *connDeadline) next() (time.Duration, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.alt > 0 {
+		alt := d.alt
+		d.alt = 0
+		return alt, true
+	}
+	return d.std, false
 }
 
 type calPayload struct {
@@ -222,6 +654,50 @@ type calPayload struct {
 	err     error
 }
 
+// BandwidthEstimate is UNCaGED's estimate of the throughput of the connection
+// with Calibre, measured from book transfers and large packets
+type BandwidthEstimate struct {
+	BytesPerSecond float64       // Weighted average throughput
+	Bytes          int64         // Total bytes measured
+	Duration       time.Duration // Total time spent transferring the measured bytes
+}
+
+// Valid returns true if enough data has been measured to provide an estimate
+func (b BandwidthEstimate) Valid() bool {
+	return b.BytesPerSecond > 0
+}
+
+// EstimateDuration estimates how long it will take to transfer 'bytes' bytes.
+// Zero is returned if no estimate is available yet.
+func (b BandwidthEstimate) EstimateDuration(bytes int64) time.Duration {
+	if !b.Valid() {
+		return 0
+	}
+	return time.Duration(float64(bytes) / b.BytesPerSecond * float64(time.Second))
+}
+
+// SessionStats summarises a session with Calibre
+type SessionStats struct {
+	BooksReceived int           // Books received from Calibre
+	BooksSent     int           // Books sent to Calibre
+	BooksDeleted  int           // Books Calibre deleted from the device
+	BytesReceived int64         // Total size of the books received
+	BytesSent     int64         // Total size of the books sent
+	Started       time.Time     // When the session started
+	Elapsed       time.Duration // How long the session lasted, or has lasted so far
+	TransferTime  time.Duration // Time spent transferring books
+	EventsDropped int           // Events not sent because ClientOptions.Events was full
+}
+
+// Throughput returns the average throughput of book transfers in the session,
+// in bytes per second
+func (s SessionStats) Throughput() float64 {
+	if s.TransferTime <= 0 {
+		return 0
+	}
+	return float64(s.BytesReceived+s.BytesSent) / s.TransferTime.Seconds()
+}
+
 // ClientOptions stores all the client specific options that a client needs
 // to set to successfully download books
 type ClientOptions struct {
@@ -234,6 +710,145 @@ type ClientOptions struct {
 		Height int
 	}
 	DirectConnect CalInstance
+	// Discovery tunes how Calibre instances are searched for on the network, such
+	// as the discovery packet and ports used. Unset fields use the defaults
+	Discovery DiscoveryOptions
+	// Locations are the device's storage locations other than its main storage, such
+	// as SD cards. Use a StorageSelector to choose where books are stored.
+	Locations []StorageLocation
+	// Middleware sees every packet exchanged with Calibre, and may handle packets
+	// UNCaGED doesn't
+	Middleware []PacketMiddleware
+	// Transforms convert books as they are received, before they are passed to SaveBook
+	Transforms []BookTransform
+	// Logger receives UNCaGED's log messages as structured records, with the
+	// opcode, lpath and sizes as attributes. LogPrintf is used if it is nil.
+	Logger *slog.Logger
+	// Events receives an Event as UNCaGED works, if set. Events the client
+	// doesn't receive within a second are dropped, and counted in SessionStats
+	Events chan<- Event
+	// WritePacing slows down the delivery of books to SaveBook, to keep the device
+	// responsive while books are written to storage
+	WritePacing WritePacing
+	// Preset is the name of a DevicePreset used to fill in any unset options
+	Preset string
+	// PathLength is the length of the device path books are stored under, which
+	// Calibre takes into account when limiting the lpath length. Defaults to 38
+	PathLength int
+	// ConnectRetry controls how failed connection attempts to Calibre are retried
+	ConnectRetry RetryPolicy
+	// AutoReconnect reconnects to Calibre if the connection is lost (closed or timed out)
+	// while UNCaGED is idle, instead of returning from Start. Note that this includes
+	// the connection being closed by Calibre when the device is ejected.
+	AutoReconnect bool
+	// TempMarkReadSynced asks Calibre to temporarily mark books in its library view
+	// when their read status is synced with the device. Requires the client to
+	// implement ReadSyncer
+	TempMarkReadSynced bool
+	// UUIDFileNames stores books under their Calibre UUID (eg: "<uuid>.epub"), rather
+	// than Calibre's "Author/Title" lpaths, for devices with restrictive filesystems.
+	// Calibre is asked to name books this way, and UNCaGED renames any books it
+	// doesn't, provided Calibre supports lpath changes. Books remain findable by
+	// UUID in the booklist.
+	UUIDFileNames bool
+	// SkipThumbnails removes thumbnails from all metadata sent to Calibre, which
+	// shrinks booklist exchanges considerably. Calibre still sends thumbnails with
+	// books and metadata updates, as the protocol has no way to turn them off, but
+	// they are removed before the metadata reaches the client.
+	SkipThumbnails bool
+	// AuditLog, if not nil, records every book added, deleted or updated
+	AuditLog AuditLog
+	// BooklistChunkSize is the number of booklist entries sent to Calibre before
+	// the write buffer is flushed when sending the device booklist. Progress is
+	// reported with the SendingBooklist status after each chunk. Defaults to 100
+	BooklistChunkSize int
+	// BusyRetry controls how long UNCaGED waits to reconnect when Calibre reports it
+	// is busy, such as when it is already connected to another device. If unset,
+	// reconnecting is attempted 5 times, starting with a 2 second delay.
+	BusyRetry RetryPolicy
+	// PasswordRetry limits how many passwords are tried with a Calibre library, and
+	// how long UNCaGED waits to reconnect after a wrong password. Once Attempts
+	// passwords have been rejected, Start fails with TooManyPasswordAttempts. If
+	// unset, 3 passwords are tried, starting with a 1 second delay.
+	PasswordRetry RetryPolicy
+	// Checksums, if not nil, is used to record the hash of every book received,
+	// allowing duplicate books to be detected
+	Checksums ChecksumStore
+	// BookStore, if not nil, keeps the booklist and primary keys between sessions,
+	// so GetDeviceBookList doesn't need to be called every session
+	BookStore BookStore
+	// MetadataCache, if not nil, keeps the metadata Calibre sends between sessions,
+	// and is used instead of GetMetadataIter for the books it has
+	MetadataCache MetadataCache
+	// Transfers, if not nil, records books that failed to save partway through, so
+	// that clients implementing BookAppender can resume saving them
+	Transfers TransferJournal
+	// StrictPackets checks that each packet from Calibre has the fields UNCaGED
+	// expects, with values of the expected type, ending the session with a
+	// *PacketError describing the problems if not. Useful when debugging against
+	// new Calibre releases, or servers emulating Calibre.
+	StrictPackets bool
+	// AllowedHosts, if not empty, limits the Calibre instances UNCaGED connects to.
+	// Entries may be IP addresses, CIDR ranges (eg: "192.168.1.0/24") or host
+	// names. Discovered instances outside the list are ignored, and connecting
+	// to any other host fails with HostNotAllowed. This stops a device on a
+	// shared network being directed to a fake Calibre instance.
+	AllowedHosts []string
+	// PreferredInstance, if set, is connected to without asking the client when
+	// discovery finds it, even if other Calibre instances are found
+	PreferredInstance PreferredInstance
+	// Registry, if not nil, records the Calibre instances discovered and connected
+	// to, and the library each had open. It is saved after each discovery and
+	// connection. A pinned PreferredInstance.LibraryUUID is looked up in it, and
+	// instances are only connected to to read their library if that fails.
+	Registry *Registry
+	// Record, if not nil, receives every frame read from or written to Calibre,
+	// as one JSON encoded Frame per line. Recordings can be attached to bug
+	// reports, and replayed with Replay. Note that recordings include the books
+	// transferred, and the password challenge Calibre sent. The password hash
+	// sent in reply is redacted. Recording sends books through UNCaGED, so that
+	// they are recorded, rather than with sendfile.
+	Record io.Writer
+	// Replay, if not nil, is a session recorded with Record. UNCaGED reads what
+	// Calibre sent from the recording, instead of connecting to Calibre, and
+	// discards what it writes. Each connection in the recording is used in turn.
+	Replay io.Reader
+	// Metrics, if not nil, receives measurements of the packets handled, the
+	// data and books transferred, and how sessions end
+	Metrics Metrics
+}
+
+// RetryPolicy controls how an operation is retried after failing. The zero
+// value disables retries.
+type RetryPolicy struct {
+	Attempts     int           // Maximum number of attempts, including the first
+	InitialDelay time.Duration // Delay before the first retry
+	MaxDelay     time.Duration // Maximum delay between attempts. Unlimited if zero
+	Multiplier   float64       // Factor the delay increases by after each retry. Defaults to 2
+	Jitter       float64       // Fraction (0 to 1) of each delay that is randomized
+}
+
+// Delay returns how long to wait before retry number 'retry', starting from 1
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	mult := p.Multiplier
+	if mult <= 0 {
+		mult = 2
+	}
+	d := float64(p.InitialDelay)
+	for i := 1; i < retry; i++ {
+		d *= mult
+		if p.MaxDelay > 0 && d >= float64(p.MaxDelay) {
+			break
+		}
+	}
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		j := math.Min(p.Jitter, 1)
+		d = d*(1-j) + d*j*rand.Float64()
+	}
+	return time.Duration(d)
 }
 
 // CalibreInitInfo is the initial information about itself that Calibre sends when establishing
@@ -343,6 +958,39 @@ type DeviceInfo struct {
 	} `json:"device_info"`
 }
 
+// LastConnected returns the time the device was last connected to Calibre,
+// and false if it has never connected
+func (d *DeviceInfo) LastConnected() (time.Time, bool) {
+	t := d.DevInfo.DateLastConnected
+	return t, !t.IsZero()
+}
+
+// Lpath converts a path that may be qualified with DevInfo.Prefix into a
+// device relative lpath. Paths without the prefix are returned unchanged.
+func (d *DeviceInfo) Lpath(p string) string {
+	prefix := strings.TrimSuffix(d.DevInfo.Prefix, "/")
+	if prefix == "" {
+		return p
+	}
+	if p == prefix {
+		return ""
+	}
+	if strings.HasPrefix(p, prefix+"/") {
+		return strings.TrimPrefix(p, prefix+"/")
+	}
+	return p
+}
+
+// FullPath qualifies a device relative lpath with DevInfo.Prefix, matching
+// the path conventions used by Calibre's USB device drivers
+func (d *DeviceInfo) FullPath(lpath string) string {
+	prefix := strings.TrimSuffix(d.DevInfo.Prefix, "/")
+	if prefix == "" {
+		return lpath
+	}
+	return path.Join(prefix, d.Lpath(lpath))
+}
+
 // SendBook is used to hold information about each ebook as it arrives
 type SendBook struct {
 	TotalBooks             int             `json:"totalBooks"`
@@ -368,11 +1016,6 @@ type BookID struct {
 	UUID  string
 }
 
-// FreeSpace is used to send the available space in bytes to Calibre
-type FreeSpace struct {
-	FreeSpaceOnDevice uint64 `json:"free_space_on_device"`
-}
-
 // MetadataUpdate is used for sending updated metadata to the client
 type MetadataUpdate struct {
 	Count        int             `json:"count"`
@@ -405,6 +1048,25 @@ type BookCountDetails struct {
 	Extension    string    `json:"extension"`
 	Lpath        string    `json:"lpath"`
 	LastModified time.Time `json:"last_modified"`
+	// FormatMtime is when the book file was last modified on the device. It is
+	// filled in by UNCaGED for clients implementing BookUpdater
+	FormatMtime *CalibreTime `json:"_format_mtime_,omitempty"`
+	// IsRead, LastReadDate and SyncType carry the read status of the book. They
+	// are filled in by UNCaGED for clients implementing ReadSyncer
+	IsRead       *bool        `json:"_is_read_,omitempty"`
+	LastReadDate *CalibreTime `json:"_last_read_date_,omitempty"`
+	SyncType     *string      `json:"_sync_type_,omitempty"`
+	// syntheticUUID is true if UUID was generated by UNCaGED, because
+	// the client did not provide one
+	syntheticUUID bool
+}
+
+// bookID returns the BookID the client knows this book by
+func (bd BookCountDetails) bookID() BookID {
+	if bd.syntheticUUID {
+		return BookID{Lpath: bd.Lpath}
+	}
+	return BookID{Lpath: bd.Lpath, UUID: bd.UUID}
 }
 
 // GetBookSend prepares Calibre for the book we are about to send
@@ -429,10 +1091,14 @@ type NewLpath struct {
 	Lpath string `json:"lpath"`
 }
 
+// Collections maps the name of each collection Calibre builds from the columns
+// configured in its device settings, to the lpaths of the books in it
+type Collections map[string][]string
+
 // BookListsDetails is sent from calibre to prepare for receiving metadata
 type BookListsDetails struct {
 	Count              int         `json:"count"`
-	Collections        interface{} `json:"collections"`
+	Collections        Collections `json:"collections"`
 	WillStreamMetadata bool        `json:"willStreamMetadata"`
 	SupportsSync       bool        `json:"supportsSync"`
 }
@@ -469,6 +1135,13 @@ type CalibreBookMeta struct {
 	AuthorLinkMap   map[string]string              `json:"author_link_map"`
 	Title           string                         `json:"title"`
 	Identifiers     map[string]string              `json:"identifiers"`
+	FormatMtime     *CalibreTime                   `json:"_format_mtime_,omitempty"`
+	IsRead          *bool                          `json:"_is_read_,omitempty"`
+	LastReadDate    *CalibreTime                   `json:"_last_read_date_,omitempty"`
+	SyncType        *string                        `json:"_sync_type_,omitempty"`
+	// Extra holds fields Calibre sent that UNCaGED doesn't know. They are sent
+	// back to Calibre with the rest of the metadata.
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // LangString returns the string representation of the 'language' field
@@ -489,6 +1162,32 @@ func (m *CalibreBookMeta) PubString() string {
 	return ""
 }
 
+// Comment returns the book's comments (usually its description, as HTML), or
+// the empty string if there are none
+func (m *CalibreBookMeta) Comment() string {
+	if m.Comments != nil {
+		return *m.Comments
+	}
+	return ""
+}
+
+// CoverPath returns the path of the book's cover in the Calibre library, or the
+// empty string if it has no cover
+func (m *CalibreBookMeta) CoverPath() string {
+	if m.Cover != nil {
+		return *m.Cover
+	}
+	return ""
+}
+
+// SeriesIndexOr returns the series index, or def if no series index is set
+func (m *CalibreBookMeta) SeriesIndexOr(def float64) float64 {
+	if m.SeriesIndex != nil {
+		return *m.SeriesIndex
+	}
+	return def
+}
+
 // RatingString returns the rating column as a string, in the form of stars
 func (m *CalibreBookMeta) RatingString() string {
 	if m.Rating != nil {
@@ -497,6 +1196,24 @@ func (m *CalibreBookMeta) RatingString() string {
 	return ""
 }
 
+// SeriesString returns the series and series index as Calibre displays them,
+// for example "Discworld [2]", or the empty string if no series is set
+func (m *CalibreBookMeta) SeriesString() string {
+	if m.Series == nil || *m.Series == "" {
+		return ""
+	}
+	return formatSeries(*m.Series, m.SeriesIndex)
+}
+
+// SeriesIndexString returns the series index without a trailing ".0", or the
+// empty string if no series index is set
+func (m *CalibreBookMeta) SeriesIndexString() string {
+	if m.SeriesIndex == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*m.SeriesIndex, 'f', -1, 64)
+}
+
 // InitMaps initializes any maps that may be nil
 func (m *CalibreBookMeta) InitMaps() {
 	if m.UserMetadata == nil {
@@ -519,10 +1236,12 @@ func (m *CalibreBookMeta) InitMaps() {
 // CalibreTime holds timestamps from calibre
 type CalibreTime string
 
-// GetTime returns a time if there is a valid time, nil otherwise
+// GetTime returns a time if there is a valid time, nil otherwise. Any of the ISO
+// formats Calibre uses are accepted. CalibreInitInfo.ParseTime also accepts the
+// date formats Calibre announces.
 func (ct *CalibreTime) GetTime() *time.Time {
 	if ct != nil {
-		if parsedTime, err := time.Parse(time.RFC3339, string(*ct)); err == nil {
+		if parsedTime, ok := parseISOTime(string(*ct)); ok {
 			return &parsedTime
 		}
 	}
@@ -534,9 +1253,10 @@ func ConvertTime(t time.Time) CalibreTime {
 	return CalibreTime(t.Format(time.RFC3339))
 }
 
-// ParseTime returns an RFC3339 formatted timestamp as a *CalibreTimem or nil otherwise
+// ParseTime returns an ISO formatted timestamp as a *CalibreTime or nil otherwise.
+// The timestamp is kept as is, so it is sent back to Calibre unchanged.
 func ParseTime(timestamp string) *CalibreTime {
-	if _, err := time.Parse(time.RFC3339, timestamp); err == nil {
+	if _, ok := parseISOTime(timestamp); ok {
 		ct := CalibreTime(timestamp)
 		return &ct
 	}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func loadBytes(t *testing.T, filename string) []byte {
@@ -62,3 +63,68 @@ func TestParseTime(t *testing.T) {
 		})
 	}
 }
+
+func TestDeviceInfoPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		path   string
+		lpath  string
+		full   string
+	}{
+		{name: "No prefix", prefix: "", path: "books/a.epub", lpath: "books/a.epub", full: "books/a.epub"},
+		{name: "Qualified", prefix: "/mnt/onboard/", path: "/mnt/onboard/books/a.epub", lpath: "books/a.epub", full: "/mnt/onboard/books/a.epub"},
+		{name: "Relative", prefix: "/mnt/onboard", path: "books/a.epub", lpath: "books/a.epub", full: "/mnt/onboard/books/a.epub"},
+		{name: "Partial match", prefix: "/mnt/onboard", path: "/mnt/onboard2/a.epub", lpath: "/mnt/onboard2/a.epub", full: "/mnt/onboard/mnt/onboard2/a.epub"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			di := DeviceInfo{}
+			di.DevInfo.Prefix = tt.prefix
+			if got := di.Lpath(tt.path); got != tt.lpath {
+				t.Errorf("Lpath: got %s, expected %s", got, tt.lpath)
+			}
+			if got := di.FullPath(tt.path); got != tt.full {
+				t.Errorf("FullPath: got %s, expected %s", got, tt.full)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{Attempts: 5, InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, e := range expected {
+		if d := p.Delay(i + 1); d != e {
+			t.Errorf("Retry %d: got %v, expected %v", i+1, d, e)
+		}
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 20; i++ {
+		if d := p.Delay(2); d < 100*time.Millisecond || d > 200*time.Millisecond {
+			t.Errorf("Jittered delay %v out of range", d)
+		}
+	}
+}
+
+func TestSeriesString(t *testing.T) {
+	series := "Discworld"
+	idx := func(f float64) *float64 { return &f }
+	tests := []struct {
+		series   *string
+		index    *float64
+		str, idx string
+	}{
+		{&series, idx(2), "Discworld [2]", "2"},
+		{&series, idx(2.5), "Discworld [2.5]", "2.5"},
+		{&series, nil, "Discworld", ""},
+		{nil, idx(1), "", "1"},
+		{nil, nil, "", ""},
+	}
+	for _, tt := range tests {
+		md := CalibreBookMeta{Series: tt.series, SeriesIndex: tt.index}
+		if md.SeriesString() != tt.str || md.SeriesIndexString() != tt.idx {
+			t.Errorf("Got %q, %q, want %q, %q", md.SeriesString(), md.SeriesIndexString(), tt.str, tt.idx)
+		}
+	}
+}
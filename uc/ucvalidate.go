@@ -0,0 +1,60 @@
+package uc
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// MetadataError is returned by CalibreBookMeta.Validate when a book's metadata
+// is missing required fields, or has fields with invalid values
+type MetadataError struct {
+	Lpath  string
+	Fields []string
+}
+
+func (e *MetadataError) Error() string {
+	return fmt.Sprintf("invalid metadata for '%s': %s", e.Lpath, strings.Join(e.Fields, ", "))
+}
+
+// Validate checks that the book has the fields every book from Calibre should
+// have (a UUID, lpath and title), and that its numeric fields are usable. A
+// *MetadataError naming the invalid fields is returned if not.
+func (m *CalibreBookMeta) Validate() error {
+	var fields []string
+	if strings.TrimSpace(m.UUID) == "" {
+		fields = append(fields, "uuid")
+	}
+	if strings.TrimSpace(m.Lpath) == "" {
+		fields = append(fields, "lpath")
+	}
+	if strings.TrimSpace(m.Title) == "" {
+		fields = append(fields, "title")
+	}
+	if m.SeriesIndex != nil && (math.IsNaN(*m.SeriesIndex) || math.IsInf(*m.SeriesIndex, 0)) {
+		fields = append(fields, "series_index")
+	}
+	if m.Rating != nil && (*m.Rating < 0 || *m.Rating > 10) {
+		fields = append(fields, "rating")
+	}
+	if m.Size < 0 {
+		fields = append(fields, "size")
+	}
+	if len(fields) > 0 {
+		return &MetadataError{Lpath: m.Lpath, Fields: fields}
+	}
+	return nil
+}
+
+// validateMetadata warns the client about malformed metadata received from
+// Calibre. The metadata is still passed on, so the client can decide what to
+// do with it.
+func (c *calConn) validateMetadata(md CalibreBookMeta) {
+	if err := md.Validate(); err != nil {
+		c.warn(Warning{
+			Kind:    InvalidMetadata,
+			Message: err.Error(),
+			Books:   []BookID{{Lpath: md.Lpath, UUID: md.UUID}},
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package uc
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// warnClient records the warnings it receives
+type warnClient struct {
+	logClient
+	warnings []Warning
+}
+
+func (wc *warnClient) ReportWarning(w Warning) { wc.warnings = append(wc.warnings, w) }
+
+func TestValidateMetadata(t *testing.T) {
+	nan, rating := math.NaN(), 12.0
+	tests := []struct {
+		md     CalibreBookMeta
+		fields []string
+	}{
+		{CalibreBookMeta{UUID: "abc", Lpath: "a.epub", Title: "Title"}, nil},
+		{CalibreBookMeta{Lpath: "a.epub", Title: " "}, []string{"uuid", "title"}},
+		{CalibreBookMeta{UUID: "abc", Title: "Title", SeriesIndex: &nan}, []string{"lpath", "series_index"}},
+		{CalibreBookMeta{UUID: "abc", Lpath: "a.epub", Title: "Title", Rating: &rating, Size: -1}, []string{"rating", "size"}},
+	}
+	for _, tt := range tests {
+		err := tt.md.Validate()
+		var me *MetadataError
+		if tt.fields == nil {
+			if err != nil {
+				t.Errorf("Expected valid metadata, got %v", err)
+			}
+		} else if !errors.As(err, &me) || !reflect.DeepEqual(me.Fields, tt.fields) {
+			t.Errorf("Expected invalid fields %v, got %v", tt.fields, err)
+		}
+	}
+	wc := &warnClient{}
+	c := &calConn{client: wc}
+	c.validateMetadata(CalibreBookMeta{UUID: "abc", Lpath: "a.epub", Title: "Title"})
+	c.validateMetadata(CalibreBookMeta{UUID: "def", Lpath: "b.epub"})
+	if len(wc.warnings) != 1 || wc.warnings[0].Kind != InvalidMetadata || wc.warnings[0].Books[0].Lpath != "b.epub" {
+		t.Errorf("Expected a single InvalidMetadata warning, got %+v", wc.warnings)
+	}
+}
+
+func TestMetadataAccessors(t *testing.T) {
+	var md CalibreBookMeta
+	if md.Comment() != "" || md.CoverPath() != "" || md.SeriesIndexOr(1) != 1 {
+		t.Errorf("Expected defaults for unset fields")
+	}
+	comment, cover, idx := "<p>A book</p>", "/library/cover.jpg", 3.0
+	md = CalibreBookMeta{Comments: &comment, Cover: &cover, SeriesIndex: &idx}
+	if md.Comment() != comment || md.CoverPath() != cover || md.SeriesIndexOr(1) != 3 {
+		t.Errorf("Unexpected accessor values %q, %q, %v", md.Comment(), md.CoverPath(), md.SeriesIndexOr(1))
+	}
+}
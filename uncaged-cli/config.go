@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+// config holds the settings for a run of uncaged-cli. Settings can be read
+// from a TOML file given with -config, and any flags on the command line
+// override the file's values. A config file looks like:
+//
+//	name = "UNCaGED"
+//	model = "CLI"
+//	library = "library"
+//	extensions = ["epub", "mobi"]
+//	password = "secret"
+//	connect = "192.168.1.10:9090"
+//	select = "laptop"
+//	select_timeout = "30s"
+//
+//	[cover]
+//	width = 530
+//	height = 530
+type config struct {
+	Name       string   `toml:"name"`
+	Model      string   `toml:"model"`
+	Preset     string   `toml:"preset"`
+	Library    string   `toml:"library"`
+	Extensions []string `toml:"extensions"`
+	Cover      struct {
+		Width  int `toml:"width"`
+		Height int `toml:"height"`
+	} `toml:"cover"`
+	Password string `toml:"password"`
+	// Connect is the host:port of Calibre, bypassing discovery
+	Connect string `toml:"connect"`
+	Card    bool   `toml:"card"`
+	// ReplaceFormats deletes other formats of a book when Calibre sends a new one
+	ReplaceFormats bool   `toml:"replace_formats"`
+	Audit          bool   `toml:"audit"`
+	Debug          bool   `toml:"debug"`
+	RPC            string `toml:"rpc"`
+	// Select is the name or address of the Calibre instance to use when
+	// several are found. Otherwise the user is asked, for up to SelectTimeout.
+	Select        string        `toml:"select"`
+	SelectTimeout time.Duration `toml:"select_timeout"`
+	// Daemon keeps serving Calibre sessions until interrupted
+	Daemon bool `toml:"daemon"`
+	// VerifyAudit is a one-off action, so is only available as a flag
+	VerifyAudit bool `toml:"-"`
+}
+
+// parseConfig parses the command line args, reading the config file first
+// if one is given with -config
+func parseConfig(fs *flag.FlagSet, args []string) (*config, error) {
+	cfg := &config{Name: "UNCaGED", Library: "library", SelectTimeout: 30 * time.Second}
+	configPath := fs.String("config", "", "Read settings from a TOML file. Flags override the file's values")
+	fs.StringVar(&cfg.Preset, "preset", cfg.Preset, "Device preset to use (kobo-clara, kindle-pw, android)")
+	fs.BoolVar(&cfg.Audit, "audit", cfg.Audit, "Record added, deleted and updated books in an audit log")
+	fs.BoolVar(&cfg.VerifyAudit, "verify-audit", cfg.VerifyAudit, "Verify the audit log has not been corrupted, then exit")
+	fs.StringVar(&cfg.Connect, "connect", cfg.Connect, "Connect to Calibre at host:port, instead of searching the network")
+	fs.BoolVar(&cfg.Card, "card", cfg.Card, "Store new books on a simulated SD card")
+	fs.BoolVar(&cfg.ReplaceFormats, "replace-formats", cfg.ReplaceFormats, "Delete other formats of a book when Calibre sends a new one")
+	fs.StringVar(&cfg.RPC, "rpc", cfg.RPC, "Serve JSON-RPC at host:port, and start sessions when asked, instead of starting one")
+	fs.StringVar(&cfg.Select, "select", cfg.Select, "Name or host:port of the Calibre instance to use, if several are found")
+	fs.DurationVar(&cfg.SelectTimeout, "select-timeout", cfg.SelectTimeout, "How long to wait for a Calibre instance to be chosen, before using the first. Zero disables the prompt")
+	fs.BoolVar(&cfg.Daemon, "daemon", cfg.Daemon, "Wait for Calibre again after each session, until interrupted")
+	fs.StringVar(&cfg.Library, "library", cfg.Library, "Directory to store books and metadata in")
+	fs.StringVar(&cfg.Name, "name", cfg.Name, "Device name shown in Calibre")
+	fs.StringVar(&cfg.Model, "model", cfg.Model, "Device model reported to Calibre (default \"CLI\", or the preset's model)")
+	fs.Func("ext", "Comma separated list of supported book formats (default \"epub,mobi\", or the preset's formats)", func(s string) error {
+		cfg.Extensions = parseExtensions(s)
+		return nil
+	})
+	fs.BoolVar(&cfg.Debug, "debug", cfg.Debug, "Log packets and other debugging information")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *configPath == "" {
+		return cfg, nil
+	}
+	if err := cfg.load(*configPath); err != nil {
+		return nil, err
+	}
+	// Parsing again puts back any values the file replaced, leaving the
+	// file's values for flags that weren't given
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// load reads the settings in a TOML file into cfg. A relative library path
+// is taken to be relative to the file.
+func (cfg *config) load(path string) error {
+	md, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		return fmt.Errorf("load: %w", err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return fmt.Errorf("load: unknown setting '%s' in %s", undecoded[0], path)
+	}
+	if md.IsDefined("library") && !filepath.IsAbs(cfg.Library) {
+		cfg.Library = filepath.Join(filepath.Dir(path), cfg.Library)
+	}
+	cfg.Extensions = parseExtensions(strings.Join(cfg.Extensions, ","))
+	return nil
+}
+
+// instance returns the Calibre instance to connect to directly, or an empty
+// instance if Calibre should be found on the network
+func (cfg *config) instance() (uc.CalInstance, error) {
+	var inst uc.CalInstance
+	if cfg.Connect == "" {
+		return inst, nil
+	}
+	host, port, err := net.SplitHostPort(cfg.Connect)
+	if err == nil {
+		inst.TCPPort, err = strconv.Atoi(port)
+	}
+	if err != nil {
+		return inst, fmt.Errorf("invalid Calibre address '%s': %w", cfg.Connect, err)
+	}
+	inst.Host = host
+	return inst, nil
+}
+
+// parseExtensions splits a comma separated list of book formats, as given
+// to the -ext flag. Leading dots are dropped, so ".epub" and "epub" are the same.
+func parseExtensions(list string) []string {
+	var exts []string
+	for _, e := range strings.Split(list, ",") {
+		e = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(e), "."))
+		if e != "" {
+			exts = append(exts, e)
+		}
+	}
+	return exts
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseExtensions(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+	}{
+		{"", nil},
+		{"epub", []string{"epub"}},
+		{"epub, .MOBI,,pdf ", []string{"epub", "mobi", "pdf"}},
+	}
+	for _, tt := range tests {
+		if got := parseExtensions(tt.list); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseExtensions(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uncaged-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "uncaged.toml")
+	err = ioutil.WriteFile(path, []byte(`
+name = "File Device"
+model = "Reader"
+library = "books"
+extensions = [".EPUB", "pdf"]
+password = "secret"
+connect = "10.0.0.2:9090"
+select = "laptop"
+select_timeout = "5s"
+
+[cover]
+width = 600
+height = 800
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args []string
+		want func(cfg *config) bool
+	}{
+		{[]string{}, func(cfg *config) bool {
+			return cfg.Name == "UNCaGED" && cfg.Library == "library" && cfg.Extensions == nil && cfg.SelectTimeout == 30*time.Second
+		}},
+		{[]string{"-config", path}, func(cfg *config) bool {
+			return cfg.Name == "File Device" && cfg.Model == "Reader" && cfg.Password == "secret" &&
+				cfg.Library == filepath.Join(dir, "books") && reflect.DeepEqual(cfg.Extensions, []string{"epub", "pdf"}) &&
+				cfg.Cover.Width == 600 && cfg.Cover.Height == 800 && cfg.Select == "laptop" && cfg.SelectTimeout == 5*time.Second
+		}},
+		{[]string{"-name", "Flag Device", "-ext", "mobi", "-library", "lib", "-config", path}, func(cfg *config) bool {
+			return cfg.Name == "Flag Device" && cfg.Model == "Reader" && cfg.Library == "lib" &&
+				reflect.DeepEqual(cfg.Extensions, []string{"mobi"})
+		}},
+	}
+	for _, tt := range tests {
+		cfg, err := parseConfig(flag.NewFlagSet("uncaged-cli", flag.ContinueOnError), tt.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tt.want(cfg) {
+			t.Errorf("Unexpected config for %v: %+v", tt.args, cfg)
+		}
+		if inst, err := cfg.instance(); cfg.Connect != "" && (err != nil || inst.Host != "10.0.0.2" || inst.TCPPort != 9090) {
+			t.Errorf("Unexpected instance %+v, %v", inst, err)
+		}
+	}
+	if err = ioutil.WriteFile(path, []byte("nmae = \"typo\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = parseConfig(flag.NewFlagSet("uncaged-cli", flag.ContinueOnError), []string{"-config", path}); err == nil {
+		t.Errorf("Expected an error for an unknown setting")
+	}
+}
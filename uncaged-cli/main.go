@@ -21,35 +21,68 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"image"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	_ "image/jpeg"
 
 	"github.com/shermp/UNCaGED/uc"
+	"github.com/shermp/UNCaGED/uc/ucrpc"
 )
 
 const metadataFile = ".metadata.calibre"
 const drivinfoFile = ".driveinfo.calibre"
+const auditFile = ".audit.calibre"
+const cardLocation = "cardA"
 
 type UncagedCLI struct {
 	deviceName   string
 	deviceModel  string
+	preset       string
 	bookDir      string
 	metadataFile string
 	drivinfoFile string
 	metadata     cliMeta
 	deviceInfo   uc.DeviceInfo
+	auditLog     *uc.FileAuditLog
+	// connect is the Calibre instance to connect to, bypassing discovery
+	connect uc.CalInstance
+	// card stores new books on a simulated SD card
+	card bool
+	// extensions overrides the book formats the device accepts
+	extensions []string
+	// coverWidth and coverHeight override the size of thumbnails Calibre sends
+	coverWidth, coverHeight int
+	password                string
+	// replaceFormats deletes other formats of a book when Calibre sends a new one
+	replaceFormats bool
+	// selectInstance is the name or address of the Calibre instance to use,
+	// when several are found
+	selectInstance string
+	// input is read for the user's choice of Calibre instance, for up to
+	// selectTimeout
+	input         io.Reader
+	selectTimeout time.Duration
+	lines         chan string
+	linesOnce     sync.Once
 }
 
 type cliMeta struct {
@@ -137,27 +170,139 @@ func (cli *UncagedCLI) saveDriveInfoFile() error {
 	return ioutil.WriteFile(cli.drivinfoFile, diJSON, 0644)
 }
 
-// SelectCalibreInstance allows the client to choose a calibre instance if multiple
-// are found on the network
+// loadCardInfo reads the drive info of the simulated SD card, creating it with a
+// new store UUID the first time the card is used. As with Calibre's USB drivers,
+// each storage location has its own '.driveinfo.calibre', so the card can be
+// told apart from the cards of other devices.
+func (cli *UncagedCLI) loadCardInfo() (uc.DeviceInfo, error) {
+	var di uc.DeviceInfo
+	cardDir := filepath.Join(cli.bookDir, cardLocation)
+	diPath := filepath.Join(cardDir, drivinfoFile)
+	diJSON, err := ioutil.ReadFile(diPath)
+	if err == nil {
+		err = json.Unmarshal(diJSON, &di.DevInfo)
+		return di, err
+	}
+	if !os.IsNotExist(err) {
+		return di, err
+	}
+	di.DevInfo.DeviceName = cli.deviceName
+	di.DevInfo.LocationCode = cardLocation
+	if di.DevInfo.DeviceStoreUUID, err = newUUID(); err != nil {
+		return di, err
+	}
+	if diJSON, err = json.MarshalIndent(di.DevInfo, "", "    "); err != nil {
+		return di, err
+	}
+	if err = os.MkdirAll(cardDir, 0777); err != nil {
+		return di, err
+	}
+	return di, ioutil.WriteFile(diPath, diJSON, 0644)
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
+
+// SelectCalibreInstance asks the user to choose a calibre instance if multiple
+// are found on the network. The first instance is chosen if nothing is entered
+// before the selection timeout.
 // The function should return the instance to use
 func (cli *UncagedCLI) SelectCalibreInstance(calInstances []uc.CalInstance) uc.CalInstance {
+	if len(calInstances) == 1 {
+		return calInstances[0]
+	}
 	fmt.Println("The following Calibre instances were found:")
 	for i, instance := range calInstances {
-		fmt.Printf("\t%d. %s at %s\n", i, instance.Name, instance.Host)
+		fmt.Printf("\t%d. %s\n", i+1, instance.Label())
+	}
+	if cli.input == nil || cli.selectTimeout <= 0 {
+		fmt.Println("Automatically selecting the first Calibre instance...")
+		return calInstances[0]
+	}
+	deadline := time.Now().Add(cli.selectTimeout)
+	for {
+		fmt.Printf("Select a Calibre instance [1-%d] (first in %v): ", len(calInstances), time.Until(deadline).Round(time.Second))
+		line, ok := cli.readLine(time.Until(deadline))
+		if !ok {
+			fmt.Println("\nAutomatically selecting the first Calibre instance...")
+			return calInstances[0]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return calInstances[0]
+		}
+		if i, err := strconv.Atoi(line); err == nil && i >= 1 && i <= len(calInstances) {
+			return calInstances[i-1]
+		}
+		fmt.Printf("'%s' is not one of the instances listed\n", line)
+	}
+}
+
+// readLine reads a line of input, giving up after timeout. Lines are read in
+// the background, so input typed after a timeout isn't lost.
+func (cli *UncagedCLI) readLine(timeout time.Duration) (string, bool) {
+	cli.linesOnce.Do(func() {
+		cli.lines = make(chan string)
+		go func() {
+			defer close(cli.lines)
+			sc := bufio.NewScanner(cli.input)
+			for sc.Scan() {
+				cli.lines <- sc.Text()
+			}
+		}()
+	})
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case line, ok := <-cli.lines:
+		return line, ok
+	case <-t.C:
+		return "", false
 	}
-	fmt.Println("Automatically selecting the first Calibre instance...")
-	return calInstances[0]
 }
 
 // GetClientOptions returns all the client specific options required for UNCaGED
 func (cli *UncagedCLI) GetClientOptions() (uc.ClientOptions, error) {
 	var opts uc.ClientOptions
 	opts.ClientName = "UNCaGED"
-	opts.CoverDims.Height = 530
-	opts.CoverDims.Width = 530
-	opts.SupportedExt = []string{"epub", "mobi"}
 	opts.DeviceName = cli.deviceName
+	if cli.auditLog != nil {
+		opts.AuditLog = cli.auditLog
+	}
+	opts.DirectConnect = cli.connect
+	if cli.selectInstance != "" {
+		opts.PreferredInstance = uc.PreferredInstance{Host: cli.selectInstance, Name: cli.selectInstance}
+	}
 	opts.DeviceModel = cli.deviceModel
+	opts.SupportedExt = cli.extensions
+	opts.CoverDims.Width, opts.CoverDims.Height = cli.coverWidth, cli.coverHeight
+	if cli.card {
+		opts.Locations = []uc.StorageLocation{{Code: cardLocation}}
+	}
+	if cli.preset != "" {
+		// Let the preset provide the device specific options
+		opts.Preset = cli.preset
+		return opts, nil
+	}
+	if opts.CoverDims.Width == 0 && opts.CoverDims.Height == 0 {
+		opts.CoverDims.Height = 530
+		opts.CoverDims.Width = 530
+	}
+	if len(opts.SupportedExt) == 0 {
+		opts.SupportedExt = []string{"epub", "mobi"}
+	}
+	if opts.DeviceModel == "" {
+		opts.DeviceModel = "CLI"
+	}
+	opts.ConnectRetry = uc.RetryPolicy{Attempts: 5, InitialDelay: 500 * time.Millisecond, MaxDelay: 5 * time.Second, Jitter: 0.2}
 	return opts, nil
 }
 
@@ -253,20 +398,55 @@ func (cli *UncagedCLI) UpdateMetadata(mdList []uc.CalibreBookMeta) error {
 
 // GetPassword gets a password from the user.
 func (cli *UncagedCLI) GetPassword(calibreInfo uc.CalibreInitInfo) (string, error) {
-	// For testing purposes ONLY
-	return "uncaged", nil
+	return cli.password, nil
 }
 
-// GetFreeSpace reports the amount of free storage space to Calibre
+// GetFreeSpace reports the free space on the filesystem holding the library
+// to Calibre. A fixed 1GB is reported if the filesystem can't be queried.
 func (cli *UncagedCLI) GetFreeSpace() uint64 {
+	free, _, err := diskSpace(cli.bookDir)
+	if err != nil {
+		return 1024 * 1024 * 1024
+	}
+	return free
+}
+
+// GetTotalSpace reports the size of the filesystem holding the library to
+// Calibre. A fixed 8GB is reported if the filesystem can't be queried.
+func (cli *UncagedCLI) GetTotalSpace() uint64 {
+	_, total, err := diskSpace(cli.bookDir)
+	if err != nil {
+		return 8 * 1024 * 1024 * 1024
+	}
+	return total
+}
+
+// LocationFreeSpace reports the free space on the simulated SD card
+func (cli *UncagedCLI) LocationFreeSpace(code string) uint64 {
+	// For testing purposes ONLY
+	return 512 * 1024 * 1024
+}
+
+// LocationTotalSpace reports the capacity of the simulated SD card
+func (cli *UncagedCLI) LocationTotalSpace(code string) uint64 {
 	// For testing purposes ONLY
-	return 1024 * 1024 * 1024
+	return 2 * 1024 * 1024 * 1024
+}
+
+// AcceptBook refuses books too large for the free space on the device
+func (cli *UncagedCLI) AcceptBook(book uc.SendBook) error {
+	if uint64(book.Length) > cli.GetFreeSpace() {
+		return fmt.Errorf("not enough space for %s", book.Lpath)
+	}
+	return nil
 }
 
-// CheckLpath asks the client to verify a provided Lpath, and change it if required
-// Return the original string if the Lpath does not need changing
-func (cli *UncagedCLI) CheckLpath(lpath string) string {
-	return lpath
+// SelectStorage stores new books on the simulated SD card, if it is enabled
+func (cli *UncagedCLI) SelectStorage(md uc.CalibreBookMeta, len int) string {
+	if cli.card {
+		return cardLocation
+	}
+	return ""
 }
 
 // SaveBook saves a book with the provided metadata to the disk.
@@ -279,7 +459,12 @@ func (cli *UncagedCLI) SaveBook(md uc.CalibreBookMeta, book io.Reader, len int,
 	imgPath := bookPath + ".jpg"
 	dir, _ := filepath.Split(bookPath)
 	os.MkdirAll(dir, 0777)
-	bookFile, err := os.OpenFile(bookPath, os.O_WRONLY|os.O_CREATE, 0644)
+	// Truncate, as updated books may replace a larger file
+	bookFile, err := os.OpenFile(bookPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer bookFile.Close()
 	written, err := io.CopyN(bookFile, book, int64(len))
 	if written != int64(len) {
 		return errors.New("Number of bytes written different from expected")
@@ -349,33 +534,153 @@ func (cli *UncagedCLI) DeleteBook(book uc.BookID) error {
 	cli.saveMDfile()
 	return nil
 }
-func (cli *UncagedCLI) UpdateStatus(status uc.Status, progress int) {
-
-}
 
 // LogPrintf instructs the client to log stuff
 func (cli *UncagedCLI) LogPrintf(logLevel uc.LogLevel, format string, a ...interface{}) {
 	fmt.Printf(format, a...)
 }
 
-// SetExitChannel provides the client with a channel to prematurely stop UNCaGED.
-func (cli *UncagedCLI) SetExitChannel(exitChan chan<- bool) {
+// BookQueueStarted prints the number of books Calibre is about to send
+func (cli *UncagedCLI) BookQueueStarted(total int) {
+	fmt.Printf("Receiving %d books from Calibre\n", total)
+}
+
+// BookQueued prints the title of each book as Calibre announces it
+func (cli *UncagedCLI) BookQueued(index, total int, md uc.CalibreBookMeta) {
+	fmt.Printf("(%d/%d) %s\n", index+1, total, md.Title)
+}
+
+// FormatModified reports the modification time of a book file, so Calibre can
+// send newer copies from the library
+func (cli *UncagedCLI) FormatModified(book uc.BookID) (time.Time, bool) {
+	fi, err := os.Stat(filepath.Join(cli.bookDir, book.Lpath))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return fi.ModTime(), true
+}
+
+// ApproveUpdate accepts every updated book Calibre sends
+func (cli *UncagedCLI) ApproveUpdate(book uc.BookID, md uc.CalibreBookMeta) bool {
+	fmt.Printf("Updating %s with a newer copy from Calibre\n", book.Lpath)
+	return true
+}
+
+// ReplaceFormat replaces other formats of a book with the one Calibre sent,
+// if -replace-formats is set, keeping one copy of each book
+func (cli *UncagedCLI) ReplaceFormat(old uc.BookID, md uc.CalibreBookMeta, oldExt, newExt string) bool {
+	if !cli.replaceFormats {
+		return false
+	}
+	fmt.Printf("Replacing %s with %s\n", old.Lpath, md.Lpath)
+	return true
+}
+
+// UpdateBandwidth prints the estimated connection throughput
+func (cli *UncagedCLI) UpdateBandwidth(est uc.BandwidthEstimate) {
+	fmt.Printf("Estimated throughput: %.1f KB/s\n", est.BytesPerSecond/1024)
+}
+
+// DisplayMessage prints messages from Calibre
+func (cli *UncagedCLI) DisplayMessage(kind uc.MessageKind, text string) {
+	fmt.Printf("Message from Calibre: %s\n", text)
+}
+
+// daemonBackoff is how long the daemon waits before looking for Calibre
+// again. The wait grows while sessions keep failing, or Calibre can't be found.
+var daemonBackoff = uc.RetryPolicy{InitialDelay: 5 * time.Second, MaxDelay: 2 * time.Minute, Jitter: 0.2}
+
+// session connects to Calibre, and serves it until it disconnects or ctx is
+// cancelled
+func (cli *UncagedCLI) session(ctx context.Context, debug bool) error {
+	ucc, err := uc.New(cli, debug)
+	if err != nil {
+		return err
+	}
+	err = ucc.StartContext(ctx)
+	stats := ucc.Stats()
+	fmt.Printf("Session lasted %v: %d books received, %d sent, %d deleted\n",
+		stats.Elapsed.Round(time.Second), stats.BooksReceived, stats.BooksSent, stats.BooksDeleted)
+	return err
+}
+
+// daemon serves Calibre sessions one after another until ctx is cancelled,
+// waiting between them as set by backoff
+func (cli *UncagedCLI) daemon(ctx context.Context, debug bool, backoff uc.RetryPolicy) {
+	failures := 0
+	for ctx.Err() == nil {
+		err := cli.session(ctx, debug)
+		switch {
+		case errors.Is(err, uc.CalibreNotFound):
+			failures++
+		case err != nil:
+			failures++
+			fmt.Println(err)
+		default:
+			failures = 0
+		}
+		// Calibre keeps answering discovery after the device is ejected, so
+		// wait even after a good session
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff.Delay(failures + 1)):
+		}
+	}
 }
 
 func main() {
-	cwd, _ := os.Getwd()
+	cfg, err := parseConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	bookDir, err := filepath.Abs(cfg.Library)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	cli := &UncagedCLI{
-		deviceName:   "UNCaGED",
-		deviceModel:  "CLI",
-		bookDir:      filepath.Join(cwd, "library/"),
-		metadataFile: filepath.Join(cwd, "library/", metadataFile),
-		drivinfoFile: filepath.Join(cwd, "library/", drivinfoFile),
+		deviceName:     cfg.Name,
+		deviceModel:    cfg.Model,
+		preset:         cfg.Preset,
+		extensions:     cfg.Extensions,
+		coverWidth:     cfg.Cover.Width,
+		coverHeight:    cfg.Cover.Height,
+		password:       cfg.Password,
+		selectInstance: cfg.Select,
+		input:          os.Stdin,
+		selectTimeout:  cfg.SelectTimeout,
+		bookDir:        bookDir,
+		metadataFile:   filepath.Join(bookDir, metadataFile),
+		drivinfoFile:   filepath.Join(bookDir, drivinfoFile),
+		card:           cfg.Card,
+	}
+	if cli.connect, err = cfg.instance(); err != nil {
+		fmt.Println(err)
+		return
 	}
-	err := os.MkdirAll(cli.bookDir, 0777)
+	err = os.MkdirAll(cli.bookDir, 0777)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	auditPath := filepath.Join(cli.bookDir, auditFile)
+	if cfg.VerifyAudit {
+		n, err := uc.VerifyAuditLog(auditPath)
+		if err != nil {
+			fmt.Printf("Audit log verification failed after %d records: %v\n", n, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Audit log OK, %d records verified\n", n)
+		return
+	}
+	if cfg.Audit {
+		if cli.auditLog, err = uc.OpenFileAuditLog(auditPath); err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer cli.auditLog.Close()
+	}
 	err = cli.loadMDfile()
 	if err != nil {
 		fmt.Println(err)
@@ -387,15 +692,51 @@ func main() {
 	if cli.deviceInfo.DevInfo.DeviceName == "" {
 		cli.deviceInfo.DevInfo.DeviceName = cli.deviceName
 		cli.deviceInfo.DevInfo.LocationCode = "main"
-		cli.deviceInfo.DevInfo.DeviceStoreUUID = "586e12c6-50b7-43bf-be8d-a4a0b85be530"
+		if cli.deviceInfo.DevInfo.DeviceStoreUUID, err = newUUID(); err != nil {
+			fmt.Println(err)
+			return
+		}
 	}
-	uc, err := uc.New(cli, true)
-	if err != nil {
-		fmt.Println(err)
+	if cli.card {
+		card, err := cli.loadCardInfo()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("Using simulated SD card %s\n", card.DevInfo.DeviceStoreUUID)
+	}
+	if t, ok := cli.deviceInfo.LastConnected(); ok {
+		fmt.Printf("Last connected to Calibre: %s\n", t.Local().Format(time.RFC1123))
+	}
+	if cfg.RPC != "" {
+		server, err := ucrpc.NewServer(cli, cfg.Debug)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		ln, err := net.Listen("tcp", cfg.RPC)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("Serving JSON-RPC at %s\n", ln.Addr())
+		fmt.Println(server.Serve(ln))
 		return
 	}
-	err = uc.Start()
-	if err != nil {
+	// Finish the current job, then disconnect on Ctrl-C
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+	if cfg.Daemon {
+		cli.daemon(ctx, cfg.Debug, daemonBackoff)
+		return
+	}
+	if err = cli.session(ctx, cfg.Debug); err != nil {
 		fmt.Println(err)
 		return
 	}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shermp/UNCaGED/calibre/calibretest"
+	"github.com/shermp/UNCaGED/uc"
+)
+
+const testPassword = "uncaged"
+
+// session takes the client through a typical session, failing the test if
+// anything goes wrong
+func session(t *testing.T, srv *calibretest.Server, cached bool) {
+	ss, err := srv.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ss.Close()
+	if _, err = ss.DeviceInfo("UNCaGED"); err != nil {
+		t.Error(err)
+		return
+	}
+	space, err := ss.FreeSpace()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if space == 0 {
+		t.Errorf("Expected free space to be reported")
+	}
+	books, err := ss.BookCount(cached)
+	if err != nil || len(books) != 0 {
+		t.Errorf("Expected an empty device, got %v: %v", books, err)
+		return
+	}
+	md := map[string]interface{}{"uuid": "book-uuid", "title": "Title", "authors": []string{"Author"}}
+	lpath, err := ss.SendBook("Author/Title.epub", md, []byte("not really an epub"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if books, err = ss.BookCount(cached); err != nil || len(books) != 1 || books[0].Lpath != lpath {
+		t.Errorf("Expected %s on the device, got %v: %v", lpath, books, err)
+	}
+}
+
+// newTestCLI returns a CLI storing books in dir, and connecting to srv
+func newTestCLI(dir string, srv *calibretest.Server) *UncagedCLI {
+	cli := &UncagedCLI{
+		deviceName:   "UNCaGED",
+		deviceModel:  "CLI",
+		bookDir:      dir,
+		metadataFile: filepath.Join(dir, metadataFile),
+		drivinfoFile: filepath.Join(dir, drivinfoFile),
+		connect:      srv.ConnectionInfo(),
+		password:     testPassword,
+	}
+	cli.deviceInfo.DevInfo.DeviceName = cli.deviceName
+	return cli
+}
+
+func TestCLICancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uncaged-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv, err := calibretest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ucc, err := uc.New(newTestCLI(dir, srv), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ss, err := srv.Accept()
+		if err != nil {
+			t.Error(err)
+			cancel()
+			return
+		}
+		defer ss.Close()
+		// Calibre goes quiet, so only cancelling ends the session
+		cancel()
+		ss.Recv(nil)
+	}()
+	if err = ucc.StartContext(ctx); err != nil {
+		t.Fatalf("Expected a clean exit on cancel, got %v", err)
+	}
+	<-done
+}
+
+func TestCLISession(t *testing.T) {
+	tests := []struct {
+		name     string
+		password bool
+		cached   bool
+		lpathChg bool
+		card     bool
+		lpath    string
+	}{
+		{"plain", false, false, false, false, "Author/Title.epub"},
+		{"password", true, false, false, false, "Author/Title.epub"},
+		{"cached", false, true, false, false, "Author/Title.epub"},
+		{"password+cached", true, true, true, false, "Author/Title.epub"},
+		{"card", false, false, true, true, "cardA/Author/Title.epub"},
+		{"card without lpath changes", false, true, false, true, "Author/Title.epub"},
+		{"everything", true, true, true, true, "cardA/Author/Title.epub"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "uncaged-cli")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			srv, err := calibretest.NewServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+			srv.LpathChanges = tt.lpathChg
+			if tt.password {
+				srv.Password = testPassword
+			}
+			cli := newTestCLI(dir, srv)
+			cli.card = tt.card
+			ucc, err := uc.New(cli, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				session(t, srv, tt.cached)
+			}()
+			if err = ucc.Start(); err != nil {
+				t.Fatalf("Session failed: %v", err)
+			}
+			<-done
+			if stats := ucc.Stats(); stats.BooksReceived != 1 || stats.BytesReceived != int64(len("not really an epub")) {
+				t.Errorf("Unexpected session stats %+v", stats)
+			}
+			book, err := ioutil.ReadFile(filepath.Join(dir, tt.lpath))
+			if err != nil || !bytes.Equal(book, []byte("not really an epub")) {
+				t.Errorf("Expected book saved to %s: %v", tt.lpath, err)
+			}
+		})
+	}
+}
+
+func TestCardInfo(t *testing.T) {
+	var uuids []string
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "uncaged-cli")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		cli := &UncagedCLI{deviceName: "UNCaGED", bookDir: dir, card: true}
+		card, err := cli.loadCardInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if card.DevInfo.LocationCode != cardLocation || len(card.DevInfo.DeviceStoreUUID) != 36 {
+			t.Errorf("Unexpected card info %+v", card.DevInfo)
+		}
+		// The card keeps its UUID
+		if again, err := cli.loadCardInfo(); err != nil || again.DevInfo.DeviceStoreUUID != card.DevInfo.DeviceStoreUUID {
+			t.Errorf("Expected card UUID %s to be kept, got %s: %v", card.DevInfo.DeviceStoreUUID, again.DevInfo.DeviceStoreUUID, err)
+		}
+		uuids = append(uuids, card.DevInfo.DeviceStoreUUID)
+	}
+	if uuids[0] == uuids[1] {
+		t.Errorf("Expected each card to have its own UUID, both are %s", uuids[0])
+	}
+}
+
+func TestCLIDaemon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uncaged-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv, err := calibretest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newTestCLI(dir, srv).daemon(ctx, false, uc.RetryPolicy{InitialDelay: 10 * time.Millisecond})
+	}()
+	// Books sent in the first session should still be there in the second
+	for i := 0; i < 2; i++ {
+		ss, err := srv.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ss.DeviceInfo("UNCaGED"); err != nil {
+			t.Fatal(err)
+		}
+		if books, err := ss.BookCount(false); err != nil || len(books) != i {
+			t.Fatalf("Expected %d books in session %d, got %v: %v", i, i+1, books, err)
+		}
+		if _, err = ss.SendBook(fmt.Sprintf("Author/Title %d.epub", i), nil, []byte("not really an epub")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ss.BookCount(false); err != nil {
+			t.Fatal(err)
+		}
+		ss.Close()
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Daemon did not stop when cancelled")
+	}
+}
+
+func TestSelectCalibreInstance(t *testing.T) {
+	instances := []uc.CalInstance{{Host: "10.0.0.1"}, {Host: "10.0.0.2"}, {Host: "10.0.0.3"}}
+	tests := []struct {
+		name    string
+		input   io.Reader
+		timeout time.Duration
+		want    string
+	}{
+		{"choice", strings.NewReader("2\n"), time.Second, "10.0.0.2"},
+		{"retry", strings.NewReader("9\nabc\n3\n"), time.Second, "10.0.0.3"},
+		{"default", strings.NewReader("\n"), time.Second, "10.0.0.1"},
+		{"closed input", strings.NewReader(""), time.Second, "10.0.0.1"},
+		{"timeout", blockingReader{}, 10 * time.Millisecond, "10.0.0.1"},
+		{"no prompt", strings.NewReader("2\n"), 0, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		cli := &UncagedCLI{input: tt.input, selectTimeout: tt.timeout}
+		if got := cli.SelectCalibreInstance(instances); got.Host != tt.want {
+			t.Errorf("%s: selected %s, want %s", tt.name, got.Host, tt.want)
+		}
+	}
+	// A single instance is used without waiting for the user
+	cli := &UncagedCLI{input: blockingReader{}, selectTimeout: time.Hour}
+	if got := cli.SelectCalibreInstance(instances[:1]); got.Host != "10.0.0.1" {
+		t.Errorf("Expected the only instance selected, got %s", got.Host)
+	}
+	cli = &UncagedCLI{selectInstance: "laptop"}
+	if opts, _ := cli.GetClientOptions(); opts.PreferredInstance.Name != "laptop" {
+		t.Errorf("Expected laptop to be preferred, got %+v", opts.PreferredInstance)
+	}
+}
+
+// blockingReader never has anything to read
+type blockingReader struct{}
+
+func (blockingReader) Read(p []byte) (int, error) { select {} }
+
+func TestSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uncaged-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cli := &UncagedCLI{bookDir: dir}
+	if _, _, err = diskSpace(dir); err != nil {
+		t.Skip(err)
+	}
+	if free, total := cli.GetFreeSpace(), cli.GetTotalSpace(); free == 0 || free > total {
+		t.Errorf("Unexpected space %d free of %d", free, total)
+	}
+	cli.bookDir = filepath.Join(dir, "missing")
+	if free := cli.GetFreeSpace(); free != 1024*1024*1024 {
+		t.Errorf("Expected the fixed free space when the library is missing, got %d", free)
+	}
+}
+
+func TestClientOptionsOverrides(t *testing.T) {
+	cli := &UncagedCLI{}
+	opts, _ := cli.GetClientOptions()
+	if opts.DeviceModel != "CLI" || !reflect.DeepEqual(opts.SupportedExt, []string{"epub", "mobi"}) {
+		t.Errorf("Unexpected defaults: %q, %v", opts.DeviceModel, opts.SupportedExt)
+	}
+	cli = &UncagedCLI{preset: "kobo-clara", extensions: []string{"pdf"}}
+	opts, _ = cli.GetClientOptions()
+	if opts.DeviceModel != "" || !reflect.DeepEqual(opts.SupportedExt, []string{"pdf"}) {
+		t.Errorf("Expected preset to fill in the model only, got %q, %v", opts.DeviceModel, opts.SupportedExt)
+	}
+}
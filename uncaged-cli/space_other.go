@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !openbsd
+// +build !linux,!darwin,!freebsd,!dragonfly,!openbsd
+
+package main
+
+import "errors"
+
+// diskSpace is not implemented on this platform. Windows, and Unix platforms
+// without syscall.Statfs, such as NetBSD and Solaris, report a fixed size instead.
+func diskSpace(dir string) (free, total uint64, err error) {
+	return 0, 0, errors.New("diskSpace: not supported on this platform")
+}
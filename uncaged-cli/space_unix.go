@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+package main
+
+import "syscall"
+
+// diskSpace returns the free and total space of the filesystem dir is on
+func diskSpace(dir string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	// The types of these fields differ between platforms, and available
+	// blocks may be negative when the reserved blocks are in use
+	avail := int64(st.Bavail)
+	if avail < 0 {
+		avail = 0
+	}
+	return uint64(avail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}